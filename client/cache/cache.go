@@ -0,0 +1,245 @@
+// Package cache persists the client's history, contacts and unread counters
+// between sessions, so chats open instantly and can be read offline.
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"msim-client/crypt"
+	"msim-client/protocol"
+)
+
+// saveDelay coalesces bursts of changes into a single write
+const saveDelay = 2 * time.Second
+
+// ErrPassphraseRequired is returned when the cache file is encrypted but no passphrase was given
+var ErrPassphraseRequired = errors.New("message cache is encrypted, passphrase required")
+
+// Outgoing is a message typed while disconnected and not yet sent
+type Outgoing struct {
+	ContactID string
+	Text      string
+	Timestamp string // local timestamp of the pending entry in the chat
+}
+
+// data is the on-disk document
+type data struct {
+	Contacts []protocol.Contact            `json:"contacts"`
+	Messages map[string][]protocol.Message `json:"messages"`
+	Unread   map[string]int                `json:"unread"`
+	Outbox   []Outgoing                    `json:"outbox"`
+}
+
+// Cache is the local store of one account on one server
+type Cache struct {
+	path       string
+	passphrase string
+	mu         sync.Mutex
+	data       data
+	dirty      bool
+	saveTimer  *time.Timer
+}
+
+// DefaultDir returns the cache directory inside the user's config directory
+func DefaultDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "msim", "cache"), nil
+}
+
+// Open loads the cache of login on server from dir, creating an empty one if missing.
+// A non-empty passphrase encrypts the file; an existing plain cache is
+// encrypted on the next save.
+func Open(dir, server, login, passphrase string) (*Cache, error) {
+	c := &Cache{
+		path:       filepath.Join(dir, fileName(server, login)),
+		passphrase: passphrase,
+		data: data{
+			Messages: make(map[string][]protocol.Message),
+			Unread:   make(map[string]int),
+		},
+	}
+
+	raw, err := os.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if crypt.IsEncrypted(raw) {
+		if passphrase == "" {
+			return nil, ErrPassphraseRequired
+		}
+		if raw, err = crypt.Decrypt(passphrase, raw); err != nil {
+			return nil, err
+		}
+	} else if passphrase != "" {
+		// Plain cache from before the passphrase was set
+		c.dirty = true
+	}
+
+	if err := json.Unmarshal(raw, &c.data); err != nil {
+		return nil, err
+	}
+	if c.data.Messages == nil {
+		c.data.Messages = make(map[string][]protocol.Message)
+	}
+	if c.data.Unread == nil {
+		c.data.Unread = make(map[string]int)
+	}
+	return c, nil
+}
+
+// Contacts returns the cached contact list
+func (c *Cache) Contacts() []protocol.Contact {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]protocol.Contact(nil), c.data.Contacts...)
+}
+
+// SetContacts replaces the cached contact list
+func (c *Cache) SetContacts(contacts []protocol.Contact) {
+	c.mu.Lock()
+	c.data.Contacts = append([]protocol.Contact(nil), contacts...)
+	c.mu.Unlock()
+	c.changed()
+}
+
+// Messages returns cached messages of every chat
+func (c *Cache) Messages() map[string][]protocol.Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := make(map[string][]protocol.Message, len(c.data.Messages))
+	for contactID, messages := range c.data.Messages {
+		result[contactID] = append([]protocol.Message(nil), messages...)
+	}
+	return result
+}
+
+// SetMessages replaces the cached messages of one chat
+func (c *Cache) SetMessages(contactID string, messages []protocol.Message) {
+	c.mu.Lock()
+	if len(messages) == 0 {
+		delete(c.data.Messages, contactID)
+	} else {
+		c.data.Messages[contactID] = append([]protocol.Message(nil), messages...)
+	}
+	c.mu.Unlock()
+	c.changed()
+}
+
+// Unread returns cached unread counters
+func (c *Cache) Unread() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result := make(map[string]int, len(c.data.Unread))
+	for contactID, count := range c.data.Unread {
+		result[contactID] = count
+	}
+	return result
+}
+
+// SetUnread replaces cached unread counters
+func (c *Cache) SetUnread(unread map[string]int) {
+	c.mu.Lock()
+	c.data.Unread = make(map[string]int, len(unread))
+	for contactID, count := range unread {
+		if count > 0 {
+			c.data.Unread[contactID] = count
+		}
+	}
+	c.mu.Unlock()
+	c.changed()
+}
+
+// Outbox returns messages queued while disconnected
+func (c *Cache) Outbox() []Outgoing {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Outgoing(nil), c.data.Outbox...)
+}
+
+// SetOutbox replaces the queue of unsent messages
+func (c *Cache) SetOutbox(outbox []Outgoing) {
+	c.mu.Lock()
+	c.data.Outbox = append([]Outgoing(nil), outbox...)
+	c.mu.Unlock()
+	c.changed()
+}
+
+// changed marks the cache dirty and schedules a delayed save
+func (c *Cache) changed() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dirty = true
+	if c.saveTimer == nil {
+		c.saveTimer = time.AfterFunc(saveDelay, func() {
+			c.Save()
+		})
+	}
+}
+
+// Save writes the cache to disk if it has unsaved changes
+func (c *Cache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.saveTimer != nil {
+		c.saveTimer.Stop()
+		c.saveTimer = nil
+	}
+	if !c.dirty {
+		return nil
+	}
+
+	raw, err := json.Marshal(&c.data)
+	if err != nil {
+		return err
+	}
+	if c.passphrase != "" {
+		if raw, err = crypt.Encrypt(c.passphrase, raw); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename so a crash never leaves a truncated cache
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	c.dirty = false
+	return nil
+}
+
+// Close flushes pending changes
+func (c *Cache) Close() error {
+	return c.Save()
+}
+
+// fileName names the cache file of an account. The name is a hash of the
+// server and the login, so no two accounts share a file whatever characters
+// their logins contain.
+func fileName(server, login string) string {
+	sum := sha256.Sum256([]byte(server + "\x00" + login))
+	return hex.EncodeToString(sum[:]) + ".cache"
+}
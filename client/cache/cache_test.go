@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"os"
+	"testing"
+
+	"msim-client/crypt"
+	"msim-client/protocol"
+)
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+
+	c, err := Open(dir, "localhost:3215", "alice", "secret")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	c.SetContacts([]protocol.Contact{{ID: "bob", Nick: "Bob"}})
+	c.SetMessages("bob", []protocol.Message{{Sender: "bob", Text: "hi", Timestamp: "2024-01-01T12:00:00Z", Status: "ackn"}})
+	c.SetUnread(map[string]int{"bob": 2})
+	c.SetOutbox([]Outgoing{{ContactID: "bob", Text: "later", Timestamp: "2024-01-01T12:01:00Z"}})
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	raw, err := os.ReadFile(c.path)
+	if err != nil {
+		t.Fatalf("Cache file not written: %v", err)
+	}
+	if !crypt.IsEncrypted(raw) {
+		t.Fatalf("Expected encrypted cache file")
+	}
+
+	if _, err := Open(dir, "localhost:3215", "alice", ""); err != ErrPassphraseRequired {
+		t.Errorf("Expected ErrPassphraseRequired, got %v", err)
+	}
+	if _, err := Open(dir, "localhost:3215", "alice", "wrong"); err != crypt.ErrWrongPassphrase {
+		t.Errorf("Expected ErrWrongPassphrase, got %v", err)
+	}
+
+	c, err = Open(dir, "localhost:3215", "alice", "secret")
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	if contacts := c.Contacts(); len(contacts) != 1 || contacts[0].Nick != "Bob" {
+		t.Errorf("Unexpected contacts: %+v", contacts)
+	}
+	if messages := c.Messages()["bob"]; len(messages) != 1 || messages[0].Text != "hi" {
+		t.Errorf("Unexpected messages: %+v", messages)
+	}
+	if unread := c.Unread(); unread["bob"] != 2 {
+		t.Errorf("Unexpected unread: %+v", unread)
+	}
+	if outbox := c.Outbox(); len(outbox) != 1 || outbox[0].Text != "later" {
+		t.Errorf("Unexpected outbox: %+v", outbox)
+	}
+}
+
+func TestPlainCacheGetsEncrypted(t *testing.T) {
+	dir := t.TempDir()
+
+	c, err := Open(dir, "example.com:3215", "bob", "")
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	c.SetUnread(map[string]int{"alice": 1})
+	c.Close()
+
+	c, err = Open(dir, "example.com:3215", "bob", "secret")
+	if err != nil {
+		t.Fatalf("Open with new passphrase failed: %v", err)
+	}
+	c.Close()
+
+	raw, err := os.ReadFile(c.path)
+	if err != nil {
+		t.Fatalf("Cache file not found: %v", err)
+	}
+	if !crypt.IsEncrypted(raw) {
+		t.Errorf("Expected plain cache to be encrypted after setting a passphrase")
+	}
+}
+
+func TestAccountsDoNotShareFile(t *testing.T) {
+	dir := t.TempDir()
+
+	accounts := [][2]string{{"localhost:3215", "a+b"}, {"localhost:3215", "a_b"}, {"localhost_3215", "a+b"}}
+	for _, acc := range accounts {
+		c, err := Open(dir, acc[0], acc[1], "")
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		c.SetMessages("bob", []protocol.Message{{Sender: "bob", Text: acc[0] + " " + acc[1]}})
+		if err := c.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+	}
+
+	for _, acc := range accounts {
+		c, err := Open(dir, acc[0], acc[1], "")
+		if err != nil {
+			t.Fatalf("Reopen failed: %v", err)
+		}
+		if messages := c.Messages()["bob"]; len(messages) != 1 || messages[0].Text != acc[0]+" "+acc[1] {
+			t.Errorf("%s %s: unexpected messages %+v", acc[0], acc[1], messages)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Package cli implements non-interactive subcommands of the client for
+// scripts, cron jobs and CI: every command connects, authenticates, does one
+// thing and exits with a status code describing the outcome.
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"msim/cmdutil"
+)
+
+// Exit codes
+const (
+	ExitOK         = cmdutil.ExitOK         // command succeeded
+	ExitFailure    = cmdutil.ExitFailure    // server rejected the operation or the transfer failed
+	ExitUsage      = cmdutil.ExitUsage      // bad arguments, config or missing credentials
+	ExitConnection = cmdutil.ExitConnection // cannot connect, timed out or the connection was lost
+	ExitAuth       = 4                      // login or password rejected
+)
+
+// command is a subcommand of the client binary
+type command struct {
+	summary string
+	run     func(args []string, stdin io.Reader, stdout io.Writer) error
+}
+
+var commands = map[string]command{
+	"send":     {"Send a message; text is read from stdin if omitted or \"-\"", runSend},
+	"history":  {"Print the history with a contact", runHistory},
+	"contacts": {"Print the contact list", runContacts},
+	"status":   {"Print online status of contacts or given users", runStatus},
+	"sendfile": {"Send a file and wait until it is delivered", runSendFile},
+	"listen":   {"Stream incoming messages as JSON lines until disconnected", runListen},
+}
+
+// IsCommand reports whether name is a subcommand rather than a flag of the interactive client
+func IsCommand(name string) bool {
+	_, ok := commands[name]
+	return ok || name == "help"
+}
+
+// Run executes the subcommand in args[0] and returns the process exit code
+func Run(args []string) int {
+	return run(args, os.Stdin, os.Stdout, os.Stderr)
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	name := args[0]
+	if name == "help" {
+		printUsage(stdout)
+		return ExitOK
+	}
+
+	cmd := commands[name]
+	err := cmd.run(args[1:], stdin, stdout)
+	code := cmdutil.ExitCode(err)
+	if code != ExitOK {
+		fmt.Fprintf(stderr, "%s: %v\n", name, err)
+	}
+	return code
+}
+
+// printUsage lists the subcommands
+func printUsage(w io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "Usage: msim-chat <command> [options] [arguments]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-9s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run \"msim-chat <command> -h\" for the options of a command.")
+	fmt.Fprintln(w, "Without a command the interactive client starts.")
+}
+
+func authError(format string, args ...interface{}) error {
+	return cmdutil.Errorf(ExitAuth, format, args...)
+}
@@ -0,0 +1,130 @@
+package cli
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"msim/cmdutil/cmdtest"
+)
+
+// fakeServer answers requests with scripted responses and records what it received
+func fakeServer(t *testing.T, responses map[string]string) (string, <-chan string) {
+	return cmdtest.Serve(t, "tcp", "127.0.0.1:0", responses, func(line string) string {
+		return strings.SplitN(line, "|", 2)[0]
+	})
+}
+
+func runArgs(t *testing.T, stdin string, args ...string) (int, string, string) {
+	t.Setenv(envPassword, "")
+	t.Setenv(envLogin, "")
+	t.Setenv(envServer, "")
+	t.Setenv(envProfile, "")
+
+	args = append(args[:1], append([]string{"-config", t.TempDir() + "/config.toml"}, args[1:]...)...)
+	return cmdtest.Run(func(stdout, stderr io.Writer) int {
+		return run(args, strings.NewReader(stdin), stdout, stderr)
+	})
+}
+
+func TestSend(t *testing.T) {
+	addr, received := fakeServer(t, map[string]string{
+		"auth": "ok|auth",
+		"msg":  "ok|msg",
+	})
+
+	code, _, stderr := runArgs(t, "line1|x\nline2\n", "send", "-server", addr, "-login", "alice", "-password", "pw", "bob")
+	if code != ExitOK {
+		t.Fatalf("Expected exit code %d, got %d: %s", ExitOK, code, stderr)
+	}
+
+	<-received // caps
+	<-received // auth
+	if line := <-received; line != `msg|bob|line1\|x\nline2` {
+		t.Errorf("Unexpected message packet %q", line)
+	}
+}
+
+func TestHistoryJSON(t *testing.T) {
+	addr, _ := fakeServer(t, map[string]string{
+		"auth": "ok|auth",
+		"hist": `hist|bob|msg|bob|a\,b|2024-01-01T12:00:00Z|ackn`,
+	})
+
+	code, stdout, stderr := runArgs(t, "", "history", "-server", addr, "-login", "alice", "-password", "pw", "-json", "bob")
+	if code != ExitOK {
+		t.Fatalf("Expected exit code %d, got %d: %s", ExitOK, code, stderr)
+	}
+	expected := `{"sender":"bob","text":"a,b","timestamp":"2024-01-01T12:00:00Z","status":"ackn"}` + "\n"
+	if stdout != expected {
+		t.Errorf("Expected %q, got %q", expected, stdout)
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	addr, _ := fakeServer(t, map[string]string{
+		"auth": "fail|auth|Invalid credentials",
+	})
+	if code, _, _ := runArgs(t, "", "contacts", "-server", addr, "-login", "alice", "-password", "bad"); code != ExitAuth {
+		t.Errorf("Auth failure: expected %d, got %d", ExitAuth, code)
+	}
+
+	addr, _ = fakeServer(t, map[string]string{
+		"auth": "ok|auth",
+		"stat": "fail|stat|User not found|E_NO_USER",
+	})
+	if code, _, _ := runArgs(t, "", "status", "-server", addr, "-login", "alice", "-password", "pw", "nobody"); code != ExitFailure {
+		t.Errorf("Server failure: expected %d, got %d", ExitFailure, code)
+	}
+
+	if code, _, _ := runArgs(t, "", "send", "-login", "alice", "-password", "pw"); code != ExitUsage {
+		t.Errorf("Missing recipient: expected %d, got %d", ExitUsage, code)
+	}
+	if code, _, _ := runArgs(t, "", "contacts", "-server", addr); code != ExitUsage {
+		t.Errorf("Missing credentials: expected %d, got %d", ExitUsage, code)
+	}
+}
+
+func TestHistoryOffsetWithoutLimit(t *testing.T) {
+	addr, received := fakeServer(t, map[string]string{
+		"auth": "ok|auth",
+		"hist": `hist|bob|msg|bob|hi|2024-01-01T12:00:00Z|ackn`,
+	})
+
+	code, stdout, stderr := runArgs(t, "", "history", "-server", addr, "-login", "alice", "-password", "pw", "-offset", "5", "bob")
+	if code != ExitOK {
+		t.Fatalf("Expected exit code %d, got %d: %s", ExitOK, code, stderr)
+	}
+
+	<-received // caps
+	<-received // auth
+	if line := <-received; line != "hist|bob|5|1000" {
+		t.Errorf("Unexpected history request %q", line)
+	}
+	if !strings.Contains(stdout, "bob: hi") {
+		t.Errorf("Expected the message in output, got %q", stdout)
+	}
+}
+
+func TestStatusUsers(t *testing.T) {
+	addr, received := fakeServer(t, map[string]string{
+		"auth": "ok|auth",
+		"stat": "stat|bob|on|2024-01-01T12:00:00Z",
+	})
+
+	code, stdout, stderr := runArgs(t, "", "status", "-server", addr, "-login", "alice", "-password", "pw", "bob", "carol")
+	if code != ExitOK {
+		t.Fatalf("Expected exit code %d, got %d: %s", ExitOK, code, stderr)
+	}
+
+	<-received // caps
+	<-received // auth
+	for _, want := range []string{"stat|bob", "stat|carol"} {
+		if line := <-received; line != want {
+			t.Errorf("Expected %q, got %q", want, line)
+		}
+	}
+	if lines := strings.Split(strings.TrimSpace(stdout), "\n"); len(lines) != 2 {
+		t.Errorf("Expected a status per user, got %q", stdout)
+	}
+}
@@ -0,0 +1,406 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"msim-client/protocol"
+	"msim/cmdutil"
+)
+
+// runSend sends one message
+func runSend(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs, opts := newFlagSet("send", "<recipient> [text]")
+	waitAck := fs.Bool("ack", false, "Wait until the recipient acknowledges delivery")
+	ackTimeout := fs.Duration("ack-timeout", time.Minute, "How long to wait for the acknowledgement with -ack")
+	rest, err := cmdutil.ParseArgs(fs, args, 1, -1)
+	if err != nil {
+		return err
+	}
+
+	recipient := rest[0]
+	text := strings.Join(rest[1:], " ")
+	if len(rest) == 1 || text == "-" {
+		data, err := io.ReadAll(stdin)
+		if err != nil {
+			return cmdutil.Failure("read message: %v", err)
+		}
+		text = strings.TrimRight(string(data), "\r\n")
+	}
+	if text == "" {
+		return cmdutil.UsageError("message text is empty")
+	}
+
+	s, err := connect(opts)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	if err := s.client.SendMessage(recipient, text); err != nil {
+		return cmdutil.ConnectionError("%v", err)
+	}
+	if _, err := s.result(protocol.TypeMsg); err != nil {
+		return err
+	}
+
+	if *waitAck {
+		// Format: ack|recipient|timestamp
+		_, err := s.wait(*ackTimeout, func(parts []string) bool {
+			return parts[0] == protocol.TypeAck && len(parts) >= 2 && parts[1] == recipient
+		})
+		if err != nil {
+			return cmdutil.Failure("not acknowledged by %s: %v", recipient, err)
+		}
+	}
+	return nil
+}
+
+// historyLine is a history entry in JSON output
+type historyLine struct {
+	Sender    string `json:"sender"`
+	Text      string `json:"text"`
+	Timestamp string `json:"timestamp"`
+	Status    string `json:"status"`
+}
+
+// historyAll is the limit the server applies to hist without one
+const historyAll = 1000
+
+// runHistory prints the history with a contact
+func runHistory(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs, opts := newFlagSet("history", "<contact>")
+	limit := fs.Int("limit", 0, "Print at most this many messages (0: all)")
+	offset := fs.Int("offset", 0, "Skip this many oldest messages")
+	asJSON := fs.Bool("json", false, "Print JSON lines")
+	rest, err := cmdutil.ParseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	contact := rest[0]
+
+	s, err := connect(opts)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	if *limit > 0 || *offset > 0 {
+		// An offset needs a limit on the wire; with none ask for as many as the server gives by default
+		n := *limit
+		if n <= 0 {
+			n = historyAll
+		}
+		err = s.client.GetHistoryRange(contact, *offset, n)
+	} else {
+		err = s.client.GetHistory(contact)
+	}
+	if err != nil {
+		return cmdutil.ConnectionError("%v", err)
+	}
+
+	// Format: hist|contact|<list>
+	content, err := s.list(protocol.TypeHist, func(parts []string) bool {
+		return len(parts) >= 2 && parts[1] == contact
+	})
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(stdout)
+	for _, msg := range protocol.ParseHistory(content) {
+		if *asJSON {
+			enc.Encode(historyLine{msg.Sender, msg.Text, msg.Timestamp, msg.Status})
+		} else {
+			fmt.Fprintf(stdout, "%s %s: %s\n", msg.Timestamp, msg.Sender, msg.Text)
+		}
+	}
+	return nil
+}
+
+// contactLine is a contact in JSON output
+type contactLine struct {
+	Login string `json:"login"`
+	Nick  string `json:"nick"`
+	Bot   bool   `json:"bot,omitempty"`
+}
+
+// runContacts prints the contact list
+func runContacts(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs, opts := newFlagSet("contacts", "")
+	asJSON := fs.Bool("json", false, "Print JSON lines")
+	if _, err := cmdutil.ParseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	s, err := connect(opts)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	if err := s.client.GetContacts(); err != nil {
+		return cmdutil.ConnectionError("%v", err)
+	}
+	content, err := s.list(protocol.TypeList, nil)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(stdout)
+	for _, c := range protocol.ParseContacts(content) {
+		if *asJSON {
+			enc.Encode(contactLine{c.ID, c.Nick, c.Bot})
+		} else {
+			fmt.Fprintf(stdout, "%s\t%s\n", c.ID, c.Nick)
+		}
+	}
+	return nil
+}
+
+// statusLine is a user status in JSON output
+type statusLine struct {
+	User     string `json:"user"`
+	Online   bool   `json:"online"`
+	LastSeen string `json:"last_seen"`
+	Bot      bool   `json:"bot,omitempty"`
+}
+
+// runStatus prints online status of contacts or the given users
+func runStatus(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs, opts := newFlagSet("status", "[user...]")
+	asJSON := fs.Bool("json", false, "Print JSON lines")
+	users, err := cmdutil.ParseArgs(fs, args, 0, -1)
+	if err != nil {
+		return err
+	}
+
+	s, err := connect(opts)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	// stat asks for one user or all contacts, so given users are asked for one by one
+	var statuses []protocol.Status
+	fetch := func(user ...string) error {
+		if err := s.client.GetStatus(user...); err != nil {
+			return cmdutil.ConnectionError("%v", err)
+		}
+		content, err := s.list(protocol.TypeStat, nil)
+		if err != nil {
+			return err
+		}
+		statuses = append(statuses, protocol.ParseStatuses(content)...)
+		return nil
+	}
+	if len(users) == 0 {
+		if err := fetch(); err != nil {
+			return err
+		}
+	}
+	for _, user := range users {
+		if err := fetch(user); err != nil {
+			return err
+		}
+	}
+
+	enc := json.NewEncoder(stdout)
+	for _, st := range statuses {
+		if *asJSON {
+			enc.Encode(statusLine{st.UserID, st.Online, st.LastSeen, st.Bot})
+			continue
+		}
+		state := "off"
+		if st.Online {
+			state = "on"
+		}
+		fmt.Fprintf(stdout, "%s\t%s\t%s\n", st.UserID, state, st.LastSeen)
+	}
+	return nil
+}
+
+// runSendFile offers a file and uploads it once the recipient accepts
+func runSendFile(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs, opts := newFlagSet("sendfile", "<recipient> <path>")
+	acceptTimeout := fs.Duration("accept-timeout", 5*time.Minute, "How long to wait for the recipient to accept")
+	rest, err := cmdutil.ParseArgs(fs, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	recipient, path := rest[0], rest[1]
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return cmdutil.UsageError("%v", err)
+	}
+	if info.IsDir() {
+		return cmdutil.UsageError("%s is a directory", path)
+	}
+	hash, err := protocol.FileHash(path)
+	if err != nil {
+		return cmdutil.Failure("hash %s: %v", path, err)
+	}
+
+	s, err := connect(opts)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	if err := s.client.SendFile(recipient, filepath.Base(path), info.Size(), hash); err != nil {
+		return cmdutil.ConnectionError("%v", err)
+	}
+	// Format: ok|fsnd|session_id|expires_in
+	parts, err := s.result(protocol.TypeFsnd)
+	if err != nil {
+		return err
+	}
+	if len(parts) < 3 {
+		return cmdutil.Failure("no session id in server response")
+	}
+	sessionID := parts[2]
+
+	// Format: facc|recipient|session_id|upload_port, fdec/fcan|user|session_id|reason
+	parts, err = s.wait(*acceptTimeout, func(parts []string) bool {
+		switch parts[0] {
+		case protocol.TypeFacc, protocol.TypeFdec, protocol.TypeFcan:
+			return len(parts) >= 3 && parts[2] == sessionID
+		}
+		return false
+	})
+	if err != nil {
+		s.client.CancelFile(recipient, sessionID, "timeout")
+		return cmdutil.Failure("not accepted by %s: %v", recipient, err)
+	}
+	switch parts[0] {
+	case protocol.TypeFdec:
+		return cmdutil.Failure("declined by %s: %s", recipient, optional(parts, 3))
+	case protocol.TypeFcan:
+		return cmdutil.Failure("cancelled by %s: %s", recipient, optional(parts, 3))
+	}
+
+	port, err := strconv.Atoi(optional(parts, 3))
+	if err != nil {
+		return cmdutil.Failure("bad upload port %q", optional(parts, 3))
+	}
+	return upload(s.client.GetServerAddr(), port, path)
+}
+
+// upload streams the file to the transfer port of the server
+func upload(host string, port int, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return cmdutil.Failure("%v", err)
+	}
+	defer file.Close()
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), 30*time.Second)
+	if err != nil {
+		return cmdutil.ConnectionError("upload: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := io.Copy(conn, file); err != nil {
+		return cmdutil.Failure("upload: %v", err)
+	}
+	return nil
+}
+
+// messageEvent is an incoming message printed by listen; system messages
+// from the server administrator have type sys and no sender
+type messageEvent struct {
+	Type      string `json:"type"`
+	From      string `json:"from,omitempty"`
+	Text      string `json:"text"`
+	Timestamp string `json:"timestamp"`
+}
+
+// noticeEvent is a server announcement printed by listen: planned
+// maintenance, where an event without start and end cancels it, or the
+// message of the day with type motd and text only
+type noticeEvent struct {
+	Type  string `json:"type"`
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+	Text  string `json:"text"`
+}
+
+// runListen prints incoming and system messages and server announcements as JSON lines until the connection ends
+func runListen(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs, opts := newFlagSet("listen", "")
+	noAck := fs.Bool("no-ack", false, "Do not acknowledge received messages")
+	if _, err := cmdutil.ParseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	s, err := connect(opts)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	// Ctrl+C or a service manager stop ends listening normally
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	enc := json.NewEncoder(stdout)
+	events := make(chan error, 1)
+	go func() {
+		_, err := s.wait(0, func(parts []string) bool {
+			// Format: sys|timestamp|text
+			if parts[0] == protocol.TypeSys && len(parts) >= 3 {
+				return enc.Encode(messageEvent{Type: protocol.TypeSys, Text: parts[2], Timestamp: parts[1]}) != nil
+			}
+			// Format: notice|start|end|text, or a bare notice
+			if parts[0] == protocol.TypeNotice {
+				return enc.Encode(noticeEvent{protocol.TypeNotice, optional(parts, 1), optional(parts, 2), optional(parts, 3)}) != nil
+			}
+			// Format: motd|text, sent after auth
+			if parts[0] == protocol.TypeMotd && len(parts) >= 2 {
+				return enc.Encode(noticeEvent{Type: protocol.TypeMotd, Text: parts[1]}) != nil
+			}
+			// Format: msg|sender|text|timestamp
+			if parts[0] != protocol.TypeMsg || len(parts) < 4 {
+				return false
+			}
+			if err := enc.Encode(messageEvent{protocol.TypeMsg, parts[1], parts[2], parts[3]}); err != nil {
+				// Nobody reads the output anymore
+				return true
+			}
+			if !*noAck {
+				s.client.SendAck(parts[1], parts[3])
+			}
+			return false
+		})
+		events <- err
+	}()
+
+	select {
+	case <-stop:
+		return nil
+	case err := <-events:
+		if err == nil {
+			return cmdutil.Failure("output closed")
+		}
+		return err
+	}
+}
+
+// optional returns parts[i] or an empty string
+func optional(parts []string, i int) string {
+	if i < len(parts) {
+		return parts[i]
+	}
+	return ""
+}
@@ -0,0 +1,98 @@
+package cli
+
+import (
+	"flag"
+	"os"
+	"time"
+
+	"msim-client/config"
+	"msim/cmdutil"
+)
+
+// Environment variables read when the matching flag is not given
+const (
+	envServer   = "MSIM_SERVER"
+	envProfile  = "MSIM_PROFILE"
+	envLogin    = "MSIM_LOGIN"
+	envPassword = "MSIM_PASSWORD"
+)
+
+const defaultServer = "localhost:3215"
+
+// options are the connection flags shared by all commands
+type options struct {
+	configPath string
+	profile    string
+	server     string
+	login      string
+	password   string
+	timeout    time.Duration
+}
+
+// newFlagSet creates the flag set of a command with the connection flags registered
+func newFlagSet(name, args string) (*flag.FlagSet, *options) {
+	fs := cmdutil.NewFlagSet("msim-chat", name, args)
+
+	defaultConfigPath, _ := config.DefaultPath()
+	opts := &options{}
+	fs.StringVar(&opts.configPath, "config", defaultConfigPath, "Path to the client config file")
+	fs.StringVar(&opts.profile, "profile", "", "Saved profile to use (env "+envProfile+")")
+	fs.StringVar(&opts.server, "server", "", "Server address host:port (env "+envServer+")")
+	fs.StringVar(&opts.login, "login", "", "Login (env "+envLogin+")")
+	fs.StringVar(&opts.password, "password", "", "Password (env "+envPassword+"; prefer the env or a saved password)")
+	fs.DurationVar(&opts.timeout, "timeout", 10*time.Second, "How long to wait for a server response")
+	return fs, opts
+}
+
+// credentials resolves server, login and password: flags first, then the
+// environment, then the profile from the config file
+func (o *options) credentials() (server, login, password string, err error) {
+	server = firstNonEmpty(o.server, os.Getenv(envServer))
+	login = firstNonEmpty(o.login, os.Getenv(envLogin))
+	password = firstNonEmpty(o.password, os.Getenv(envPassword))
+
+	cfg, err := config.Load(o.configPath)
+	if err != nil {
+		return "", "", "", &cmdutil.ExitError{Code: ExitUsage, Err: err}
+	}
+
+	name := firstNonEmpty(o.profile, os.Getenv(envProfile))
+	if name == "" && server == "" && login == "" {
+		name = cfg.DefaultProfile
+	}
+	if name != "" {
+		profile := cfg.Profile(name)
+		if profile == nil {
+			return "", "", "", cmdutil.UsageError("profile %q not found in %s", name, o.configPath)
+		}
+		server = firstNonEmpty(server, profile.Server)
+		login = firstNonEmpty(login, profile.Login)
+
+		// Saved password of the same account
+		if password == "" && login == profile.Login {
+			if passphrase := os.Getenv(config.PassphraseEnv); passphrase != "" {
+				keys, err := config.OpenKeyfile(config.KeyfilePath(o.configPath), passphrase)
+				if err != nil {
+					return "", "", "", cmdutil.UsageError("saved passwords: %v", err)
+				}
+				password, _ = keys.Password(profile.Name)
+			}
+		}
+	}
+
+	server = firstNonEmpty(server, defaultServer)
+	if login == "" || password == "" {
+		return "", "", "", cmdutil.UsageError("login and password required: use -login/-password, %s/%s or a profile with a saved password and %s",
+			envLogin, envPassword, config.PassphraseEnv)
+	}
+	return server, login, password, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,122 @@
+package cli
+
+import (
+	"time"
+
+	"msim-client/protocol"
+	"msim/cmdutil"
+)
+
+// subscribed are the packets a command may wait for
+var subscribed = []string{
+	protocol.TypeOk, protocol.TypeFail, protocol.TypeMsg, protocol.TypeAck,
+	protocol.TypeHist, protocol.TypeStat, protocol.TypeList,
+	protocol.TypeFacc, protocol.TypeFdec, protocol.TypeFcan, protocol.TypeBye,
+	protocol.TypeSys, protocol.TypeNotice, protocol.TypeMotd,
+}
+
+// session is an authenticated connection that waits for responses synchronously
+type session struct {
+	client  *protocol.Client
+	packets chan []string
+	timeout time.Duration
+}
+
+// connect connects to the server and authenticates
+func connect(opts *options) (*session, error) {
+	server, login, password, err := opts.credentials()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &session{
+		client:  protocol.NewClient(),
+		packets: make(chan []string, 64),
+		timeout: opts.timeout,
+	}
+	for _, pktType := range subscribed {
+		s.client.OnPacket(pktType, func(parts []string) {
+			s.packets <- parts
+		})
+	}
+
+	if err := s.client.Connect(server); err != nil {
+		return nil, cmdutil.ConnectionError("connect to %s: %v", server, err)
+	}
+	if err := s.client.Auth(login, password); err != nil {
+		return nil, cmdutil.ConnectionError("%v", err)
+	}
+	if _, err := s.result(protocol.TypeAuth); err != nil {
+		s.close()
+		if exitErr, ok := err.(*cmdutil.ExitError); ok && exitErr.Code == ExitFailure {
+			return nil, authError("authentication failed: %v", exitErr.Err)
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+// close says bye to the server
+func (s *session) close() {
+	s.client.Disconnect()
+}
+
+// wait returns the first packet accepted by match.
+// A zero timeout waits until the connection ends.
+func (s *session) wait(timeout time.Duration, match func(parts []string) bool) ([]string, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		select {
+		case parts := <-s.packets:
+			if parts[0] == protocol.TypeBye {
+				reason := "connection_lost"
+				if len(parts) >= 2 && parts[1] != "" {
+					reason = parts[1]
+				}
+				return nil, cmdutil.ConnectionError("disconnected: %s", reason)
+			}
+			if match(parts) {
+				return parts, nil
+			}
+		case <-expired:
+			return nil, cmdutil.ConnectionError("no response from server in %s", timeout)
+		}
+	}
+}
+
+// result waits for ok|op or fail|op; a fail becomes a *protocol.ServerError
+func (s *session) result(op string) ([]string, error) {
+	parts, err := s.wait(s.timeout, func(parts []string) bool {
+		return (parts[0] == protocol.TypeOk || parts[0] == protocol.TypeFail) && len(parts) >= 2 && parts[1] == op
+	})
+	if err != nil {
+		return nil, err
+	}
+	if parts[0] == protocol.TypeFail {
+		return nil, &cmdutil.ExitError{Code: ExitFailure, Err: protocol.ParseFail(parts)}
+	}
+	return parts, nil
+}
+
+// list waits for a list packet of pktType or fail|pktType and returns its raw content
+func (s *session) list(pktType string, match func(parts []string) bool) (string, error) {
+	parts, err := s.wait(s.timeout, func(parts []string) bool {
+		if parts[0] == protocol.TypeFail {
+			return len(parts) >= 2 && parts[1] == pktType
+		}
+		return parts[0] == pktType && (match == nil || match(parts))
+	})
+	if err != nil {
+		return "", err
+	}
+	if parts[0] == protocol.TypeFail {
+		return "", &cmdutil.ExitError{Code: ExitFailure, Err: protocol.ParseFail(parts)}
+	}
+	return parts[len(parts)-1], nil
+}
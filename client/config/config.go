@@ -0,0 +1,119 @@
+// Package config loads the client configuration file with saved
+// server/account profiles and client-wide defaults.
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Profile is a saved server account
+type Profile struct {
+	Name      string `toml:"name"`
+	Server    string `toml:"server"`
+	Login     string `toml:"login"`
+	AutoLogin bool   `toml:"auto_login,omitempty"` // log in on start without showing the dialog
+}
+
+// Config is the client configuration file
+type Config struct {
+	DefaultProfile string    `toml:"default_profile,omitempty"`
+	DownloadDir    string    `toml:"download_dir,omitempty"` // where received files are saved by default
+	CacheDir       string    `toml:"cache_dir,omitempty"`
+	NoCache        bool      `toml:"no_cache,omitempty"`
+	Profiles       []Profile `toml:"profile"`
+}
+
+// DefaultPath returns the config file location inside the user's config directory
+func DefaultPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "msim", "config.toml"), nil
+}
+
+// KeyfilePath returns where saved passwords are kept for the config file at path
+func KeyfilePath(path string) string {
+	return filepath.Join(filepath.Dir(path), "passwords.key")
+}
+
+// Load reads the config file; a missing file gives an empty config
+func Load(path string) (*Config, error) {
+	cfg := &Config{}
+	if _, err := toml.DecodeFile(path, cfg); err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+
+	for i, p := range cfg.Profiles {
+		if p.Name == "" {
+			return nil, fmt.Errorf("config %s: profile %d has no name", path, i+1)
+		}
+		if cfg.Profile(p.Name) != &cfg.Profiles[i] {
+			return nil, fmt.Errorf("config %s: duplicate profile %q", path, p.Name)
+		}
+	}
+	if cfg.DefaultProfile != "" && cfg.Profile(cfg.DefaultProfile) == nil {
+		return nil, fmt.Errorf("config %s: default profile %q not found", path, cfg.DefaultProfile)
+	}
+
+	cfg.DownloadDir = expandHome(cfg.DownloadDir)
+	cfg.CacheDir = expandHome(cfg.CacheDir)
+	return cfg, nil
+}
+
+// Save writes the config file, creating its directory if needed
+func (c *Config) Save(path string) error {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(c); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0600)
+}
+
+// Profile returns the profile with the given name or nil
+func (c *Config) Profile(name string) *Profile {
+	for i := range c.Profiles {
+		if c.Profiles[i].Name == name {
+			return &c.Profiles[i]
+		}
+	}
+	return nil
+}
+
+// SetProfile adds a profile or replaces the one with the same name
+func (c *Config) SetProfile(p Profile) {
+	if existing := c.Profile(p.Name); existing != nil {
+		*existing = p
+		return
+	}
+	c.Profiles = append(c.Profiles, p)
+}
+
+// ProfileName builds the default profile name for an account
+func ProfileName(server, login string) string {
+	return login + "@" + server
+}
+
+// expandHome replaces a leading ~ with the user's home directory
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
@@ -0,0 +1,118 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"msim-client/crypt"
+)
+
+func TestLoadProfiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	content := `
+default_profile = "work"
+download_dir = "/tmp/msim"
+
+[[profile]]
+name = "work"
+server = "chat.example.com:3215"
+login = "alice"
+auto_login = true
+
+[[profile]]
+name = "home"
+server = "localhost:3215"
+login = "alice"
+`
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.DownloadDir != "/tmp/msim" {
+		t.Errorf("Unexpected download dir %q", cfg.DownloadDir)
+	}
+	p := cfg.Profile(cfg.DefaultProfile)
+	if p == nil || p.Server != "chat.example.com:3215" || p.Login != "alice" || !p.AutoLogin {
+		t.Errorf("Unexpected default profile %+v", p)
+	}
+	if len(cfg.Profiles) != 2 {
+		t.Errorf("Expected 2 profiles, got %d", len(cfg.Profiles))
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := map[string]string{
+		"duplicate": "[[profile]]\nname = \"a\"\n[[profile]]\nname = \"a\"\n",
+		"unnamed":   "[[profile]]\nserver = \"localhost:3215\"\n",
+		"default":   "default_profile = \"missing\"\n",
+	}
+	for name, content := range tests {
+		path := filepath.Join(t.TempDir(), "config.toml")
+		os.WriteFile(path, []byte(content), 0600)
+		if _, err := Load(path); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestSaveAndMissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "msim", "config.toml")
+
+	cfg, err := Load(path)
+	if err != nil || len(cfg.Profiles) != 0 {
+		t.Fatalf("Expected empty config for missing file, got %+v, %v", cfg, err)
+	}
+
+	cfg.SetProfile(Profile{Name: ProfileName("localhost:3215", "bob"), Server: "localhost:3215", Login: "bob"})
+	cfg.SetProfile(Profile{Name: "bob@localhost:3215", Server: "localhost:3215", Login: "bob", AutoLogin: true})
+	if err := cfg.Save(path); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(loaded.Profiles) != 1 || !loaded.Profiles[0].AutoLogin {
+		t.Errorf("Unexpected profiles %+v", loaded.Profiles)
+	}
+}
+
+func TestKeyfile(t *testing.T) {
+	path := KeyfilePath(filepath.Join(t.TempDir(), "config.toml"))
+
+	if _, err := OpenKeyfile(path, ""); err != ErrKeyRequired {
+		t.Errorf("Expected ErrKeyRequired, got %v", err)
+	}
+
+	keys, err := OpenKeyfile(path, "secret")
+	if err != nil {
+		t.Fatalf("OpenKeyfile failed: %v", err)
+	}
+	if err := keys.SetPassword("work", "p|a,ss"); err != nil {
+		t.Fatalf("SetPassword failed: %v", err)
+	}
+	if !KeyfileExists(path) {
+		t.Fatalf("Keyfile not written")
+	}
+
+	if _, err := OpenKeyfile(path, "wrong"); err != crypt.ErrWrongPassphrase {
+		t.Errorf("Expected ErrWrongPassphrase, got %v", err)
+	}
+
+	keys, err = OpenKeyfile(path, "secret")
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	if password, ok := keys.Password("work"); !ok || password != "p|a,ss" {
+		t.Errorf("Unexpected password %q", password)
+	}
+	if _, ok := keys.Password("home"); ok {
+		t.Errorf("Unexpected password for unknown profile")
+	}
+}
@@ -0,0 +1,106 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"msim-client/crypt"
+)
+
+// PassphraseEnv lets scripts pass the key passphrase without a prompt
+const PassphraseEnv = "MSIM_KEY"
+
+// ErrKeyRequired is returned when the keyfile is opened without a passphrase
+var ErrKeyRequired = errors.New("key passphrase required for saved passwords")
+
+// Keyfile stores account passwords per profile, encrypted with a passphrase.
+// The format does not depend on any OS keychain, so the file can be copied
+// between machines.
+type Keyfile struct {
+	path       string
+	passphrase string
+	passwords  map[string]string
+}
+
+// OpenKeyfile decrypts the keyfile at path; a missing file gives an empty keyfile
+func OpenKeyfile(path, passphrase string) (*Keyfile, error) {
+	if passphrase == "" {
+		return nil, ErrKeyRequired
+	}
+
+	k := &Keyfile{
+		path:       path,
+		passphrase: passphrase,
+		passwords:  make(map[string]string),
+	}
+
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err := crypt.Decrypt(passphrase, raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(plain, &k.passwords); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// KeyfileExists reports whether any passwords were saved at path
+func KeyfileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Password returns the saved password of a profile
+func (k *Keyfile) Password(profile string) (string, bool) {
+	password, ok := k.passwords[profile]
+	return password, ok
+}
+
+// SetPassword saves the password of a profile and writes the keyfile
+func (k *Keyfile) SetPassword(profile, password string) error {
+	k.passwords[profile] = password
+	return k.save()
+}
+
+// DeletePassword forgets the password of a profile and writes the keyfile
+func (k *Keyfile) DeletePassword(profile string) error {
+	if _, ok := k.passwords[profile]; !ok {
+		return nil
+	}
+	delete(k.passwords, profile)
+	return k.save()
+}
+
+func (k *Keyfile) save() error {
+	plain, err := json.Marshal(k.passwords)
+	if err != nil {
+		return err
+	}
+	raw, err := crypt.Encrypt(k.passphrase, plain)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(k.path), 0700); err != nil {
+		return err
+	}
+
+	tmp := k.path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, k.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+// Package crypt encrypts small local files (message cache, saved passwords)
+// with a key derived from a user passphrase.
+package crypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// magic prefixes every encrypted blob so that plain files can be told apart
+var magic = []byte("MSIMENC1")
+
+const (
+	saltSize = 16
+	keySize  = 32 // AES-256
+
+	// scrypt parameters recommended for interactive logins
+	scryptN = 32768
+	scryptR = 8
+	scryptP = 1
+)
+
+var (
+	// ErrWrongPassphrase is returned when data cannot be decrypted with the passphrase
+	ErrWrongPassphrase = errors.New("wrong passphrase or corrupted data")
+	// ErrNotEncrypted is returned when Decrypt is given plain data
+	ErrNotEncrypted = errors.New("data is not encrypted")
+)
+
+// IsEncrypted reports whether data was produced by Encrypt
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, magic)
+}
+
+// Encrypt seals plaintext with AES-256-GCM using a key derived from passphrase.
+// Layout: magic | salt | nonce | ciphertext+tag
+func Encrypt(passphrase string, plaintext []byte) ([]byte, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(magic)+saltSize+len(nonce)+len(plaintext)+gcm.Overhead())
+	out = append(out, magic...)
+	out = append(out, salt...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, plaintext, magic), nil
+}
+
+// Decrypt opens data produced by Encrypt
+func Decrypt(passphrase string, data []byte) ([]byte, error) {
+	if !IsEncrypted(data) {
+		return nil, ErrNotEncrypted
+	}
+	data = data[len(magic):]
+	if len(data) < saltSize {
+		return nil, ErrWrongPassphrase
+	}
+	salt, data := data[:saltSize], data[saltSize:]
+
+	gcm, err := newGCM(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, ErrWrongPassphrase
+	}
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, magic)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return plaintext, nil
+}
+
+// newGCM derives the key from passphrase and salt and creates the AEAD
+func newGCM(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, keySize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
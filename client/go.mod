@@ -3,8 +3,12 @@ module msim-client
 go 1.21
 
 require (
+	github.com/BurntSushi/toml v1.3.2
 	github.com/gdamore/tcell/v2 v2.7.4
 	github.com/rivo/tview v0.0.0-20241103174730-c76f7879f592
+	golang.org/x/crypto v0.17.0
+	golang.org/x/term v0.17.0
+	msim v0.0.0
 )
 
 require (
@@ -13,6 +17,7 @@ require (
 	github.com/mattn/go-runewidth v0.0.15 // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
 	golang.org/x/sys v0.17.0 // indirect
-	golang.org/x/term v0.17.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 )
+
+replace msim => ../
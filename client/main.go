@@ -5,17 +5,122 @@ import (
 	"fmt"
 	"os"
 
+	"msim-client/cache"
+	"msim-client/cli"
+	"msim-client/config"
 	"msim-client/ui"
+
+	"golang.org/x/term"
 )
 
 func main() {
+	// Non-interactive subcommands for scripts: msim-chat send bob "Build passed"
+	if len(os.Args) > 1 && cli.IsCommand(os.Args[1]) {
+		os.Exit(cli.Run(os.Args[1:]))
+	}
+
+	defaultConfigPath, _ := config.DefaultPath()
+
+	configPath := flag.String("config", defaultConfigPath, "Path to the client config file")
 	serverAddr := flag.String("server", "localhost:3215", "mSIM server address (host:port)")
+	profileName := flag.String("profile", "", "Saved profile to use (default: default_profile from the config)")
+	login := flag.String("login", "", "Login to fill in the auth dialog")
+	autoLogin := flag.Bool("autologin", false, "Log in on start using the password saved for the profile")
+	cacheDir := flag.String("cache-dir", "", "Directory for the local message cache")
+	noCache := flag.Bool("no-cache", false, "Do not keep a local message cache")
+	downloadDir := flag.String("download-dir", "", "Default directory for received files")
 	flag.Parse()
 
+	// Flags given explicitly take precedence over the config file
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
 	app := ui.NewApp(*serverAddr)
+	app.SetConfig(cfg, *configPath)
+
+	if !set["cache-dir"] {
+		*cacheDir = cfg.CacheDir
+	}
+	if *cacheDir == "" {
+		*cacheDir, _ = cache.DefaultDir()
+	}
+	if *noCache || (cfg.NoCache && !set["cache-dir"]) {
+		app.SetCacheDir("")
+	} else {
+		app.SetCacheDir(*cacheDir)
+	}
+
+	if !set["download-dir"] {
+		*downloadDir = cfg.DownloadDir
+	}
+	app.SetDownloadDir(*downloadDir)
+
+	// Pick the profile; -server alone means an ad hoc account
+	name := *profileName
+	if name == "" && !set["server"] {
+		name = cfg.DefaultProfile
+	}
+	profile := cfg.Profile(name)
+	if name != "" && profile == nil {
+		fmt.Fprintf(os.Stderr, "Error: profile %q not found in %s\n", name, *configPath)
+		os.Exit(1)
+	}
+
+	if profile != nil {
+		app.SetProfile(profile.Name)
+		if set["server"] {
+			// Same account, different address (e.g. a tunnel)
+			app.SetServer(*serverAddr)
+		}
+		if *login == "" {
+			*login = profile.Login
+		}
+		if profile.AutoLogin {
+			*autoLogin = true
+		}
+	}
+
+	if *autoLogin {
+		if profile == nil {
+			fmt.Fprintln(os.Stderr, "Error: -autologin requires a saved profile")
+			os.Exit(1)
+		}
+		passphrase, err := readPassphrase()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		app.SetAutoLogin(*login, "", passphrase)
+	} else if *login != "" {
+		app.SetLogin(*login)
+	}
+
 	if err := app.Run(); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 }
 
+// readPassphrase returns the key passphrase from the environment or asks for it on the terminal
+func readPassphrase() (string, error) {
+	if passphrase, ok := os.LookupEnv(config.PassphraseEnv); ok {
+		return passphrase, nil
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", fmt.Errorf("key passphrase required: set %s", config.PassphraseEnv)
+	}
+
+	fmt.Fprint(os.Stderr, "Key: ")
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return string(passphrase), nil
+}
@@ -0,0 +1,48 @@
+package protocol
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff computes exponentially growing reconnect delays with jitter
+type Backoff struct {
+	Min     time.Duration // delay before the first retry
+	Max     time.Duration // upper bound for a single delay
+	attempt int
+}
+
+// NewBackoff creates a backoff starting at min and capped at max
+func NewBackoff(min, max time.Duration) *Backoff {
+	return &Backoff{Min: min, Max: max}
+}
+
+// Next returns the delay before the next attempt and advances the attempt counter.
+// The delay doubles on every call and is randomized in [d/2, d) so that many
+// clients dropped at the same moment do not reconnect in lockstep.
+func (b *Backoff) Next() time.Duration {
+	d := b.Min
+	for i := 0; i < b.attempt && d < b.Max; i++ {
+		d *= 2
+	}
+	if d > b.Max {
+		d = b.Max
+	}
+	b.attempt++
+
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
+
+// Attempt returns the number of delays handed out since the last reset
+func (b *Backoff) Attempt() int {
+	return b.attempt
+}
+
+// Reset starts the sequence over after a successful connection
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
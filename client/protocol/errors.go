@@ -0,0 +1,73 @@
+package protocol
+
+import "errors"
+
+// Capabilities negotiated with the caps packet
+const (
+	// CapErrCodes makes the server append a machine-readable code to fail packets
+	CapErrCodes = "errcodes"
+)
+
+// Error codes sent by servers that support CapErrCodes
+const (
+	ErrCodeInternal       = "E_INTERNAL"
+	ErrCodeInvalid        = "E_INVALID"
+	ErrCodeUnknownPacket  = "E_UNKNOWN_PACKET"
+	ErrCodeNotAuth        = "E_NOT_AUTH"
+	ErrCodeBadCredentials = "E_BAD_CREDENTIALS"
+	ErrCodeForbidden      = "E_FORBIDDEN"
+	ErrCodeNoUser         = "E_NO_USER"
+	ErrCodeUserExists     = "E_USER_EXISTS"
+	ErrCodeNoContact      = "E_NO_CONTACT"
+	ErrCodeContactExists  = "E_CONTACT_EXISTS"
+	ErrCodeNoSession      = "E_NO_SESSION"
+	ErrCodeBadState       = "E_BAD_STATE"
+	ErrCodeUnavailable    = "E_UNAVAILABLE"
+	ErrCodeRateLimit      = "E_RATE_LIMIT"
+	ErrCodeLocked         = "E_LOCKED"
+	ErrCodeTooLong        = "E_TOO_LONG"
+	ErrCodeLimit          = "E_LIMIT"
+	ErrCodeFailed         = "E_FAILED"
+)
+
+// ServerError is a fail packet from the server
+type ServerError struct {
+	Operation string // failed packet type, empty for errors not tied to a packet
+	Message   string // server description, may be empty
+	Code      string // machine-readable code, empty if the server sent none
+}
+
+func (e *ServerError) Error() string {
+	if e.Message != "" {
+		return e.Message
+	}
+	if e.Code != "" {
+		return e.Code
+	}
+	return "operation failed"
+}
+
+// ParseFail converts a fail packet into a ServerError.
+// Formats: fail|operation|description|code (negotiated), fail|operation|description, fail|operation
+func ParseFail(parts []string) *ServerError {
+	e := &ServerError{}
+	if len(parts) >= 2 {
+		e.Operation = parts[1]
+	}
+	if len(parts) >= 3 {
+		e.Message = parts[2]
+	}
+	if len(parts) >= 4 {
+		e.Code = parts[3]
+	}
+	return e
+}
+
+// ErrorCode returns the server error code of err, or "" if err carries none
+func ErrorCode(err error) string {
+	var serverErr *ServerError
+	if errors.As(err, &serverErr) {
+		return serverErr.Code
+	}
+	return ""
+}
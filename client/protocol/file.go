@@ -0,0 +1,24 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+)
+
+// FileHash calculates the SHA256 hash of a file in the form sent in fsnd
+func FileHash(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+
+	return "sha256:" + hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -4,44 +4,53 @@ import (
 	"bufio"
 	"fmt"
 	"net"
-	"strings"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"msim/protocol"
 )
 
-// Packet types
+// Packet types, shared with the server through the msim/protocol codec
 const (
-	TypePing   = "ping"
-	TypePong   = "pong"
-	TypeBye    = "bye"
-	TypeHelp   = "help"
-	TypeAuth   = "auth"
-	TypeReg    = "reg"
-	TypeOk     = "ok"
-	TypeFail   = "fail"
-	TypeMsg    = "msg"
-	TypeAck    = "ack"
-	TypeHist   = "hist"
-	TypeHClear = "hclear"
-	TypeStat   = "stat"
-	TypeList   = "list"
-	TypeAdd    = "add"
-	TypeRen    = "ren"
-	TypeDel    = "del"
-	TypeOn     = "on"
-	TypeOff    = "off"
-	TypeOffmsg = "offmsg"
-	TypeFsnd   = "fsnd"
-	TypeFacc   = "facc"
-	TypeFdec   = "fdec"
-	TypeFcan   = "fcan"
-	TypeFst    = "fst"
+	TypePing   = protocol.TypePing
+	TypePong   = protocol.TypePong
+	TypeBye    = protocol.TypeBye
+	TypeHelp   = protocol.TypeHelp
+	TypeAuth   = protocol.TypeAuth
+	TypeReg    = protocol.TypeReg
+	TypeOk     = protocol.TypeOk
+	TypeFail   = protocol.TypeFail
+	TypeMsg    = protocol.TypeMsg
+	TypeAck    = protocol.TypeAck
+	TypeHist   = protocol.TypeHist
+	TypeHClear = protocol.TypeHClear
+	TypeStat   = protocol.TypeStat
+	TypeList   = protocol.TypeList
+	TypeAdd    = protocol.TypeAdd
+	TypeRen    = protocol.TypeRen
+	TypeDel    = protocol.TypeDel
+	TypeOn     = protocol.TypeOn
+	TypeOff    = protocol.TypeOff
+	TypeOffmsg = protocol.TypeOffmsg
+	TypeFsnd   = protocol.TypeFsnd
+	TypeFacc   = protocol.TypeFacc
+	TypeFdec   = protocol.TypeFdec
+	TypeFcan   = protocol.TypeFcan
+	TypeFst    = protocol.TypeFst
+	TypeCaps   = protocol.TypeCaps
+	TypeSys    = protocol.TypeSys
+	TypeNotice = protocol.TypeNotice
+	TypeInfo   = protocol.TypeInfo
+	TypeMotd   = protocol.TypeMotd
 )
 
 // Contact represents a contact with id and nickname
 type Contact struct {
 	ID   string
 	Nick string
+	Bot  bool // bot account
 }
 
 // Message represents a chat message
@@ -57,6 +66,7 @@ type Status struct {
 	UserID   string
 	Online   bool
 	LastSeen string // ISO 8601 timestamp of last status change
+	Bot      bool   // bot account
 }
 
 // Client represents an mSIM protocol client
@@ -66,17 +76,20 @@ type Client struct {
 	mu         sync.Mutex
 	sendMu     sync.Mutex
 	handlers   map[string][]func([]string)
+	replies    map[string][]replyHandler // one-shot handlers, see OnReply
 	pingTicker *time.Ticker
 	done       chan struct{}
-	connected  bool
+	connected  atomic.Bool // read and written by readLoop, pingLoop and callers
 	lastPong   time.Time
 	pongMu     sync.RWMutex
+	caps       map[string]bool // capabilities the server accepted
 }
 
 // NewClient creates a new mSIM client
 func NewClient() *Client {
 	return &Client{
 		handlers: make(map[string][]func([]string)),
+		replies:  make(map[string][]replyHandler),
 		done:     make(chan struct{}),
 	}
 }
@@ -89,7 +102,7 @@ func (c *Client) Connect(addr string) error {
 	}
 	c.conn = conn
 	c.reader = bufio.NewReader(conn)
-	c.connected = true
+	c.connected.Store(true)
 	c.lastPong = time.Now()
 
 	// Handle pong to track last response time
@@ -99,6 +112,17 @@ func (c *Client) Connect(addr string) error {
 		c.pongMu.Unlock()
 	})
 
+	// Ask for error codes in fail packets. Servers without caps answer
+	// fail|Unknown packet type, which matches no operation and is ignored.
+	c.OnPacket(TypeCaps, func(parts []string) {
+		c.mu.Lock()
+		c.caps = make(map[string]bool)
+		for _, name := range parts[1:] {
+			c.caps[name] = true
+		}
+		c.mu.Unlock()
+	})
+
 	// Start ping goroutine
 	c.pingTicker = time.NewTicker(30 * time.Second)
 	go c.pingLoop()
@@ -106,15 +130,21 @@ func (c *Client) Connect(addr string) error {
 	// Start read goroutine
 	go c.readLoop()
 
-	return nil
+	return c.Send(TypeCaps, CapErrCodes)
+}
+
+// HasCap reports whether the server accepted a capability
+func (c *Client) HasCap(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.caps[name]
 }
 
 // Disconnect gracefully disconnects from the server
 func (c *Client) Disconnect() error {
-	if !c.connected {
+	if !c.connected.CompareAndSwap(true, false) {
 		return nil
 	}
-	c.connected = false
 	close(c.done)
 	if c.pingTicker != nil {
 		c.pingTicker.Stop()
@@ -126,7 +156,7 @@ func (c *Client) Disconnect() error {
 
 // IsConnected returns connection status
 func (c *Client) IsConnected() bool {
-	return c.connected
+	return c.connected.Load()
 }
 
 // LastPongTime returns time since last pong response
@@ -150,7 +180,7 @@ func (c *Client) pingLoop() {
 		case <-c.done:
 			return
 		case <-c.pingTicker.C:
-			if c.connected {
+			if c.connected.Load() {
 				c.Send(TypePing)
 			}
 		}
@@ -159,39 +189,32 @@ func (c *Client) pingLoop() {
 
 // readLoop reads packets from server
 func (c *Client) readLoop() {
-	for c.connected {
+	for c.connected.Load() {
 		line, err := c.reader.ReadString('\n')
 		if err != nil {
-			if c.connected {
-				c.connected = false
+			if c.connected.CompareAndSwap(true, false) {
 				c.notifyHandlers(TypeBye, []string{"connection_lost", ""})
 			}
 			return
 		}
-		line = strings.TrimSuffix(line, "\n")
-		if line == "" {
+		if line == "\n" {
 			continue
 		}
 
-		// For packets with raw content (hist, stat, list), use limited splitting
-		// to preserve unescaped pipes in the content
-		var parts []string
-		if strings.HasPrefix(line, TypeHist+"|") {
-			// hist|contact|<raw content with unescaped pipes>
-			parts = splitPacketN(line, 3)
-		} else if strings.HasPrefix(line, TypeStat+"|") || strings.HasPrefix(line, TypeList+"|") || strings.HasPrefix(line, TypeOffmsg+"|") {
-			// stat|<raw content> or list|<raw content> or offmsg|<raw content>
-			parts = splitPacketN(line, 2)
-		} else {
-			parts = splitPacket(line)
-		}
+		// List packets (hist, stat, list, offmsg, help, info) keep their encoded
+		// list as the last part; it is decoded by the Parse* helpers
+		parts := protocol.SplitLine(line)
 
-		if len(parts) == 0 {
-			continue
+		// bye ends the session: either it answers our own bye (already
+		// disconnected, nothing to report) or the server is dropping us
+		if parts[0] == TypeBye {
+			if c.connected.Swap(false) {
+				c.notifyHandlers(TypeBye, parts)
+			}
+			return
 		}
 
-		packetType := parts[0]
-		c.notifyHandlers(packetType, parts)
+		c.notifyHandlers(parts[0], parts)
 	}
 }
 
@@ -199,6 +222,14 @@ func (c *Client) readLoop() {
 func (c *Client) notifyHandlers(packetType string, parts []string) {
 	c.mu.Lock()
 	handlers := c.handlers[packetType]
+	waiting := c.replies[packetType]
+	for i, r := range waiting {
+		if r.match(parts) {
+			handlers = append(handlers[:len(handlers):len(handlers)], r.handler)
+			c.replies[packetType] = append(waiting[:i:i], waiting[i+1:]...)
+			break
+		}
+	}
 	c.mu.Unlock()
 
 	for _, h := range handlers {
@@ -213,20 +244,31 @@ func (c *Client) OnPacket(packetType string, handler func([]string)) {
 	c.handlers[packetType] = append(c.handlers[packetType], handler)
 }
 
+// replyHandler waits for the reply to one request
+type replyHandler struct {
+	match   func([]string) bool
+	handler func([]string)
+}
+
+// OnReply registers a handler for the first packet of a type accepted by match
+// and removes it after that packet. Several waiting handlers accepting the
+// same packet get one reply each, in the order they were registered.
+func (c *Client) OnReply(packetType string, match func([]string) bool, handler func([]string)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.replies[packetType] = append(c.replies[packetType], replyHandler{match, handler})
+}
+
 // Send sends a packet to the server
 func (c *Client) Send(parts ...string) error {
 	c.sendMu.Lock()
 	defer c.sendMu.Unlock()
 
-	if !c.connected && parts[0] != TypeBye {
+	if !c.connected.Load() && parts[0] != TypeBye {
 		return fmt.Errorf("not connected")
 	}
 
-	escaped := make([]string, len(parts))
-	for i, p := range parts {
-		escaped[i] = Escape(p)
-	}
-	line := strings.Join(escaped, "|") + "\n"
+	line := protocol.FormatFields(parts[0], parts[1:]...)
 	_, err := c.conn.Write([]byte(line))
 	return err
 }
@@ -256,6 +298,11 @@ func (c *Client) GetHistory(contact string) error {
 	return c.Send(TypeHist, contact)
 }
 
+// GetHistoryRange requests up to limit messages after skipping offset messages
+func (c *Client) GetHistoryRange(contact string, offset, limit int) error {
+	return c.Send(TypeHist, contact, strconv.Itoa(offset), strconv.Itoa(limit))
+}
+
 // ClearHistory clears message history with a contact
 func (c *Client) ClearHistory(contact string) error {
 	return c.Send(TypeHClear, contact)
@@ -294,188 +341,38 @@ func (c *Client) DeleteContact(id string) error {
 
 // Escape escapes special characters in a string
 func Escape(s string) string {
-	s = strings.ReplaceAll(s, "\\", "\\\\")
-	s = strings.ReplaceAll(s, "|", "\\|")
-	s = strings.ReplaceAll(s, ",", "\\,")
-	s = strings.ReplaceAll(s, "\n", "\\n")
-	s = strings.ReplaceAll(s, "\r", "\\r")
-	return s
+	return protocol.Escape(s)
 }
 
 // Unescape unescapes special characters in a string
 func Unescape(s string) string {
-	var result strings.Builder
-	escaped := false
-	for _, ch := range s {
-		if escaped {
-			switch ch {
-			case '|':
-				result.WriteRune('|')
-			case ',':
-				result.WriteRune(',')
-			case '\\':
-				result.WriteRune('\\')
-			case 'n':
-				result.WriteRune('\n')
-			case 'r':
-				result.WriteRune('\r')
-			default:
-				result.WriteRune('\\')
-				result.WriteRune(ch)
-			}
-			escaped = false
-		} else if ch == '\\' {
-			escaped = true
-		} else {
-			result.WriteRune(ch)
-		}
-	}
-	if escaped {
-		result.WriteRune('\\')
-	}
-	return result.String()
-}
-
-// splitPacket splits a packet by unescaped pipe
-func splitPacket(line string) []string {
-	var parts []string
-	var current strings.Builder
-	escaped := false
-
-	for _, ch := range line {
-		if escaped {
-			current.WriteRune('\\')
-			current.WriteRune(ch)
-			escaped = false
-		} else if ch == '\\' {
-			escaped = true
-		} else if ch == '|' {
-			parts = append(parts, Unescape(current.String()))
-			current.Reset()
-		} else {
-			current.WriteRune(ch)
-		}
-	}
-	if escaped {
-		current.WriteRune('\\')
-	}
-	parts = append(parts, Unescape(current.String()))
-	return parts
-}
-
-// splitPacketN splits a packet by unescaped pipe, but only up to n parts
-// The last part contains the remaining content (may contain unescaped pipes)
-func splitPacketN(line string, n int) []string {
-	if n <= 0 {
-		return []string{line}
-	}
-
-	var parts []string
-	var current strings.Builder
-	escaped := false
-	count := 0
-	bytePos := 0
-
-	for _, ch := range line {
-		charLen := len(string(ch))
-
-		if count >= n-1 {
-			// Return the rest as the last part (don't unescape - it may have structural pipes)
-			parts = append(parts, line[bytePos:])
-			return parts
-		}
-
-		if escaped {
-			current.WriteRune('\\')
-			current.WriteRune(ch)
-			escaped = false
-		} else if ch == '\\' {
-			escaped = true
-		} else if ch == '|' {
-			parts = append(parts, Unescape(current.String()))
-			current.Reset()
-			count++
-		} else {
-			current.WriteRune(ch)
-		}
-		bytePos += charLen
-	}
-	if escaped {
-		current.WriteRune('\\')
-	}
-	parts = append(parts, Unescape(current.String()))
-	return parts
-}
-
-// SplitList splits a comma-separated list
-func SplitList(s string) []string {
-	if s == "" {
-		return nil
-	}
-	var parts []string
-	var current strings.Builder
-	escaped := false
-
-	for _, ch := range s {
-		if escaped {
-			current.WriteRune('\\')
-			current.WriteRune(ch)
-			escaped = false
-		} else if ch == '\\' {
-			escaped = true
-		} else if ch == ',' {
-			parts = append(parts, current.String())
-			current.Reset()
-		} else {
-			current.WriteRune(ch)
-		}
-	}
-	if escaped {
-		current.WriteRune('\\')
-	}
-	parts = append(parts, current.String())
-	return parts
+	return protocol.Unescape(s)
 }
 
 // ParseContacts parses contact list response
 func ParseContacts(content string) []Contact {
-	if content == "" {
-		return nil
-	}
-	items := SplitList(content)
 	var contacts []Contact
-	for _, item := range items {
-		parts := splitPacket(item)
-		if len(parts) >= 2 {
-			contacts = append(contacts, Contact{
-				ID:   parts[0],
-				Nick: parts[1],
-			})
-		}
+	for _, e := range protocol.DecodeContactEntries(content) {
+		contacts = append(contacts, Contact{
+			ID:   e.Login,
+			Nick: e.Nick,
+			Bot:  e.Bot,
+		})
 	}
 	return contacts
 }
 
 // ParseStatuses parses status response
-// Format: user|status|last_seen (last_seen is optional for backwards compatibility)
+// Format: user|status|last_seen[|bot] (last_seen is optional for backwards compatibility)
 func ParseStatuses(content string) []Status {
-	if content == "" {
-		return nil
-	}
-	items := SplitList(content)
 	var statuses []Status
-	for _, item := range items {
-		parts := splitPacket(item)
-		if len(parts) >= 2 {
-			s := Status{
-				UserID: parts[0],
-				Online: parts[1] == "on",
-			}
-			if len(parts) >= 3 {
-				s.LastSeen = parts[2]
-			}
-			statuses = append(statuses, s)
-		}
+	for _, e := range protocol.DecodeStatusEntries(content) {
+		statuses = append(statuses, Status{
+			UserID:   e.User,
+			Online:   e.Online(),
+			LastSeen: e.LastSeen,
+			Bot:      e.Bot,
+		})
 	}
 	return statuses
 }
@@ -489,27 +386,30 @@ type OfflineMessageCount struct {
 // ParseOfflineMessages parses offmsg response
 // Format: contact|count,contact|count,...
 func ParseOfflineMessages(content string) []OfflineMessageCount {
-	if content == "" {
-		return nil
-	}
-	items := SplitList(content)
 	var counts []OfflineMessageCount
-	for _, item := range items {
-		parts := splitPacket(item)
-		if len(parts) >= 2 {
-			count := 0
-			fmt.Sscanf(parts[1], "%d", &count)
-			if count > 0 {
-				counts = append(counts, OfflineMessageCount{
-					ContactID: parts[0],
-					Count:     count,
-				})
-			}
-		}
+	for _, e := range protocol.DecodeOfflineEntries(content) {
+		counts = append(counts, OfflineMessageCount{
+			ContactID: e.Contact,
+			Count:     e.Count,
+		})
 	}
 	return counts
 }
 
+// ServerInfo describes the server: name, version, uptime, limits and features
+type ServerInfo = protocol.InfoPacket
+
+// GetInfo requests the server info; it is answered before auth as well
+func (c *Client) GetInfo() error {
+	return c.Send(TypeInfo)
+}
+
+// ParseInfo parses info response
+// Format: key|value,key|value,...
+func ParseInfo(content string) *ServerInfo {
+	return protocol.DecodeInfoRecords(content)
+}
+
 // GetOfflineMessages requests offline messages count
 func (c *Client) GetOfflineMessages() error {
 	return c.Send(TypeOffmsg)
@@ -556,31 +456,14 @@ func (c *Client) GetServerAddr() string {
 // ParseHistory parses history response content
 // Format: msg|sender|text|timestamp|status,msg|sender|text|timestamp|status,...
 func ParseHistory(content string) []Message {
-	if content == "" {
-		return nil
-	}
-	items := SplitList(content)
 	var messages []Message
-	for _, item := range items {
-		// Use splitPacketN with 5 parts to handle text that may contain |
-		// Format: msg|sender|text|timestamp|status
-		parts := splitPacketN(item, 5)
-		if len(parts) >= 5 && parts[0] == TypeMsg {
-			messages = append(messages, Message{
-				Sender:    parts[1],
-				Text:      parts[2],
-				Timestamp: parts[3],
-				Status:    parts[4],
-			})
-		}
+	for _, e := range protocol.DecodeHistoryEntries(content) {
+		messages = append(messages, Message{
+			Sender:    e.Sender,
+			Text:      e.Text,
+			Timestamp: e.Timestamp,
+			Status:    e.Status,
+		})
 	}
 	return messages
 }
-
-// ParseHistoryFromParts is deprecated, use ParseHistory with raw content
-func ParseHistoryFromParts(parts []string) []Message {
-	// This is called with parts after hist|contact| have been stripped
-	// Join them back and parse
-	content := strings.Join(parts, "|")
-	return ParseHistory(content)
-}
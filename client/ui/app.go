@@ -4,6 +4,8 @@ import (
 	"sync"
 	"time"
 
+	"msim-client/cache"
+	"msim-client/config"
 	"msim-client/protocol"
 
 	"github.com/gdamore/tcell/v2"
@@ -34,16 +36,35 @@ type App struct {
 	connectionView     *tview.TextView
 	statusTicker       *time.Ticker
 	statusTickerDone   chan struct{}
+	autoReconnect      bool              // reconnect automatically after the connection drops
+	backoff            *protocol.Backoff // delays between automatic reconnect attempts
+	reconnectTimer     *time.Timer       // pending automatic reconnect attempt
+	outbox             []cache.Outgoing  // messages typed while disconnected
+	cache              *cache.Cache      // local history cache, nil if disabled
+	cacheDir           string            // where the cache is stored, empty disables it
+	config             *config.Config    // saved profiles
+	configPath         string            // where config is saved, empty if profiles are not saved
+	profileName        string            // profile selected in the auth dialog
+	presetLogin        string            // login to fill in the auth dialog
+	autoLogin          *credentials      // log in on start, nil to show the auth dialog
+	downloadDir        string            // default directory for received files
+	notice             *maintenance      // planned maintenance announced by the server
+	motd               string            // message of the day waiting for the main screen
+	shownMOTD          string            // last message of the day shown, not repeated on reconnect
 }
 
 // NewApp creates a new application instance
 func NewApp(serverAddr string) *App {
+	cacheDir, _ := cache.DefaultDir()
 	return &App{
 		serverAddr:     serverAddr,
 		statuses:       make(map[string]bool),
 		statusLastSeen: make(map[string]string),
 		unreadCounts:   make(map[string]int),
 		messages:       make(map[string][]protocol.Message),
+		backoff:        protocol.NewBackoff(time.Second, time.Minute),
+		cacheDir:       cacheDir,
+		config:         &config.Config{},
 	}
 }
 
@@ -65,6 +86,8 @@ func (a *App) Run() error {
 
 // quit exits the application
 func (a *App) quit() {
+	a.stopReconnect()
+	a.closeCache()
 	if a.client != nil && a.client.IsConnected() {
 		a.client.Disconnect()
 	}
@@ -21,10 +21,10 @@ func (a *App) showAuthDialog() {
 	form.SetButtonTextColor(ColorTitle)
 	form.SetBorder(true)
 	form.SetBorderColor(ColorBorder)
-	form.SetTitle(" mSIM Authorization ")
 	form.SetTitleColor(ColorTitle)
 
-	var loginField, passwordField *tview.InputField
+	var loginField, passwordField, passphraseField *tview.InputField
+	var rememberBox *tview.Checkbox
 	var statusText *tview.TextView
 
 	statusText = tview.NewTextView()
@@ -44,35 +44,111 @@ func (a *App) showAuthDialog() {
 	passwordField.SetMaskCharacter('*')
 	passwordField.SetBackgroundColor(ColorBg)
 
+	// One passphrase unlocks both the local cache and saved passwords
+	passphraseField = tview.NewInputField()
+	passphraseField.SetLabel("Key: ")
+	passphraseField.SetFieldWidth(30)
+	passphraseField.SetMaskCharacter('*')
+	passphraseField.SetBackgroundColor(ColorBg)
+
+	rememberBox = tview.NewCheckbox()
+	rememberBox.SetLabel("Remember: ")
+	rememberBox.SetBackgroundColor(ColorBg)
+
+	// Saved profiles: picking one switches the server and fills in the login
+	if len(a.config.Profiles) > 0 {
+		const newAccount = "New account"
+		options := make([]string, 0, len(a.config.Profiles)+1)
+		selected := len(a.config.Profiles)
+		for i, p := range a.config.Profiles {
+			options = append(options, p.Name)
+			if p.Name == a.profileName {
+				selected = i
+			}
+		}
+		options = append(options, newAccount)
+
+		profileField := tview.NewDropDown()
+		profileField.SetLabel("Profile: ")
+		profileField.SetFieldWidth(30)
+		profileField.SetBackgroundColor(ColorBg)
+		profileField.SetOptions(options, nil)
+		profileField.SetCurrentOption(selected)
+		profileField.SetSelectedFunc(func(name string, index int) {
+			if p := a.selectProfile(name); p != nil {
+				loginField.SetText(p.Login)
+				passwordField.SetText("")
+			}
+			a.updateAuthTitle(form)
+		})
+		form.AddFormItem(profileField)
+	}
+
+	if a.presetLogin != "" {
+		loginField.SetText(a.presetLogin)
+	}
+
 	form.AddFormItem(loginField)
 	form.AddFormItem(passwordField)
+	if a.cacheDir != "" || a.configPath != "" {
+		form.AddFormItem(passphraseField)
+	}
+	if a.configPath != "" {
+		form.AddFormItem(rememberBox)
+	}
+
+	// collect validates the form; the password may be left empty to use the saved one
+	collect := func(register bool) (credentials, bool) {
+		creds := credentials{
+			login:      loginField.GetText(),
+			password:   passwordField.GetText(),
+			passphrase: passphraseField.GetText(),
+		}
+		if creds.login == "" || (creds.password == "" && (register || !a.hasSavedPassword())) {
+			statusText.SetText("[red]Please enter login and password[-]")
+			return creds, false
+		}
+		return creds, true
+	}
 
 	// Auth button
 	form.AddButton("Login", func() {
-		login := loginField.GetText()
-		password := passwordField.GetText()
-		if login == "" || password == "" {
-			statusText.SetText("[red]Please enter login and password[-]")
-			return
+		if creds, ok := collect(false); ok {
+			a.doAuth(creds, statusText, false, rememberBox.IsChecked())
 		}
-		a.doAuth(login, password, statusText, false)
 	})
 
 	// Register button
 	form.AddButton("Register", func() {
-		login := loginField.GetText()
-		password := passwordField.GetText()
-		if login == "" || password == "" {
-			statusText.SetText("[red]Please enter login and password[-]")
-			return
+		if creds, ok := collect(true); ok {
+			a.doAuth(creds, statusText, true, rememberBox.IsChecked())
 		}
-		a.doAuth(login, password, statusText, true)
 	})
 
+	// Offline button: read cached history without connecting
+	if a.cacheDir != "" {
+		form.AddButton("Offline", func() {
+			login := loginField.GetText()
+			if login == "" {
+				statusText.SetText("[red]Please enter login[-]")
+				return
+			}
+			if err := a.openCache(login, passphraseField.GetText()); err != nil {
+				statusText.SetText(fmt.Sprintf("[red]%v[-]", err))
+				return
+			}
+			a.currentUser = login
+			a.currentPass = passwordField.GetText()
+			a.showMainScreen()
+		})
+	}
+
 	form.AddButton("Quit", func() {
 		a.app.Stop()
 	})
 
+	a.updateAuthTitle(form)
+
 	// Center the form
 	formFlex := tview.NewFlex().SetDirection(tview.FlexRow).
 		AddItem(form, 0, 1, true).
@@ -80,7 +156,7 @@ func (a *App) showAuthDialog() {
 
 	// Create modal-like container
 	width := 54
-	height := 12
+	height := 8 + 2*form.GetFormItemCount()
 
 	modal := tview.NewFlex().SetDirection(tview.FlexRow).
 		AddItem(nil, 0, 1, false).
@@ -92,13 +168,56 @@ func (a *App) showAuthDialog() {
 
 	a.pages.AddPage("auth", modal, true, true)
 	a.app.SetFocus(form)
+
+	// Auto-login requested on the command line
+	if a.autoLogin != nil {
+		creds := *a.autoLogin
+		a.autoLogin = nil
+		loginField.SetText(creds.login)
+		a.doAuth(creds, statusText, false, false)
+	}
+}
+
+// updateAuthTitle shows the server the auth dialog connects to
+func (a *App) updateAuthTitle(form *tview.Form) {
+	form.SetTitle(fmt.Sprintf(" mSIM Authorization: %s ", a.serverAddr))
 }
 
-func (a *App) doAuth(login, password string, statusText *tview.TextView, register bool) {
+func (a *App) doAuth(creds credentials, statusText *tview.TextView, register, remember bool) {
 	statusText.SetText("Connecting...")
+	login, password, passphrase := creds.login, creds.password, creds.passphrase
 
 	// Run connection in goroutine to avoid blocking UI
 	go func() {
+		// Open the local cache first: a wrong passphrase should not cost a login
+		if err := a.openCache(login, passphrase); err != nil {
+			a.app.QueueUpdateDraw(func() {
+				statusText.SetText(fmt.Sprintf("[red]%v[-]", err))
+			})
+			return
+		}
+
+		// Empty password: take the one saved for the profile
+		if password == "" {
+			var err error
+			if password, err = a.savedPassword(login, passphrase); err != nil {
+				a.app.QueueUpdateDraw(func() {
+					statusText.SetText(fmt.Sprintf("[red]%v[-]", err))
+				})
+				return
+			}
+		}
+
+		// Entering the main screen, saving the account first if asked to
+		loggedIn := func() {
+			a.showMainScreen()
+			if remember {
+				if err := a.rememberAccount(login, password, passphrase); err != nil {
+					a.showErrorDialog("Profile", fmt.Sprintf("Could not save profile: %v", err))
+				}
+			}
+		}
+
 		// Connect to server
 		a.client = protocol.NewClient()
 		err := a.client.Connect(a.serverAddr)
@@ -140,11 +259,7 @@ func (a *App) doAuth(login, password string, statusText *tview.TextView, registe
 			if len(parts) >= 2 {
 				op := parts[1]
 				if op == protocol.TypeAuth || op == protocol.TypeReg {
-					if len(parts) >= 3 {
-						authError = parts[2]
-					} else {
-						authError = "Operation failed"
-					}
+					authError = errorText(parts, "Operation failed")
 					select {
 					case done <- -1: // error
 					default:
@@ -173,9 +288,7 @@ func (a *App) doAuth(login, password string, statusText *tview.TextView, registe
 		case result := <-done:
 			if result == 1 {
 				// Auth success
-				a.app.QueueUpdateDraw(func() {
-					a.showMainScreen()
-				})
+				a.app.QueueUpdateDraw(loggedIn)
 			} else if result == 0 {
 				// Registration success, now authenticate
 				a.app.QueueUpdateDraw(func() {
@@ -188,7 +301,7 @@ func (a *App) doAuth(login, password string, statusText *tview.TextView, registe
 				case authResult := <-done:
 					a.app.QueueUpdateDraw(func() {
 						if authResult == 1 {
-							a.showMainScreen()
+							loggedIn()
 						} else {
 							statusText.SetText(authError)
 							a.client.Disconnect()
@@ -0,0 +1,82 @@
+package ui
+
+import (
+	"msim-client/cache"
+)
+
+// SetCacheDir sets where the local message cache is stored; empty disables caching
+func (a *App) SetCacheDir(dir string) {
+	a.cacheDir = dir
+}
+
+// openCache loads the local cache of login and restores contacts,
+// history, unread counters and unsent messages from it
+func (a *App) openCache(login, passphrase string) error {
+	a.closeCache()
+	if a.cacheDir == "" {
+		return nil
+	}
+
+	c, err := cache.Open(a.cacheDir, a.serverAddr, login, passphrase)
+	if err != nil {
+		return err
+	}
+	a.cache = c
+
+	a.mu.Lock()
+	a.contacts = c.Contacts()
+	a.messages = c.Messages()
+	a.unreadCounts = c.Unread()
+	a.outbox = c.Outbox()
+	a.mu.Unlock()
+	return nil
+}
+
+// closeCache flushes and closes the local cache
+func (a *App) closeCache() {
+	if a.cache != nil {
+		a.cache.Close()
+		a.cache = nil
+	}
+}
+
+// persistContacts stores the contact list in the local cache
+func (a *App) persistContacts() {
+	if a.cache == nil {
+		return
+	}
+	// The cache copies the data, so hold the lock while it does
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	a.cache.SetContacts(a.contacts)
+}
+
+// persistChat stores the messages of one chat in the local cache
+func (a *App) persistChat(contactID string) {
+	if a.cache == nil {
+		return
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	a.cache.SetMessages(contactID, a.messages[contactID])
+}
+
+// persistUnread stores unread counters in the local cache
+func (a *App) persistUnread() {
+	if a.cache == nil {
+		return
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	a.cache.SetUnread(a.unreadCounts)
+}
+
+// persistOutbox stores messages queued while disconnected in the local cache
+func (a *App) persistOutbox() {
+	if a.cache == nil {
+		return
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	a.cache.SetOutbox(a.outbox)
+}
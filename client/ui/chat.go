@@ -27,9 +27,17 @@ func (a *App) openChat(contactID string) {
 
 	// Update contacts list to reflect cleared unread count
 	a.updateContactsList()
-
-	// Load history
-	a.loadHistory(contactID)
+	a.persistUnread()
+
+	// Show cached history right away and fetch only what is missing
+	if a.isConnected() {
+		a.syncHistory(contactID)
+	} else {
+		a.mu.Lock()
+		a.applyUnreadMarker()
+		a.mu.Unlock()
+	}
+	a.refreshChatView()
 }
 
 func (a *App) getChatTitle(contactID string) string {
@@ -182,39 +190,64 @@ func (a *App) loadHistory(contactID string) {
 	handler := func(parts []string) {
 		// Format: hist|contact|<raw content with msg|sender|text|timestamp|status,...>
 		// parts[0] = "hist", parts[1] = "contact", parts[2] = raw content
-		if len(parts) >= 2 && parts[0] == protocol.TypeHist {
-			content := ""
-			if len(parts) >= 3 {
-				content = parts[2]
-			}
-			messages := protocol.ParseHistory(content)
-			a.mu.Lock()
-			a.messages[contactID] = messages
-			// Calculate unread marker position from pending unread count (only once)
-			// Only process if there's a pending count - don't reset marker if already set
-			unreadCount := a.pendingUnreadCount
-			if unreadCount > 0 {
-				if unreadCount <= len(messages) {
-					a.unreadMarker = len(messages) - unreadCount
-				} else {
-					// More unreads than messages - show marker at beginning
-					a.unreadMarker = 0
-				}
-				// Reset pending count only after processing
-				a.pendingUnreadCount = 0
+		content := ""
+		if len(parts) >= 3 {
+			content = parts[2]
+		}
+		messages := protocol.ParseHistory(content)
+		a.mu.Lock()
+		// Messages typed while offline are not on the server yet
+		for _, msg := range a.messages[contactID] {
+			if msg.Status == statusPending {
+				messages = append(messages, msg)
 			}
-			// If pendingUnreadCount was 0, don't touch unreadMarker (might be set by previous handler)
-			a.mu.Unlock()
-			a.app.QueueUpdateDraw(func() {
-				a.refreshChatView()
-			})
 		}
+		a.messages[contactID] = messages
+		a.applyUnreadMarker()
+		a.mu.Unlock()
+		a.persistChat(contactID)
+		a.app.QueueUpdateDraw(func() {
+			a.refreshChatView()
+		})
 	}
 
-	a.client.OnPacket(protocol.TypeHist, handler)
+	// Offline: keep showing what we already have
+	if !a.isConnected() {
+		a.refreshChatView()
+		return
+	}
+
+	a.client.OnReply(protocol.TypeHist, isHistoryOf(contactID), handler)
 	a.client.GetHistory(contactID)
 }
 
+// isHistoryOf matches the hist reply for a contact
+func isHistoryOf(contactID string) func(parts []string) bool {
+	return func(parts []string) bool {
+		return len(parts) >= 2 && parts[1] == contactID
+	}
+}
+
+// applyUnreadMarker calculates the unread marker position from the pending
+// unread count once the history of the current chat is known.
+// The caller must hold a.mu.
+func (a *App) applyUnreadMarker() {
+	// Only process if there's a pending count - don't reset marker if already set
+	unreadCount := a.pendingUnreadCount
+	if unreadCount <= 0 {
+		return
+	}
+	total := len(a.messages[a.currentChat])
+	if unreadCount <= total {
+		a.unreadMarker = total - unreadCount
+	} else {
+		// More unreads than messages - show marker at beginning
+		a.unreadMarker = 0
+	}
+	// Reset pending count only after processing
+	a.pendingUnreadCount = 0
+}
+
 func (a *App) refreshChatView() {
 	if a.chatView == nil {
 		return
@@ -277,6 +310,8 @@ func (a *App) refreshChatView() {
 		statusIcon := "[gray]○[-]" // sent
 		if msg.Status == "ackn" {
 			statusIcon = "[green]✓[-]"
+		} else if msg.Status == statusPending {
+			statusIcon = "[yellow]…[-]"
 		}
 
 		// Outgoing = white, Incoming = yellow
@@ -296,18 +331,28 @@ func (a *App) refreshChatView() {
 func (a *App) sendMessage(contactID, text string) {
 	timestamp := time.Now().UTC().Format("2006-01-02T15:04:05Z")
 
-	// Store message locally with sent status
+	// Send to server, or queue until reconnected
+	status := "sent"
+	if !a.isConnected() || a.client.SendMessage(contactID, text) != nil {
+		status = statusPending
+	}
+
+	// Store message locally
 	a.mu.Lock()
 	a.messages[contactID] = append(a.messages[contactID], protocol.Message{
 		Sender:    a.currentUser,
 		Text:      text,
 		Timestamp: timestamp,
-		Status:    "sent",
+		Status:    status,
 	})
+	if status == statusPending {
+		a.queueMessage(contactID, text, timestamp)
+	}
 	a.mu.Unlock()
-
-	// Send to server
-	a.client.SendMessage(contactID, text)
+	a.persistChat(contactID)
+	if status == statusPending {
+		a.persistOutbox()
+	}
 
 	// Update view
 	a.refreshChatView()
@@ -1,12 +1,20 @@
 package ui
 
 import (
+	"errors"
 	"fmt"
 	"time"
 
 	"msim-client/protocol"
+
+	"github.com/rivo/tview"
 )
 
+// isConnected reports whether there is a live connection to the server
+func (a *App) isConnected() bool {
+	return a.client != nil && a.client.IsConnected()
+}
+
 func (a *App) updateConnectionStatus() {
 	if a.connectionView == nil {
 		return
@@ -35,7 +43,8 @@ func (a *App) startStatusTicker() {
 				if a.client != nil && a.client.IsConnected() {
 					a.app.QueueUpdateDraw(func() {
 						a.updateConnectionStatus()
-						a.updateContactsList() // Refresh last seen times
+						a.updateStatusBarText() // Drop the maintenance banner once it is over
+						a.updateContactsList()  // Refresh last seen times
 					})
 				}
 			}
@@ -62,11 +71,47 @@ func (a *App) updateStatusBarText() {
 	if a.statusBar == nil {
 		return
 	}
+	keys := " F1:Help | F6:Connect | F10:Quit "
 	if a.client != nil && a.client.IsConnected() {
-		a.statusBar.SetText(" F1:Help | F2:Add | F3:Rename | F4:Delete | F5:Refresh | F6:Disconnect | F10:Quit ")
-	} else {
-		a.statusBar.SetText(" F1:Help | F6:Connect | F10:Quit ")
+		keys = " F1:Help | F2:Add | F3:Rename | F4:Delete | F5:Refresh | F6:Disconnect | F7:Info | F10:Quit "
 	}
+	a.statusBar.SetText(a.noticeBanner() + keys)
+}
+
+// maintenance is planned maintenance announced by the server
+type maintenance struct {
+	start, end time.Time
+	text       string
+}
+
+func (a *App) setNotice(notice *maintenance) {
+	a.mu.Lock()
+	a.notice = notice
+	a.mu.Unlock()
+}
+
+// noticeBanner returns the status bar banner for announced maintenance,
+// empty once it is over
+func (a *App) noticeBanner() string {
+	a.mu.RLock()
+	notice := a.notice
+	a.mu.RUnlock()
+	if notice == nil || !time.Now().Before(notice.end) {
+		return ""
+	}
+
+	when := "until " + notice.end.Local().Format("15:04")
+	if time.Now().Before(notice.start) {
+		when = notice.start.Local().Format("15:04") + "-" + notice.end.Local().Format("15:04")
+		if notice.start.Local().Format("2006-01-02") != time.Now().Format("2006-01-02") {
+			when = notice.start.Local().Format("Jan 2 15:04") + "-" + notice.end.Local().Format("15:04")
+		}
+	}
+	banner := "[yellow:red:b] Maintenance " + when
+	if notice.text != "" {
+		banner += ": " + tview.Escape(notice.text)
+	}
+	return banner + " [-:-:-]"
 }
 
 func (a *App) resetAllStatuses() {
@@ -74,10 +119,7 @@ func (a *App) resetAllStatuses() {
 	for k := range a.statuses {
 		a.statuses[k] = false
 	}
-	// Also reset unread counts and last seen on disconnect
-	for k := range a.unreadCounts {
-		delete(a.unreadCounts, k)
-	}
+	// Also reset last seen on disconnect; unread counts stay for offline reading
 	for k := range a.statusLastSeen {
 		delete(a.statusLastSeen, k)
 	}
@@ -85,8 +127,10 @@ func (a *App) resetAllStatuses() {
 }
 
 func (a *App) toggleConnection() {
-	if a.client != nil && a.client.IsConnected() {
+	if a.isConnected() {
 		// Disconnect
+		a.autoReconnect = false
+		a.stopReconnect()
 		a.connectionView.SetText("[yellow]Disconnecting...[-]")
 		a.client.Disconnect()
 		a.client = nil
@@ -95,31 +139,46 @@ func (a *App) toggleConnection() {
 		a.updateStatusBarText()
 		a.updateContactsList()
 	} else {
-		// Reconnect
+		// Reconnect now, skipping any scheduled automatic attempt
+		a.stopReconnect()
 		a.connectionView.SetText("[yellow]Connecting...[-]")
 		go a.reconnect()
 	}
 }
 
 func (a *App) reconnect() {
-	a.client = protocol.NewClient()
-	err := a.client.Connect(a.serverAddr)
-	if err != nil {
-		a.app.QueueUpdateDraw(func() {
-			a.setConnectionError(fmt.Sprintf("Connection failed: %v", err))
+	err := a.connectAndAuth()
+	a.app.QueueUpdateDraw(func() {
+		if err != nil {
+			a.setConnectionError(err.Error())
 			a.updateStatusBarText()
-		})
-		return
+			return
+		}
+		a.autoReconnect = true
+		a.updateConnectionStatus()
+		a.updateStatusBarText()
+		a.resync()
+	})
+}
+
+// connectAndAuth opens a new connection and authenticates with the saved credentials.
+// An *authRejectedError is returned when the server rejects the credentials
+// or the account (E_BAD_CREDENTIALS, E_FORBIDDEN).
+func (a *App) connectAndAuth() error {
+	client := protocol.NewClient()
+	if err := client.Connect(a.serverAddr); err != nil {
+		return fmt.Errorf("Connection failed: %v", err)
 	}
+	a.client = client
 
 	// Setup handlers
 	a.setupHandlers()
 
 	// Authenticate
 	done := make(chan int, 1)
-	var authError string
+	var failReason, failCode string
 
-	a.client.OnPacket(protocol.TypeOk, func(parts []string) {
+	client.OnPacket(protocol.TypeOk, func(parts []string) {
 		if len(parts) >= 2 && parts[1] == protocol.TypeAuth {
 			select {
 			case done <- 1:
@@ -128,13 +187,10 @@ func (a *App) reconnect() {
 		}
 	})
 
-	a.client.OnPacket(protocol.TypeFail, func(parts []string) {
+	client.OnPacket(protocol.TypeFail, func(parts []string) {
 		if len(parts) >= 2 && parts[1] == protocol.TypeAuth {
-			if len(parts) >= 3 {
-				authError = parts[2]
-			} else {
-				authError = "Auth failed"
-			}
+			failReason = errorText(parts, "Auth failed")
+			failCode = protocol.ParseFail(parts).Code
 			select {
 			case done <- -1:
 			default:
@@ -142,32 +198,35 @@ func (a *App) reconnect() {
 		}
 	})
 
-	a.client.Auth(a.currentUser, a.currentPass)
+	client.Auth(a.currentUser, a.currentPass)
 
 	select {
 	case result := <-done:
-		a.app.QueueUpdateDraw(func() {
-			if result == 1 {
-				a.updateConnectionStatus()
-				a.updateStatusBarText()
-				a.loadContacts()
-				a.loadStatuses()
-				a.loadOfflineMessages()
-			} else {
-				a.setConnectionError(authError)
-				a.client.Disconnect()
-				a.client = nil
-				a.updateStatusBarText()
-			}
-		})
+		if result == 1 {
+			return nil
+		}
+		client.Disconnect()
+		a.client = nil
+		// Only a definite refusal stops reconnecting: rate limits, lockouts
+		// and internal errors are temporary and worth another attempt
+		switch failCode {
+		case protocol.ErrCodeBadCredentials, protocol.ErrCodeForbidden:
+			return &authRejectedError{reason: failReason}
+		}
+		return errors.New(failReason)
 	case <-time.After(10 * time.Second):
-		a.app.QueueUpdateDraw(func() {
-			a.setConnectionError("Connection timeout")
-			if a.client != nil {
-				a.client.Disconnect()
-				a.client = nil
-			}
-			a.updateStatusBarText()
-		})
+		client.Disconnect()
+		a.client = nil
+		return fmt.Errorf("Connection timeout")
 	}
 }
+
+// authRejectedError is returned when the server rejects the saved credentials
+// or the account for good
+type authRejectedError struct {
+	reason string
+}
+
+func (e *authRejectedError) Error() string {
+	return e.reason
+}
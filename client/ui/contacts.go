@@ -8,6 +8,9 @@ import (
 )
 
 func (a *App) loadContacts() {
+	if !a.isConnected() {
+		return
+	}
 	done := make(chan bool, 1)
 
 	handler := func(parts []string) {
@@ -22,6 +25,7 @@ func (a *App) loadContacts() {
 			a.mu.Lock()
 			a.contacts = contacts
 			a.mu.Unlock()
+			a.persistContacts()
 			done <- true
 		}
 	}
@@ -41,6 +45,9 @@ func (a *App) loadContacts() {
 }
 
 func (a *App) loadStatuses() {
+	if !a.isConnected() {
+		return
+	}
 	handler := func(parts []string) {
 		// Format: stat|<raw content with user|status|last_seen,...>
 		// parts[0] = "stat", parts[1] = raw content
@@ -69,6 +76,9 @@ func (a *App) loadStatuses() {
 }
 
 func (a *App) loadOfflineMessages() {
+	if !a.isConnected() {
+		return
+	}
 	handler := func(parts []string) {
 		// Format: offmsg|<raw content with contact|count,...>
 		// parts[0] = "offmsg", parts[1] = raw content
@@ -83,6 +93,7 @@ func (a *App) loadOfflineMessages() {
 				a.unreadCounts[c.ContactID] = c.Count
 			}
 			a.mu.Unlock()
+			a.persistUnread()
 			a.app.QueueUpdateDraw(func() {
 				a.updateContactsList()
 			})
@@ -108,6 +119,9 @@ func (a *App) updateContactsList() {
 		if nick == "" {
 			nick = contact.ID
 		}
+		if contact.Bot {
+			nick += " [blue]bot[white]"
+		}
 
 		var mainText string
 		unread := a.unreadCounts[contact.ID]
@@ -2,6 +2,7 @@ package ui
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	"msim-client/protocol"
@@ -60,11 +61,7 @@ func (a *App) showAddContactDialog() {
 
 		a.client.OnPacket(protocol.TypeFail, func(parts []string) {
 			if len(parts) >= 2 && parts[1] == protocol.TypeAdd {
-				if len(parts) >= 3 {
-					errMsg = parts[2]
-				} else {
-					errMsg = "Failed to add contact"
-				}
+				errMsg = errorText(parts, "Failed to add contact")
 				done <- false
 			}
 		})
@@ -171,11 +168,7 @@ func (a *App) showRenameContactDialog() {
 
 		a.client.OnPacket(protocol.TypeFail, func(parts []string) {
 			if len(parts) >= 2 && parts[1] == protocol.TypeRen {
-				if len(parts) >= 3 {
-					errMsg = parts[2]
-				} else {
-					errMsg = "Failed to rename contact"
-				}
+				errMsg = errorText(parts, "Failed to rename contact")
 				done <- false
 			}
 		})
@@ -283,11 +276,13 @@ func (a *App) showClearHistoryDialog(contactID string) {
 	modal.SetButtonTextColor(ColorTitle)
 	modal.AddButtons([]string{"Clear", "Cancel"})
 	modal.SetDoneFunc(func(buttonIndex int, buttonLabel string) {
-		if buttonLabel == "Clear" {
+		// History lives on the server, it can only be cleared while connected
+		if buttonLabel == "Clear" && a.isConnected() {
 			a.client.ClearHistory(contactID)
 			a.mu.Lock()
 			a.messages[contactID] = nil
 			a.mu.Unlock()
+			a.persistChat(contactID)
 			a.refreshChatView()
 		}
 		a.pages.RemovePage("dialog")
@@ -298,6 +293,13 @@ func (a *App) showClearHistoryDialog(contactID string) {
 }
 
 func (a *App) showDisconnectNotification(reason, details string) {
+	if a.connectionView != nil {
+		a.connectionView.SetText(fmt.Sprintf("[red]○ %s[-]\n[gray]Press F6 to reconnect[-]", disconnectReasonText(reason, details)))
+	}
+}
+
+// disconnectReasonText describes a bye reason for the user
+func disconnectReasonText(reason, details string) string {
 	reasonText := "Disconnected"
 	switch reason {
 	case "timeout":
@@ -314,13 +316,19 @@ func (a *App) showDisconnectNotification(reason, details string) {
 		} else {
 			reasonText = "Server is restarting"
 		}
+	case "flood":
+		reasonText = "Disconnected for sending too many requests"
+	case "kicked":
+		reasonText = "Disconnected by administrator"
+		if details != "" {
+			reasonText += ": " + details
+		}
+	case "replaced":
+		reasonText = "Signed in from another place"
 	case "connection_lost":
 		reasonText = "Connection lost"
 	}
-
-	if a.connectionView != nil {
-		a.connectionView.SetText(fmt.Sprintf("[red]○ %s[-]\n[gray]Press F6 to reconnect[-]", reasonText))
-	}
+	return reasonText
 }
 
 func (a *App) showDisconnectDialog(reason string) {
@@ -332,6 +340,12 @@ func (a *App) showDisconnectDialog(reason string) {
 		reasonText = "Server is going to maintenance"
 	case "restart":
 		reasonText = "Server is restarting"
+	case "flood":
+		reasonText = "Disconnected for sending too many requests"
+	case "kicked":
+		reasonText = "Disconnected by administrator"
+	case "replaced":
+		reasonText = "Signed in from another place"
 	case "connection_lost":
 		reasonText = "Connection lost"
 	}
@@ -349,3 +363,80 @@ func (a *App) showDisconnectDialog(reason string) {
 
 	a.pages.AddPage("disconnect", modal, true, true)
 }
+
+// showSystemMessage shows a message from the server administrator
+func (a *App) showSystemMessage(stamp, text string) {
+	a.showMessageModal("sysmessage", fmt.Sprintf("Message from server (%s)\n\n%s", stamp, text))
+}
+
+// showMOTD shows the message of the day sent by the server after login
+func (a *App) showMOTD(text string) {
+	a.showMessageModal("motd", "Message of the day\n\n"+text)
+}
+
+// showPendingMOTD shows a message of the day that arrived after login, unless
+// it is the one already shown. The main screen calls it as well, because the
+// message may arrive before the screen is up.
+func (a *App) showPendingMOTD() {
+	if !a.pages.HasPage("main") {
+		return
+	}
+	a.mu.Lock()
+	motd := a.motd
+	a.motd = ""
+	if motd == a.shownMOTD {
+		motd = ""
+	} else if motd != "" {
+		a.shownMOTD = motd
+	}
+	a.mu.Unlock()
+	if motd != "" {
+		a.showMOTD(motd)
+	}
+}
+
+// showServerInfo shows the name, version, uptime and limits of the server
+func (a *App) showServerInfo(info *protocol.ServerInfo) {
+	limit := func(n int, unit string) string {
+		if n <= 0 {
+			return "unlimited"
+		}
+		return fmt.Sprintf("%d %s", n, unit)
+	}
+	features := "none"
+	if len(info.Features) > 0 {
+		features = strings.Join(info.Features, ", ")
+	}
+
+	text := fmt.Sprintf("%s %s\nUp for %s\n\nMessage length: %s\nPacket size: %s\nFile accept timeout: %s\nFile transfer timeout: %s\nFeatures: %s",
+		info.Name, info.Version,
+		formatDuration(time.Duration(info.Uptime)*time.Second),
+		limit(info.MaxMessage, "characters"),
+		limit(info.MaxLine, "bytes"),
+		formatDuration(time.Duration(info.FileAcceptTimeout)*time.Second),
+		formatDuration(time.Duration(info.FileTransferTimeout)*time.Second),
+		features)
+	a.showMessageModal("serverinfo", text)
+}
+
+// showMessageModal shows text in a modal with an OK button on top of the
+// current page and returns focus to where it was
+func (a *App) showMessageModal(page, text string) {
+	focus := a.app.GetFocus()
+
+	modal := tview.NewModal()
+	modal.SetText(text)
+	modal.SetBackgroundColor(ColorBg)
+	modal.SetTextColor(ColorFg)
+	modal.SetButtonBackgroundColor(tcell.NewRGBColor(0, 128, 128))
+	modal.SetButtonTextColor(ColorTitle)
+	modal.AddButtons([]string{"OK"})
+	modal.SetDoneFunc(func(buttonIndex int, buttonLabel string) {
+		a.pages.RemovePage(page)
+		if focus != nil {
+			a.app.SetFocus(focus)
+		}
+	})
+
+	a.pages.AddPage(page, modal, true, true)
+}
@@ -1,8 +1,6 @@
 package ui
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
@@ -13,6 +11,8 @@ import (
 	"sync"
 	"time"
 
+	"msim-client/protocol"
+
 	"github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
 )
@@ -129,7 +129,7 @@ func (a *App) showSendFileDialog(recipient string) {
 		statusLabel.SetText("[yellow]Calculating hash...")
 		a.app.ForceDraw()
 
-		hash, err := calculateFileHash(filePath)
+		hash, err := protocol.FileHash(filePath)
 		if err != nil {
 			statusLabel.SetText(fmt.Sprintf("[red]Hash error: %v", err))
 			return
@@ -480,8 +480,12 @@ func (a *App) showReceiveFileDialog(sender, filename string, size int64, hash, s
 	}
 
 	// Default save path
-	home, _ := os.UserHomeDir()
-	defaultPath := filepath.Join(home, "Downloads", filename)
+	downloadDir := a.downloadDir
+	if downloadDir == "" {
+		home, _ := os.UserHomeDir()
+		downloadDir = filepath.Join(home, "Downloads")
+	}
+	defaultPath := filepath.Join(downloadDir, filename)
 
 	// Create transfer
 	transfer := &FileTransfer{
@@ -839,7 +843,7 @@ func (a *App) performReceiveTransfer(transfer *FileTransfer, onProgress func())
 	// Verify hash if provided
 	if transfer.Status == "completed" && transfer.Hash != "" {
 		file.Close() // Close before reading for hash
-		hash, err := calculateFileHash(transfer.SavePath)
+		hash, err := protocol.FileHash(transfer.SavePath)
 		if err != nil {
 			transfer.mu.Lock()
 			transfer.Error = "hash verification failed: " + err.Error()
@@ -1012,22 +1016,6 @@ func buildProgressBar(percent, width int) string {
 	return "[" + strings.Repeat("█", filled) + strings.Repeat("░", empty) + "]"
 }
 
-// calculateFileHash calculates SHA256 hash of a file
-func calculateFileHash(path string) (string, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
-
-	hasher := sha256.New()
-	if _, err := io.Copy(hasher, file); err != nil {
-		return "", err
-	}
-
-	return "sha256:" + hex.EncodeToString(hasher.Sum(nil)), nil
-}
-
 // progressReader wraps an io.Reader to track progress
 type progressReader struct {
 	reader     io.Reader
@@ -55,6 +55,8 @@ func (a *App) setupHandlers() {
 				a.unreadCounts[sender]++
 			}
 			a.mu.Unlock()
+			a.persistChat(sender)
+			a.persistUnread()
 
 			// Update UI if chat is open
 			a.app.QueueUpdateDraw(func() {
@@ -82,6 +84,7 @@ func (a *App) setupHandlers() {
 				}
 			}
 			a.mu.Unlock()
+			a.persistChat(recipient)
 
 			// Update UI
 			a.app.QueueUpdateDraw(func() {
@@ -147,6 +150,77 @@ func (a *App) setupHandlers() {
 			a.updateStatusBarText()
 			a.updateContactsList()
 			a.showDisconnectNotification(reason, details)
+			if reason == "kicked" || reason == "replaced" {
+				// Reconnecting right after being kicked would only annoy the administrator,
+				// and after being replaced it would push out the newer session
+				a.showErrorDialog("Disconnected", disconnectReasonText(reason, details))
+				return
+			}
+
+			// The server announces when maintenance or restart is over
+			var notBefore time.Time
+			if reason == "maintenance" || reason == "restart" {
+				notBefore, _ = time.Parse(time.RFC3339, details)
+			}
+			a.scheduleReconnect(disconnectReasonText(reason, details), notBefore)
+		})
+	})
+
+	// Handle message from the server administrator: sys|timestamp|text
+	a.client.OnPacket(protocol.TypeSys, func(parts []string) {
+		if len(parts) < 3 {
+			return
+		}
+		stamp := parts[1]
+		if t, err := time.Parse(time.RFC3339, parts[1]); err == nil {
+			stamp = t.Local().Format("15:04")
+		}
+		text := parts[2]
+		a.app.QueueUpdateDraw(func() {
+			a.showSystemMessage(stamp, text)
+		})
+	})
+
+	// Handle planned maintenance: notice|start|end|text, a bare notice cancels it.
+	// The server repeats a pending notice after auth, so a new connection starts clean.
+	a.setNotice(nil)
+	a.client.OnPacket(protocol.TypeNotice, func(parts []string) {
+		var notice *maintenance
+		if len(parts) >= 3 {
+			start, err1 := time.Parse(time.RFC3339, parts[1])
+			end, err2 := time.Parse(time.RFC3339, parts[2])
+			if err1 != nil || err2 != nil {
+				return
+			}
+			notice = &maintenance{start: start, end: end}
+			if len(parts) >= 4 {
+				notice.text = parts[3]
+			}
+		}
+		a.setNotice(notice)
+		a.app.QueueUpdateDraw(a.updateStatusBarText)
+	})
+
+	// Handle message of the day: motd|text, sent right after ok|auth.
+	// It is shown once the main screen is up and not again after a reconnect.
+	a.client.OnPacket(protocol.TypeMotd, func(parts []string) {
+		if len(parts) < 2 {
+			return
+		}
+		a.mu.Lock()
+		a.motd = parts[1]
+		a.mu.Unlock()
+		a.app.QueueUpdateDraw(a.showPendingMOTD)
+	})
+
+	// Handle server info requested with F7: info|key|value,...
+	a.client.OnPacket(protocol.TypeInfo, func(parts []string) {
+		if len(parts) < 2 {
+			return
+		}
+		info := protocol.ParseInfo(parts[1])
+		a.app.QueueUpdateDraw(func() {
+			a.showServerInfo(info)
 		})
 	})
 
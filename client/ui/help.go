@@ -15,6 +15,7 @@ func (a *App) showHelp() {
    [white]F4[-]       Delete selected contact
    [white]F5[-]       Refresh contacts list
    [white]F6[-]       Connect / Disconnect
+   [white]F7[-]       Server info
    [white]F10/Esc[-]  Quit application
    [white]Enter[-]    Open chat with contact
    [white]↑ ↓[-]      Navigate contacts
@@ -44,10 +45,13 @@ func (a *App) showHelp() {
    [gray]○[-] offline  User is disconnected
    [green]✓[-]          Message delivered (acknowledged)
    [gray]○[-]          Message sent (waiting for ack)
+   [yellow]…[-]          Message queued, will be sent after reconnect
 
  [yellow]Protocol Information[-]
  ───────────────────────────────────────────────────────────────
    Server connection is kept alive with automatic ping every 30s.
+   Lost connections are restored automatically with growing delays.
+  History is cached locally and can be read while offline.
    Incoming messages are automatically acknowledged (ack).
    Messages from unknown users auto-add them to contacts.
 `
@@ -2,6 +2,7 @@ package ui
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
@@ -19,6 +20,10 @@ func (a *App) showMainScreen() {
 	// Update title with current user
 	a.contactsList.SetTitle(fmt.Sprintf(" Contacts [%s] ", a.currentUser))
 
+	// From now on a dropped connection is restored automatically
+	// (in offline mode only if a password was entered)
+	a.autoReconnect = a.currentPass != ""
+
 	// Start status ticker for ping display
 	a.startStatusTicker()
 
@@ -26,10 +31,21 @@ func (a *App) showMainScreen() {
 	a.updateConnectionStatus()
 	a.updateStatusBarText()
 
-	// Load contacts, statuses and offline messages
-	a.loadContacts()
-	a.loadStatuses()
-	a.loadOfflineMessages()
+	// Show cached contacts until the server answers
+	a.updateContactsList()
+
+	// The message of the day may have arrived with ok|auth
+	a.showPendingMOTD()
+
+	if a.isConnected() {
+		// Load contacts, statuses and offline messages, send what was queued last time
+		a.loadContacts()
+		a.loadStatuses()
+		a.loadOfflineMessages()
+		a.flushOutbox()
+	} else {
+		a.scheduleReconnect("Offline mode", time.Time{})
+	}
 
 	// Focus on contacts list
 	a.app.SetFocus(a.contactsList)
@@ -51,11 +67,7 @@ func (a *App) createMainPage() tview.Primitive {
 	a.contactsList.ShowSecondaryText(false)
 
 	a.contactsList.SetSelectedFunc(func(index int, mainText, secondaryText string, shortcut rune) {
-		// Check connection first
-		if a.client == nil || !a.client.IsConnected() {
-			a.setConnectionError("Not connected. Press F6 to connect.")
-			return
-		}
+		// Works offline too: cached history is shown and new messages are queued
 		a.mu.RLock()
 		if index < len(a.contacts) {
 			contact := a.contacts[index]
@@ -83,6 +95,7 @@ func (a *App) createMainPage() tview.Primitive {
 	a.statusBar.SetBackgroundColor(tcell.NewRGBColor(0, 128, 128))
 	a.statusBar.SetTextColor(ColorTitle)
 	a.statusBar.SetTextAlign(tview.AlignCenter)
+	a.statusBar.SetDynamicColors(true)
 	a.updateStatusBarText()
 
 	// Main layout
@@ -114,6 +127,11 @@ func (a *App) createMainPage() tview.Primitive {
 		case tcell.KeyF6:
 			a.toggleConnection()
 			return nil
+		case tcell.KeyF7:
+			if a.isConnected() {
+				a.client.GetInfo()
+			}
+			return nil
 		case tcell.KeyF10:
 			a.quit()
 			return nil
@@ -0,0 +1,113 @@
+package ui
+
+import (
+	"errors"
+
+	"msim-client/config"
+)
+
+// errNoSavedPassword is returned when the keyfile has no password for the profile
+var errNoSavedPassword = errors.New("no saved password for this profile")
+
+// SetConfig makes the saved profiles of the config file at path available
+func (a *App) SetConfig(cfg *config.Config, path string) {
+	a.config = cfg
+	a.configPath = path
+}
+
+// SetDownloadDir sets the default directory for received files
+func (a *App) SetDownloadDir(dir string) {
+	a.downloadDir = dir
+}
+
+// SetProfile preselects a saved profile in the auth dialog
+func (a *App) SetProfile(name string) {
+	if p := a.config.Profile(name); p != nil {
+		a.profileName = p.Name
+		a.serverAddr = p.Server
+	}
+}
+
+// SetServer overrides the server address of the selected profile
+func (a *App) SetServer(addr string) {
+	a.serverAddr = addr
+}
+
+// SetLogin fills in the login field of the auth dialog
+func (a *App) SetLogin(login string) {
+	a.presetLogin = login
+}
+
+// SetAutoLogin logs in with the given credentials on start instead of waiting for the auth dialog
+func (a *App) SetAutoLogin(login, password, passphrase string) {
+	a.autoLogin = &credentials{login: login, password: password, passphrase: passphrase}
+}
+
+// credentials are what the auth dialog collects
+type credentials struct {
+	login      string
+	password   string
+	passphrase string
+}
+
+// selectProfile switches the server to the one of a saved profile;
+// an empty name means a new account on the current server
+func (a *App) selectProfile(name string) *config.Profile {
+	a.profileName = ""
+	p := a.config.Profile(name)
+	if p == nil {
+		return nil
+	}
+	a.profileName = p.Name
+	a.serverAddr = p.Server
+	return p
+}
+
+// hasSavedPassword reports whether the selected profile may have a saved password
+func (a *App) hasSavedPassword() bool {
+	return a.profileName != "" && a.configPath != "" && config.KeyfileExists(config.KeyfilePath(a.configPath))
+}
+
+// savedPassword unlocks the keyfile and returns the password of the selected profile
+func (a *App) savedPassword(login, passphrase string) (string, error) {
+	if p := a.config.Profile(a.profileName); p == nil || p.Login != login {
+		return "", errNoSavedPassword
+	}
+	keys, err := config.OpenKeyfile(config.KeyfilePath(a.configPath), passphrase)
+	if err != nil {
+		return "", err
+	}
+	password, ok := keys.Password(a.profileName)
+	if !ok {
+		return "", errNoSavedPassword
+	}
+	return password, nil
+}
+
+// rememberAccount saves the logged in account as a profile and, if a key
+// passphrase was given, its password in the keyfile
+func (a *App) rememberAccount(login, password, passphrase string) error {
+	if a.configPath == "" {
+		return nil
+	}
+
+	name := config.ProfileName(a.serverAddr, login)
+	profile := config.Profile{Name: name, Server: a.serverAddr, Login: login}
+	if p := a.config.Profile(a.profileName); p != nil && p.Login == login {
+		profile = *p
+	}
+	a.config.SetProfile(profile)
+	a.profileName = profile.Name
+	if err := a.config.Save(a.configPath); err != nil {
+		return err
+	}
+
+	if passphrase == "" {
+		return nil
+	}
+	keys, err := config.OpenKeyfile(config.KeyfilePath(a.configPath), passphrase)
+	if err != nil {
+		return err
+	}
+	return keys.SetPassword(profile.Name, password)
+}
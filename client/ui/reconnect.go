@@ -0,0 +1,217 @@
+package ui
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"msim-client/cache"
+	"msim-client/protocol"
+)
+
+// statusPending marks a message typed while disconnected that is not yet sent
+const statusPending = "pending"
+
+// historySyncLimit caps the number of missed messages fetched per chat on reconnect
+const historySyncLimit = 1000
+
+// scheduleReconnect plans the next automatic reconnect attempt.
+// notBefore is the time the server promised to be back (zero if unknown).
+// Must be called from the UI goroutine.
+func (a *App) scheduleReconnect(message string, notBefore time.Time) {
+	if !a.autoReconnect || a.reconnectTimer != nil {
+		return
+	}
+
+	delay := a.backoff.Next()
+	if wait := time.Until(notBefore); wait > delay {
+		// No point knocking before the announced completion time
+		delay = wait + delay
+	}
+	attempt := a.backoff.Attempt()
+
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		a.app.QueueUpdateDraw(func() {
+			// Cancelled or superseded by F6 while the update was queued
+			if a.reconnectTimer != timer {
+				return
+			}
+			a.reconnectTimer = nil
+			a.startReconnectAttempt()
+		})
+	})
+	a.reconnectTimer = timer
+
+	if a.connectionView != nil {
+		a.connectionView.SetText(fmt.Sprintf("[red]○ %s[-]\n[yellow]Reconnecting in %s (attempt %d)[-] [gray]│ F6: now[-]",
+			message, delay.Round(100*time.Millisecond), attempt))
+	}
+}
+
+// stopReconnect cancels a scheduled automatic reconnect attempt
+func (a *App) stopReconnect() {
+	if a.reconnectTimer != nil {
+		a.reconnectTimer.Stop()
+		a.reconnectTimer = nil
+	}
+}
+
+// startReconnectAttempt runs one automatic reconnect attempt in the background.
+// Must be called from the UI goroutine.
+func (a *App) startReconnectAttempt() {
+	if a.connectionView != nil {
+		a.connectionView.SetText(fmt.Sprintf("[yellow]Reconnecting to %s...[-]", a.serverAddr))
+	}
+
+	go func() {
+		err := a.connectAndAuth()
+		a.app.QueueUpdateDraw(func() {
+			if err == nil {
+				a.backoff.Reset()
+				a.updateConnectionStatus()
+				a.updateStatusBarText()
+				a.resync()
+				return
+			}
+
+			var rejected *authRejectedError
+			if errors.As(err, &rejected) {
+				// Credentials or account rejected, retrying will not help
+				a.autoReconnect = false
+				a.setConnectionError(err.Error())
+				a.updateStatusBarText()
+				return
+			}
+
+			a.scheduleReconnect(err.Error(), time.Time{})
+		})
+	}()
+}
+
+// resync restores state after (re)connecting: contacts, statuses, offline
+// counters, messages missed in the open chat and messages queued while offline.
+// Must be called from the UI goroutine.
+func (a *App) resync() {
+	a.loadContacts()
+	a.loadStatuses()
+	a.loadOfflineMessages()
+	if a.currentChat != "" {
+		a.syncHistory(a.currentChat)
+	}
+	a.flushOutbox()
+}
+
+// syncHistory fetches only the messages of a chat that are not in memory yet:
+// ones that arrived while disconnected or since the chat was last cached.
+// A full reload is done instead if the server history no longer matches.
+func (a *App) syncHistory(contactID string) {
+	if !a.isConnected() {
+		return
+	}
+
+	a.mu.RLock()
+	known := 0
+	var lastKnown string
+	for _, msg := range a.messages[contactID] {
+		if msg.Status != statusPending {
+			known++
+			lastKnown = msg.Timestamp
+		}
+	}
+	a.mu.RUnlock()
+
+	a.client.OnReply(protocol.TypeHist, isHistoryOf(contactID), func(parts []string) {
+		// Format: hist|contact|<raw content>
+		content := ""
+		if len(parts) >= 3 {
+			content = parts[2]
+		}
+		missed := protocol.ParseHistory(content)
+
+		// Older messages than the ones we have: history was cleared
+		// or rewritten on the server, start over
+		if len(missed) > 0 && missed[0].Timestamp < lastKnown {
+			a.app.QueueUpdateDraw(func() {
+				a.loadHistory(contactID)
+			})
+			return
+		}
+
+		// Missed messages go after the synced ones but before the pending ones
+		a.mu.Lock()
+		var synced, pending []protocol.Message
+		for _, msg := range a.messages[contactID] {
+			if msg.Status == statusPending {
+				pending = append(pending, msg)
+			} else {
+				synced = append(synced, msg)
+			}
+		}
+		// Messages that came after the request, live or from another sync
+		// of this chat, are already here
+		if extra := len(synced) - known; extra > 0 {
+			missed = missed[min(extra, len(missed)):]
+		}
+		synced = append(synced, missed...)
+		a.messages[contactID] = append(synced, pending...)
+		if a.currentChat == contactID {
+			a.applyUnreadMarker()
+		}
+		a.mu.Unlock()
+		a.persistChat(contactID)
+
+		a.app.QueueUpdateDraw(func() {
+			if a.currentChat == contactID {
+				a.refreshChatView()
+			}
+		})
+	})
+	a.client.GetHistoryRange(contactID, known, historySyncLimit)
+}
+
+// queueMessage stores a message typed while disconnected.
+// The caller must hold a.mu.
+func (a *App) queueMessage(contactID, text, timestamp string) {
+	a.outbox = append(a.outbox, cache.Outgoing{
+		ContactID: contactID,
+		Text:      text,
+		Timestamp: timestamp,
+	})
+}
+
+// flushOutbox sends messages queued while disconnected.
+// Must be called from the UI goroutine.
+func (a *App) flushOutbox() {
+	a.mu.Lock()
+	queued := a.outbox
+	a.outbox = nil
+	a.mu.Unlock()
+
+	if len(queued) == 0 {
+		return
+	}
+
+	for i, out := range queued {
+		if !a.isConnected() || a.client.SendMessage(out.ContactID, out.Text) != nil {
+			// Connection dropped again, keep the rest for the next attempt
+			a.mu.Lock()
+			a.outbox = append(queued[i:], a.outbox...)
+			a.mu.Unlock()
+			break
+		}
+
+		a.mu.Lock()
+		for j, msg := range a.messages[out.ContactID] {
+			if msg.Status == statusPending && msg.Timestamp == out.Timestamp && msg.Text == out.Text {
+				a.messages[out.ContactID][j].Status = "sent"
+				break
+			}
+		}
+		a.mu.Unlock()
+		a.persistChat(out.ContactID)
+	}
+
+	a.persistOutbox()
+	a.refreshChatView()
+}
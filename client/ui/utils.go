@@ -3,6 +3,8 @@ package ui
 import (
 	"fmt"
 	"time"
+
+	"msim-client/protocol"
 )
 
 // formatDuration formats a duration for display
@@ -91,3 +93,37 @@ func formatDateSeparator(timestamp string) string {
 		return t.Format("January 2, 2006")
 	}
 }
+
+// errorTexts are user-facing explanations of server error codes
+var errorTexts = map[string]string{
+	protocol.ErrCodeInternal:       "Server error, please try again later",
+	protocol.ErrCodeInvalid:        "The request was not accepted: check the entered data",
+	protocol.ErrCodeUnknownPacket:  "The server does not support this action",
+	protocol.ErrCodeNotAuth:        "You are not logged in",
+	protocol.ErrCodeBadCredentials: "Wrong login or password",
+	protocol.ErrCodeForbidden:      "You are not allowed to do this",
+	protocol.ErrCodeNoUser:         "No such user",
+	protocol.ErrCodeUserExists:     "This login is already taken",
+	protocol.ErrCodeNoContact:      "No such contact",
+	protocol.ErrCodeContactExists:  "This contact is already in your list",
+	protocol.ErrCodeNoSession:      "The file transfer no longer exists",
+	protocol.ErrCodeBadState:       "The file transfer has already been answered",
+	protocol.ErrCodeUnavailable:    "The server is busy, please try again later",
+	protocol.ErrCodeRateLimit:      "Too many requests, please slow down",
+	protocol.ErrCodeLocked:         "Too many attempts from this address, please try again later",
+	protocol.ErrCodeTooLong:        "The text is too long",
+	protocol.ErrCodeLimit:          "A server limit has been reached",
+}
+
+// errorText returns a human-readable description of a fail packet.
+// Servers without error codes get their description shown as is.
+func errorText(parts []string, fallback string) string {
+	serverErr := protocol.ParseFail(parts)
+	if text, ok := errorTexts[serverErr.Code]; ok {
+		return text
+	}
+	if serverErr.Message != "" {
+		return serverErr.Message
+	}
+	return fallback
+}
@@ -0,0 +1,635 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"msim/cmdutil"
+)
+
+// timeLayout is how times are shown in tables, in the local time zone
+const timeLayout = "2006-01-02 15:04:05"
+
+// request sends a command and prints the reply as JSON when -json is given.
+// printed is true when nothing is left to print.
+func request(opts *options, w io.Writer, fields ...string) (result json.RawMessage, printed bool, err error) {
+	result, err = opts.call(fields...)
+	if err != nil || !opts.json {
+		return result, false, err
+	}
+	var v interface{}
+	if err := json.Unmarshal(result, &v); err != nil {
+		return nil, false, err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return result, true, enc.Encode(v)
+}
+
+// decode unmarshals a command result
+func decode(result json.RawMessage, v interface{}) error {
+	if err := json.Unmarshal(result, v); err != nil {
+		return fmt.Errorf("unexpected reply: %v", err)
+	}
+	return nil
+}
+
+// printText prints a plain text result such as "Done"
+func printText(w io.Writer, result json.RawMessage) error {
+	var text string
+	if err := decode(result, &text); err != nil {
+		return err
+	}
+	fmt.Fprintln(w, text)
+	return nil
+}
+
+// simple runs a command whose reply is a plain text result
+func simple(opts *options, w io.Writer, fields ...string) error {
+	result, printed, err := request(opts, w, fields...)
+	if err != nil || printed {
+		return err
+	}
+	return printText(w, result)
+}
+
+func newTable(w io.Writer, header ...string) *tabwriter.Writer {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	return tw
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(timeLayout)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// runStats prints connections, online users and command counters
+func runStats(args []string, w io.Writer) error {
+	fs, opts := newFlagSet("stats", "")
+	if _, err := cmdutil.ParseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+	result, printed, err := request(opts, w, "stats")
+	if err != nil || printed {
+		return err
+	}
+
+	var stats struct {
+		Connections int              `json:"connections"`
+		Users       []string         `json:"users"`
+		Commands    map[string]int64 `json:"commands"`
+		Limited     map[string]int64 `json:"limited"`
+		Floods      int64            `json:"floods"`
+	}
+	if err := decode(result, &stats); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "Connections:       %d\n", stats.Connections)
+	fmt.Fprintf(w, "Flood disconnects: %d\n", stats.Floods)
+	if len(stats.Users) > 0 {
+		fmt.Fprintf(w, "Online users:      %s\n", strings.Join(stats.Users, ", "))
+	}
+	if len(stats.Commands) == 0 {
+		return nil
+	}
+
+	fmt.Fprintln(w)
+	tw := newTable(w, "COMMAND", "COUNT", "RATE LIMITED")
+	names := make([]string, 0, len(stats.Commands))
+	for name := range stats.Commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(tw, "%s\t%d\t%d\n", name, stats.Commands[name], stats.Limited[name])
+	}
+	return tw.Flush()
+}
+
+// runCounts prints database row counts
+func runCounts(args []string, w io.Writer) error {
+	fs, opts := newFlagSet("counts", "")
+	if _, err := cmdutil.ParseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+	result, printed, err := request(opts, w, "counts")
+	if err != nil || printed {
+		return err
+	}
+
+	var counts map[string]int64
+	if err := decode(result, &counts); err != nil {
+		return err
+	}
+	// Same order as the server reports them
+	order := []string{"users", "bots", "disabled", "contacts", "messages", "undelivered",
+		"api_keys", "lockouts", "audit_events", "webhook_queue", "webhook_failed"}
+	tw := newTable(w, "TABLE", "ROWS")
+	for _, name := range order {
+		if n, ok := counts[name]; ok {
+			fmt.Fprintf(tw, "%s\t%d\n", name, n)
+		}
+	}
+	return tw.Flush()
+}
+
+// runSessions lists connected users
+func runSessions(args []string, w io.Writer) error {
+	fs, opts := newFlagSet("sessions", "")
+	if _, err := cmdutil.ParseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+	result, printed, err := request(opts, w, "sessions")
+	if err != nil || printed {
+		return err
+	}
+
+	var sessions []struct {
+		Login       string    `json:"login"`
+		Session     string    `json:"session"`
+		Remote      string    `json:"remote"`
+		Bot         bool      `json:"bot"`
+		ConnectedAt time.Time `json:"connected_at"`
+		LastActive  time.Time `json:"last_active"`
+	}
+	if err := decode(result, &sessions); err != nil {
+		return err
+	}
+	tw := newTable(w, "LOGIN", "SESSION", "REMOTE", "CONNECTED", "LAST ACTIVE", "BOT")
+	for _, s := range sessions {
+		bot := ""
+		if s.Bot {
+			bot = "yes"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", s.Login, s.Session, s.Remote,
+			formatTime(s.ConnectedAt), formatTime(s.LastActive), bot)
+	}
+	return tw.Flush()
+}
+
+// runKick disconnects a user with an optional reason shown to them
+func runKick(args []string, w io.Writer) error {
+	fs, opts := newFlagSet("kick", "<login> [reason...]")
+	rest, err := cmdutil.ParseArgs(fs, args, 1, -1)
+	if err != nil {
+		return err
+	}
+	return simple(opts, w, "kick", rest[0], strings.Join(rest[1:], " "))
+}
+
+// runBroadcast sends a system message
+func runBroadcast(args []string, w io.Writer) error {
+	fs, opts := newFlagSet("broadcast", "<text...>")
+	to := fs.String("to", "", "Comma-separated logins to send to instead of everyone online")
+	rest, err := cmdutil.ParseArgs(fs, args, 1, -1)
+	if err != nil {
+		return err
+	}
+	recipients := "*"
+	if *to != "" {
+		recipients = *to
+	}
+
+	result, printed, err := request(opts, w, "broadcast", recipients, strings.Join(rest, " "))
+	if err != nil || printed {
+		return err
+	}
+	var sent struct {
+		Delivered int `json:"delivered"`
+	}
+	if err := decode(result, &sent); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Delivered to %d sessions\n", sent.Delivered)
+	return nil
+}
+
+// runUser manages regular accounts
+func runUser(args []string, w io.Writer) error {
+	fs, opts := newFlagSet("user", "create|passwd <login> [password] | disable|enable <login>")
+	rest, err := cmdutil.ParseArgs(fs, args, 2, 3)
+	if err != nil {
+		return err
+	}
+	action, login := rest[0], rest[1]
+
+	switch action {
+	case "create", "passwd":
+		fields := append([]string{"user"}, rest...)
+		result, printed, err := request(opts, w, fields...)
+		if err != nil || printed {
+			return err
+		}
+		if len(rest) == 3 {
+			return printText(w, result)
+		}
+		var created struct {
+			Password string `json:"password"`
+		}
+		if err := decode(result, &created); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Password for %s (shown only once): %s\n", login, created.Password)
+		return nil
+
+	case "disable", "enable":
+		if len(rest) != 2 {
+			fs.Usage()
+			return cmdutil.UsageError("wrong number of arguments")
+		}
+		return simple(opts, w, "user", action, login)
+
+	default:
+		fs.Usage()
+		return cmdutil.UsageError("unknown action %q", action)
+	}
+}
+
+// runTransfers lists file transfers or cancels one
+func runTransfers(args []string, w io.Writer) error {
+	fs, opts := newFlagSet("transfers", "[cancel <id> [reason...]]")
+	rest, err := cmdutil.ParseArgs(fs, args, 0, -1)
+	if err != nil {
+		return err
+	}
+
+	if len(rest) > 0 {
+		if rest[0] != "cancel" || len(rest) < 2 {
+			fs.Usage()
+			return cmdutil.UsageError("unknown action %q", strings.Join(rest, " "))
+		}
+		return simple(opts, w, "transfers", "cancel", rest[1], strings.Join(rest[2:], " "))
+	}
+
+	result, printed, err := request(opts, w, "transfers")
+	if err != nil || printed {
+		return err
+	}
+	var transfers []struct {
+		ID        string    `json:"id"`
+		Sender    string    `json:"sender"`
+		Recipient string    `json:"recipient"`
+		Filename  string    `json:"filename"`
+		Size      int64     `json:"size"`
+		Status    string    `json:"status"`
+		CreatedAt time.Time `json:"created_at"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := decode(result, &transfers); err != nil {
+		return err
+	}
+	tw := newTable(w, "ID", "SENDER", "RECIPIENT", "STATUS", "SIZE", "CREATED", "EXPIRES", "FILE")
+	for _, t := range transfers {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", t.ID, t.Sender, t.Recipient, t.Status,
+			t.Size, formatTime(t.CreatedAt), formatTime(t.ExpiresAt), t.Filename)
+	}
+	return tw.Flush()
+}
+
+// runMaintenance shows, schedules or cancels planned maintenance
+func runMaintenance(args []string, w io.Writer) error {
+	fs, opts := newFlagSet("maintenance", "[schedule [text...] | cancel]")
+	in := fs.Duration("in", 0, "Start the maintenance after this long")
+	at := fs.String("at", "", "Start time in RFC 3339, instead of -in")
+	duration := fs.Duration("for", 0, "How long the maintenance lasts")
+	until := fs.String("until", "", "End time in RFC 3339, instead of -for")
+	rest, err := cmdutil.ParseArgs(fs, args, 0, -1)
+	if err != nil {
+		return err
+	}
+
+	if len(rest) > 0 {
+		switch rest[0] {
+		case "cancel":
+			return simple(opts, w, "maintenance", "cancel")
+		case "schedule":
+			// Flags may also follow the action: schedule -in 1h -for 30m text
+			if rest, err = cmdutil.ParseArgs(fs, rest[1:], 0, -1); err != nil {
+				return err
+			}
+			start, end, err := maintenanceWindow(*in, *at, *duration, *until)
+			if err != nil {
+				return err
+			}
+			err = simple(opts, w, "maintenance", "schedule",
+				start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339), strings.Join(rest, " "))
+			if err == nil && !opts.json {
+				fmt.Fprintf(w, "From %s to %s\n", formatTime(start), formatTime(end))
+			}
+			return err
+		}
+		fs.Usage()
+		return cmdutil.UsageError("unknown action %q", rest[0])
+	}
+
+	result, printed, err := request(opts, w, "maintenance")
+	if err != nil || printed {
+		return err
+	}
+	var status struct {
+		Scheduled   bool `json:"scheduled"`
+		Maintenance struct {
+			Start time.Time `json:"start"`
+			End   time.Time `json:"end"`
+			Text  string    `json:"text"`
+		} `json:"maintenance"`
+	}
+	if err := decode(result, &status); err != nil {
+		return err
+	}
+	if !status.Scheduled {
+		fmt.Fprintln(w, "No maintenance scheduled")
+		return nil
+	}
+	m := status.Maintenance
+	tw := newTable(w, "START", "END", "TEXT")
+	fmt.Fprintf(tw, "%s\t%s\t%s\n", formatTime(m.Start), formatTime(m.End), orDash(m.Text))
+	return tw.Flush()
+}
+
+// maintenanceWindow resolves -in/-at and -for/-until to start and end times
+func maintenanceWindow(in time.Duration, at string, duration time.Duration, until string) (start, end time.Time, err error) {
+	if in < 0 || duration < 0 {
+		return start, end, cmdutil.UsageError("negative -in or -for")
+	}
+	switch {
+	case in != 0 && at != "":
+		return start, end, cmdutil.UsageError("-in and -at are mutually exclusive")
+	case in > 0:
+		start = time.Now().Add(in)
+	case at != "":
+		if start, err = time.Parse(time.RFC3339, at); err != nil {
+			return start, end, cmdutil.UsageError("invalid -at %q: expected RFC 3339, e.g. 2024-12-21T22:00:00Z", at)
+		}
+	default:
+		return start, end, cmdutil.UsageError("the start is required: -in or -at")
+	}
+
+	switch {
+	case duration != 0 && until != "":
+		return start, end, cmdutil.UsageError("-for and -until are mutually exclusive")
+	case duration > 0:
+		end = start.Add(duration)
+	case until != "":
+		if end, err = time.Parse(time.RFC3339, until); err != nil {
+			return start, end, cmdutil.UsageError("invalid -until %q: expected RFC 3339, e.g. 2024-12-21T23:00:00Z", until)
+		}
+	default:
+		return start, end, cmdutil.UsageError("the end is required: -for or -until")
+	}
+	return start, end, nil
+}
+
+// runBot manages bot accounts and their API keys
+func runBot(args []string, w io.Writer) error {
+	fs, opts := newFlagSet("bot", "create|key|keys <login> | revoke <id>")
+	rest, err := cmdutil.ParseArgs(fs, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	action, arg := rest[0], rest[1]
+
+	switch action {
+	case "create", "revoke":
+		return simple(opts, w, "bot", action, arg)
+
+	case "key":
+		result, printed, err := request(opts, w, "bot", "key", arg)
+		if err != nil || printed {
+			return err
+		}
+		var issued struct {
+			Key string `json:"key"`
+		}
+		if err := decode(result, &issued); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "API key for %s (shown only once): %s\n", arg, issued.Key)
+		return nil
+
+	case "keys":
+		result, printed, err := request(opts, w, "bot", "keys", arg)
+		if err != nil || printed {
+			return err
+		}
+		var keys []struct {
+			ID        int64     `json:"id"`
+			Prefix    string    `json:"prefix"`
+			CreatedAt time.Time `json:"created_at"`
+			Revoked   bool      `json:"revoked"`
+		}
+		if err := decode(result, &keys); err != nil {
+			return err
+		}
+		tw := newTable(w, "ID", "PREFIX", "CREATED", "STATUS")
+		for _, k := range keys {
+			status := "active"
+			if k.Revoked {
+				status = "revoked"
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", k.ID, k.Prefix, formatTime(k.CreatedAt), status)
+		}
+		return tw.Flush()
+
+	default:
+		fs.Usage()
+		return cmdutil.UsageError("unknown action %q", action)
+	}
+}
+
+// runLockout lists and clears brute-force lockouts
+func runLockout(args []string, w io.Writer) error {
+	fs, opts := newFlagSet("lockout", "list | clear [login or IP]")
+	rest, err := cmdutil.ParseArgs(fs, args, 1, 2)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case rest[0] == "list" && len(rest) == 1:
+		result, printed, err := request(opts, w, "lockout", "list")
+		if err != nil || printed {
+			return err
+		}
+		var lockouts []struct {
+			Scope       string    `json:"scope"`
+			Key         string    `json:"key"`
+			Attempts    int       `json:"attempts"`
+			LockedUntil time.Time `json:"locked_until"`
+		}
+		if err := decode(result, &lockouts); err != nil {
+			return err
+		}
+		tw := newTable(w, "SCOPE", "KEY", "ATTEMPTS", "LOCKED UNTIL")
+		for _, l := range lockouts {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", l.Scope, l.Key, l.Attempts, formatTime(l.LockedUntil))
+		}
+		return tw.Flush()
+
+	case rest[0] == "clear":
+		result, printed, err := request(opts, w, append([]string{"lockout"}, rest...)...)
+		if err != nil || printed {
+			return err
+		}
+		var cleared struct {
+			Cleared int64 `json:"cleared"`
+		}
+		if err := decode(result, &cleared); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%d cleared\n", cleared.Cleared)
+		return nil
+
+	default:
+		fs.Usage()
+		return cmdutil.UsageError("unknown action %q", strings.Join(rest, " "))
+	}
+}
+
+// runAudit queries the audit log, newest events first
+func runAudit(args []string, w io.Writer) error {
+	fs, opts := newFlagSet("audit", "")
+	user := fs.String("user", "", "Only events of this login")
+	event := fs.String("event", "", "Only this event; a trailing * matches a prefix, e.g. admin.*")
+	since := fs.String("since", "", "Events after this RFC 3339 time or duration back from now, e.g. 24h")
+	until := fs.String("until", "", "Events before this RFC 3339 time or duration back from now")
+	limit := fs.Int("limit", 100, "Maximum number of events")
+	if _, err := cmdutil.ParseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	filters := []string{"limit=" + strconv.Itoa(*limit)}
+	for _, f := range []struct{ key, value string }{
+		{"user", *user}, {"event", *event}, {"since", *since}, {"until", *until},
+	} {
+		if strings.ContainsAny(f.value, " |") {
+			return cmdutil.UsageError("invalid -%s %q", f.key, f.value)
+		}
+		if f.value != "" {
+			filters = append(filters, f.key+"="+f.value)
+		}
+	}
+
+	result, printed, err := request(opts, w, "audit", strings.Join(filters, " "))
+	if err != nil || printed {
+		return err
+	}
+	var events []struct {
+		Timestamp time.Time `json:"timestamp"`
+		Event     string    `json:"event"`
+		Login     string    `json:"login"`
+		IP        string    `json:"ip"`
+		Details   string    `json:"details"`
+	}
+	if err := decode(result, &events); err != nil {
+		return err
+	}
+	tw := newTable(w, "TIME", "EVENT", "LOGIN", "IP", "DETAILS")
+	for _, e := range events {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", formatTime(e.Timestamp), e.Event,
+			orDash(e.Login), orDash(e.IP), orDash(e.Details))
+	}
+	return tw.Flush()
+}
+
+// runShutdown disconnects everyone with bye|reason|completion and stops the server
+func runShutdown(args []string, w io.Writer) error {
+	fs, opts := newFlagSet("shutdown", "")
+	reason := fs.String("reason", "maintenance", "Reason sent to clients: maintenance, restart or timeout")
+	downtime := fs.Duration("for", 0, "Expected downtime; clients reconnect after it")
+	at := fs.String("until", "", "Expected completion time in RFC 3339, instead of -for")
+	if _, err := cmdutil.ParseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+	return shutdown(opts, w, *reason, *downtime, *at)
+}
+
+// runRestart is shutdown with the restart reason; the server is expected
+// to be started again by its supervisor
+func runRestart(args []string, w io.Writer) error {
+	fs, opts := newFlagSet("restart", "")
+	downtime := fs.Duration("for", 0, "Expected downtime; clients reconnect after it")
+	at := fs.String("until", "", "Expected completion time in RFC 3339, instead of -for")
+	if _, err := cmdutil.ParseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+	return shutdown(opts, w, "restart", *downtime, *at)
+}
+
+// runUpgrade hands the listening sockets to a fresh copy of the server binary
+func runUpgrade(args []string, w io.Writer) error {
+	fs, opts := newFlagSet("upgrade", "")
+	// The server waits up to 30 seconds for the new process
+	timeout := fs.Lookup("timeout")
+	timeout.DefValue = time.Minute.String()
+	timeout.Value.Set(timeout.DefValue)
+	if _, err := cmdutil.ParseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+	result, printed, err := request(opts, w, "upgrade")
+	if err != nil || printed {
+		return err
+	}
+	var r struct {
+		PID int `json:"pid"`
+	}
+	if err := decode(result, &r); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Upgraded, new process %d\n", r.PID)
+	return nil
+}
+
+func shutdown(opts *options, w io.Writer, reason string, downtime time.Duration, at string) error {
+	switch reason {
+	case "maintenance", "restart", "timeout":
+	default:
+		return cmdutil.UsageError("unknown reason %q", reason)
+	}
+	if downtime < 0 {
+		return cmdutil.UsageError("negative -for")
+	}
+	if downtime > 0 && at != "" {
+		return cmdutil.UsageError("-for and -until are mutually exclusive")
+	}
+
+	var completion time.Time
+	if at != "" {
+		t, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			return cmdutil.UsageError("invalid -until %q: expected RFC 3339, e.g. 2024-12-21T22:00:00Z", at)
+		}
+		completion = t
+	} else if downtime > 0 {
+		completion = time.Now().Add(downtime)
+	}
+
+	fields := []string{"shutdown", reason}
+	if !completion.IsZero() {
+		fields = append(fields, completion.UTC().Format(time.RFC3339))
+	}
+	if err := simple(opts, w, fields...); err != nil {
+		return err
+	}
+	if !completion.IsZero() && !opts.json {
+		fmt.Fprintf(w, "Clients were told to reconnect after %s\n", formatTime(completion))
+	}
+	return nil
+}
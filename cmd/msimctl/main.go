@@ -0,0 +1,92 @@
+// Command msimctl administers a running mSIM server through its control
+// socket: it lists sessions and transfers, manages accounts, sends system
+// messages, announces maintenance, upgrades and shuts the server down.
+// Output is a table, or JSON with -json.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"msim/cmdutil"
+)
+
+// Exit codes
+const (
+	ExitOK         = cmdutil.ExitOK         // command succeeded
+	ExitFailure    = cmdutil.ExitFailure    // the server rejected the command
+	ExitUsage      = cmdutil.ExitUsage      // bad arguments
+	ExitConnection = cmdutil.ExitConnection // cannot reach the control socket
+)
+
+// command is a subcommand of msimctl
+type command struct {
+	summary string
+	run     func(args []string, stdout io.Writer) error
+}
+
+var commands = map[string]command{
+	"stats":       {"Show connections, online users and command counters", runStats},
+	"counts":      {"Show database row counts", runCounts},
+	"sessions":    {"List connected users", runSessions},
+	"kick":        {"Disconnect a user", runKick},
+	"broadcast":   {"Send a system message to everyone online or to given users", runBroadcast},
+	"user":        {"Create accounts, reset passwords, disable and enable accounts", runUser},
+	"transfers":   {"List file transfers or cancel one", runTransfers},
+	"bot":         {"Create bot accounts and manage their API keys", runBot},
+	"lockout":     {"List and clear brute-force lockouts", runLockout},
+	"audit":       {"Query the audit log", runAudit},
+	"maintenance": {"Announce, show or cancel planned maintenance", runMaintenance},
+	"shutdown":    {"Disconnect everyone and stop the server", runShutdown},
+	"restart":     {"Announce a restart and stop the server", runRestart},
+	"upgrade":     {"Restart into a new binary without dropping the listening sockets", runUpgrade},
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "-help" {
+		printUsage(stdout)
+		if len(args) == 0 {
+			return ExitUsage
+		}
+		return ExitOK
+	}
+
+	name := args[0]
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "msimctl: unknown command %q\n\n", name)
+		printUsage(stderr)
+		return ExitUsage
+	}
+
+	err := cmd.run(args[1:], stdout)
+	code := cmdutil.ExitCode(err)
+	if code != ExitOK {
+		fmt.Fprintf(stderr, "%s: %v\n", name, err)
+	}
+	return code
+}
+
+// printUsage lists the subcommands
+func printUsage(w io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "Usage: msimctl <command> [options] [arguments]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-12s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run \"msimctl <command> -h\" for the options of a command.")
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"msim/cmdutil/cmdtest"
+)
+
+// fakeSocket answers control commands with scripted JSON replies and records what it received
+func fakeSocket(t *testing.T, replies map[string]string) (string, <-chan string) {
+	return cmdtest.Serve(t, "unix", filepath.Join(t.TempDir(), "msim.sock"), replies, func(line string) string {
+		return strings.SplitN(strings.TrimPrefix(line, "json|"), "|", 2)[0]
+	})
+}
+
+func runArgs(t *testing.T, socket string, args ...string) (int, string, string) {
+	t.Setenv(envSocket, socket)
+	return cmdtest.Run(func(stdout, stderr io.Writer) int {
+		return run(args, stdout, stderr)
+	})
+}
+
+func TestSessionsTable(t *testing.T) {
+	socket, received := fakeSocket(t, map[string]string{
+		"sessions": `{"ok":true,"result":[{"login":"alice@example.com","session":"s1","remote":"10.0.0.1:5000","bot":false,"connected_at":"2024-01-01T12:00:00Z","last_active":"2024-01-01T12:05:00Z"},{"login":"ci@example.com","session":"s2","remote":"10.0.0.2:5000","bot":true,"connected_at":"2024-01-01T12:00:00Z","last_active":"2024-01-01T12:00:00Z"}]}`,
+	})
+
+	code, stdout, stderr := runArgs(t, socket, "sessions")
+	if code != ExitOK {
+		t.Fatalf("Expected exit 0, got %d: %s", code, stderr)
+	}
+	if got := <-received; got != "json|sessions" {
+		t.Errorf("Unexpected command %q", got)
+	}
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "LOGIN") {
+		t.Fatalf("Unexpected table:\n%s", stdout)
+	}
+	if !strings.Contains(lines[1], "alice@example.com") || !strings.HasSuffix(lines[2], "yes") {
+		t.Errorf("Unexpected rows:\n%s", stdout)
+	}
+}
+
+func TestJSONOutput(t *testing.T) {
+	socket, _ := fakeSocket(t, map[string]string{
+		"counts": `{"ok":true,"result":{"users":3,"bots":1}}`,
+	})
+
+	code, stdout, _ := runArgs(t, socket, "counts", "-json")
+	if code != ExitOK {
+		t.Fatalf("Expected exit 0, got %d", code)
+	}
+	if !strings.Contains(stdout, `"users": 3`) {
+		t.Errorf("Expected indented JSON, got %q", stdout)
+	}
+}
+
+func TestCommandArguments(t *testing.T) {
+	socket, received := fakeSocket(t, map[string]string{
+		"kick":      `{"ok":true,"result":"Kicked"}`,
+		"broadcast": `{"ok":true,"result":{"delivered":2}}`,
+		"user":      `{"ok":true,"result":{"login":"bob@example.com","password":"secret"}}`,
+		"audit":     `{"ok":true,"result":[]}`,
+	})
+
+	tests := []struct {
+		args []string
+		sent string
+		out  string
+	}{
+		{[]string{"kick", "bob@example.com", "Too", "many", "messages"}, "json|kick|bob@example.com|Too many messages", "Kicked"},
+		{[]string{"broadcast", "-to", "a@example.com,b@example.com", "Back", "soon"}, "json|broadcast|a@example.com,b@example.com|Back soon", "Delivered to 2 sessions"},
+		{[]string{"broadcast", "Hello"}, "json|broadcast|*|Hello", "Delivered to 2 sessions"},
+		{[]string{"user", "create", "bob@example.com"}, "json|user|create|bob@example.com", "secret"},
+		{[]string{"audit", "-event", "admin.*", "-since", "24h"}, "json|audit|limit=100 event=admin.* since=24h", "TIME"},
+	}
+	for _, tt := range tests {
+		code, stdout, stderr := runArgs(t, socket, tt.args...)
+		if code != ExitOK {
+			t.Errorf("%v: expected exit 0, got %d: %s", tt.args, code, stderr)
+			continue
+		}
+		if got := <-received; got != tt.sent {
+			t.Errorf("%v: expected %q, got %q", tt.args, tt.sent, got)
+		}
+		if !strings.Contains(stdout, tt.out) {
+			t.Errorf("%v: expected %q in output, got %q", tt.args, tt.out, stdout)
+		}
+	}
+}
+
+func TestRestart(t *testing.T) {
+	socket, received := fakeSocket(t, map[string]string{
+		"shutdown": `{"ok":true,"result":"Shutting down"}`,
+	})
+
+	before := time.Now().Add(5 * time.Minute).UTC().Truncate(time.Second)
+	code, _, stderr := runArgs(t, socket, "restart", "-for", "5m")
+	if code != ExitOK {
+		t.Fatalf("Expected exit 0, got %d: %s", code, stderr)
+	}
+	fields := strings.Split(<-received, "|")
+	if len(fields) != 4 || fields[1] != "shutdown" || fields[2] != "restart" {
+		t.Fatalf("Unexpected command %v", fields)
+	}
+	completion, err := time.Parse(time.RFC3339, fields[3])
+	if err != nil || completion.Before(before) || completion.After(before.Add(time.Minute)) {
+		t.Errorf("Unexpected completion time %q", fields[3])
+	}
+
+	code, _, _ = runArgs(t, socket, "shutdown", "-for", "5m", "-until", "2024-01-01T00:00:00Z")
+	if code != ExitUsage {
+		t.Errorf("Expected usage error for -for with -until, got %d", code)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	socket, received := fakeSocket(t, map[string]string{
+		"upgrade": `{"ok":true,"result":{"pid":4242}}`,
+	})
+
+	code, stdout, stderr := runArgs(t, socket, "upgrade")
+	if code != ExitOK {
+		t.Fatalf("Expected exit 0, got %d: %s", code, stderr)
+	}
+	if got := <-received; got != "json|upgrade" {
+		t.Errorf("Unexpected command %q", got)
+	}
+	if !strings.Contains(stdout, "new process 4242") {
+		t.Errorf("Expected new PID in output, got %q", stdout)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	socket, received := fakeSocket(t, map[string]string{
+		"maintenance": `{"ok":true,"result":{"scheduled":true,"maintenance":{"start":"2024-12-21T22:00:00Z","end":"2024-12-21T23:00:00Z","text":"Database upgrade"}}}`,
+	})
+
+	code, stdout, stderr := runArgs(t, socket, "maintenance")
+	if code != ExitOK {
+		t.Fatalf("Expected exit 0, got %d: %s", code, stderr)
+	}
+	if got := <-received; got != "json|maintenance" {
+		t.Errorf("Unexpected command %q", got)
+	}
+	if !strings.Contains(stdout, "Database upgrade") {
+		t.Errorf("Expected the announcement in output, got %q", stdout)
+	}
+
+	socket, received = fakeSocket(t, map[string]string{
+		"maintenance": `{"ok":true,"result":"Maintenance scheduled"}`,
+	})
+	code, _, stderr = runArgs(t, socket, "maintenance", "schedule", "-at", "2030-01-01T22:00:00Z", "-for", "1h", "Database", "upgrade")
+	if code != ExitOK {
+		t.Fatalf("Expected exit 0, got %d: %s", code, stderr)
+	}
+	if got, want := <-received, "json|maintenance|schedule|2030-01-01T22:00:00Z|2030-01-01T23:00:00Z|Database upgrade"; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+
+	if code, _, _ := runArgs(t, socket, "maintenance", "schedule", "-for", "1h"); code != ExitUsage {
+		t.Errorf("Expected usage error without a start, got %d", code)
+	}
+	if code, _, _ := runArgs(t, socket, "maintenance", "schedule", "-in", "1h", "-at", "2030-01-01T22:00:00Z", "-for", "1h"); code != ExitUsage {
+		t.Errorf("Expected usage error for -in with -at, got %d", code)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	socket, _ := fakeSocket(t, map[string]string{
+		"kick": `{"ok":false,"error":"user is not connected"}`,
+	})
+
+	code, _, stderr := runArgs(t, socket, "kick", "bob@example.com")
+	if code != ExitFailure || !strings.Contains(stderr, "user is not connected") {
+		t.Errorf("Expected server error, got %d: %s", code, stderr)
+	}
+
+	if code, _, _ := runArgs(t, socket, "kick"); code != ExitUsage {
+		t.Errorf("Expected usage error, got %d", code)
+	}
+	if code, _, _ := runArgs(t, socket, "frobnicate"); code != ExitUsage {
+		t.Errorf("Expected usage error for unknown command, got %d", code)
+	}
+	if code, _, _ := runArgs(t, socket, "broadcast", "line\nbreak"); code != ExitUsage {
+		t.Errorf("Expected usage error for multi-line text, got %d", code)
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing.sock")
+	if code, _, _ := runArgs(t, missing, "stats"); code != ExitConnection {
+		t.Errorf("Expected connection error, got %d", code)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"msim/cmdutil"
+)
+
+// envSocket is read when -socket is not given; the server uses the same variable
+const envSocket = "MSIM_CONTROL_SOCKET"
+
+const defaultSocket = "/tmp/msim.sock"
+
+// options are the flags shared by all commands
+type options struct {
+	socket  string
+	json    bool
+	timeout time.Duration
+}
+
+// newFlagSet creates the flag set of a command with the shared flags registered
+func newFlagSet(name, args string) (*flag.FlagSet, *options) {
+	fs := cmdutil.NewFlagSet("msimctl", name, args)
+
+	socket := os.Getenv(envSocket)
+	if socket == "" {
+		socket = defaultSocket
+	}
+	opts := &options{}
+	fs.StringVar(&opts.socket, "socket", socket, "Path to the server control socket (env "+envSocket+")")
+	fs.BoolVar(&opts.json, "json", false, "Print the server reply as JSON")
+	fs.DurationVar(&opts.timeout, "timeout", 10*time.Second, "How long to wait for the server")
+	return fs, opts
+}
+
+// reply is the JSON answer of the control socket
+type reply struct {
+	OK     bool            `json:"ok"`
+	Result json.RawMessage `json:"result"`
+	Error  string          `json:"error"`
+}
+
+// call sends one command to the control socket in JSON mode and returns its result
+func (o *options) call(fields ...string) (json.RawMessage, error) {
+	for _, f := range fields {
+		if strings.ContainsAny(f, "\r\n") {
+			return nil, cmdutil.UsageError("arguments must not contain line breaks")
+		}
+	}
+
+	conn, err := net.DialTimeout("unix", o.socket, o.timeout)
+	if err != nil {
+		return nil, cmdutil.ConnectionError("cannot connect to %s: %v", o.socket, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(o.timeout))
+
+	line := "json|" + strings.Join(fields, "|") + "\n"
+	if _, err := conn.Write([]byte(line)); err != nil {
+		return nil, cmdutil.ConnectionError("%v", err)
+	}
+	data, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return nil, cmdutil.ConnectionError("no reply from server: %v", err)
+	}
+
+	var r reply
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, cmdutil.ConnectionError("unexpected reply %q", strings.TrimSpace(string(data)))
+	}
+	if !r.OK {
+		return nil, errors.New(r.Error)
+	}
+	return r.Result, nil
+}
@@ -0,0 +1,58 @@
+// Package cmdtest helps to test the command-line tools of mSIM against a
+// scripted server.
+package cmdtest
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// Serve listens on network and address and answers every line it receives
+// with replies[key(line)], if there is one. Received lines without the line
+// break go to the returned channel. The listener is closed when the test ends.
+func Serve(t testing.TB, network, address string, replies map[string]string, key func(line string) string) (string, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	received := make(chan string, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					line = strings.TrimSuffix(line, "\n")
+					received <- line
+					if reply, ok := replies[key(line)]; ok {
+						conn.Write([]byte(reply + "\n"))
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), received
+}
+
+// Run calls the entry point of a tool with captured output and returns
+// its exit code, stdout and stderr
+func Run(run func(stdout, stderr io.Writer) int) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(&stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
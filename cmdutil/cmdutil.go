@@ -0,0 +1,90 @@
+// Package cmdutil holds what the command-line tools of mSIM share: exit
+// codes, errors carrying them and flag parsing of subcommands. It is used by
+// msimctl and by the subcommands of the client.
+package cmdutil
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+)
+
+// Exit codes common to all tools; a tool may add its own above ExitConnection
+const (
+	ExitOK         = 0 // command succeeded
+	ExitFailure    = 1 // the server rejected the command or it failed
+	ExitUsage      = 2 // bad arguments
+	ExitConnection = 3 // cannot reach the server
+)
+
+// ExitError carries the exit code of a failed command
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+// Errorf returns an error exiting with code
+func Errorf(code int, format string, args ...interface{}) error {
+	return &ExitError{code, fmt.Errorf(format, args...)}
+}
+
+func UsageError(format string, args ...interface{}) error {
+	return Errorf(ExitUsage, format, args...)
+}
+
+func Failure(format string, args ...interface{}) error {
+	return Errorf(ExitFailure, format, args...)
+}
+
+func ConnectionError(format string, args ...interface{}) error {
+	return Errorf(ExitConnection, format, args...)
+}
+
+// ExitCode returns the process exit code for the result of a command:
+// ExitOK for nil and -h, the code of an *ExitError, ExitFailure otherwise
+func ExitCode(err error) int {
+	if err == nil || errors.Is(err, flag.ErrHelp) {
+		return ExitOK
+	}
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.Code
+	}
+	return ExitFailure
+}
+
+// NewFlagSet creates the flag set of a subcommand; its usage reads
+// "Usage: <program> <name> [options] <args>" followed by the flags
+func NewFlagSet(program, name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s [options] %s\n\nOptions:\n", program, name, args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// ParseArgs parses command flags and checks the number of positional
+// arguments; max < 0 means no upper limit
+func ParseArgs(fs *flag.FlagSet, args []string, min, max int) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil, err
+		}
+		return nil, &ExitError{ExitUsage, err}
+	}
+	rest := fs.Args()
+	if len(rest) < min || (max >= 0 && len(rest) > max) {
+		fs.Usage()
+		return nil, UsageError("wrong number of arguments")
+	}
+	return rest, nil
+}
@@ -1,62 +1,407 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"net/url"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
 )
 
+// RateLimit is a token bucket: Rate requests per second in bursts of up to Burst.
+// A zero Rate disables the limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimits are the limits of one command class per session, login and remote IP
+type RateLimits struct {
+	Session RateLimit
+	Login   RateLimit
+	IP      RateLimit
+}
+
+// Config holds the server settings. Every setting can be given in the TOML
+// config file under the name of its environment variable without the MSIM_
+// prefix in lower case (MSIM_READ_TIMEOUT is read_timeout); environment
+// variables override the file.
 type Config struct {
-	Port               int
-	DBPath             string
-	ReadTimeout        int // seconds
-	WriteTimeout       int // seconds
-	FilePortRangeStart int
-	FilePortRangeEnd   int
+	Port               int                   `toml:"port"`
+	DBPath             string                `toml:"db_path"`
+	ReadTimeout        int                   `toml:"read_timeout"`  // seconds
+	WriteTimeout       int                   `toml:"write_timeout"` // seconds
+	FilePortRangeStart int                   `toml:"file_port_start"`
+	FilePortRangeEnd   int                   `toml:"file_port_end"`
+	WSPort             int                   `toml:"ws_port"`        // 0 disables the WebSocket gateway
+	WSPath             string                `toml:"ws_path"`        // HTTP path of the WebSocket endpoint
+	WSAllowedOrigins   []string              `toml:"ws_origins"`     // allowed Origin headers, empty means same host only
+	APIPort            int                   `toml:"api_port"`       // 0 disables the HTTP API
+	APITokenTTL        int                   `toml:"api_token_ttl"`  // seconds
+	WebhookURLs        []string              `toml:"webhook_urls"`   // empty disables webhooks
+	WebhookSecret      string                `toml:"webhook_secret"` // HMAC-SHA256 signing key
+	WebhookEvents      []string              `toml:"webhook_events"` // events to send, empty means all
+	WebhookMaxAttempts int                   `toml:"webhook_max_attempts"`
+	EchoBot            string                `toml:"echo_bot"`             // login of the echo bot plugin, empty disables it
+	RateLimits         map[string]RateLimits `toml:"-"`                    // by command class: msg, auth, file, query
+	FloodStrikes       int                   `toml:"flood_strikes"`        // rejected packets per minute before bye|flood, 0 never disconnects
+	LockoutThreshold   int                   `toml:"lockout_threshold"`    // failed logins into an account before a lockout, 0 disables
+	LockoutIPThreshold int                   `toml:"lockout_ip_threshold"` // failed logins from an IP before a lockout, 0 disables
+	LockoutDuration    int                   `toml:"lockout_duration"`     // seconds, doubles with each further lockout
+	RegistrationsPerIP int                   `toml:"reg_per_ip"`           // registrations from an IP in a row, 0 disables the limit
+	RegistrationWindow int                   `toml:"reg_window"`           // seconds
+	MaxLineLength      int                   `toml:"max_line"`             // bytes per packet line
+	MaxMessageLength   int                   `toml:"max_message"`          // characters of message text, 0 disables the limit
+	MaxLoginLength     int                   `toml:"max_login"`            // characters of a new login, 0 disables the limit
+	MaxNickLength      int                   `toml:"max_nick"`             // characters of a contact nick, 0 disables the limit
+	MaxContacts        int                   `toml:"max_contacts"`         // contacts per user, 0 disables the limit
+	MaxConnsPerIP      int                   `toml:"max_conn_per_ip"`      // concurrent connections per IP, 0 disables the limit
+	MetricsPort        int                   `toml:"metrics_port"`         // port of the Prometheus /metrics endpoint, 0 disables it
+	LogLevel           string                `toml:"log_level"`            // debug, info, warn or error
+	LogFormat          string                `toml:"log_format"`           // text or json
+	LogRedact          []string              `toml:"log_redact"`           // packet arguments replaced with *** in logs
+	LogPackets         bool                  `toml:"log_packets"`          // log raw packet lines at debug level
+	AuditRetentionDays int                   `toml:"audit_retention_days"` // days to keep audit events, 0 keeps them forever
+	ControlSocket      string                `toml:"control_socket"`       // path of the admin control socket
+	ControlSocketMode  string                `toml:"control_socket_mode"`  // octal permissions of the control socket
+	PidFile            string                `toml:"pid_file"`             // file with the server PID, rewritten by an upgrade; empty disables
+	ShutdownTimeout    int                   `toml:"shutdown_timeout"`     // seconds to let handlers and file transfers finish on shutdown
+	MaintenanceNotice  int                   `toml:"maintenance_notice"`   // seconds between repeated maintenance notices, 0 announces once
+	ServerName         string                `toml:"server_name"`          // name reported in the info packet
+	MOTD               string                `toml:"motd"`                 // message of the day sent after auth, empty disables it
 }
 
-func Load() *Config {
-	cfg := &Config{
+// Load returns the defaults overridden by the config file at path, if any, and
+// then by MSIM_* environment variables. All malformed and out-of-range values
+// are reported together in the returned error.
+func Load(path string) (*Config, error) {
+	cfg := defaults()
+
+	e := &envReader{}
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: %w", path, err))
+		}
+	}
+	cfg.loadEnv(e)
+	if err := errors.Join(append(e.errs, cfg.validate()...)...); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func defaults() *Config {
+	return &Config{
 		Port:               3215,
 		DBPath:             "msim.db",
 		ReadTimeout:        120,
 		WriteTimeout:       30,
 		FilePortRangeStart: 35000,
 		FilePortRangeEnd:   35999,
+		WSPath:             "/ws",
+		APITokenTTL:        86400,
+		WebhookMaxAttempts: 10,
+		RateLimits: map[string]RateLimits{
+			"msg":   {Session: RateLimit{5, 20}, Login: RateLimit{10, 40}, IP: RateLimit{20, 80}},
+			"auth":  {Session: RateLimit{1, 5}, IP: RateLimit{2, 20}},
+			"file":  {Session: RateLimit{1, 10}, Login: RateLimit{2, 20}, IP: RateLimit{5, 50}},
+			"query": {Session: RateLimit{10, 50}, Login: RateLimit{20, 100}, IP: RateLimit{50, 200}},
+		},
+		FloodStrikes:       20,
+		LockoutThreshold:   5,
+		LockoutIPThreshold: 20,
+		LockoutDuration:    900,
+		RegistrationsPerIP: 5,
+		RegistrationWindow: 3600,
+		MaxLineLength:      65536,
+		MaxMessageLength:   4096,
+		MaxLoginLength:     64,
+		MaxNickLength:      64,
+		MaxContacts:        1000,
+		MaxConnsPerIP:      20,
+		LogLevel:           "info",
+		LogFormat:          "text",
+		LogRedact:          []string{"text", "filename"},
+		AuditRetentionDays: 90,
+		ControlSocket:      "/tmp/msim.sock",
+		ControlSocketMode:  "0600",
+		ShutdownTimeout:    30,
+		MaintenanceNotice:  600,
+		ServerName:         "mSIM",
 	}
+}
 
-	if portStr := os.Getenv("MSIM_PORT"); portStr != "" {
-		if port, err := strconv.Atoi(portStr); err == nil {
-			cfg.Port = port
+// loadFile decodes the TOML file over the defaults. Unknown keys are errors,
+// so a typo does not silently leave a setting at its default.
+func (c *Config) loadFile(path string) error {
+	md, err := toml.DecodeFile(path, c)
+	if err != nil {
+		return err
+	}
+
+	// [rate_limits] msg = "session:5/20,login:10/40" uses the MSIM_RATE_* syntax
+	var file struct {
+		RateLimits map[string]string `toml:"rate_limits"`
+	}
+	if _, err := toml.DecodeFile(path, &file); err != nil {
+		return err
+	}
+	var errs []error
+	classes := make([]string, 0, len(file.RateLimits))
+	for class := range file.RateLimits {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		value := file.RateLimits[class]
+		limits, ok := c.RateLimits[class]
+		if !ok {
+			errs = append(errs, fmt.Errorf("rate_limits: unknown command class %q", class))
+			continue
 		}
+		limits, err := parseRateLimits(value, limits)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rate_limits.%s: %w", class, err))
+			continue
+		}
+		c.RateLimits[class] = limits
 	}
 
-	if dbPath := os.Getenv("MSIM_DB_PATH"); dbPath != "" {
-		cfg.DBPath = dbPath
+	for _, key := range md.Undecoded() {
+		if len(key) > 0 && key[0] != "rate_limits" {
+			errs = append(errs, fmt.Errorf("unknown setting %s", key))
+		}
 	}
+	return errors.Join(errs...)
+}
+
+func (c *Config) loadEnv(e *envReader) {
+	e.int("MSIM_PORT", &c.Port)
+	e.string("MSIM_DB_PATH", &c.DBPath)
+	e.int("MSIM_READ_TIMEOUT", &c.ReadTimeout)
+	e.int("MSIM_WRITE_TIMEOUT", &c.WriteTimeout)
+	e.int("MSIM_FILE_PORT_START", &c.FilePortRangeStart)
+	e.int("MSIM_FILE_PORT_END", &c.FilePortRangeEnd)
+	e.int("MSIM_WS_PORT", &c.WSPort)
+	e.string("MSIM_WS_PATH", &c.WSPath)
+	e.list("MSIM_WS_ORIGINS", &c.WSAllowedOrigins)
+	e.int("MSIM_API_PORT", &c.APIPort)
+	e.int("MSIM_API_TOKEN_TTL", &c.APITokenTTL)
+	e.string("MSIM_ECHO_BOT", &c.EchoBot)
+	e.list("MSIM_WEBHOOK_URLS", &c.WebhookURLs)
+	e.string("MSIM_WEBHOOK_SECRET", &c.WebhookSecret)
+	e.list("MSIM_WEBHOOK_EVENTS", &c.WebhookEvents)
+	e.int("MSIM_WEBHOOK_MAX_ATTEMPTS", &c.WebhookMaxAttempts)
 
-	if timeoutStr := os.Getenv("MSIM_READ_TIMEOUT"); timeoutStr != "" {
-		if timeout, err := strconv.Atoi(timeoutStr); err == nil {
-			cfg.ReadTimeout = timeout
+	// MSIM_RATE_MSG=session:5/20,login:10/40,ip:20/80 — rate per second and burst;
+	// omitted scopes keep their defaults, a zero rate disables the scope
+	for class, limits := range c.RateLimits {
+		name := "MSIM_RATE_" + strings.ToUpper(class)
+		if value := os.Getenv(name); value != "" {
+			limits, err := parseRateLimits(value, limits)
+			if err != nil {
+				e.errs = append(e.errs, fmt.Errorf("%s: %w", name, err))
+				continue
+			}
+			c.RateLimits[class] = limits
 		}
 	}
 
-	if timeoutStr := os.Getenv("MSIM_WRITE_TIMEOUT"); timeoutStr != "" {
-		if timeout, err := strconv.Atoi(timeoutStr); err == nil {
-			cfg.WriteTimeout = timeout
+	e.int("MSIM_FLOOD_STRIKES", &c.FloodStrikes)
+	e.int("MSIM_LOCKOUT_THRESHOLD", &c.LockoutThreshold)
+	e.int("MSIM_LOCKOUT_IP_THRESHOLD", &c.LockoutIPThreshold)
+	e.int("MSIM_LOCKOUT_DURATION", &c.LockoutDuration)
+	e.int("MSIM_REG_PER_IP", &c.RegistrationsPerIP)
+	e.int("MSIM_REG_WINDOW", &c.RegistrationWindow)
+	e.int("MSIM_MAX_LINE", &c.MaxLineLength)
+	e.int("MSIM_MAX_MESSAGE", &c.MaxMessageLength)
+	e.int("MSIM_MAX_LOGIN", &c.MaxLoginLength)
+	e.int("MSIM_MAX_NICK", &c.MaxNickLength)
+	e.int("MSIM_MAX_CONTACTS", &c.MaxContacts)
+	e.int("MSIM_MAX_CONN_PER_IP", &c.MaxConnsPerIP)
+	e.int("MSIM_METRICS_PORT", &c.MetricsPort)
+	e.string("MSIM_LOG_LEVEL", &c.LogLevel)
+	e.string("MSIM_LOG_FORMAT", &c.LogFormat)
+	e.list("MSIM_LOG_REDACT", &c.LogRedact)
+	e.bool("MSIM_LOG_PACKETS", &c.LogPackets)
+	e.int("MSIM_AUDIT_RETENTION_DAYS", &c.AuditRetentionDays)
+	e.string("MSIM_CONTROL_SOCKET", &c.ControlSocket)
+	e.string("MSIM_CONTROL_SOCKET_MODE", &c.ControlSocketMode)
+	e.string("MSIM_PID_FILE", &c.PidFile)
+	e.int("MSIM_SHUTDOWN_TIMEOUT", &c.ShutdownTimeout)
+	e.int("MSIM_MAINTENANCE_NOTICE", &c.MaintenanceNotice)
+	e.string("MSIM_SERVER_NAME", &c.ServerName)
+	e.string("MSIM_MOTD", &c.MOTD)
+
+	c.LogLevel = strings.ToLower(c.LogLevel)
+	c.LogFormat = strings.ToLower(c.LogFormat)
+}
+
+// setting is a numeric setting named by its config file key
+type setting struct {
+	key   string
+	value int
+}
+
+// SocketMode returns the control socket permissions; validate guarantees
+// that ControlSocketMode parses
+func (c *Config) SocketMode() os.FileMode {
+	mode, _ := strconv.ParseUint(c.ControlSocketMode, 8, 32)
+	return os.FileMode(mode)
+}
+
+// validate checks ranges of all settings, naming them by their config file keys
+func (c *Config) validate() []error {
+	var errs []error
+	check := func(ok bool, key, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: "+format, append([]interface{}{key}, args...)...))
 		}
 	}
 
-	if portStr := os.Getenv("MSIM_FILE_PORT_START"); portStr != "" {
-		if port, err := strconv.Atoi(portStr); err == nil {
-			cfg.FilePortRangeStart = port
+	check(c.Port > 0 && c.Port <= 65535, "port", "invalid port %d", c.Port)
+	for _, s := range []setting{{"ws_port", c.WSPort}, {"api_port", c.APIPort}, {"metrics_port", c.MetricsPort}} {
+		check(s.value >= 0 && s.value <= 65535, s.key, "invalid port %d", s.value)
+	}
+	check(c.FilePortRangeStart > 0 && c.FilePortRangeStart <= c.FilePortRangeEnd && c.FilePortRangeEnd <= 65535,
+		"file_port_start", "invalid range %d-%d", c.FilePortRangeStart, c.FilePortRangeEnd)
+	check(c.DBPath != "", "db_path", "must not be empty")
+	check(strings.HasPrefix(c.WSPath, "/"), "ws_path", "must start with /")
+	check(c.ServerName != "", "server_name", "must not be empty")
+	check(len(c.MOTD) < c.MaxLineLength, "motd", "must be shorter than max_line (%d bytes)", c.MaxLineLength)
+
+	for _, s := range []setting{
+		{"read_timeout", c.ReadTimeout},
+		{"write_timeout", c.WriteTimeout},
+		{"api_token_ttl", c.APITokenTTL},
+		{"webhook_max_attempts", c.WebhookMaxAttempts},
+		{"lockout_duration", c.LockoutDuration},
+		{"reg_window", c.RegistrationWindow},
+		{"max_line", c.MaxLineLength},
+		{"shutdown_timeout", c.ShutdownTimeout},
+	} {
+		check(s.value > 0, s.key, "must be positive, got %d", s.value)
+	}
+	for _, s := range []setting{
+		{"flood_strikes", c.FloodStrikes},
+		{"lockout_threshold", c.LockoutThreshold},
+		{"lockout_ip_threshold", c.LockoutIPThreshold},
+		{"reg_per_ip", c.RegistrationsPerIP},
+		{"max_message", c.MaxMessageLength},
+		{"max_login", c.MaxLoginLength},
+		{"max_nick", c.MaxNickLength},
+		{"max_contacts", c.MaxContacts},
+		{"max_conn_per_ip", c.MaxConnsPerIP},
+		{"audit_retention_days", c.AuditRetentionDays},
+		{"maintenance_notice", c.MaintenanceNotice},
+	} {
+		check(s.value >= 0, s.key, "must not be negative, got %d", s.value)
+	}
+
+	for _, u := range c.WebhookURLs {
+		parsed, err := url.Parse(u)
+		check(err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != "",
+			"webhook_urls", "invalid URL %q", u)
+	}
+
+	switch c.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		check(false, "log_level", "unknown level %q", c.LogLevel)
+	}
+	check(c.LogFormat == "text" || c.LogFormat == "json", "log_format", "unknown format %q", c.LogFormat)
+
+	check(c.ControlSocket != "", "control_socket", "must not be empty")
+	mode, err := strconv.ParseUint(c.ControlSocketMode, 8, 32)
+	check(err == nil && mode <= 0777, "control_socket_mode", "invalid octal mode %q", c.ControlSocketMode)
+	return errs
+}
+
+// parseRateLimits applies scope:rate/burst items to limits
+func parseRateLimits(value string, limits RateLimits) (RateLimits, error) {
+	for _, item := range splitList(value) {
+		scope, spec, ok := strings.Cut(item, ":")
+		if !ok {
+			return limits, fmt.Errorf("expected scope:rate/burst, got %q", item)
+		}
+		rateStr, burstStr, ok := strings.Cut(spec, "/")
+		if !ok {
+			return limits, fmt.Errorf("expected scope:rate/burst, got %q", item)
+		}
+		rate, err := strconv.ParseFloat(rateStr, 64)
+		if err != nil || rate < 0 {
+			return limits, fmt.Errorf("invalid rate %q", rateStr)
+		}
+		burst, err := strconv.Atoi(burstStr)
+		if err != nil || burst < 1 {
+			return limits, fmt.Errorf("invalid burst %q", burstStr)
+		}
+		limit := RateLimit{Rate: rate, Burst: burst}
+		switch strings.TrimSpace(scope) {
+		case "session":
+			limits.Session = limit
+		case "login":
+			limits.Login = limit
+		case "ip":
+			limits.IP = limit
+		default:
+			return limits, fmt.Errorf("unknown scope %q", scope)
 		}
 	}
+	return limits, nil
+}
 
-	if portStr := os.Getenv("MSIM_FILE_PORT_END"); portStr != "" {
-		if port, err := strconv.Atoi(portStr); err == nil {
-			cfg.FilePortRangeEnd = port
+// envReader applies set environment variables and collects malformed values
+type envReader struct {
+	errs []error
+}
+
+func (e *envReader) int(name string, dst *int) {
+	if value := os.Getenv(name); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: invalid number %q", name, value))
+			return
+		}
+		*dst = n
+	}
+}
+
+func (e *envReader) string(name string, dst *string) {
+	if value := os.Getenv(name); value != "" {
+		*dst = value
+	}
+}
+
+func (e *envReader) bool(name string, dst *bool) {
+	if value := os.Getenv(name); value != "" {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: invalid boolean %q", name, value))
+			return
 		}
+		*dst = b
 	}
+}
 
-	return cfg
+// list sets a comma-separated list; a variable set to an empty value clears it
+func (e *envReader) list(name string, dst *[]string) {
+	if value, ok := os.LookupEnv(name); ok {
+		*dst = splitList(value)
+	}
+}
+
+// splitList splits a comma-separated list, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "msim.toml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadFile(t *testing.T) {
+	path := writeConfig(t, `
+port = 4000
+read_timeout = 60
+ws_origins = ["https://chat.example.com"]
+log_level = "DEBUG"
+motd = """
+Welcome!
+Rules: be nice."""
+
+[rate_limits]
+msg = "session:1/2"
+`)
+	t.Setenv("MSIM_READ_TIMEOUT", "90")
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Port != 4000 {
+		t.Errorf("Expected port from file, got %d", cfg.Port)
+	}
+	if cfg.ReadTimeout != 90 {
+		t.Errorf("Expected environment to override file, got %d", cfg.ReadTimeout)
+	}
+	if len(cfg.WSAllowedOrigins) != 1 || cfg.WSAllowedOrigins[0] != "https://chat.example.com" {
+		t.Errorf("Unexpected origins %v", cfg.WSAllowedOrigins)
+	}
+	if cfg.LogLevel != "debug" {
+		t.Errorf("Expected lower-case log level, got %q", cfg.LogLevel)
+	}
+	msg := cfg.RateLimits["msg"]
+	if msg.Session != (RateLimit{1, 2}) || msg.Login != (RateLimit{10, 40}) {
+		t.Errorf("Unexpected msg limits %+v", msg)
+	}
+	if cfg.MOTD != "Welcome!\nRules: be nice." {
+		t.Errorf("Expected multi-line MOTD, got %q", cfg.MOTD)
+	}
+	if cfg.WriteTimeout != 30 {
+		t.Errorf("Expected default write timeout, got %d", cfg.WriteTimeout)
+	}
+}
+
+func TestLoadWithoutFile(t *testing.T) {
+	t.Setenv("MSIM_PORT", "5000")
+	cfg, err := Load("")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.Port != 5000 || cfg.DBPath != "msim.db" {
+		t.Errorf("Unexpected config %+v", cfg)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := map[string]string{
+		"unknown key":   "prot = 3215\n",
+		"wrong type":    "port = \"3215\"\n",
+		"port range":    "port = 70000\n",
+		"file ports":    "file_port_start = 36000\nfile_port_end = 35000\n",
+		"negative":      "max_contacts = -1\n",
+		"zero timeout":  "read_timeout = 0\n",
+		"log level":     "log_level = \"verbose\"\n",
+		"webhook url":   "webhook_urls = [\"ftp://example.com\"]\n",
+		"rate class":    "[rate_limits]\nchat = \"session:1/1\"\n",
+		"rate syntax":   "[rate_limits]\nmsg = \"session:fast\"\n",
+		"toml syntax":   "port = \n",
+		"ws path":       "ws_path = \"ws\"\n",
+		"empty db path": "db_path = \"\"\n",
+		"socket mode":   "control_socket_mode = \"0999\"\n",
+		"long motd":     "max_line = 16\nmotd = \"Welcome to the server\"\n",
+	}
+	for name, content := range tests {
+		if _, err := Load(writeConfig(t, content)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.toml")); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
+
+func TestLoadReportsAllErrors(t *testing.T) {
+	t.Setenv("MSIM_MAX_NICK", "long")
+	_, err := Load(writeConfig(t, "port = 0\nmax_line = -5\n"))
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	for _, want := range []string{"port", "max_line", "MSIM_MAX_NICK"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %s in error, got %v", want, err)
+		}
+	}
+}
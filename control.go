@@ -0,0 +1,613 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"msim/db"
+	"msim/server"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The control socket accepts one command per connection:
+//
+//	command|arg|arg...
+//
+// and answers with a single line, "OK|result" or "ERROR|message". Prefixing
+// the command with json| (json|sessions) returns {"ok":true,"result":...}
+// or {"ok":false,"error":"..."} instead.
+
+// controlReply is the result of a control command. text follows OK| in plain
+// mode; data is encoded in JSON mode, text is used when data is nil.
+type controlReply struct {
+	text string
+	data interface{}
+}
+
+func textReply(text string) controlReply {
+	return controlReply{text: text}
+}
+
+type controlHandler func(srv *server.Server, args []string) (controlReply, error)
+
+var controlCommands = map[string]controlHandler{
+	"stats":       handleStatsCommand,
+	"counts":      handleCountsCommand,
+	"sessions":    handleSessionsCommand,
+	"kick":        handleKickCommand,
+	"broadcast":   handleBroadcastCommand,
+	"user":        handleUserCommand,
+	"transfers":   handleTransfersCommand,
+	"bot":         handleBotCommand,
+	"lockout":     handleLockoutCommand,
+	"audit":       handleAuditCommand,
+	"maintenance": handleMaintenanceCommand,
+}
+
+// listenControlSocket opens the control socket at path with the given
+// permissions, or adopts the one inherited from the previous process
+func listenControlSocket(path string, mode os.FileMode, inherited *os.File) (*net.UnixListener, error) {
+	if inherited != nil {
+		defer inherited.Close()
+		listener, err := net.FileListener(inherited)
+		if err == nil {
+			if l, ok := listener.(*net.UnixListener); ok && l.Addr().String() == path {
+				return l, nil
+			}
+			listener.Close()
+		}
+	}
+
+	// Remove existing socket file
+	os.Remove(path)
+
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// serveControlSocket serves management commands until the listener is closed
+func serveControlSocket(srv *server.Server, listener *net.UnixListener, proc *process) {
+	slog.Info("Control socket listening", "path", proc.controlPath)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+
+		go handleControlCommand(srv, conn, proc)
+	}
+}
+
+func handleControlCommand(srv *server.Server, conn net.Conn, proc *process) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return
+	}
+
+	parts := strings.Split(strings.TrimSpace(line), "|")
+	jsonMode := parts[0] == "json"
+	if jsonMode {
+		parts = parts[1:]
+		if len(parts) == 0 {
+			writeControlReply(conn, jsonMode, controlReply{}, errors.New("Invalid command"))
+			return
+		}
+	}
+	cmd, args := parts[0], parts[1:]
+
+	if cmd == "shutdown" {
+		reason := "maintenance"
+		var completionTime time.Time
+
+		if len(args) >= 1 && args[0] != "" {
+			reason = args[0]
+		}
+		if len(args) >= 2 && args[1] != "" {
+			completionTime, _ = time.Parse(time.RFC3339, args[1])
+		}
+
+		writeControlReply(conn, jsonMode, textReply("Shutting down"), nil)
+		conn.Close()
+
+		// Give time for response to be sent
+		time.Sleep(100 * time.Millisecond)
+
+		slog.Info("Shutdown requested", "reason", reason, "completion", completionTime)
+		details := []string{"reason", reason}
+		if !completionTime.IsZero() {
+			details = append(details, "completion", completionTime.UTC().Format(time.RFC3339))
+		}
+		srv.Audit("shutdown", "", details...)
+		proc.shutdown(reason, completionTime)
+		return
+	}
+
+	if cmd == "upgrade" {
+		pid, err := proc.start()
+		if err != nil {
+			writeControlReply(conn, jsonMode, controlReply{}, err)
+			return
+		}
+		writeControlReply(conn, jsonMode, controlReply{
+			text: "Upgraded, new process " + strconv.Itoa(pid),
+			data: map[string]int{"pid": pid},
+		}, nil)
+		conn.Close()
+		proc.retire(pid)
+	}
+
+	handler, ok := controlCommands[cmd]
+	if !ok {
+		writeControlReply(conn, jsonMode, controlReply{}, errors.New("Unknown command"))
+		return
+	}
+	reply, err := handler(srv, args)
+	writeControlReply(conn, jsonMode, reply, err)
+}
+
+func writeControlReply(conn net.Conn, jsonMode bool, reply controlReply, err error) {
+	if !jsonMode {
+		if err != nil {
+			conn.Write([]byte("ERROR|" + err.Error() + "\n"))
+		} else {
+			conn.Write([]byte("OK|" + reply.text + "\n"))
+		}
+		return
+	}
+
+	resp := map[string]interface{}{"ok": err == nil}
+	if err != nil {
+		resp["error"] = err.Error()
+	} else if reply.data != nil {
+		resp["result"] = reply.data
+	} else {
+		resp["result"] = reply.text
+	}
+	data, _ := json.Marshal(resp)
+	conn.Write(append(data, '\n'))
+}
+
+// handleStatsCommand returns connections, online users and command counters
+func handleStatsCommand(srv *server.Server, args []string) (controlReply, error) {
+	return controlReply{text: srv.GetStats(), data: srv.Stats()}, nil
+}
+
+// handleCountsCommand returns database row counts as "users=N,bots=N,..."
+func handleCountsCommand(srv *server.Server, args []string) (controlReply, error) {
+	c, err := srv.Counts()
+	if err != nil {
+		return controlReply{}, err
+	}
+	fields := []struct {
+		name  string
+		value int64
+	}{
+		{"users", c.Users},
+		{"bots", c.Bots},
+		{"disabled", c.Disabled},
+		{"contacts", c.Contacts},
+		{"messages", c.Messages},
+		{"undelivered", c.Undelivered},
+		{"api_keys", c.APIKeys},
+		{"lockouts", c.Lockouts},
+		{"audit_events", c.AuditEvents},
+		{"webhook_queue", c.WebhookQueue},
+		{"webhook_failed", c.WebhookFailed},
+	}
+	items := make([]string, len(fields))
+	for i, f := range fields {
+		items[i] = f.name + "=" + strconv.FormatInt(f.value, 10)
+	}
+	return controlReply{text: strings.Join(items, ","), data: c}, nil
+}
+
+// handleSessionsCommand lists connected users as
+// "login session remote connected_at last_active [bot];..."
+func handleSessionsCommand(srv *server.Server, args []string) (controlReply, error) {
+	sessions := srv.Sessions()
+	items := make([]string, 0, len(sessions))
+	for _, s := range sessions {
+		item := s.Login + " " + s.ID + " " + s.Remote + " " +
+			s.ConnectedAt.UTC().Format(time.RFC3339) + " " + s.LastActive.UTC().Format(time.RFC3339)
+		if s.Bot {
+			item += " bot"
+		}
+		items = append(items, item)
+	}
+	return controlReply{text: strings.Join(items, ";"), data: sessions}, nil
+}
+
+// handleKickCommand disconnects a user: kick|login|reason
+func handleKickCommand(srv *server.Server, args []string) (controlReply, error) {
+	if len(args) < 1 || args[0] == "" {
+		return controlReply{}, errors.New("Usage: kick|login|reason")
+	}
+	login, reason := args[0], strings.Join(args[1:], "|")
+	if err := srv.Kick(login, reason); err != nil {
+		return controlReply{}, err
+	}
+	slog.Info("User kicked via control socket", "login", login)
+	srv.Audit("kick", login, "reason", reason)
+	return textReply("Kicked"), nil
+}
+
+// handleBroadcastCommand sends a system message to everyone online or to
+// listed users: broadcast|*|text or broadcast|alice,bob|text
+func handleBroadcastCommand(srv *server.Server, args []string) (controlReply, error) {
+	if len(args) < 2 || args[0] == "" || strings.Join(args[1:], "|") == "" {
+		return controlReply{}, errors.New("Usage: broadcast|*|text, broadcast|login,login|text")
+	}
+	var logins []string
+	if args[0] != "*" {
+		logins = splitLogins(args[0])
+	}
+	n := srv.Broadcast(strings.Join(args[1:], "|"), logins)
+	slog.Info("Broadcast sent via control socket", "to", args[0], "sessions", n)
+	srv.Audit("broadcast", "", "to", args[0], "sessions", strconv.Itoa(n))
+	return controlReply{
+		text: "Delivered to " + strconv.Itoa(n) + " sessions",
+		data: map[string]int{"delivered": n},
+	}, nil
+}
+
+func splitLogins(value string) []string {
+	var logins []string
+	for _, login := range strings.Split(value, ",") {
+		if login = strings.TrimSpace(login); login != "" {
+			logins = append(logins, login)
+		}
+	}
+	return logins
+}
+
+// handleUserCommand manages regular accounts:
+//
+//	user|create|login[|password] - create an account, the password is generated if omitted
+//	user|passwd|login[|password] - set or generate a new password
+//	user|disable|login           - disable an account and disconnect the user
+//	user|enable|login            - re-enable an account
+//
+// Generated passwords are returned once and are not logged.
+func handleUserCommand(srv *server.Server, args []string) (controlReply, error) {
+	usage := errors.New("Usage: user|create|login[|password], user|passwd|login[|password], user|disable|login, user|enable|login")
+	if len(args) < 2 || args[1] == "" {
+		return controlReply{}, usage
+	}
+	action, login := args[0], args[1]
+
+	switch action {
+	case "create", "passwd":
+		password := strings.Join(args[2:], "|")
+		var err error
+		if action == "create" {
+			password, err = srv.CreateUser(login, password)
+		} else {
+			password, err = srv.ResetPassword(login, password)
+		}
+		if err != nil {
+			return controlReply{}, err
+		}
+		slog.Info("Account updated via control socket", "action", action, "login", login)
+		srv.Audit("user."+action, login)
+		if len(args) > 2 {
+			// The operator chose the password, there is nothing to show
+			return textReply("Done"), nil
+		}
+		return controlReply{text: password, data: map[string]string{"login": login, "password": password}}, nil
+
+	case "disable", "enable":
+		if err := srv.SetUserDisabled(login, action == "disable"); err != nil {
+			return controlReply{}, err
+		}
+		slog.Info("Account updated via control socket", "action", action, "login", login)
+		srv.Audit("user."+action, login)
+		return textReply("Done"), nil
+
+	default:
+		return controlReply{}, usage
+	}
+}
+
+// handleTransfersCommand lists and cancels file transfers:
+//
+//	transfers                    - list as "id sender recipient status size filename;..."
+//	transfers|cancel|id[|reason] - cancel a transfer and notify both users
+func handleTransfersCommand(srv *server.Server, args []string) (controlReply, error) {
+	if len(args) == 0 || args[0] == "" || args[0] == "list" {
+		transfers := srv.Transfers()
+		items := make([]string, 0, len(transfers))
+		for _, t := range transfers {
+			items = append(items, t.ID+" "+t.Sender+" "+t.Recipient+" "+t.Status+" "+strconv.FormatInt(t.Size, 10)+" "+t.Filename)
+		}
+		return controlReply{text: strings.Join(items, ";"), data: transfers}, nil
+	}
+
+	if args[0] != "cancel" || len(args) < 2 || args[1] == "" {
+		return controlReply{}, errors.New("Usage: transfers, transfers|cancel|id[|reason]")
+	}
+	id := args[1]
+	reason := strings.Join(args[2:], "|")
+	if reason == "" {
+		reason = "Cancelled by administrator"
+	}
+	if err := srv.CancelTransfer(id, reason); err != nil {
+		return controlReply{}, err
+	}
+	slog.Info("File transfer cancelled via control socket", "transfer", id)
+	srv.Audit("transfer.cancel", "", "id", id)
+	return textReply("Transfer cancelled"), nil
+}
+
+// maintenanceStatus is the JSON reply of the maintenance command
+type maintenanceStatus struct {
+	Scheduled   bool                `json:"scheduled"`
+	Maintenance *server.Maintenance `json:"maintenance,omitempty"`
+}
+
+// handleMaintenanceCommand announces planned downtime:
+//
+//	maintenance                         - show the scheduled maintenance
+//	maintenance|schedule|start|end|text - schedule it, times in RFC 3339
+//	maintenance|cancel                  - cancel it
+//
+// Users are notified at once, again every maintenance_notice seconds and
+// on login; at the start time the server shuts down with bye|maintenance|end.
+func handleMaintenanceCommand(srv *server.Server, args []string) (controlReply, error) {
+	if len(args) == 0 || args[0] == "" {
+		m, ok := srv.Maintenance()
+		if !ok {
+			return controlReply{text: "No maintenance scheduled", data: maintenanceStatus{}}, nil
+		}
+		return controlReply{
+			text: "Maintenance " + m.Start.Format(time.RFC3339) + " - " + m.End.Format(time.RFC3339) + " " + m.Text,
+			data: maintenanceStatus{Scheduled: true, Maintenance: &m},
+		}, nil
+	}
+
+	switch args[0] {
+	case "schedule":
+		if len(args) < 3 {
+			break
+		}
+		start, err := time.Parse(time.RFC3339, args[1])
+		if err != nil {
+			return controlReply{}, errors.New("Invalid start time, expected RFC 3339")
+		}
+		end, err := time.Parse(time.RFC3339, args[2])
+		if err != nil {
+			return controlReply{}, errors.New("Invalid end time, expected RFC 3339")
+		}
+		m := server.Maintenance{Start: start, End: end, Text: strings.Join(args[3:], "|")}
+		if err := srv.ScheduleMaintenance(m); err != nil {
+			return controlReply{}, err
+		}
+		srv.Audit("maintenance.schedule", "", "start", args[1], "end", args[2])
+		return textReply("Maintenance scheduled"), nil
+	case "cancel":
+		if err := srv.CancelMaintenance(); err != nil {
+			return controlReply{}, err
+		}
+		srv.Audit("maintenance.cancel", "")
+		return textReply("Maintenance cancelled"), nil
+	}
+	return controlReply{}, errors.New("Usage: maintenance, maintenance|schedule|start|end|text, maintenance|cancel")
+}
+
+// handleBotCommand manages bot accounts and their API keys:
+//
+//	bot|create|login  - create a bot account
+//	bot|key|login     - issue a new API key (shown only once)
+//	bot|keys|login    - list keys as "id prefix created status;..."
+//	bot|revoke|id     - revoke a key
+func handleBotCommand(srv *server.Server, args []string) (controlReply, error) {
+	if len(args) < 2 || args[1] == "" {
+		return controlReply{}, errors.New("Usage: bot|create|login, bot|key|login, bot|keys|login, bot|revoke|id")
+	}
+	action, arg := args[0], args[1]
+
+	switch action {
+	case "create":
+		if err := srv.CreateBot(arg); err != nil {
+			return controlReply{}, err
+		}
+		slog.Info("Bot created via control socket", "login", arg)
+		srv.Audit("bot.create", arg)
+		return textReply("Bot created"), nil
+
+	case "key":
+		key, err := srv.IssueAPIKey(arg)
+		if err != nil {
+			return controlReply{}, err
+		}
+		slog.Info("API key issued via control socket", "login", arg)
+		srv.Audit("key.issue", arg)
+		return controlReply{text: key, data: map[string]string{"login": arg, "key": key}}, nil
+
+	case "keys":
+		keys, err := srv.APIKeys(arg)
+		if err != nil {
+			return controlReply{}, err
+		}
+		type keyInfo struct {
+			ID        int64     `json:"id"`
+			Prefix    string    `json:"prefix"`
+			CreatedAt time.Time `json:"created_at"`
+			Revoked   bool      `json:"revoked"`
+		}
+		items := make([]string, 0, len(keys))
+		infos := make([]keyInfo, 0, len(keys))
+		for _, k := range keys {
+			status := "active"
+			if !k.RevokedAt.IsZero() {
+				status = "revoked"
+			}
+			items = append(items, strconv.FormatInt(k.ID, 10)+" "+k.Prefix+" "+k.CreatedAt.Format(time.RFC3339)+" "+status)
+			infos = append(infos, keyInfo{k.ID, k.Prefix, k.CreatedAt, !k.RevokedAt.IsZero()})
+		}
+		return controlReply{text: strings.Join(items, ";"), data: infos}, nil
+
+	case "revoke":
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return controlReply{}, errors.New("Invalid key id")
+		}
+		if err := srv.RevokeAPIKey(id); err != nil {
+			return controlReply{}, err
+		}
+		slog.Info("API key revoked via control socket", "id", id)
+		srv.Audit("key.revoke", "", "id", arg)
+		return textReply("Key revoked"), nil
+
+	default:
+		return controlReply{}, errors.New("Unknown bot command")
+	}
+}
+
+// handleLockoutCommand lists and clears brute-force lockouts:
+//
+//	lockout|list        - list counters as "scope key attempts locked_until;..."
+//	lockout|clear|key   - clear counters of a login or IP address
+//	lockout|clear       - clear all counters
+func handleLockoutCommand(srv *server.Server, args []string) (controlReply, error) {
+	if len(args) < 1 {
+		return controlReply{}, errors.New("Usage: lockout|list, lockout|clear|key, lockout|clear")
+	}
+
+	switch args[0] {
+	case "list":
+		lockouts, err := srv.Lockouts()
+		if err != nil {
+			return controlReply{}, err
+		}
+		type lockoutInfo struct {
+			Scope       string     `json:"scope"`
+			Key         string     `json:"key"`
+			Attempts    int        `json:"attempts"`
+			LockedUntil *time.Time `json:"locked_until,omitempty"`
+		}
+		items := make([]string, 0, len(lockouts))
+		infos := make([]lockoutInfo, 0, len(lockouts))
+		for _, l := range lockouts {
+			info := lockoutInfo{Scope: l.Scope, Key: l.Key, Attempts: l.Attempts}
+			until := "-"
+			if l.LockedUntil.After(time.Now()) {
+				until = l.LockedUntil.Format(time.RFC3339)
+				info.LockedUntil = &l.LockedUntil
+			}
+			items = append(items, l.Scope+" "+l.Key+" "+strconv.Itoa(l.Attempts)+" "+until)
+			infos = append(infos, info)
+		}
+		return controlReply{text: strings.Join(items, ";"), data: infos}, nil
+
+	case "clear":
+		key := ""
+		if len(args) >= 2 {
+			key = args[1]
+		}
+		n, err := srv.ClearLockouts(key)
+		if err != nil {
+			return controlReply{}, err
+		}
+		if key == "" {
+			slog.Info("All lockouts cleared via control socket")
+			srv.Audit("lockout.clear", "", "key", "*")
+		} else {
+			slog.Info("Lockouts cleared via control socket", "key", key)
+			srv.Audit("lockout.clear", "", "key", key)
+		}
+		return controlReply{
+			text: strconv.FormatInt(n, 10) + " cleared",
+			data: map[string]int64{"cleared": n},
+		}, nil
+
+	default:
+		return controlReply{}, errors.New("Unknown lockout command")
+	}
+}
+
+// handleAuditCommand queries the audit log, newest events first:
+//
+//	audit|user=login event=auth.failure since=24h until=2024-01-02T00:00:00Z limit=50
+//
+// All filters are optional; event accepts a prefix such as admin.*, since and
+// until accept RFC 3339 times or durations back from now. Events are returned
+// as "timestamp event login ip details;..." with "-" for empty fields.
+func handleAuditCommand(srv *server.Server, args []string) (controlReply, error) {
+	filter := db.AuditFilter{Limit: 100}
+	for _, item := range strings.Fields(strings.Join(args, " ")) {
+		key, value, ok := strings.Cut(item, "=")
+		if !ok || value == "" {
+			return controlReply{}, errors.New("Invalid filter " + item)
+		}
+		var err error
+		switch key {
+		case "user":
+			filter.Login = value
+		case "event":
+			filter.Event = value
+		case "since":
+			filter.Since, err = parseAuditTime(value)
+		case "until":
+			filter.Until, err = parseAuditTime(value)
+		case "limit":
+			filter.Limit, err = strconv.Atoi(value)
+		default:
+			return controlReply{}, errors.New("Unknown filter " + key)
+		}
+		if err != nil {
+			return controlReply{}, errors.New("Invalid " + key + " " + value)
+		}
+	}
+
+	events, err := srv.AuditEvents(filter)
+	if err != nil {
+		return controlReply{}, err
+	}
+	type auditInfo struct {
+		Timestamp time.Time `json:"timestamp"`
+		Event     string    `json:"event"`
+		Login     string    `json:"login,omitempty"`
+		IP        string    `json:"ip,omitempty"`
+		Details   string    `json:"details,omitempty"`
+	}
+	items := make([]string, 0, len(events))
+	infos := make([]auditInfo, 0, len(events))
+	for _, e := range events {
+		fields := []string{e.Timestamp.Format(time.RFC3339), e.Event, e.Login, e.IP, e.Details}
+		for i, f := range fields {
+			if f == "" {
+				fields[i] = "-"
+			}
+		}
+		items = append(items, strings.Join(fields, " "))
+		infos = append(infos, auditInfo{e.Timestamp, e.Event, e.Login, e.IP, e.Details})
+	}
+	return controlReply{text: strings.Join(items, ";"), data: infos}, nil
+}
+
+// parseAuditTime accepts an RFC 3339 time or a duration back from now, e.g. 24h
+func parseAuditTime(value string) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,87 @@
+package db
+
+import (
+	"database/sql"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Counts are row counts shown by the control socket
+type Counts struct {
+	Users         int64 `json:"users"`
+	Bots          int64 `json:"bots"`
+	Disabled      int64 `json:"disabled"`
+	Contacts      int64 `json:"contacts"`
+	Messages      int64 `json:"messages"`
+	Undelivered   int64 `json:"undelivered"`
+	APIKeys       int64 `json:"api_keys"`
+	Lockouts      int64 `json:"lockouts"`
+	AuditEvents   int64 `json:"audit_events"`
+	WebhookQueue  int64 `json:"webhook_queue"`
+	WebhookFailed int64 `json:"webhook_failed"`
+}
+
+// GetCounts returns row counts of the main tables
+func (db *DB) GetCounts() (*Counts, error) {
+	c := &Counts{}
+	err := db.conn.QueryRow(`
+		SELECT
+			(SELECT COUNT(*) FROM users),
+			(SELECT COUNT(*) FROM users WHERE bot = 1),
+			(SELECT COUNT(*) FROM users WHERE disabled = 1),
+			(SELECT COUNT(*) FROM contacts),
+			(SELECT COUNT(*) FROM messages),
+			(SELECT COUNT(*) FROM messages WHERE status = 'sent'),
+			(SELECT COUNT(*) FROM api_keys WHERE revoked_at IS NULL),
+			(SELECT COUNT(*) FROM lockouts),
+			(SELECT COUNT(*) FROM audit_log),
+			(SELECT COUNT(*) FROM webhook_deliveries WHERE status = 'pending'),
+			(SELECT COUNT(*) FROM webhook_deliveries WHERE status = 'failed')
+	`).Scan(&c.Users, &c.Bots, &c.Disabled, &c.Contacts, &c.Messages, &c.Undelivered,
+		&c.APIKeys, &c.Lockouts, &c.AuditEvents, &c.WebhookQueue, &c.WebhookFailed)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// SetUserDisabled disables or re-enables an account; disabled users cannot log in
+func (db *DB) SetUserDisabled(login string, disabled bool) error {
+	res, err := db.conn.Exec("UPDATE users SET disabled = ? WHERE login = ?", disabled, login)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNoRows
+	}
+	return nil
+}
+
+// IsUserDisabled reports whether the account is disabled; unknown users are not
+func (db *DB) IsUserDisabled(login string) (bool, error) {
+	var disabled bool
+	err := db.conn.QueryRow("SELECT disabled FROM users WHERE login = ?", login).Scan(&disabled)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return disabled, nil
+}
+
+// SetPassword replaces the password of a regular (non-bot) account
+func (db *DB) SetPassword(login, password string) error {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	res, err := db.conn.Exec("UPDATE users SET password = ? WHERE login = ? AND bot = 0", string(hashed), login)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNoRows
+	}
+	return nil
+}
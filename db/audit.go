@@ -0,0 +1,95 @@
+package db
+
+import (
+	"msim/models"
+	"strings"
+	"time"
+)
+
+// AuditFilter selects audit events; zero fields match everything
+type AuditFilter struct {
+	Login string
+	Event string // exact name, or a prefix ending in "*" such as "admin.*"
+	Since time.Time
+	Until time.Time
+	Limit int
+}
+
+// AddAuditEvent appends an event to the audit log. Events are never updated,
+// only removed by PruneAuditLog once they fall out of retention.
+func (db *DB) AddAuditEvent(event *models.AuditEvent) error {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+	res, err := db.conn.Exec(
+		"INSERT INTO audit_log (timestamp, event, login, ip, details) VALUES (?, ?, ?, ?, ?)",
+		event.Timestamp.UTC().Format(time.RFC3339), event.Event, event.Login, event.IP, event.Details,
+	)
+	if err != nil {
+		return err
+	}
+	event.ID, err = res.LastInsertId()
+	return err
+}
+
+// GetAuditEvents returns events matching filter, newest first
+func (db *DB) GetAuditEvents(filter AuditFilter) ([]models.AuditEvent, error) {
+	var where []string
+	var args []interface{}
+	if filter.Login != "" {
+		where = append(where, "login = ?")
+		args = append(args, filter.Login)
+	}
+	if prefix, ok := strings.CutSuffix(filter.Event, "*"); ok {
+		where = append(where, "substr(event, 1, ?) = ?")
+		args = append(args, len(prefix), prefix)
+	} else if filter.Event != "" {
+		where = append(where, "event = ?")
+		args = append(args, filter.Event)
+	}
+	if !filter.Since.IsZero() {
+		where = append(where, "timestamp >= ?")
+		args = append(args, filter.Since.UTC().Format(time.RFC3339))
+	}
+	if !filter.Until.IsZero() {
+		where = append(where, "timestamp < ?")
+		args = append(args, filter.Until.UTC().Format(time.RFC3339))
+	}
+
+	query := "SELECT id, timestamp, event, login, ip, details FROM audit_log"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC"
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []models.AuditEvent
+	for rows.Next() {
+		var e models.AuditEvent
+		var timestamp string
+		if err := rows.Scan(&e.ID, &timestamp, &e.Event, &e.Login, &e.IP, &e.Details); err != nil {
+			return nil, err
+		}
+		e.Timestamp, _ = time.Parse(time.RFC3339, timestamp)
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// PruneAuditLog removes events older than before
+func (db *DB) PruneAuditLog(before time.Time) (int64, error) {
+	res, err := db.conn.Exec("DELETE FROM audit_log WHERE timestamp < ?", before.UTC().Format(time.RFC3339))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
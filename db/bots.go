@@ -0,0 +1,109 @@
+package db
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"msim/models"
+	"time"
+)
+
+// CreateBot creates a bot account. Bots have no password and authenticate with API keys only.
+func (db *DB) CreateBot(login string) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	_, err := db.conn.Exec(
+		"INSERT INTO users (login, password, last_online, last_offline, bot) VALUES (?, '', ?, ?, 1)",
+		login, now, now,
+	)
+	return err
+}
+
+// IsBot reports whether the user is a bot account; unknown users are not bots
+func (db *DB) IsBot(login string) (bool, error) {
+	var bot bool
+	err := db.conn.QueryRow("SELECT bot FROM users WHERE login = ?", login).Scan(&bot)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return bot, nil
+}
+
+// AddAPIKey stores a new API key for the user; only a hash of the key is kept
+func (db *DB) AddAPIKey(login, key, prefix string) (int64, error) {
+	res, err := db.conn.Exec(
+		"INSERT INTO api_keys (login, key_hash, prefix, created_at) VALUES (?, ?, ?, ?)",
+		login, hashAPIKey(key), prefix, time.Now().UTC().Format(time.RFC3339),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// ValidateAPIKey checks that the key belongs to the user and is not revoked
+func (db *DB) ValidateAPIKey(login, key string) (bool, error) {
+	var owner string
+	err := db.conn.QueryRow(
+		"SELECT login FROM api_keys WHERE key_hash = ? AND revoked_at IS NULL",
+		hashAPIKey(key),
+	).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare([]byte(owner), []byte(login)) == 1, nil
+}
+
+// GetAPIKeys returns all keys of the user, including revoked ones
+func (db *DB) GetAPIKeys(login string) ([]models.APIKey, error) {
+	rows, err := db.conn.Query(
+		"SELECT id, login, prefix, created_at, COALESCE(revoked_at, '') FROM api_keys WHERE login = ? ORDER BY id",
+		login,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []models.APIKey
+	for rows.Next() {
+		var k models.APIKey
+		var createdStr, revokedStr string
+		if err := rows.Scan(&k.ID, &k.Login, &k.Prefix, &createdStr, &revokedStr); err != nil {
+			return nil, err
+		}
+		k.CreatedAt, _ = time.Parse(time.RFC3339, createdStr)
+		if revokedStr != "" {
+			k.RevokedAt, _ = time.Parse(time.RFC3339, revokedStr)
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey revokes an active key by id
+func (db *DB) RevokeAPIKey(id int64) error {
+	res, err := db.conn.Exec(
+		"UPDATE api_keys SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL",
+		time.Now().UTC().Format(time.RFC3339), id,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNoRows
+	}
+	return nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -13,7 +13,7 @@ import (
 var ErrNoRows = errors.New("no rows found")
 
 type DB struct {
-	conn *sql.DB
+	conn *timedConn
 }
 
 func New(path string) (*DB, error) {
@@ -22,7 +22,7 @@ func New(path string) (*DB, error) {
 		return nil, err
 	}
 
-	db := &DB{conn: conn}
+	db := &DB{conn: &timedConn{DB: conn}}
 	if err := db.init(); err != nil {
 		conn.Close()
 		return nil, err
@@ -60,6 +60,44 @@ func (db *DB) init() error {
 		`CREATE INDEX IF NOT EXISTS idx_messages_sender ON messages(sender, timestamp)`,
 		`CREATE INDEX IF NOT EXISTS idx_messages_recipient ON messages(recipient, timestamp)`,
 		`CREATE INDEX IF NOT EXISTS idx_contacts_owner ON contacts(owner)`,
+		`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			url TEXT NOT NULL,
+			event TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			next_attempt TEXT NOT NULL,
+			last_error TEXT NOT NULL DEFAULT '',
+			status TEXT NOT NULL DEFAULT 'pending'
+		)`,
+		`CREATE TABLE IF NOT EXISTS api_keys (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			login TEXT NOT NULL,
+			key_hash TEXT UNIQUE NOT NULL,
+			prefix TEXT NOT NULL,
+			created_at TEXT NOT NULL,
+			revoked_at TEXT
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_api_keys_login ON api_keys(login)`,
+		`CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(status, next_attempt)`,
+		`CREATE TABLE IF NOT EXISTS lockouts (
+			scope TEXT NOT NULL,
+			key TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			last_attempt TEXT NOT NULL,
+			locked_until TEXT,
+			PRIMARY KEY (scope, key)
+		)`,
+		`CREATE TABLE IF NOT EXISTS audit_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			timestamp TEXT NOT NULL,
+			event TEXT NOT NULL,
+			login TEXT NOT NULL DEFAULT '',
+			ip TEXT NOT NULL DEFAULT '',
+			details TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_timestamp ON audit_log(timestamp)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_log_login ON audit_log(login, timestamp)`,
 	}
 
 	for _, query := range queries {
@@ -106,6 +144,27 @@ func (db *DB) migrate() error {
 		}
 	}
 
+	// Check and add webhook_messages column (per-user opt-in for message webhooks)
+	if !db.columnExists("users", "webhook_messages") {
+		if _, err := db.conn.Exec("ALTER TABLE users ADD COLUMN webhook_messages INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+	}
+
+	// Check and add bot column to users table
+	if !db.columnExists("users", "bot") {
+		if _, err := db.conn.Exec("ALTER TABLE users ADD COLUMN bot INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+	}
+
+	// Check and add disabled column to users table
+	if !db.columnExists("users", "disabled") {
+		if _, err := db.conn.Exec("ALTER TABLE users ADD COLUMN disabled INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -153,6 +212,31 @@ func (db *DB) UpdateLastOffline(login string, t time.Time) error {
 	return err
 }
 
+// UpdateLastOfflineAll sets the last offline timestamp of several users in one transaction
+func (db *DB) UpdateLastOfflineAll(logins []string, t time.Time) error {
+	defer db.conn.done("UPDATE", time.Now())
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare("UPDATE users SET last_offline = ? WHERE login = ?")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	ts := t.Format(time.RFC3339)
+	for _, login := range logins {
+		if _, err := stmt.Exec(ts, login); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 // GetUserStatus returns user's online status timestamps
 func (db *DB) GetUserStatus(login string) (lastOnline, lastOffline time.Time, err error) {
 	var onlineStr, offlineStr string
@@ -198,7 +282,12 @@ func (db *DB) UserExists(login string) (bool, error) {
 
 // Contact methods
 func (db *DB) GetContacts(owner string) ([]models.Contact, error) {
-	rows, err := db.conn.Query("SELECT id, owner, contact, nick FROM contacts WHERE owner = ?", owner)
+	rows, err := db.conn.Query(`
+		SELECT c.id, c.owner, c.contact, c.nick, COALESCE(u.bot, 0)
+		FROM contacts c LEFT JOIN users u ON u.login = c.contact
+		WHERE c.owner = ?
+		ORDER BY c.id
+	`, owner)
 	if err != nil {
 		return nil, err
 	}
@@ -207,7 +296,7 @@ func (db *DB) GetContacts(owner string) ([]models.Contact, error) {
 	var contacts []models.Contact
 	for rows.Next() {
 		var c models.Contact
-		if err := rows.Scan(&c.ID, &c.Owner, &c.Contact, &c.Nick); err != nil {
+		if err := rows.Scan(&c.ID, &c.Owner, &c.Contact, &c.Nick, &c.Bot); err != nil {
 			return nil, err
 		}
 		contacts = append(contacts, c)
@@ -216,6 +305,13 @@ func (db *DB) GetContacts(owner string) ([]models.Contact, error) {
 	return contacts, rows.Err()
 }
 
+// CountContacts returns the size of the owner's contact list
+func (db *DB) CountContacts(owner string) (int, error) {
+	var count int
+	err := db.conn.QueryRow("SELECT COUNT(*) FROM contacts WHERE owner = ?", owner).Scan(&count)
+	return count, err
+}
+
 func (db *DB) AddContact(owner, contact, nick string) error {
 	_, err := db.conn.Exec("INSERT INTO contacts (owner, contact, nick) VALUES (?, ?, ?)", owner, contact, nick)
 	return err
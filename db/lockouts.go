@@ -0,0 +1,102 @@
+package db
+
+import (
+	"database/sql"
+	"msim/models"
+	"time"
+)
+
+// GetLockout returns the attempt counter for scope and key; unknown keys get a zero counter
+func (db *DB) GetLockout(scope, key string) (*models.Lockout, error) {
+	lockout := &models.Lockout{Scope: scope, Key: key}
+	var lastAttempt string
+	var lockedUntil sql.NullString
+	err := db.conn.QueryRow(
+		"SELECT attempts, last_attempt, locked_until FROM lockouts WHERE scope = ? AND key = ?",
+		scope, key,
+	).Scan(&lockout.Attempts, &lastAttempt, &lockedUntil)
+	if err == sql.ErrNoRows {
+		return lockout, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	lockout.LastAttempt, _ = time.Parse(time.RFC3339, lastAttempt)
+	if lockedUntil.Valid {
+		lockout.LockedUntil, _ = time.Parse(time.RFC3339, lockedUntil.String)
+	}
+	return lockout, nil
+}
+
+// SaveLockout creates or updates the attempt counter
+func (db *DB) SaveLockout(lockout *models.Lockout) error {
+	var lockedUntil interface{}
+	if !lockout.LockedUntil.IsZero() {
+		lockedUntil = lockout.LockedUntil.UTC().Format(time.RFC3339)
+	}
+	_, err := db.conn.Exec(
+		`INSERT INTO lockouts (scope, key, attempts, last_attempt, locked_until) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(scope, key) DO UPDATE SET attempts = excluded.attempts,
+			last_attempt = excluded.last_attempt, locked_until = excluded.locked_until`,
+		lockout.Scope, lockout.Key, lockout.Attempts,
+		lockout.LastAttempt.UTC().Format(time.RFC3339), lockedUntil,
+	)
+	return err
+}
+
+// DeleteLockout removes the attempt counter for scope and key
+func (db *DB) DeleteLockout(scope, key string) error {
+	_, err := db.conn.Exec("DELETE FROM lockouts WHERE scope = ? AND key = ?", scope, key)
+	return err
+}
+
+// ClearLockouts removes the counters of key in every scope, or all counters if key is empty
+func (db *DB) ClearLockouts(key string) (int64, error) {
+	var res sql.Result
+	var err error
+	if key == "" {
+		res, err = db.conn.Exec("DELETE FROM lockouts")
+	} else {
+		res, err = db.conn.Exec("DELETE FROM lockouts WHERE key = ?", key)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// GetLockouts returns all counters, locked ones first
+func (db *DB) GetLockouts() ([]models.Lockout, error) {
+	rows, err := db.conn.Query(
+		"SELECT scope, key, attempts, last_attempt, locked_until FROM lockouts ORDER BY locked_until IS NULL, scope, key",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lockouts []models.Lockout
+	for rows.Next() {
+		var l models.Lockout
+		var lastAttempt string
+		var lockedUntil sql.NullString
+		if err := rows.Scan(&l.Scope, &l.Key, &l.Attempts, &lastAttempt, &lockedUntil); err != nil {
+			return nil, err
+		}
+		l.LastAttempt, _ = time.Parse(time.RFC3339, lastAttempt)
+		if lockedUntil.Valid {
+			l.LockedUntil, _ = time.Parse(time.RFC3339, lockedUntil.String)
+		}
+		lockouts = append(lockouts, l)
+	}
+	return lockouts, rows.Err()
+}
+
+// PruneLockouts removes counters that are not locked and had no attempts since before
+func (db *DB) PruneLockouts(before time.Time) error {
+	_, err := db.conn.Exec(
+		"DELETE FROM lockouts WHERE last_attempt < ? AND (locked_until IS NULL OR locked_until < ?)",
+		before.UTC().Format(time.RFC3339), time.Now().UTC().Format(time.RFC3339),
+	)
+	return err
+}
@@ -0,0 +1,49 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// timedConn wraps *sql.DB and reports how long every statement took
+type timedConn struct {
+	*sql.DB
+	observe func(statement string, d time.Duration)
+}
+
+func (c *timedConn) Exec(query string, args ...interface{}) (sql.Result, error) {
+	defer c.done(query, time.Now())
+	return c.DB.Exec(query, args...)
+}
+
+func (c *timedConn) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	defer c.done(query, time.Now())
+	return c.DB.Query(query, args...)
+}
+
+func (c *timedConn) QueryRow(query string, args ...interface{}) *sql.Row {
+	defer c.done(query, time.Now())
+	return c.DB.QueryRow(query, args...)
+}
+
+func (c *timedConn) done(query string, start time.Time) {
+	if c.observe != nil {
+		c.observe(statementType(query), time.Since(start))
+	}
+}
+
+// statementType returns the leading keyword of a query, e.g. SELECT
+func statementType(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToUpper(fields[0])
+}
+
+// SetQueryObserver registers a function called after every statement with its
+// leading keyword and duration. It must be set before the database is used concurrently.
+func (db *DB) SetQueryObserver(observe func(statement string, d time.Duration)) {
+	db.conn.observe = observe
+}
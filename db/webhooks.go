@@ -0,0 +1,115 @@
+package db
+
+import (
+	"msim/models"
+	"time"
+)
+
+// webhookTimeFormat has a fixed width so that times compare correctly as strings
+const webhookTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// SetWebhookMessages enables or disables message webhooks for the user
+func (db *DB) SetWebhookMessages(login string, enabled bool) error {
+	value := 0
+	if enabled {
+		value = 1
+	}
+	res, err := db.conn.Exec("UPDATE users SET webhook_messages = ? WHERE login = ?", value, login)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNoRows
+	}
+	return nil
+}
+
+// WebhookMessagesEnabled reports whether the user opted in to message webhooks
+func (db *DB) WebhookMessagesEnabled(login string) (bool, error) {
+	var enabled bool
+	err := db.conn.QueryRow("SELECT webhook_messages FROM users WHERE login = ?", login).Scan(&enabled)
+	if err != nil {
+		return false, err
+	}
+	return enabled, nil
+}
+
+// EnqueueWebhook stores a webhook delivery to be sent at the given time
+func (db *DB) EnqueueWebhook(url, event, payload string, at time.Time) (int64, error) {
+	res, err := db.conn.Exec(
+		"INSERT INTO webhook_deliveries (url, event, payload, next_attempt) VALUES (?, ?, ?, ?)",
+		url, event, payload, at.UTC().Format(webhookTimeFormat),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// DueWebhooks returns pending deliveries whose next attempt is not after now, oldest first
+func (db *DB) DueWebhooks(now time.Time, limit int) ([]models.WebhookDelivery, error) {
+	rows, err := db.conn.Query(`
+		SELECT id, url, event, payload, attempts, next_attempt, last_error, status
+		FROM webhook_deliveries
+		WHERE status = 'pending' AND next_attempt <= ?
+		ORDER BY next_attempt, id
+		LIMIT ?
+	`, now.UTC().Format(webhookTimeFormat), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []models.WebhookDelivery
+	for rows.Next() {
+		var d models.WebhookDelivery
+		var nextStr string
+		if err := rows.Scan(&d.ID, &d.URL, &d.Event, &d.Payload, &d.Attempts, &nextStr, &d.LastError, &d.Status); err != nil {
+			return nil, err
+		}
+		d.NextAttempt, _ = time.Parse(webhookTimeFormat, nextStr)
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// NextWebhookAttempt returns the time of the earliest pending delivery
+func (db *DB) NextWebhookAttempt() (time.Time, bool, error) {
+	var nextStr string
+	err := db.conn.QueryRow(
+		"SELECT COALESCE(MIN(next_attempt), '') FROM webhook_deliveries WHERE status = 'pending'",
+	).Scan(&nextStr)
+	if err != nil || nextStr == "" {
+		return time.Time{}, false, err
+	}
+	next, err := time.Parse(webhookTimeFormat, nextStr)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return next, true, nil
+}
+
+// DeleteWebhook removes a delivered webhook from the queue
+func (db *DB) DeleteWebhook(id int64) error {
+	_, err := db.conn.Exec("DELETE FROM webhook_deliveries WHERE id = ?", id)
+	return err
+}
+
+// RetryWebhook records a failed attempt and schedules the next one
+func (db *DB) RetryWebhook(id int64, attempts int, next time.Time, lastError string) error {
+	_, err := db.conn.Exec(
+		"UPDATE webhook_deliveries SET attempts = ?, next_attempt = ?, last_error = ? WHERE id = ?",
+		attempts, next.UTC().Format(webhookTimeFormat), lastError, id,
+	)
+	return err
+}
+
+// FailWebhook gives up on a delivery; it stays in the table for inspection
+func (db *DB) FailWebhook(id int64, attempts int, lastError string) error {
+	_, err := db.conn.Exec(
+		"UPDATE webhook_deliveries SET status = 'failed', attempts = ?, last_error = ? WHERE id = ?",
+		attempts, lastError, id,
+	)
+	return err
+}
@@ -3,6 +3,8 @@ module msim
 go 1.21
 
 require (
+	github.com/BurntSushi/toml v1.3.2
+	github.com/gorilla/websocket v1.5.3
 	github.com/mattn/go-sqlite3 v1.14.18
 	golang.org/x/crypto v0.17.0
 )
@@ -1,12 +1,13 @@
 package main
 
 import (
-	"bufio"
-	"log"
+	"flag"
+	"fmt"
+	"log/slog"
 	"msim/config"
 	"msim/db"
+	"msim/plugins"
 	"msim/server"
-	"net"
 	"os"
 	"os/signal"
 	"strings"
@@ -14,117 +15,279 @@ import (
 	"time"
 )
 
-const controlSocketPath = "/tmp/msim.sock"
+// version is reported in the info packet; release builds set it with
+// -ldflags "-X main.version=1.2.3"
+var version = "dev"
 
-func main() {
-	cfg := config.Load()
+// setupLogging installs the default slog logger; the standard log package
+// writes through it as well, so third-party output gets the same format.
+// The returned level is changed on SIGHUP.
+func setupLogging(cfg *config.Config) *slog.LevelVar {
+	level := new(slog.LevelVar)
+	level.UnmarshalText([]byte(cfg.LogLevel))
 
-	database, err := db.New(cfg.DBPath)
-	if err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	if cfg.LogFormat == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, opts)
 	}
-	defer database.Close()
+	slog.SetDefault(slog.New(handler))
+	warnLogPackets(cfg)
+	return level
+}
 
+func warnLogPackets(cfg *config.Config) {
+	if cfg.LogPackets && cfg.LogLevel != "debug" {
+		slog.Warn("log_packets has no effect unless log_level is debug")
+	}
+}
+
+// fatal logs an error and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+// serverConfig converts the loaded settings to the server configuration
+func serverConfig(cfg *config.Config) *server.ServerConfig {
 	srvConfig := &server.ServerConfig{
 		Port:               cfg.Port,
 		ReadTimeout:        time.Duration(cfg.ReadTimeout) * time.Second,
 		WriteTimeout:       time.Duration(cfg.WriteTimeout) * time.Second,
 		FilePortRangeStart: cfg.FilePortRangeStart,
 		FilePortRangeEnd:   cfg.FilePortRangeEnd,
+		WSPort:             cfg.WSPort,
+		WSPath:             cfg.WSPath,
+		WSAllowedOrigins:   cfg.WSAllowedOrigins,
+		APIPort:            cfg.APIPort,
+		APITokenTTL:        time.Duration(cfg.APITokenTTL) * time.Second,
+		WebhookURLs:        cfg.WebhookURLs,
+		WebhookSecret:      cfg.WebhookSecret,
+		WebhookEvents:      cfg.WebhookEvents,
+		WebhookMaxAttempts: cfg.WebhookMaxAttempts,
+		RateLimits:         make(map[string]server.RateLimits),
+		FloodStrikes:       cfg.FloodStrikes,
+		LockoutThreshold:   cfg.LockoutThreshold,
+		LockoutIPThreshold: cfg.LockoutIPThreshold,
+		LockoutDuration:    time.Duration(cfg.LockoutDuration) * time.Second,
+		RegistrationsPerIP: cfg.RegistrationsPerIP,
+		RegistrationWindow: time.Duration(cfg.RegistrationWindow) * time.Second,
+		MaxLineLength:      cfg.MaxLineLength,
+		MaxMessageLength:   cfg.MaxMessageLength,
+		MaxLoginLength:     cfg.MaxLoginLength,
+		MaxNickLength:      cfg.MaxNickLength,
+		MaxContacts:        cfg.MaxContacts,
+		MaxConnsPerIP:      cfg.MaxConnsPerIP,
+		MetricsPort:        cfg.MetricsPort,
+		LogRedact:          cfg.LogRedact,
+		LogPackets:         cfg.LogPackets,
+		AuditRetention:     time.Duration(cfg.AuditRetentionDays) * 24 * time.Hour,
+		MaintenanceNotice:  time.Duration(cfg.MaintenanceNotice) * time.Second,
+		Name:               cfg.ServerName,
+		Version:            version,
+		MOTD:               cfg.MOTD,
 	}
+	for class, limits := range cfg.RateLimits {
+		srvConfig.RateLimits[class] = server.RateLimits{
+			Session: server.RateLimit(limits.Session),
+			Login:   server.RateLimit(limits.Login),
+			IP:      server.RateLimit(limits.IP),
+		}
+	}
+	return srvConfig
+}
 
-	srv := server.New(database, srvConfig)
-
-	// Start control socket for management commands
-	go startControlSocket(srv)
-
-	// Handle signals for graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+// reloadConfig re-reads the config file and environment on SIGHUP. An invalid
+// file leaves the running settings untouched; settings read only at startup
+// are reported and keep their old values until a restart.
+func reloadConfig(srv *server.Server, path string, current *config.Config, level *slog.LevelVar) *config.Config {
+	cfg, err := config.Load(path)
+	if err != nil {
+		slog.Error("Config reload failed, keeping current settings", "err", err)
+		return current
+	}
 
-	go func() {
-		sig := <-sigChan
-		log.Printf("Received signal %v, shutting down...", sig)
-		srv.Shutdown("maintenance", time.Time{})
-		os.Remove(controlSocketPath)
-		os.Exit(0)
-	}()
+	level.UnmarshalText([]byte(cfg.LogLevel))
+	warnLogPackets(cfg)
+	restart := srv.Reload(serverConfig(cfg))
+	if cfg.DBPath != current.DBPath {
+		restart = append(restart, "DBPath")
+	}
+	if cfg.EchoBot != current.EchoBot {
+		restart = append(restart, "EchoBot")
+	}
+	if cfg.LogFormat != current.LogFormat {
+		restart = append(restart, "LogFormat")
+	}
+	if cfg.ControlSocket != current.ControlSocket || cfg.ControlSocketMode != current.ControlSocketMode {
+		restart = append(restart, "ControlSocket")
+	}
+	if cfg.PidFile != current.PidFile {
+		restart = append(restart, "PidFile")
+	}
+	if cfg.ShutdownTimeout != current.ShutdownTimeout {
+		restart = append(restart, "ShutdownTimeout")
+	}
+	if len(restart) > 0 {
+		slog.Warn("Some settings require a restart to take effect", "settings", strings.Join(restart, ","))
+	}
 
-	log.Fatal(srv.Start())
+	// Keep the values the process is running with, like Server.Reload does for
+	// ports, so the next reload still reports a pending restart
+	cfg.DBPath = current.DBPath
+	cfg.EchoBot = current.EchoBot
+	cfg.LogFormat = current.LogFormat
+	cfg.ControlSocket = current.ControlSocket
+	cfg.ControlSocketMode = current.ControlSocketMode
+	cfg.PidFile = current.PidFile
+	cfg.ShutdownTimeout = current.ShutdownTimeout
+	slog.Info("Config reloaded", "path", path, "level", cfg.LogLevel)
+	return cfg
 }
 
-func startControlSocket(srv *server.Server) {
-	// Remove existing socket file
-	os.Remove(controlSocketPath)
+func main() {
+	configPath := flag.String("config", os.Getenv("MSIM_CONFIG"), "path to the TOML config file")
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	flag.Parse()
+	if *showVersion {
+		fmt.Println(version)
+		return
+	}
 
-	listener, err := net.Listen("unix", controlSocketPath)
+	cfg, err := config.Load(*configPath)
 	if err != nil {
-		log.Printf("Failed to create control socket: %v", err)
-		return
+		fmt.Fprintln(os.Stderr, "Invalid configuration:")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-	defer listener.Close()
-	defer os.Remove(controlSocketPath)
+	level := setupLogging(cfg)
+	slog.Info("Starting mSIM server", "version", version)
 
-	log.Printf("Control socket listening on %s", controlSocketPath)
+	database, err := db.New(cfg.DBPath)
+	if err != nil {
+		fatal("Failed to initialize database", err)
+	}
+	defer database.Close()
+
+	srvConfig := serverConfig(cfg)
+	srv := server.New(database, srvConfig)
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			continue
+	// Register plugins before the server starts accepting connections
+	if cfg.EchoBot != "" {
+		if err := srv.Register(plugins.NewEcho(cfg.EchoBot)); err != nil {
+			fatal("Failed to register plugin", err)
 		}
+	}
 
-		go handleControlCommand(srv, conn)
+	proc := &process{
+		srv:          srv,
+		db:           database,
+		controlPath:  cfg.ControlSocket,
+		pidFile:      cfg.PidFile,
+		drainTimeout: time.Duration(cfg.ShutdownTimeout) * time.Second,
 	}
-}
 
-func handleControlCommand(srv *server.Server, conn net.Conn) {
-	defer conn.Close()
+	// Scheduled maintenance stops the server when it begins
+	srv.OnMaintenanceStart(func(m server.Maintenance) {
+		slog.Info("Scheduled maintenance begins, shutting down", "end", m.End)
+		proc.shutdown("maintenance", m.End)
+	})
 
-	reader := bufio.NewReader(conn)
-	line, err := reader.ReadString('\n')
+	// After an upgrade, take over the sockets of the previous process
+	inheritedControl, ready, err := inherit(srv)
 	if err != nil {
-		return
+		fatal("Failed to take over from the previous process", err)
 	}
 
-	line = strings.TrimSpace(line)
-	parts := strings.SplitN(line, "|", 3)
+	// Start WebSocket gateway for browser clients
+	if srvConfig.WSPort != 0 {
+		go func() {
+			if err := srv.StartWebSocket(); err != nil {
+				slog.Error("WebSocket gateway failed", "err", err)
+			}
+		}()
+	}
 
-	if len(parts) == 0 {
-		conn.Write([]byte("ERROR|Invalid command\n"))
-		return
+	// Start HTTP API
+	if srvConfig.APIPort != 0 {
+		go func() {
+			if err := srv.StartAPI(); err != nil {
+				slog.Error("HTTP API failed", "err", err)
+			}
+		}()
 	}
 
-	cmd := parts[0]
+	// Start Prometheus metrics endpoint
+	if srvConfig.MetricsPort != 0 {
+		go func() {
+			if err := srv.StartMetrics(); err != nil {
+				slog.Error("Metrics endpoint failed", "err", err)
+			}
+		}()
+	}
 
-	switch cmd {
-	case "stats":
-		stats := srv.GetStats()
-		conn.Write([]byte("OK|" + stats + "\n"))
+	// Start control socket for management commands
+	control, err := listenControlSocket(cfg.ControlSocket, cfg.SocketMode(), inheritedControl)
+	if err != nil {
+		slog.Error("Failed to create control socket", "err", err)
+	} else {
+		proc.control = control
+		go serveControlSocket(srv, control, proc)
+	}
 
-	case "shutdown":
-		reason := "maintenance"
-		var completionTime time.Time
+	if err := writePidFile(cfg.PidFile); err != nil {
+		slog.Error("Failed to write pid file", "path", cfg.PidFile, "err", err)
+	}
 
-		if len(parts) >= 2 && parts[1] != "" {
-			reason = parts[1]
-		}
-		if len(parts) >= 3 && parts[2] != "" {
-			completionTime, _ = time.Parse(time.RFC3339, parts[2])
+	// Handle signals for graceful shutdown
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-sigChan
+		if proc.isRetiring() {
+			// The new process owns the sockets; only transfers are left here
+			slog.Info("Received signal while retiring, exiting", "signal", sig.String())
+			os.Exit(0)
 		}
+		slog.Info("Received signal, shutting down", "signal", sig.String())
+		proc.shutdown("maintenance", time.Time{})
+	}()
 
-		conn.Write([]byte("OK|Shutting down\n"))
-		conn.Close()
+	// SIGUSR2 hands the sockets to a fresh copy of the binary
+	usrChan := make(chan os.Signal, 1)
+	signal.Notify(usrChan, syscall.SIGUSR2)
 
-		// Give time for response to be sent
-		time.Sleep(100 * time.Millisecond)
+	go func() {
+		for range usrChan {
+			pid, err := proc.start()
+			if err != nil {
+				slog.Error("Upgrade failed, still serving", "err", err)
+				continue
+			}
+			proc.retire(pid)
+		}
+	}()
 
-		log.Printf("Shutdown requested: reason=%s, completion=%v", reason, completionTime)
-		srv.Shutdown(reason, completionTime)
+	// SIGHUP reloads settings that can change without dropping connections
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
 
-		os.Remove(controlSocketPath)
-		os.Exit(0)
+	go func() {
+		for range hupChan {
+			cfg = reloadConfig(srv, *configPath, cfg, level)
+		}
+	}()
 
-	default:
-		conn.Write([]byte("ERROR|Unknown command\n"))
+	if ready != nil {
+		ready()
+	}
+	if err := srv.Start(); err != nil {
+		fatal("Server failed", err)
 	}
+	// Start returns once the server is shut down or retired; the goroutine
+	// that stopped it exits the process
+	select {}
 }
@@ -13,6 +13,7 @@ type Contact struct {
 	Owner   string
 	Contact string
 	Nick    string
+	Bot     bool // the contact is a bot account
 }
 
 type Message struct {
@@ -30,3 +31,41 @@ type Session struct {
 	LastPing  time.Time
 }
 
+
+type WebhookDelivery struct {
+	ID          int64
+	URL         string
+	Event       string
+	Payload     string // JSON
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+	Status      string // "pending" or "failed"
+}
+
+type APIKey struct {
+	ID        int64
+	Login     string
+	Prefix    string // first characters of the key, for identification
+	CreatedAt time.Time
+	RevokedAt time.Time // zero if the key is active
+}
+
+// Lockout counts failed or throttled attempts for a login or remote IP
+type Lockout struct {
+	Scope       string // "login", "ip" or "reg"
+	Key         string // login or IP address
+	Attempts    int
+	LastAttempt time.Time
+	LockedUntil time.Time // zero if not locked
+}
+
+// AuditEvent is an append-only record of a security-relevant action
+type AuditEvent struct {
+	ID        int64
+	Timestamp time.Time
+	Event     string // e.g. "auth.success", "contact.delete", "admin.shutdown"
+	Login     string // user the event is about, empty for server-wide events
+	IP        string // remote address, empty for control socket actions
+	Details   string // space-separated key=value pairs
+}
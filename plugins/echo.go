@@ -0,0 +1,40 @@
+// Package plugins contains server plugins shipped with mSIM.
+package plugins
+
+import (
+	"log/slog"
+	"msim/server"
+)
+
+// Echo answers every message sent to its login with the same text.
+// The login should be a bot account so that its contacts get no presence spam.
+type Echo struct {
+	Login string
+
+	host server.Host
+}
+
+// NewEcho creates an echo bot answering as login
+func NewEcho(login string) *Echo {
+	return &Echo{Login: login}
+}
+
+func (e *Echo) Name() string { return "echo" }
+
+func (e *Echo) Start(host server.Host) error {
+	e.host = host
+	return nil
+}
+
+func (e *Echo) AfterMessage(msg server.Message) {
+	// Skip our own replies, otherwise two echo bots would talk forever
+	if msg.Recipient != e.Login || msg.Sender == e.Login {
+		return
+	}
+	// Reply asynchronously: the hook runs inside the sender's request
+	go func() {
+		if err := e.host.SendMessage(e.Login, msg.Sender, msg.Text); err != nil {
+			slog.Error("Echo reply failed", "recipient", msg.Sender, "err", err)
+		}
+	}()
+}
@@ -0,0 +1,51 @@
+package plugins
+
+import (
+	"msim/db"
+	"msim/server"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEcho(t *testing.T) {
+	database, err := db.New(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer database.Close()
+
+	if err := database.CreateUser("alice", "password123"); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	if err := database.CreateBot("echo"); err != nil {
+		t.Fatalf("Failed to create bot: %v", err)
+	}
+
+	srv := server.New(database, &server.ServerConfig{})
+	if err := srv.Register(NewEcho("echo")); err != nil {
+		t.Fatalf("Failed to register plugin: %v", err)
+	}
+
+	if err := srv.SendMessage("alice", "echo", "ping me"); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		messages, err := database.GetMessages("alice", "echo", 0, 10)
+		if err != nil {
+			t.Fatalf("Failed to get messages: %v", err)
+		}
+		for _, msg := range messages {
+			if msg.Sender == "echo" {
+				if msg.Recipient != "alice" || msg.Text != "ping me" {
+					t.Errorf("Unexpected reply %+v", msg)
+				}
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Echo bot did not reply")
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"msim/db"
+	"msim/server"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// process owns what outlives the server object: the control socket, the
+// pid file and the database. It stops the process on shutdown and replaces
+// it on upgrade, see upgrade.go.
+type process struct {
+	srv          *server.Server
+	db           *db.DB
+	control      *net.UnixListener
+	controlPath  string
+	pidFile      string
+	drainTimeout time.Duration
+
+	running  sync.Mutex // held by an upgrade in progress
+	retiring atomic.Bool
+}
+
+// shutdown drains the server, closes the database and exits. A second call
+// while the first is draining returns, so the first caller exits.
+func (p *process) shutdown(reason string, completionTime time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.drainTimeout)
+	defer cancel()
+
+	err := p.srv.Shutdown(ctx, reason, completionTime)
+	if errors.Is(err, server.ErrShuttingDown) {
+		return
+	}
+	if err != nil {
+		slog.Warn("Drain deadline exceeded, remaining connections were closed", "timeout", p.drainTimeout, "err", err)
+	}
+	if err := p.db.Close(); err != nil {
+		slog.Error("Failed to close database", "err", err)
+	}
+	p.cleanup()
+	slog.Info("Server stopped")
+	os.Exit(0)
+}
+
+// isRetiring reports that the process has handed everything over
+func (p *process) isRetiring() bool {
+	return p.retiring.Load()
+}
+
+// cleanup removes the control socket and the pid file on shutdown
+func (p *process) cleanup() {
+	os.Remove(p.controlPath)
+	if p.pidFile != "" {
+		os.Remove(p.pidFile)
+	}
+}
+
+// writePidFile records the PID of this process for supervisors
+func writePidFile(path string) error {
+	if path == "" {
+		return nil
+	}
+	return os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
@@ -0,0 +1,184 @@
+package protocol
+
+import (
+	"strings"
+)
+
+// Типы пакетов протокола mSIM
+const (
+	TypePing   = "ping"
+	TypePong   = "pong"
+	TypeBye    = "bye"
+	TypeHelp   = "help"
+	TypeAuth   = "auth"
+	TypeReg    = "reg"
+	TypeOk     = "ok"
+	TypeFail   = "fail"
+	TypeMsg    = "msg"
+	TypeAck    = "ack"
+	TypeHist   = "hist"
+	TypeHClear = "hclear"
+	TypeStat   = "stat"
+	TypeList   = "list"
+	TypeAdd    = "add"
+	TypeRen    = "ren"
+	TypeDel    = "del"
+	TypeOn     = "on"
+	TypeOff    = "off"
+	TypeOffmsg = "offmsg"
+	TypeFsnd   = "fsnd"
+	TypeFacc   = "facc"
+	TypeFdec   = "fdec"
+	TypeFcan   = "fcan"
+	TypeFst    = "fst"
+	TypeCaps   = "caps"
+	TypeSys    = "sys"
+	TypeNotice = "notice"
+	TypeInfo   = "info"
+	TypeMotd   = "motd"
+)
+
+// Record — запись списка: набор полей, разделённых неэкранированным |
+type Record []string
+
+// listHeaders описывает пакеты, содержимое которых является списком записей.
+// Значение — количество обычных полей, идущих между типом пакета и списком.
+// Например, hist|contact|<список> имеет одно поле заголовка.
+var listHeaders = map[string]int{
+	TypeHist:   1,
+	TypeStat:   0,
+	TypeList:   0,
+	TypeOffmsg: 0,
+	TypeHelp:   0,
+	TypeInfo:   0,
+}
+
+// ListHeader возвращает количество полей заголовка для пакета со списком.
+// Второе значение false, если пакет данного типа не содержит списка.
+func ListHeader(pktType string) (int, bool) {
+	n, ok := listHeaders[pktType]
+	return n, ok
+}
+
+// FormatFields формирует строку пакета: тип и поля экранируются по отдельности
+// и разделяются неэкранированным |
+// Формат: pktType|field1|field2|...\n
+func FormatFields(pktType string, fields ...string) string {
+	var sb strings.Builder
+	sb.WriteString(Escape(pktType))
+	for _, field := range fields {
+		sb.WriteByte('|')
+		sb.WriteString(Escape(field))
+	}
+	sb.WriteByte('\n')
+	return sb.String()
+}
+
+// FormatList формирует строку пакета со списком записей
+// Формат: pktType|header1|...|rec1field1|rec1field2,rec2field1|rec2field2\n
+// Поля заголовка и поля записей экранируются, разделители | и , внутри списка — нет
+func FormatList(pktType string, header []string, records []Record) string {
+	var sb strings.Builder
+	sb.WriteString(Escape(pktType))
+	for _, field := range header {
+		sb.WriteByte('|')
+		sb.WriteString(Escape(field))
+	}
+	sb.WriteByte('|')
+	sb.WriteString(EncodeList(records))
+	sb.WriteByte('\n')
+	return sb.String()
+}
+
+// EncodeRecord кодирует запись: поля экранируются и соединяются через |
+func EncodeRecord(r Record) string {
+	escaped := make([]string, len(r))
+	for i, field := range r {
+		escaped[i] = Escape(field)
+	}
+	return strings.Join(escaped, "|")
+}
+
+// EncodeList кодирует список записей, записи разделяются запятой
+func EncodeList(records []Record) string {
+	items := make([]string, len(records))
+	for i, r := range records {
+		items[i] = EncodeRecord(r)
+	}
+	return strings.Join(items, ",")
+}
+
+// DecodeList раскодирует список записей, закодированный EncodeList
+func DecodeList(raw string) []Record {
+	if raw == "" {
+		return nil
+	}
+	items := splitUnescaped(raw, ',')
+	records := make([]Record, 0, len(items))
+	for _, item := range items {
+		records = append(records, DecodeRecord(item))
+	}
+	return records
+}
+
+// DecodeRecord раскодирует одну запись списка
+func DecodeRecord(raw string) Record {
+	parts := splitUnescaped(raw, '|')
+	record := make(Record, len(parts))
+	for i, part := range parts {
+		record[i] = Unescape(part)
+	}
+	return record
+}
+
+// SplitLine разбивает строку пакета на поля с учётом типа пакета.
+// Для обычных пакетов все поля раскодируются.
+// Для пакетов со списком (см. ListHeader) раскодируются тип и поля заголовка,
+// а последним элементом возвращается закодированный список целиком,
+// который затем разбирается через DecodeList.
+func SplitLine(line string) []string {
+	line = strings.TrimSuffix(line, "\n")
+	line = strings.TrimSuffix(line, "\r")
+
+	pktType, rest, hasRest := cutUnescaped(line, '|')
+	parts := []string{Unescape(pktType)}
+	if !hasRest {
+		return parts
+	}
+
+	header, isList := ListHeader(parts[0])
+	if !isList {
+		for _, field := range splitUnescaped(rest, '|') {
+			parts = append(parts, Unescape(field))
+		}
+		return parts
+	}
+
+	for i := 0; i < header; i++ {
+		var field string
+		field, rest, hasRest = cutUnescaped(rest, '|')
+		parts = append(parts, Unescape(field))
+		if !hasRest {
+			return parts
+		}
+	}
+	return append(parts, rest)
+}
+
+// cutUnescaped разрезает строку по первому неэкранированному разделителю
+func cutUnescaped(s string, delimiter byte) (before, after string, found bool) {
+	escape := false
+	for i := 0; i < len(s); i++ {
+		if escape {
+			escape = false
+			continue
+		}
+		switch s[i] {
+		case '\\':
+			escape = true
+		case delimiter:
+			return s[:i], s[i+1:], true
+		}
+	}
+	return s, "", false
+}
@@ -0,0 +1,152 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestHistoryRoundTrip проверяет кодирование и разбор истории со спецсимволами
+func TestHistoryRoundTrip(t *testing.T) {
+	pkt := &HistoryPacket{
+		Contact: "user|2,x",
+		Entries: []HistoryEntry{
+			{Sender: "user1", Text: "Hello|World, with\\slash\nand newline", Timestamp: "2024-01-01T12:00:00Z", Status: "ackn"},
+			{Sender: "user|2,x", Text: "", Timestamp: "2024-01-01T12:01:00Z", Status: "sent"},
+		},
+	}
+
+	line := pkt.Encode()
+	decoded, err := DecodeHistory(line)
+	if err != nil {
+		t.Fatalf("DecodeHistory failed: %v", err)
+	}
+
+	if !reflect.DeepEqual(pkt, decoded) {
+		t.Errorf("Expected %+v, got %+v", pkt, decoded)
+	}
+}
+
+// TestHistoryWireFormat проверяет, что формат на проводе совпадает со спецификацией
+func TestHistoryWireFormat(t *testing.T) {
+	pkt := &HistoryPacket{
+		Contact: "friend",
+		Entries: []HistoryEntry{
+			{Sender: "me", Text: "a|b", Timestamp: "2024-01-01T12:00:00Z", Status: "ackn"},
+			{Sender: "friend", Text: "c,d", Timestamp: "2024-01-01T12:01:00Z", Status: "sent"},
+		},
+	}
+
+	expected := "hist|friend|msg|me|a\\|b|2024-01-01T12:00:00Z|ackn,msg|friend|c\\,d|2024-01-01T12:01:00Z|sent\n"
+	if got := pkt.Encode(); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
+
+// TestEmptyLists проверяет кодирование пустых списков
+func TestEmptyLists(t *testing.T) {
+	tests := []struct {
+		pkt      Encoder
+		expected string
+	}{
+		{&StatusPacket{}, "stat|\n"},
+		{&ListPacket{}, "list|\n"},
+		{&OfflinePacket{}, "offmsg|\n"},
+		{&HistoryPacket{Contact: "friend"}, "hist|friend|\n"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.pkt.Encode(); got != tt.expected {
+			t.Errorf("Expected %q, got %q", tt.expected, got)
+		}
+	}
+
+	status, err := DecodeStatus("stat|\n")
+	if err != nil {
+		t.Fatalf("DecodeStatus failed: %v", err)
+	}
+	if len(status.Entries) != 0 {
+		t.Errorf("Expected no entries, got %+v", status.Entries)
+	}
+}
+
+// TestListRoundTrips проверяет кодирование и разбор stat, list, offmsg и help
+func TestListRoundTrips(t *testing.T) {
+	status := &StatusPacket{Entries: []StatusEntry{
+		{User: "a,b", Status: "on", LastSeen: "2024-01-01T12:00:00Z"},
+		{User: "c|d", Status: "off", LastSeen: "2024-01-01T11:00:00Z"},
+		{User: "robot", Status: "on", LastSeen: "2024-01-01T10:00:00Z", Bot: true},
+	}}
+	decodedStatus, err := DecodeStatus(status.Encode())
+	if err != nil || !reflect.DeepEqual(status, decodedStatus) {
+		t.Errorf("Status round trip failed: %v, %+v", err, decodedStatus)
+	}
+
+	list := &ListPacket{Entries: []ContactEntry{
+		{Login: "friend", Nick: "Best, friend"},
+		{Login: "other", Nick: "pipe|nick"},
+		{Login: "robot", Nick: "Robot", Bot: true},
+	}}
+	decodedList, err := DecodeContacts(list.Encode())
+	if err != nil || !reflect.DeepEqual(list, decodedList) {
+		t.Errorf("List round trip failed: %v, %+v", err, decodedList)
+	}
+
+	offline := &OfflinePacket{Entries: []OfflineEntry{{Contact: "friend", Count: 5}}}
+	decodedOffline, err := DecodeOffline(offline.Encode())
+	if err != nil || !reflect.DeepEqual(offline, decodedOffline) {
+		t.Errorf("Offline round trip failed: %v, %+v", err, decodedOffline)
+	}
+
+	help := &HelpPacket{Commands: []string{"ping", "auth", "msg"}}
+	decodedHelp, err := DecodeHelp(help.Encode())
+	if err != nil || !reflect.DeepEqual(help, decodedHelp) {
+		t.Errorf("Help round trip failed: %v, %+v", err, decodedHelp)
+	}
+
+	info := &InfoPacket{
+		Name:                "mSIM, test",
+		Version:             "1.2.3",
+		Uptime:              3600,
+		MaxLine:             65536,
+		MaxMessage:          4096,
+		FileAcceptTimeout:   300,
+		FileTransferTimeout: 600,
+		Features:            []string{"files", "websocket"},
+	}
+	decodedInfo, err := DecodeInfo(info.Encode())
+	if err != nil || !reflect.DeepEqual(info, decodedInfo) {
+		t.Errorf("Info round trip failed: %v, %+v", err, decodedInfo)
+	}
+	// Ключи новых версий сервера пропускаются
+	if decoded, err := DecodeInfo("info|name|mSIM,max_upload|100\n"); err != nil || decoded.Name != "mSIM" {
+		t.Errorf("Expected unknown keys to be skipped, got %v, %+v", err, decoded)
+	}
+}
+
+// TestSplitLine проверяет разбиение обычных пакетов и пакетов со списком
+func TestSplitLine(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected []string
+	}{
+		{"ping\n", []string{"ping"}},
+		{"msg|sender|a\\|b|2024-01-01T12:00:00Z\n", []string{"msg", "sender", "a|b", "2024-01-01T12:00:00Z"}},
+		{"stat|\n", []string{"stat", ""}},
+		{"stat|u1|on|t1,u2|off|t2\n", []string{"stat", "u1|on|t1,u2|off|t2"}},
+		{"hist|fr\\|iend|msg|a|b\\|c|t|ackn\n", []string{"hist", "fr|iend", "msg|a|b\\|c|t|ackn"}},
+		{"fail|stat|User not found\n", []string{"fail", "stat", "User not found"}},
+	}
+
+	for _, tt := range tests {
+		if got := SplitLine(tt.line); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("SplitLine(%q): expected %q, got %q", tt.line, tt.expected, got)
+		}
+	}
+}
+
+// TestDecodeWrongType проверяет, что декодер отклоняет пакет другого типа
+func TestDecodeWrongType(t *testing.T) {
+	if _, err := DecodeHistory("stat|\n"); err != ErrInvalidPacket {
+		t.Errorf("Expected ErrInvalidPacket, got %v", err)
+	}
+}
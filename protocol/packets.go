@@ -0,0 +1,352 @@
+package protocol
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Encoder — пакет, который умеет сериализоваться в строку протокола
+type Encoder interface {
+	Encode() string
+}
+
+// MessagePacket — входящее сообщение msg|sender|text|timestamp
+type MessagePacket struct {
+	Sender    string
+	Text      string
+	Timestamp string
+}
+
+// Encode сериализует сообщение
+func (p *MessagePacket) Encode() string {
+	return FormatFields(TypeMsg, p.Sender, p.Text, p.Timestamp)
+}
+
+// DecodeMessage разбирает строку msg|sender|text|timestamp
+func DecodeMessage(line string) (*MessagePacket, error) {
+	parts := SplitLine(line)
+	if parts[0] != TypeMsg || len(parts) < 4 {
+		return nil, ErrInvalidPacket
+	}
+	return &MessagePacket{Sender: parts[1], Text: parts[2], Timestamp: parts[3]}, nil
+}
+
+// HistoryEntry — сообщение в ответе hist
+type HistoryEntry struct {
+	Sender    string
+	Text      string
+	Timestamp string
+	Status    string // "sent" или "ackn"
+}
+
+// HistoryPacket — ответ hist|contact|msg|sender|text|timestamp|status,...
+type HistoryPacket struct {
+	Contact string
+	Entries []HistoryEntry
+}
+
+// Encode сериализует историю сообщений
+func (p *HistoryPacket) Encode() string {
+	records := make([]Record, len(p.Entries))
+	for i, e := range p.Entries {
+		records[i] = Record{TypeMsg, e.Sender, e.Text, e.Timestamp, e.Status}
+	}
+	return FormatList(TypeHist, []string{p.Contact}, records)
+}
+
+// DecodeHistoryEntries разбирает список сообщений из ответа hist
+func DecodeHistoryEntries(raw string) []HistoryEntry {
+	var entries []HistoryEntry
+	for _, r := range DecodeList(raw) {
+		if len(r) >= 5 && r[0] == TypeMsg {
+			entries = append(entries, HistoryEntry{
+				Sender:    r[1],
+				Text:      r[2],
+				Timestamp: r[3],
+				Status:    r[4],
+			})
+		}
+	}
+	return entries
+}
+
+// DecodeHistory разбирает строку ответа hist
+func DecodeHistory(line string) (*HistoryPacket, error) {
+	head, raw, err := splitListLine(line, TypeHist)
+	if err != nil {
+		return nil, err
+	}
+	return &HistoryPacket{Contact: head[0], Entries: DecodeHistoryEntries(raw)}, nil
+}
+
+// StatusEntry — статус пользователя в ответе stat
+type StatusEntry struct {
+	User     string
+	Status   string // "on" или "off"
+	LastSeen string // ISO 8601, может быть пустым у старых серверов
+	Bot      bool   // бот-аккаунт, передаётся четвёртым полем "bot"
+}
+
+// Online возвращает true, если пользователь в сети
+func (e StatusEntry) Online() bool {
+	return e.Status == TypeOn
+}
+
+// Значение дополнительного поля записи stat и list для бот-аккаунтов
+const botMarker = "bot"
+
+// StatusPacket — ответ stat|user|status|last_seen[|bot],...
+type StatusPacket struct {
+	Entries []StatusEntry
+}
+
+// Encode сериализует список статусов
+func (p *StatusPacket) Encode() string {
+	records := make([]Record, len(p.Entries))
+	for i, e := range p.Entries {
+		records[i] = Record{e.User, e.Status, e.LastSeen}
+		if e.Bot {
+			records[i] = append(records[i], botMarker)
+		}
+	}
+	return FormatList(TypeStat, nil, records)
+}
+
+// DecodeStatusEntries разбирает список статусов из ответа stat
+func DecodeStatusEntries(raw string) []StatusEntry {
+	var entries []StatusEntry
+	for _, r := range DecodeList(raw) {
+		if len(r) >= 2 {
+			e := StatusEntry{User: r[0], Status: r[1]}
+			if len(r) >= 3 {
+				e.LastSeen = r[2]
+			}
+			e.Bot = len(r) >= 4 && r[3] == botMarker
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// DecodeStatus разбирает строку ответа stat
+func DecodeStatus(line string) (*StatusPacket, error) {
+	_, raw, err := splitListLine(line, TypeStat)
+	if err != nil {
+		return nil, err
+	}
+	return &StatusPacket{Entries: DecodeStatusEntries(raw)}, nil
+}
+
+// ContactEntry — контакт в ответе list
+type ContactEntry struct {
+	Login string
+	Nick  string
+	Bot   bool // бот-аккаунт, передаётся третьим полем "bot"
+}
+
+// ListPacket — ответ list|contact|nick[|bot],...
+type ListPacket struct {
+	Entries []ContactEntry
+}
+
+// Encode сериализует список контактов
+func (p *ListPacket) Encode() string {
+	records := make([]Record, len(p.Entries))
+	for i, e := range p.Entries {
+		records[i] = Record{e.Login, e.Nick}
+		if e.Bot {
+			records[i] = append(records[i], botMarker)
+		}
+	}
+	return FormatList(TypeList, nil, records)
+}
+
+// DecodeContactEntries разбирает список контактов из ответа list
+func DecodeContactEntries(raw string) []ContactEntry {
+	var entries []ContactEntry
+	for _, r := range DecodeList(raw) {
+		if len(r) >= 2 {
+			entries = append(entries, ContactEntry{Login: r[0], Nick: r[1], Bot: len(r) >= 3 && r[2] == botMarker})
+		}
+	}
+	return entries
+}
+
+// DecodeContacts разбирает строку ответа list
+func DecodeContacts(line string) (*ListPacket, error) {
+	_, raw, err := splitListLine(line, TypeList)
+	if err != nil {
+		return nil, err
+	}
+	return &ListPacket{Entries: DecodeContactEntries(raw)}, nil
+}
+
+// OfflineEntry — количество оффлайн-сообщений от контакта в ответе offmsg
+type OfflineEntry struct {
+	Contact string
+	Count   int
+}
+
+// OfflinePacket — ответ offmsg|contact|count,...
+type OfflinePacket struct {
+	Entries []OfflineEntry
+}
+
+// Encode сериализует счётчики оффлайн-сообщений
+func (p *OfflinePacket) Encode() string {
+	records := make([]Record, len(p.Entries))
+	for i, e := range p.Entries {
+		records[i] = Record{e.Contact, strconv.Itoa(e.Count)}
+	}
+	return FormatList(TypeOffmsg, nil, records)
+}
+
+// DecodeOfflineEntries разбирает список счётчиков из ответа offmsg.
+// Записи с нулевым или некорректным количеством пропускаются.
+func DecodeOfflineEntries(raw string) []OfflineEntry {
+	var entries []OfflineEntry
+	for _, r := range DecodeList(raw) {
+		if len(r) >= 2 {
+			count, err := strconv.Atoi(r[1])
+			if err == nil && count > 0 {
+				entries = append(entries, OfflineEntry{Contact: r[0], Count: count})
+			}
+		}
+	}
+	return entries
+}
+
+// DecodeOffline разбирает строку ответа offmsg
+func DecodeOffline(line string) (*OfflinePacket, error) {
+	_, raw, err := splitListLine(line, TypeOffmsg)
+	if err != nil {
+		return nil, err
+	}
+	return &OfflinePacket{Entries: DecodeOfflineEntries(raw)}, nil
+}
+
+// HelpPacket — ответ help|command1,command2,...
+type HelpPacket struct {
+	Commands []string
+}
+
+// Encode сериализует список команд
+func (p *HelpPacket) Encode() string {
+	records := make([]Record, len(p.Commands))
+	for i, cmd := range p.Commands {
+		records[i] = Record{cmd}
+	}
+	return FormatList(TypeHelp, nil, records)
+}
+
+// DecodeHelp разбирает строку ответа help
+func DecodeHelp(line string) (*HelpPacket, error) {
+	_, raw, err := splitListLine(line, TypeHelp)
+	if err != nil {
+		return nil, err
+	}
+	p := &HelpPacket{}
+	for _, r := range DecodeList(raw) {
+		if len(r) >= 1 {
+			p.Commands = append(p.Commands, r[0])
+		}
+	}
+	return p, nil
+}
+
+// Ключи записей ответа info
+const (
+	InfoName                = "name"
+	InfoVersion             = "version"
+	InfoUptime              = "uptime"
+	InfoMaxLine             = "max_line"
+	InfoMaxMessage          = "max_message"
+	InfoFileAcceptTimeout   = "file_accept_timeout"
+	InfoFileTransferTimeout = "file_transfer_timeout"
+	InfoFeatures            = "features"
+)
+
+// InfoPacket — ответ info|key|value,key|value,...
+// Длительности передаются в секундах, нулевой лимит означает его отсутствие.
+// Неизвестные ключи при разборе пропускаются, поэтому сервер может добавлять новые.
+type InfoPacket struct {
+	Name                string
+	Version             string
+	Uptime              int // секунды
+	MaxLine             int // байты строки пакета
+	MaxMessage          int // символы текста сообщения
+	FileAcceptTimeout   int // секунды на принятие файла
+	FileTransferTimeout int // секунды на передачу файла
+	Features            []string
+}
+
+// Encode сериализует сведения о сервере
+func (p *InfoPacket) Encode() string {
+	records := []Record{
+		{InfoName, p.Name},
+		{InfoVersion, p.Version},
+		{InfoUptime, strconv.Itoa(p.Uptime)},
+		{InfoMaxLine, strconv.Itoa(p.MaxLine)},
+		{InfoMaxMessage, strconv.Itoa(p.MaxMessage)},
+		{InfoFileAcceptTimeout, strconv.Itoa(p.FileAcceptTimeout)},
+		{InfoFileTransferTimeout, strconv.Itoa(p.FileTransferTimeout)},
+		{InfoFeatures, strings.Join(p.Features, ",")},
+	}
+	return FormatList(TypeInfo, nil, records)
+}
+
+// DecodeInfo разбирает строку ответа info
+func DecodeInfo(line string) (*InfoPacket, error) {
+	_, raw, err := splitListLine(line, TypeInfo)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeInfoRecords(raw), nil
+}
+
+// DecodeInfoRecords разбирает список записей key|value из ответа info
+func DecodeInfoRecords(raw string) *InfoPacket {
+	p := &InfoPacket{}
+	ints := map[string]*int{
+		InfoUptime:              &p.Uptime,
+		InfoMaxLine:             &p.MaxLine,
+		InfoMaxMessage:          &p.MaxMessage,
+		InfoFileAcceptTimeout:   &p.FileAcceptTimeout,
+		InfoFileTransferTimeout: &p.FileTransferTimeout,
+	}
+	for _, r := range DecodeList(raw) {
+		if len(r) < 2 {
+			continue
+		}
+		switch r[0] {
+		case InfoName:
+			p.Name = r[1]
+		case InfoVersion:
+			p.Version = r[1]
+		case InfoFeatures:
+			if r[1] != "" {
+				p.Features = strings.Split(r[1], ",")
+			}
+		default:
+			if v, ok := ints[r[0]]; ok {
+				*v, _ = strconv.Atoi(r[1])
+			}
+		}
+	}
+	return p
+}
+
+// splitListLine разбирает строку пакета со списком ожидаемого типа
+// и возвращает поля заголовка и закодированный список
+func splitListLine(line, pktType string) (head []string, raw string, err error) {
+	header, _ := ListHeader(pktType)
+	parts := SplitLine(line)
+	if parts[0] != pktType || len(parts) < header+1 {
+		return nil, "", ErrInvalidPacket
+	}
+	head = parts[1 : header+1]
+	if len(parts) > header+1 {
+		raw = parts[header+1]
+	}
+	return head, raw, nil
+}
@@ -26,21 +26,21 @@ func ParsePacket(line string) (*Packet, error) {
 	}
 
 	pkt := &Packet{
-		Type: unescape(parts[0]),
+		Type: Unescape(parts[0]),
 	}
 
 	if len(parts) == 2 {
 		// TYPE|CONTENT (для сервера)
-		pkt.Content = unescape(parts[1])
+		pkt.Content = Unescape(parts[1])
 		pkt.Fields = splitUnescaped(pkt.Content, '|')
 	} else if len(parts) >= 3 {
 		// TYPE|DESTINATION|CONTENT or TYPE|DESTINATION|FIELD1|FIELD2|...
-		pkt.Destination = unescape(parts[1])
+		pkt.Destination = Unescape(parts[1])
 		// Content is everything after destination
 		// Unescape each part and store in Fields
 		pkt.Fields = make([]string, len(parts)-2)
 		for i := 2; i < len(parts); i++ {
-			pkt.Fields[i-2] = unescape(parts[i])
+			pkt.Fields[i-2] = Unescape(parts[i])
 		}
 		// Content is the joined fields (for backwards compatibility)
 		pkt.Content = strings.Join(pkt.Fields, "|")
@@ -104,8 +104,8 @@ func splitUnescaped(s string, delimiter rune) []string {
 	return parts
 }
 
-// unescape раскодирует экранированные символы
-func unescape(s string) string {
+// Unescape раскодирует экранированные символы
+func Unescape(s string) string {
 	var result strings.Builder
 	escape := false
 
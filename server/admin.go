@@ -0,0 +1,253 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"msim/db"
+	"sort"
+	"time"
+)
+
+// Ошибки команд управляющего сокета
+var (
+	ErrUnknownUser  = errors.New("user not found")
+	ErrNotConnected = errors.New("user is not connected")
+	ErrBotAccount   = errors.New("bot accounts log in with API keys")
+)
+
+// SessionInfo описывает подключённого пользователя для управляющего сокета
+type SessionInfo struct {
+	Login       string    `json:"login"`
+	ID          string    `json:"session"`
+	Remote      string    `json:"remote"`
+	Bot         bool      `json:"bot"`
+	ConnectedAt time.Time `json:"connected_at"`
+	LastActive  time.Time `json:"last_active"`
+}
+
+// Sessions возвращает авторизованные сессии, отсортированные по логину
+func (s *Server) Sessions() []SessionInfo {
+	s.mu.RLock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	s.mu.RUnlock()
+
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, sess := range sessions {
+		sess.mu.Lock()
+		lastActive := sess.LastPing
+		sess.mu.Unlock()
+		infos = append(infos, SessionInfo{
+			Login:       sess.Login,
+			ID:          sess.ID,
+			Remote:      sess.Conn.RemoteAddr().String(),
+			Bot:         sess.Bot,
+			ConnectedAt: sess.ConnectedAt,
+			LastActive:  lastActive,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Login < infos[j].Login })
+	return infos
+}
+
+// Kick отключает пользователя пакетом bye|kicked|reason.
+// Сессию удаляет обработчик соединения, как при обычном разрыве.
+func (s *Server) Kick(login, reason string) error {
+	session, ok := s.getSession(login)
+	if !ok {
+		return ErrNotConnected
+	}
+	s.sendBye(session.Conn, "kicked", reason)
+	session.Conn.Close()
+	session.logger().Info("Client kicked", "reason", reason)
+	return nil
+}
+
+// Broadcast отправляет системное сообщение sys|timestamp|text всем
+// подключённым пользователям или только перечисленным в logins.
+// Возвращает число сессий, получивших сообщение; офлайн-пользователям оно не сохраняется.
+func (s *Server) Broadcast(text string, logins []string) int {
+	var sessions []*Session
+	s.mu.RLock()
+	if len(logins) == 0 {
+		for _, sess := range s.sessions {
+			sessions = append(sessions, sess)
+		}
+	} else {
+		for _, login := range logins {
+			if sess, ok := s.sessions[login]; ok {
+				sessions = append(sessions, sess)
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	ts := time.Now().UTC().Format(time.RFC3339)
+	for _, sess := range sessions {
+		s.sendPacket(sess.Conn, "sys", ts, text)
+	}
+	return len(sessions)
+}
+
+// CreateUser создаёт обычный аккаунт. Если пароль пустой, он генерируется;
+// возвращается пароль, с которым создан аккаунт.
+func (s *Server) CreateUser(login, password string) (string, error) {
+	if !s.validLogin(login) {
+		return "", ErrInvalidLogin
+	}
+	exists, err := s.db.UserExists(login)
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return "", ErrUserExists
+	}
+	if password == "" {
+		if password, err = generatePassword(); err != nil {
+			return "", err
+		}
+	}
+	return password, s.db.CreateUser(login, password)
+}
+
+// ResetPassword задаёт новый пароль обычного аккаунта, пустой — генерирует.
+// Ботам вместо пароля выпускаются ключи, см. IssueAPIKey.
+func (s *Server) ResetPassword(login, password string) (string, error) {
+	bot, err := s.db.IsBot(login)
+	if err != nil {
+		return "", err
+	}
+	if bot {
+		return "", ErrBotAccount
+	}
+	if password == "" {
+		if password, err = generatePassword(); err != nil {
+			return "", err
+		}
+	}
+	err = s.db.SetPassword(login, password)
+	if err == db.ErrNoRows {
+		return "", ErrUnknownUser
+	}
+	return password, err
+}
+
+// SetUserDisabled блокирует или разблокирует аккаунт. Заблокированный
+// пользователь отключается, его токены API отзываются.
+func (s *Server) SetUserDisabled(login string, disabled bool) error {
+	err := s.db.SetUserDisabled(login, disabled)
+	if err == db.ErrNoRows {
+		return ErrUnknownUser
+	}
+	if err != nil || !disabled {
+		return err
+	}
+	s.apiTokens.revokeLogin(login)
+	if err := s.Kick(login, "Account disabled"); err != nil && err != ErrNotConnected {
+		return err
+	}
+	return nil
+}
+
+// generatePassword возвращает случайный пароль из 16 символов
+func generatePassword() (string, error) {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// TransferInfo описывает активную передачу файла для управляющего сокета
+type TransferInfo struct {
+	ID        string    `json:"id"`
+	Sender    string    `json:"sender"`
+	Recipient string    `json:"recipient"`
+	Filename  string    `json:"filename"`
+	Size      int64     `json:"size"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Transfers возвращает ожидающие и идущие передачи файлов, старые первыми.
+// Имя файла скрывается, если filename входит в LogRedact.
+func (s *Server) Transfers() []TransferInfo {
+	active := s.fileManager.Active()
+	infos := make([]TransferInfo, 0, len(active))
+	for _, fs := range active {
+		fs.mu.Lock()
+		infos = append(infos, TransferInfo{
+			ID:        fs.ID,
+			Sender:    fs.Sender,
+			Recipient: fs.Recipient,
+			Filename:  s.redact("filename", fs.Filename),
+			Size:      fs.Size,
+			Status:    fs.Status,
+			CreatedAt: fs.CreatedAt,
+			ExpiresAt: fs.ExpiresAt,
+		})
+		fs.mu.Unlock()
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].CreatedAt.Before(infos[j].CreatedAt) })
+	return infos
+}
+
+// CancelTransfer отменяет передачу файла и уведомляет обе стороны пакетом fcan
+func (s *Server) CancelTransfer(id, reason string) error {
+	fs, ok := s.fileManager.GetSession(id)
+	if !ok {
+		return ErrSessionNotFound
+	}
+	if err := s.fileManager.CancelSession(id); err != nil {
+		return err
+	}
+	if conn, ok := s.getSessionConn(fs.Sender); ok {
+		s.sendPacket(conn, "fcan", fs.Recipient, id, reason)
+	}
+	if conn, ok := s.getSessionConn(fs.Recipient); ok {
+		s.sendPacket(conn, "fcan", fs.Sender, id, reason)
+	}
+	return nil
+}
+
+// Counts возвращает число записей в основных таблицах базы
+func (s *Server) Counts() (*db.Counts, error) {
+	return s.db.GetCounts()
+}
+
+// Stats — статистика сервера для команды stats
+type Stats struct {
+	Connections int              `json:"connections"`
+	Users       []string         `json:"users"`
+	Commands    map[string]int64 `json:"commands"`
+	Limited     map[string]int64 `json:"limited"`
+	Floods      int64            `json:"floods"`
+}
+
+// Stats возвращает то же, что GetStats, в виде структуры
+func (s *Server) Stats() Stats {
+	s.mu.RLock()
+	users := make([]string, 0, len(s.sessions))
+	for login := range s.sessions {
+		users = append(users, login)
+	}
+	s.mu.RUnlock()
+	sort.Strings(users)
+
+	commands := make(map[string]int64)
+	for name, st := range s.metrics.snapshot() {
+		commands[name] = st.Count
+	}
+	limited, floods := s.limiter.counters()
+	return Stats{
+		Connections: len(users),
+		Users:       users,
+		Commands:    commands,
+		Limited:     limited,
+		Floods:      floods,
+	}
+}
@@ -0,0 +1,645 @@
+package server
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"msim/db"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ограничения HTTP API
+const (
+	apiDefaultHistoryLimit = 100
+	apiMaxHistoryLimit     = 1000
+	apiMaxBodySize         = 64 * 1024
+)
+
+// apiTokens хранит выданные bearer-токены в памяти: после перезапуска
+// сервера клиентам нужно войти заново
+type apiTokens struct {
+	mu     sync.Mutex
+	tokens map[string]apiToken
+}
+
+type apiToken struct {
+	login     string
+	expiresAt time.Time
+}
+
+// issue выдаёт новый токен для login
+func (t *apiTokens) issue(login string, ttl time.Duration) (string, time.Time, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", time.Time{}, err
+	}
+	token := hex.EncodeToString(buf)
+	expiresAt := time.Now().Add(ttl).UTC()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.tokens == nil {
+		t.tokens = make(map[string]apiToken)
+	}
+	// Заодно убираем истёкшие токены
+	now := time.Now()
+	for key, tok := range t.tokens {
+		if now.After(tok.expiresAt) {
+			delete(t.tokens, key)
+		}
+	}
+	t.tokens[token] = apiToken{login: login, expiresAt: expiresAt}
+	return token, expiresAt, nil
+}
+
+// lookup возвращает логин владельца действующего токена
+func (t *apiTokens) lookup(token string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tok, ok := t.tokens[token]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(tok.expiresAt) {
+		delete(t.tokens, token)
+		return "", false
+	}
+	return tok.login, true
+}
+
+// revoke отзывает токен
+func (t *apiTokens) revoke(token string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.tokens, token)
+}
+
+// revokeLogin отзывает все токены пользователя
+func (t *apiTokens) revokeLogin(login string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for token, tok := range t.tokens {
+		if tok.login == login {
+			delete(t.tokens, token)
+		}
+	}
+}
+
+// StartAPI запускает HTTP/JSON API
+func (s *Server) StartAPI() error {
+	srv := &http.Server{
+		Addr:              ":" + strconv.Itoa(s.cfg().APIPort),
+		Handler:           s.apiHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		return nil
+	}
+	s.apiServer = srv
+	s.mu.Unlock()
+
+	slog.Info("HTTP API started", "port", s.cfg().APIPort)
+
+	listener, err := s.listen("api", s.cfg().APIPort)
+	if err != nil {
+		return err
+	}
+	err = srv.Serve(listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// apiHandlerFunc — обработчик запроса авторизованного пользователя
+type apiHandlerFunc func(w http.ResponseWriter, r *http.Request, login string)
+
+func (s *Server) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/login", s.apiLogin)
+	mux.HandleFunc("/api/v1/logout", s.withAPIToken("", s.apiLogout))
+	mux.HandleFunc("/api/v1/messages", s.withAPIToken(rateClassMsg, s.apiSendMessage))
+	mux.HandleFunc("/api/v1/messages/", s.withAPIToken(rateClassQuery, s.apiHistory))
+	mux.HandleFunc("/api/v1/acks", s.withAPIToken(rateClassMsg, s.apiAck))
+	mux.HandleFunc("/api/v1/contacts", s.withAPIToken(rateClassQuery, s.apiContacts))
+	mux.HandleFunc("/api/v1/contacts/", s.withAPIToken(rateClassQuery, s.apiContact))
+	mux.HandleFunc("/api/v1/statuses", s.withAPIToken(rateClassQuery, s.apiStatuses))
+	mux.HandleFunc("/api/v1/files", s.withAPIToken(rateClassFile, s.apiFileOffers))
+	mux.HandleFunc("/api/v1/events", s.withAPIToken(rateClassQuery, s.apiEvents))
+	mux.HandleFunc("/api/v1/webhooks", s.withAPIToken(rateClassQuery, s.apiWebhookOptIn))
+	return mux
+}
+
+// withAPIToken пропускает только запросы с действующим токеном в заголовке Authorization.
+// Запросы считаются в тех же классах ограничения частоты, что и команды протокола,
+// по логину и адресу клиента; пустой class — без ограничений.
+func (s *Server) withAPIToken(class string, next apiHandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := bearerToken(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAPIError(w, http.StatusUnauthorized, codeNotAuth, "Bearer token required")
+			return
+		}
+		login, ok := s.apiTokens.lookup(token)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeAPIError(w, http.StatusUnauthorized, codeNotAuth, "Invalid or expired token")
+			return
+		}
+		if class != "" && !s.limiter.allow(class, nil, login, requestIP(r)) {
+			writeAPIError(w, http.StatusTooManyRequests, codeRateLimit, "Too many requests")
+			return
+		}
+		next(w, r, login)
+	}
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", false
+	}
+	return strings.TrimSpace(header[len(prefix):]), true
+}
+
+// POST /api/v1/login {"login": "...", "password": "..."}
+func (s *Server) apiLogin(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+
+	var req struct {
+		Login    string `json:"login"`
+		Password string `json:"password"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Login == "" || req.Password == "" {
+		writeAPIError(w, http.StatusBadRequest, codeBadCredentials, "Invalid credentials")
+		return
+	}
+	if !s.limiter.allow(rateClassAuth, nil, "", requestIP(r)) {
+		writeAPIError(w, http.StatusTooManyRequests, codeRateLimit, "Too many requests")
+		return
+	}
+
+	logger := slog.With("remote", r.RemoteAddr, "login", req.Login)
+	if _, err := s.login(logger, req.Login, req.Password, requestIP(r), "api"); err != nil {
+		var locked *lockedError
+		if errors.As(err, &locked) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(locked.until).Seconds())+1))
+		}
+		writeAPIError(w, apiErrorStatus(err), errorCode(err), err.Error())
+		return
+	}
+
+	token, expiresAt, err := s.apiTokens.issue(req.Login, s.cfg().APITokenTTL)
+	if err != nil {
+		logger.Error("API token error", "err", err)
+		writeAPIError(w, http.StatusInternalServerError, codeInternal, "Internal error")
+		return
+	}
+
+	logger.Info("API login")
+	writeJSON(w, http.StatusOK, map[string]string{
+		"token":      token,
+		"expires_at": expiresAt.Format(time.RFC3339),
+	})
+}
+
+// POST /api/v1/logout
+func (s *Server) apiLogout(w http.ResponseWriter, r *http.Request, login string) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	token, _ := bearerToken(r)
+	s.apiTokens.revoke(token)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiMessage — сообщение истории в ответах API
+type apiMessage struct {
+	Sender    string `json:"sender"`
+	Text      string `json:"text"`
+	Timestamp string `json:"timestamp"`
+	Status    string `json:"status"`
+}
+
+// POST /api/v1/messages {"to": "...", "text": "..."}
+func (s *Server) apiSendMessage(w http.ResponseWriter, r *http.Request, login string) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+
+	var req struct {
+		To   string `json:"to"`
+		Text string `json:"text"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.To == "" {
+		writeAPIError(w, http.StatusBadRequest, codeInvalid, "Recipient required")
+		return
+	}
+	if req.Text == "" {
+		writeAPIError(w, http.StatusBadRequest, codeInvalid, "Message text required")
+		return
+	}
+
+	timestamp, err := s.deliverMessage(login, req.To, req.Text)
+	if err != nil {
+		writeAPIError(w, apiErrorStatus(err), errorCode(err), err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, apiMessage{
+		Sender:    login,
+		Text:      req.Text,
+		Timestamp: timestamp.Format("2006-01-02T15:04:05Z"),
+		Status:    "sent",
+	})
+}
+
+// GET /api/v1/messages/{contact}?offset=0&limit=100
+func (s *Server) apiHistory(w http.ResponseWriter, r *http.Request, login string) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	contact := strings.TrimPrefix(r.URL.Path, "/api/v1/messages/")
+	if contact == "" || strings.Contains(contact, "/") {
+		writeAPIError(w, http.StatusNotFound, codeInvalid, "Contact required")
+		return
+	}
+
+	offset, ok := queryInt(w, r, "offset", 0)
+	if !ok {
+		return
+	}
+	limit, ok := queryInt(w, r, "limit", apiDefaultHistoryLimit)
+	if !ok {
+		return
+	}
+	if limit == 0 {
+		writeAPIError(w, http.StatusBadRequest, codeInvalid, "Invalid limit")
+		return
+	}
+	if limit > apiMaxHistoryLimit {
+		limit = apiMaxHistoryLimit
+	}
+
+	messages, err := s.db.GetMessages(login, contact, offset, limit)
+	if err != nil {
+		slog.Error("API history error", "login", login, "err", err)
+		writeAPIError(w, http.StatusInternalServerError, codeInternal, "Internal error")
+		return
+	}
+
+	result := make([]apiMessage, 0, len(messages))
+	for _, msg := range messages {
+		result = append(result, apiMessage{
+			Sender:    msg.Sender,
+			Text:      msg.Text,
+			Timestamp: msg.Timestamp.Format("2006-01-02T15:04:05Z"),
+			Status:    msg.Status,
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"contact":  contact,
+		"offset":   offset,
+		"limit":    limit,
+		"messages": result,
+	})
+}
+
+// POST /api/v1/acks {"sender": "...", "timestamp": "..."}
+func (s *Server) apiAck(w http.ResponseWriter, r *http.Request, login string) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+
+	var req struct {
+		Sender    string `json:"sender"`
+		Timestamp string `json:"timestamp"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Sender == "" || req.Timestamp == "" {
+		writeAPIError(w, http.StatusBadRequest, codeInvalid, "Invalid ack format")
+		return
+	}
+
+	if err := s.acknowledgeMessage(login, req.Sender, req.Timestamp); err != nil {
+		writeAPIError(w, apiErrorStatus(err), errorCode(err), err.Error())
+		return
+	}
+
+	// Пересылаем подтверждение отправителю сообщения
+	if senderConn, ok := s.getSessionConn(req.Sender); ok {
+		s.sendPacket(senderConn, "ack", login, req.Timestamp)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiContact — контакт в ответах API
+type apiContact struct {
+	Login string `json:"login"`
+	Nick  string `json:"nick"`
+	Bot   bool   `json:"bot,omitempty"`
+}
+
+// GET /api/v1/contacts, POST /api/v1/contacts {"login": "...", "nick": "..."}
+func (s *Server) apiContacts(w http.ResponseWriter, r *http.Request, login string) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var req apiContact
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if req.Login == "" {
+			writeAPIError(w, http.StatusBadRequest, codeInvalid, "Invalid data")
+			return
+		}
+		if err := s.addContact(login, req.Login, req.Nick); err != nil {
+			writeAPIError(w, apiErrorStatus(err), errorCode(err), err.Error())
+			return
+		}
+		if req.Nick == "" {
+			req.Nick = req.Login
+		}
+		writeJSON(w, http.StatusCreated, req)
+		return
+	}
+
+	contacts, err := s.db.GetContacts(login)
+	if err != nil {
+		slog.Error("API list error", "login", login, "err", err)
+		writeAPIError(w, http.StatusInternalServerError, codeInternal, "Internal error")
+		return
+	}
+
+	result := make([]apiContact, 0, len(contacts))
+	for _, contact := range contacts {
+		result = append(result, apiContact{Login: contact.Contact, Nick: contact.Nick, Bot: contact.Bot})
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// PUT /api/v1/contacts/{login} {"nick": "..."}, DELETE /api/v1/contacts/{login}
+func (s *Server) apiContact(w http.ResponseWriter, r *http.Request, login string) {
+	if !allowMethods(w, r, http.MethodPut, http.MethodDelete) {
+		return
+	}
+
+	contact := strings.TrimPrefix(r.URL.Path, "/api/v1/contacts/")
+	if contact == "" || strings.Contains(contact, "/") {
+		writeAPIError(w, http.StatusNotFound, codeNoContact, "Contact not found")
+		return
+	}
+
+	var err error
+	if r.Method == http.MethodPut {
+		var req struct {
+			Nick string `json:"nick"`
+		}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if req.Nick == "" {
+			writeAPIError(w, http.StatusBadRequest, codeInvalid, "Invalid data")
+			return
+		}
+		if !s.validNick(req.Nick) {
+			writeAPIError(w, http.StatusBadRequest, codeInvalid, "Invalid nick")
+			return
+		}
+		err = s.db.UpdateContactNick(login, contact, req.Nick)
+	} else {
+		err = s.db.DeleteContact(login, contact)
+		if err == nil {
+			s.audit.record(auditContactDelete, login, requestIP(r), auditDetail("contact", contact), auditDetail("via", "api"))
+		}
+	}
+
+	if err == db.ErrNoRows || err == sql.ErrNoRows {
+		writeAPIError(w, http.StatusNotFound, codeNoContact, "Contact not found")
+		return
+	}
+	if err != nil {
+		slog.Error("API contact error", "login", login, "err", err)
+		writeAPIError(w, http.StatusInternalServerError, codeInternal, "Internal error")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiStatus — статус пользователя в ответах API
+type apiStatus struct {
+	User     string `json:"user"`
+	Online   bool   `json:"online"`
+	LastSeen string `json:"last_seen"`
+	Bot      bool   `json:"bot,omitempty"`
+}
+
+// GET /api/v1/statuses — статусы контактов, ?user=a&user=b — указанных пользователей
+func (s *Server) apiStatuses(w http.ResponseWriter, r *http.Request, login string) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	users := r.URL.Query()["user"]
+	if len(users) == 0 {
+		contacts, err := s.db.GetContacts(login)
+		if err != nil {
+			slog.Error("API status error", "login", login, "err", err)
+			writeAPIError(w, http.StatusInternalServerError, codeInternal, "Internal error")
+			return
+		}
+		for _, contact := range contacts {
+			users = append(users, contact.Contact)
+		}
+	} else {
+		for _, user := range users {
+			exists, err := s.db.UserExists(user)
+			if err != nil {
+				slog.Error("API status error", "login", login, "err", err)
+				writeAPIError(w, http.StatusInternalServerError, codeInternal, "Internal error")
+				return
+			}
+			if !exists {
+				writeAPIError(w, http.StatusNotFound, codeNoUser, "User not found")
+				return
+			}
+		}
+	}
+
+	result := make([]apiStatus, 0, len(users))
+	for _, user := range users {
+		entry, err := s.userStatus(user)
+		if err != nil {
+			slog.Error("API status error getting user status", "login", login, "err", err)
+			continue
+		}
+		result = append(result, apiStatus{User: entry.User, Online: entry.Online(), LastSeen: entry.LastSeen, Bot: entry.Bot})
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// apiFileOffer — входящее предложение файла
+type apiFileOffer struct {
+	SessionID string `json:"session_id"`
+	Sender    string `json:"sender"`
+	Filename  string `json:"filename"`
+	Size      int64  `json:"size"`
+	Hash      string `json:"hash"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+// GET /api/v1/files — ожидающие ответа предложения файлов
+func (s *Server) apiFileOffers(w http.ResponseWriter, r *http.Request, login string) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	sessions := s.fileManager.PendingFor(login)
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+	})
+
+	result := make([]apiFileOffer, 0, len(sessions))
+	for _, fs := range sessions {
+		result = append(result, apiFileOffer{
+			SessionID: fs.ID,
+			Sender:    fs.Sender,
+			Filename:  fs.Filename,
+			Size:      fs.Size,
+			Hash:      fs.Hash,
+			ExpiresAt: fs.ExpiresAt.UTC().Format(time.RFC3339),
+		})
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// GET /api/v1/webhooks, PUT /api/v1/webhooks {"messages": true}
+func (s *Server) apiWebhookOptIn(w http.ResponseWriter, r *http.Request, login string) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut) {
+		return
+	}
+
+	var req struct {
+		Messages bool `json:"messages"`
+	}
+	if r.Method == http.MethodPut {
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if err := s.db.SetWebhookMessages(login, req.Messages); err != nil {
+			slog.Error("API webhook opt-in error", "login", login, "err", err)
+			writeAPIError(w, http.StatusInternalServerError, codeInternal, "Internal error")
+			return
+		}
+	} else {
+		enabled, err := s.db.WebhookMessagesEnabled(login)
+		if err != nil {
+			slog.Error("API webhook opt-in error", "login", login, "err", err)
+			writeAPIError(w, http.StatusInternalServerError, codeInternal, "Internal error")
+			return
+		}
+		req.Messages = enabled
+	}
+	writeJSON(w, http.StatusOK, req)
+}
+
+// apiErrorStatus подбирает HTTP-статус для ошибки операции
+func apiErrorStatus(err error) int {
+	var locked *lockedError
+	switch {
+	case errors.As(err, &locked):
+		return http.StatusTooManyRequests
+	case errors.Is(err, errRecipientNotFound), errors.Is(err, errUserNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errContactExists):
+		return http.StatusConflict
+	case errors.Is(err, errInvalidTimestamp), errors.Is(err, errInvalidNick):
+		return http.StatusBadRequest
+	case errors.Is(err, errMessageTooLong):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, errContactLimit):
+		return http.StatusConflict
+	case errors.Is(err, errBadCredentials):
+		return http.StatusUnauthorized
+	case errors.Is(err, errAccountDisabled):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// allowMethods отвечает 405, если метод запроса не из списка
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeAPIError(w, http.StatusMethodNotAllowed, codeFailed, "Method not allowed")
+	return false
+}
+
+// readJSON разбирает тело запроса, при ошибке отвечает 400
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, apiMaxBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeAPIError(w, http.StatusBadRequest, codeInvalid, "Invalid JSON: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// queryInt читает неотрицательный числовой параметр запроса
+func queryInt(w http.ResponseWriter, r *http.Request, name string, def int) (int, bool) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		writeAPIError(w, http.StatusBadRequest, codeInvalid, "Invalid "+name)
+		return 0, false
+	}
+	return n, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("API write error", "err", err)
+	}
+}
+
+// writeAPIError отправляет {"error": текст, "code": код}; коды те же, что в пакете fail
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, map[string]string{"error": message, "code": code})
+}
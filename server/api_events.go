@@ -0,0 +1,225 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"msim/protocol"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Интервал комментариев-keepalive в потоке событий
+const apiKeepaliveInterval = 30 * time.Second
+
+// apiEventFields задаёт имена полей JSON-события для пакетов, которые
+// сервер отправляет сессии по своей инициативе
+var apiEventFields = map[string][]string{
+	"msg":    {"from", "text", "timestamp"},
+	"ack":    {"from", "timestamp"},
+	"on":     {"user", "last_seen"},
+	"off":    {"user", "last_seen"},
+	"fsnd":   {"from", "filename", "size", "hash", "session_id"},
+	"facc":   {"from", "session_id", "port"},
+	"fdec":   {"from", "session_id", "reason"},
+	"fcan":   {"from", "session_id", "reason"},
+	"bye":    {"reason", "details"},
+	"sys":    {"timestamp", "text"},
+	"notice": {"start", "end", "text"},
+	"motd":   {"text"},
+}
+
+// GET /api/v1/events — поток Server-Sent Events.
+// Пока поток открыт, пользователь считается онлайн: входящие сообщения,
+// подтверждения, статусы контактов и предложения файлов приходят сюда так же,
+// как в TCP-сессию.
+func (s *Server) apiEvents(w http.ResponseWriter, r *http.Request, login string) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, http.StatusInternalServerError, codeInternal, "Streaming not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	conn := newSSEConn(w, flusher, r.RemoteAddr)
+	defer conn.Close()
+
+	bot, err := s.db.IsBot(login)
+	if err != nil {
+		slog.Error("API events error", "remote", r.RemoteAddr, "login", login, "err", err)
+	}
+
+	session := &Session{
+		ID:          newConnID(),
+		Login:       login,
+		Bot:         bot,
+		Conn:        conn,
+		ConnectedAt: time.Now(),
+		LastPing:    time.Now(),
+	}
+	s.addSession(login, session)
+
+	now := time.Now().UTC()
+	if err := s.db.UpdateLastOnline(login, now); err != nil {
+		slog.Error("Failed to update last_online", "login", login, "err", err)
+	}
+	if !bot {
+		s.notifyContactsOnline(login, now)
+	}
+	s.motdOnLogin(session)
+	s.noticeOnLogin(session)
+	slog.Info("API event stream opened", "remote", r.RemoteAddr, "login", login)
+
+	ticker := time.NewTicker(apiKeepaliveInterval)
+	defer ticker.Stop()
+
+loop:
+	for {
+		select {
+		case <-r.Context().Done():
+			break loop
+		case <-conn.done:
+			// Сессию закрыл сервер (shutdown) или её вытеснило новое подключение
+			break loop
+		case <-ticker.C:
+			if err := conn.writeRaw(": keepalive\n\n"); err != nil {
+				break loop
+			}
+		}
+	}
+
+	conn.Close()
+
+	// Удаляем сессию, только если её не заменило другое подключение.
+	// При остановке сервера время отключения сохраняет Shutdown.
+	if s.removeSession(session) && !s.isShuttingDown() {
+		now := time.Now().UTC()
+		if err := s.db.UpdateLastOffline(login, now); err != nil {
+			slog.Error("Failed to update last_offline", "login", login, "err", err)
+		}
+		if !bot {
+			s.notifyContactsOffline(login, now)
+		}
+	}
+	slog.Info("API event stream closed", "remote", r.RemoteAddr, "login", login)
+}
+
+// sseConn представляет поток событий как net.Conn: строки пакетов,
+// которые сервер пишет в сессию, превращаются в JSON-события.
+type sseConn struct {
+	w          http.ResponseWriter
+	flusher    http.Flusher
+	remoteAddr string
+
+	mu     sync.Mutex
+	closed bool
+	done   chan struct{}
+}
+
+func newSSEConn(w http.ResponseWriter, flusher http.Flusher, remoteAddr string) *sseConn {
+	return &sseConn{
+		w:          w,
+		flusher:    flusher,
+		remoteAddr: remoteAddr,
+		done:       make(chan struct{}),
+	}
+}
+
+// Read не используется: клиент API отправляет команды обычными запросами
+func (c *sseConn) Read(p []byte) (int, error) {
+	<-c.done
+	return 0, net.ErrClosed
+}
+
+func (c *sseConn) Write(p []byte) (int, error) {
+	var event strings.Builder
+	for _, line := range strings.Split(strings.TrimSuffix(string(p), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		name, data, ok := packetEvent(line)
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(&event, "event: %s\ndata: %s\n\n", name, data)
+	}
+
+	if event.Len() > 0 {
+		if err := c.writeRaw(event.String()); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// writeRaw пишет готовый фрагмент потока и сразу отправляет его клиенту
+func (c *sseConn) writeRaw(s string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	if _, err := c.w.Write([]byte(s)); err != nil {
+		return err
+	}
+	c.flusher.Flush()
+	return nil
+}
+
+// Close запрещает дальнейшую запись: после выхода из обработчика
+// ResponseWriter использовать нельзя
+func (c *sseConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+	}
+	return nil
+}
+
+func (c *sseConn) LocalAddr() net.Addr                { return sseAddr("api") }
+func (c *sseConn) RemoteAddr() net.Addr               { return sseAddr(c.remoteAddr) }
+func (c *sseConn) SetDeadline(t time.Time) error      { return nil }
+func (c *sseConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *sseConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// sseAddr — адрес клиента потока событий
+type sseAddr string
+
+func (a sseAddr) Network() string { return "http" }
+func (a sseAddr) String() string  { return string(a) }
+
+// packetEvent превращает строку пакета в имя и JSON-данные события
+func packetEvent(line string) (string, []byte, bool) {
+	parts := protocol.SplitLine(line)
+	names, ok := apiEventFields[parts[0]]
+	if !ok {
+		return "", nil, false
+	}
+
+	fields := make(map[string]string, len(names))
+	for i, name := range names {
+		if i+1 < len(parts) {
+			fields[name] = parts[i+1]
+		}
+	}
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return "", nil, false
+	}
+	return parts[0], data, true
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"log/slog"
+	"msim/db"
+	"msim/models"
+	"strings"
+	"sync"
+	"time"
+)
+
+// События журнала аудита
+const (
+	auditAuthSuccess    = "auth.success"    // вход по протоколу или через API
+	auditAuthFailure    = "auth.failure"    // неверный пароль или ключ
+	auditAuthLocked     = "auth.locked"     // попытка входа при блокировке
+	auditAuthDisabled   = "auth.disabled"   // вход в отключённый аккаунт
+	auditLockout        = "auth.lockout"    // логин или адрес заблокирован после серии неудач
+	auditRegister       = "register"        // регистрация пользователя
+	auditRegisterDenied = "register.denied" // регистрация отклонена лимитом адреса
+	auditHistoryClear   = "history.clear"   // очистка истории с контактом
+	auditContactDelete  = "contact.delete"  // удаление контакта
+	auditAdminPrefix    = "admin."          // действия через управляющий сокет: admin.shutdown и т.д.
+)
+
+// auditLog записывает события безопасности в таблицу audit_log.
+// Записи только добавляются; устаревшие удаляются не чаще раза в час.
+type auditLog struct {
+	db *db.DB
+
+	mu        sync.Mutex
+	retention time.Duration // 0 — хранить бессрочно
+	lastPrune time.Time
+}
+
+func newAuditLog(database *db.DB, retention time.Duration) *auditLog {
+	return &auditLog{db: database, retention: retention}
+}
+
+// record добавляет событие; details — пары key=value через пробел.
+// Ошибка записи не прерывает обработку запроса и только пишется в лог.
+func (a *auditLog) record(event, login, ip string, details ...string) {
+	e := &models.AuditEvent{
+		Event:   event,
+		Login:   login,
+		IP:      ip,
+		Details: strings.Join(details, " "),
+	}
+	if err := a.db.AddAuditEvent(e); err != nil {
+		slog.Error("Failed to write audit event", "event", event, "login", login, "err", err)
+	}
+	a.prune()
+}
+
+func (a *auditLog) prune() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.retention <= 0 {
+		return
+	}
+	if time.Since(a.lastPrune) < time.Hour {
+		return
+	}
+	a.lastPrune = time.Now()
+	if n, err := a.db.PruneAuditLog(time.Now().Add(-a.retention)); err != nil {
+		slog.Error("Failed to prune audit log", "err", err)
+	} else if n > 0 {
+		slog.Info("Audit log pruned", "events", n)
+	}
+}
+
+// setRetention меняет срок хранения при перезагрузке настроек
+func (a *auditLog) setRetention(retention time.Duration) {
+	a.mu.Lock()
+	a.retention = retention
+	a.mu.Unlock()
+}
+
+// auditDetail форматирует пару key=value, заменяя пробелы в значении на _,
+// чтобы details разбирались по пробелам
+func auditDetail(key, value string) string {
+	return key + "=" + strings.Join(strings.Fields(value), "_")
+}
+
+// Audit записывает действие администратора через управляющий сокет.
+// К имени события добавляется префикс admin., keyvals — чередующиеся ключи и значения.
+func (s *Server) Audit(action, login string, keyvals ...string) {
+	details := make([]string, 0, len(keyvals)/2)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		details = append(details, auditDetail(keyvals[i], keyvals[i+1]))
+	}
+	s.audit.record(auditAdminPrefix+action, login, "", details...)
+}
+
+// AuditEvents возвращает события журнала аудита, новые первыми
+func (s *Server) AuditEvents(filter db.AuditFilter) ([]models.AuditEvent, error) {
+	return s.db.GetAuditEvents(filter)
+}
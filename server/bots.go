@@ -0,0 +1,94 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"msim/db"
+	"msim/models"
+)
+
+// Префикс API-ключей ботов, по нему ключ легко узнать в конфигурации и логах
+const apiKeyPrefix = "msk_"
+
+// Ошибки управления ботами
+var (
+	ErrUserExists   = errors.New("user already exists")
+	ErrNotBot       = errors.New("user is not a bot")
+	ErrKeyNotFound  = errors.New("key not found")
+	ErrInvalidLogin = errors.New("invalid login")
+)
+
+// CreateBot создаёт бот-аккаунт. Бот входит только по API-ключу,
+// а его подключения и отключения не рассылаются контактам.
+func (s *Server) CreateBot(login string) error {
+	if !s.validLogin(login) {
+		return ErrInvalidLogin
+	}
+	exists, err := s.db.UserExists(login)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrUserExists
+	}
+	return s.db.CreateBot(login)
+}
+
+// IssueAPIKey выпускает новый ключ для бота. Ключ возвращается один раз,
+// в базе хранится только его хеш.
+func (s *Server) IssueAPIKey(login string) (string, error) {
+	bot, err := s.db.IsBot(login)
+	if err != nil {
+		return "", err
+	}
+	if !bot {
+		return "", ErrNotBot
+	}
+
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	key := apiKeyPrefix + hex.EncodeToString(buf)
+
+	if _, err := s.db.AddAPIKey(login, key, key[:len(apiKeyPrefix)+8]); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// APIKeys возвращает ключи бота, включая отозванные
+func (s *Server) APIKeys(login string) ([]models.APIKey, error) {
+	bot, err := s.db.IsBot(login)
+	if err != nil {
+		return nil, err
+	}
+	if !bot {
+		return nil, ErrNotBot
+	}
+	return s.db.GetAPIKeys(login)
+}
+
+// RevokeAPIKey отзывает ключ по номеру
+func (s *Server) RevokeAPIKey(id int64) error {
+	err := s.db.RevokeAPIKey(id)
+	if err == db.ErrNoRows {
+		return ErrKeyNotFound
+	}
+	return err
+}
+
+// authenticate проверяет пароль пользователя или API-ключ бота
+func (s *Server) authenticate(login, secret string) (valid, bot bool, err error) {
+	bot, err = s.db.IsBot(login)
+	if err != nil {
+		return false, false, err
+	}
+	if bot {
+		valid, err = s.db.ValidateAPIKey(login, secret)
+		return valid, true, err
+	}
+	valid, err = s.db.AuthenticateUser(login, secret)
+	return valid, false, err
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"msim/protocol"
+	"net"
+)
+
+// Возможности протокола, которые клиент может включить пакетом caps.
+// Без согласования сервер отвечает в исходном формате, поэтому старые клиенты
+// продолжают работать.
+const (
+	// capErrCodes — код ошибки последним полем пакета fail: fail|operation|description|code
+	capErrCodes = "errcodes"
+)
+
+// serverCaps — возможности, которые поддерживает сервер
+var serverCaps = []string{capErrCodes}
+
+func (s *Server) handleCaps(session *Session, pkt *protocol.Packet, args []string, conn net.Conn) {
+	// Формат: caps|cap1|cap2|... — ответ caps|<включённые возможности>.
+	// Неизвестные возможности пропускаются, пустой caps возвращает список поддерживаемых.
+	requested := pkt.Fields
+	if pkt.Destination != "" {
+		requested = append([]string{pkt.Destination}, pkt.Fields...)
+	}
+	if pkt.Content == "" && pkt.Destination == "" {
+		s.sendPacket(conn, "caps", serverCaps...)
+		return
+	}
+
+	var enabled []string
+	session.mu.Lock()
+	for _, name := range requested {
+		for _, supported := range serverCaps {
+			if name == supported {
+				if session.caps == nil {
+					session.caps = make(map[string]bool)
+				}
+				session.caps[name] = true
+				enabled = append(enabled, name)
+			}
+		}
+	}
+	session.mu.Unlock()
+	s.sendPacket(conn, "caps", enabled...)
+}
+
+// hasCap сообщает, согласовал ли клиент возможность
+func (session *Session) hasCap(name string) bool {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return session.caps[name]
+}
@@ -0,0 +1,276 @@
+package server
+
+import (
+	"msim/protocol"
+	"net"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// commandHandler обрабатывает пакет от клиента. args — аргументы пакета
+// по схеме команды, см. packetArgs; обязательные уже проверены argsMiddleware.
+type commandHandler func(session *Session, pkt *protocol.Packet, args []string, conn net.Conn)
+
+// commandArg описывает поле пакета команды
+type commandArg struct {
+	name    string
+	secret  bool     // значение не пишется в лог
+	missing *opError // ответ на пустой обязательный аргумент, nil — аргумент необязателен
+}
+
+// command — команда протокола в реестре
+type command struct {
+	name    string
+	auth    bool   // требует авторизации
+	class   string // класс для ограничения частоты, пусто — без ограничений
+	args    []commandArg
+	handler commandHandler
+	plugin  string // имя плагина, добавившего команду
+}
+
+// middleware оборачивает обработчик команды
+type middleware func(cmd *command, next commandHandler) commandHandler
+
+// arg, required и secret — сокращения для описания схемы аргументов
+func arg(name string) commandArg { return commandArg{name: name} }
+func required(name string, missing *opError) commandArg {
+	return commandArg{name: name, missing: missing}
+}
+func secret(name string, missing *opError) commandArg {
+	return commandArg{name: name, secret: true, missing: missing}
+}
+
+// builtinCommands возвращает команды сервера в порядке вывода в help
+func (s *Server) builtinCommands() []*command {
+	return []*command{
+		{name: "ping", handler: s.handlePing},
+		{name: "auth", class: rateClassAuth, args: []commandArg{required("login", errBadCredentials), secret("password", errBadCredentials)}, handler: s.handleAuth},
+		{name: "reg", class: rateClassAuth, args: []commandArg{required("login", errInvalidData), secret("password", errInvalidData)}, handler: s.handleRegister},
+		{name: "msg", auth: true, class: rateClassMsg, args: []commandArg{required("recipient", errRecipientRequired), required("text", errTextRequired)}, handler: s.handleMessage},
+		{name: "ack", auth: true, class: rateClassMsg, args: []commandArg{required("sender", errInvalidAck), required("timestamp", errInvalidAck)}, handler: s.handleAck},
+		{name: "hist", auth: true, class: rateClassQuery, args: []commandArg{required("contact", errContactRequired), arg("offset"), arg("limit")}, handler: s.handleHistory},
+		{name: "hclear", auth: true, class: rateClassQuery, args: []commandArg{required("contact", errContactRequired)}, handler: s.handleClearHistory},
+		{name: "offmsg", auth: true, class: rateClassQuery, handler: s.handleOfflineMessages},
+		{name: "stat", auth: true, class: rateClassQuery, args: []commandArg{arg("user")}, handler: s.handleStatus},
+		{name: "list", auth: true, class: rateClassQuery, handler: s.handleList},
+		{name: "add", auth: true, class: rateClassQuery, args: []commandArg{required("contact", errInvalidData), arg("nick")}, handler: s.handleAddContact},
+		{name: "ren", auth: true, class: rateClassQuery, args: []commandArg{required("contact", errInvalidData), required("nick", errInvalidData)}, handler: s.handleRenameContact},
+		{name: "del", auth: true, class: rateClassQuery, args: []commandArg{required("contact", errInvalidData)}, handler: s.handleDeleteContact},
+		{name: "bye", handler: s.handleBye},
+		{name: "help", handler: s.handleHelp},
+		{name: "caps", args: []commandArg{arg("caps")}, handler: s.handleCaps},
+		{name: "info", handler: s.handleInfo},
+		{name: "fsnd", auth: true, class: rateClassFile, args: []commandArg{required("recipient", errInvalidFormat), required("filename", errInvalidFormat), required("size", errInvalidFormat), arg("hash")}, handler: s.handleFileSend},
+		{name: "facc", auth: true, class: rateClassFile, args: []commandArg{arg("sender"), required("session_id", errSessionIDRequired)}, handler: s.handleFileAccept},
+		{name: "fdec", auth: true, class: rateClassFile, args: []commandArg{arg("sender"), required("session_id", errSessionIDRequired), arg("reason")}, handler: s.handleFileDecline},
+		{name: "fcan", auth: true, class: rateClassFile, args: []commandArg{arg("user"), required("session_id", errSessionIDRequired), arg("reason")}, handler: s.handleFileCancel},
+		{name: "fst", auth: true, class: rateClassFile, args: []commandArg{required("session_id", errSessionIDRequired)}, handler: s.handleFileStatus},
+		{name: "hook", auth: true, class: rateClassQuery, args: []commandArg{arg("state")}, handler: s.handleWebhookOptIn},
+	}
+}
+
+// commandRegistry хранит команды и готовые цепочки обработчиков.
+// Команды добавляются до запуска сервера, поэтому реестр читается без блокировок.
+type commandRegistry struct {
+	middlewares []middleware
+	order       []string
+	commands    map[string]*command
+	chains      map[string]commandHandler
+}
+
+// newCommandRegistry создаёт реестр; первый middleware в списке выполняется первым
+func newCommandRegistry(middlewares ...middleware) *commandRegistry {
+	return &commandRegistry{
+		middlewares: middlewares,
+		commands:    make(map[string]*command),
+		chains:      make(map[string]commandHandler),
+	}
+}
+
+// add регистрирует команду, оборачивая её обработчик в middleware
+func (r *commandRegistry) add(cmd *command) {
+	handler := cmd.handler
+	for i := len(r.middlewares) - 1; i >= 0; i-- {
+		handler = r.middlewares[i](cmd, handler)
+	}
+	if _, exists := r.commands[cmd.name]; !exists {
+		r.order = append(r.order, cmd.name)
+	}
+	r.commands[cmd.name] = cmd
+	r.chains[cmd.name] = handler
+}
+
+// lookup возвращает команду и её обработчик с middleware
+func (r *commandRegistry) lookup(name string) (*command, commandHandler, bool) {
+	handler, ok := r.chains[name]
+	return r.commands[name], handler, ok
+}
+
+// get возвращает описание команды
+func (r *commandRegistry) get(name string) (*command, bool) {
+	cmd, ok := r.commands[name]
+	return cmd, ok
+}
+
+// names возвращает имена команд в порядке регистрации
+func (r *commandRegistry) names() []string {
+	return append([]string(nil), r.order...)
+}
+
+// recoverMiddleware не даёт панике в обработчике закрыть соединение
+func (s *Server) recoverMiddleware(cmd *command, next commandHandler) commandHandler {
+	return func(session *Session, pkt *protocol.Packet, args []string, conn net.Conn) {
+		defer func() {
+			if r := recover(); r != nil {
+				session.logger().Error("Panic in handler", "type", cmd.name, "panic", r, "stack", string(debug.Stack()))
+				s.sendError(session, cmd.name, codeInternal, "Internal error")
+			}
+		}()
+		next(session, pkt, args, conn)
+	}
+}
+
+// metricsMiddleware считает вызовы команд и время их обработки
+func (s *Server) metricsMiddleware(cmd *command, next commandHandler) commandHandler {
+	return func(session *Session, pkt *protocol.Packet, args []string, conn net.Conn) {
+		start := time.Now()
+		defer func() {
+			s.metrics.observe(cmd.name, time.Since(start))
+		}()
+		next(session, pkt, args, conn)
+	}
+}
+
+// logMiddleware пишет входящий пакет в лог, скрывая секретные аргументы, см. logPacket
+func (s *Server) logMiddleware(cmd *command, next commandHandler) commandHandler {
+	return func(session *Session, pkt *protocol.Packet, args []string, conn net.Conn) {
+		s.logPacket(session, cmd, pkt, args)
+		next(session, pkt, args, conn)
+	}
+}
+
+// authMiddleware отклоняет команды, требующие авторизации, до входа
+func (s *Server) authMiddleware(cmd *command, next commandHandler) commandHandler {
+	if !cmd.auth {
+		return next
+	}
+	return func(session *Session, pkt *protocol.Packet, args []string, conn net.Conn) {
+		if session.Login == "" {
+			s.sendError(session, cmd.name, codeNotAuth, "Not authenticated")
+			return
+		}
+		next(session, pkt, args, conn)
+	}
+}
+
+// argsMiddleware отклоняет пакет, в котором пуст обязательный аргумент схемы.
+// Ответ — ошибка, указанная в схеме для этого аргумента.
+func (s *Server) argsMiddleware(cmd *command, next commandHandler) commandHandler {
+	return func(session *Session, pkt *protocol.Packet, args []string, conn net.Conn) {
+		for i, a := range cmd.args {
+			if a.missing != nil && args[i] == "" {
+				s.sendError(session, cmd.name, a.missing.code, a.missing.msg)
+				return
+			}
+		}
+		next(session, pkt, args, conn)
+	}
+}
+
+// packetArgs раскладывает поля пакета по аргументам схемы команды:
+// ровно по значению на аргумент, недостающие пусты. Поля сверх схемы
+// относятся к последнему аргументу (например, текст сообщения с |).
+// Команды без схемы получают поля пакета как есть.
+func packetArgs(cmd *command, pkt *protocol.Packet) []string {
+	var fields []string
+	if pkt.Destination != "" {
+		fields = append([]string{pkt.Destination}, pkt.Fields...)
+	} else if pkt.Content != "" {
+		fields = append(fields, pkt.Fields...)
+	}
+	if len(cmd.args) == 0 {
+		return fields
+	}
+
+	args := make([]string, len(cmd.args))
+	last := len(cmd.args) - 1
+	copy(args[:last], fields)
+	if len(fields) > last {
+		args[last] = strings.Join(fields[last:], "|")
+	}
+	return args
+}
+
+// redactPacket восстанавливает строку пакета для лога,
+// заменяя секретные аргументы команды на ***
+func redactPacket(cmd *command, pkt *protocol.Packet) string {
+	args := packetArgs(cmd, pkt)
+	for i, a := range cmd.args {
+		if a.secret && args[i] != "" {
+			args[i] = redactedValue
+		}
+	}
+	// Пустые необязательные аргументы в конце пакета не показываем
+	for len(args) > 0 && args[len(args)-1] == "" {
+		args = args[:len(args)-1]
+	}
+	return strings.TrimSuffix(protocol.FormatFields(pkt.Type, args...), "\n")
+}
+
+// commandMetrics — счётчики вызовов команд
+type commandMetrics struct {
+	mu    sync.Mutex
+	stats map[string]*commandStat
+}
+
+type commandStat struct {
+	Count    int64
+	Duration time.Duration // суммарное время обработки
+}
+
+func newCommandMetrics() *commandMetrics {
+	return &commandMetrics{stats: make(map[string]*commandStat)}
+}
+
+func (m *commandMetrics) observe(name string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st, ok := m.stats[name]
+	if !ok {
+		st = &commandStat{}
+		m.stats[name] = st
+	}
+	st.Count++
+	st.Duration += d
+}
+
+// snapshot возвращает копию счётчиков
+func (m *commandMetrics) snapshot() map[string]commandStat {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result := make(map[string]commandStat, len(m.stats))
+	for name, st := range m.stats {
+		result[name] = *st
+	}
+	return result
+}
+
+// String форматирует счётчики для команды stats: name:count;name:count
+func (m *commandMetrics) String() string {
+	snapshot := m.snapshot()
+	names := make([]string, 0, len(snapshot))
+	for name := range snapshot {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	items := make([]string, 0, len(names))
+	for _, name := range names {
+		items = append(items, name+":"+strconv.FormatInt(snapshot[name].Count, 10))
+	}
+	return strings.Join(items, ";")
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"errors"
+	"time"
+)
+
+// Ошибки операций, общих для протокола и HTTP API.
+// Текст ошибки отправляется клиенту в пакете fail без изменений, код — последним полем.
+var (
+	errInternal          = &opError{code: codeInternal, msg: "Internal error"}
+	errRecipientNotFound = &opError{code: codeNoUser, msg: "Recipient not found"}
+	errUserNotFound      = &opError{code: codeNoUser, msg: "User not found"}
+	errContactExists     = &opError{code: codeContactExists, msg: "Contact already exists or internal error"}
+	errInvalidTimestamp  = &opError{code: codeInvalid, msg: "Invalid timestamp"}
+	errMessageTooLong    = &opError{code: codeTooLong, msg: "Message too long"}
+	errInvalidNick       = &opError{code: codeInvalid, msg: "Invalid nick"}
+	errContactLimit      = &opError{code: codeLimit, msg: "Contact list is full"}
+	errBadCredentials    = &opError{code: codeBadCredentials, msg: "Invalid credentials"}
+	errAccountDisabled   = &opError{code: codeForbidden, msg: "Account disabled"}
+)
+
+// Ответы на пустые обязательные аргументы команд, см. commandArg.missing
+var (
+	errInvalidData       = &opError{code: codeInvalid, msg: "Invalid data"}
+	errInvalidFormat     = &opError{code: codeInvalid, msg: "Invalid format"}
+	errInvalidAck        = &opError{code: codeInvalid, msg: "Invalid ack format"}
+	errRecipientRequired = &opError{code: codeInvalid, msg: "Recipient required"}
+	errTextRequired      = &opError{code: codeInvalid, msg: "Message text required"}
+	errContactRequired   = &opError{code: codeInvalid, msg: "Contact required"}
+	errSessionIDRequired = &opError{code: codeInvalid, msg: "Session ID required"}
+)
+
+// lockedError — вход заблокирован после неудачных попыток до момента until
+type lockedError struct {
+	until time.Time
+}
+
+func (e *lockedError) Error() string {
+	return "Too many failed attempts"
+}
+
+func (e *lockedError) Code() string {
+	return codeLocked
+}
+
+// opError — ошибка операции вместе с её машиночитаемым кодом
+type opError struct {
+	code string
+	msg  string
+}
+
+func (e *opError) Error() string {
+	return e.msg
+}
+
+func (e *opError) Code() string {
+	return e.code
+}
+
+// Машиночитаемые коды ошибок. Коды стабильны: клиенты, согласовавшие
+// возможность capErrCodes, получают код последним полем пакета fail.
+const (
+	codeInternal       = "E_INTERNAL"
+	codeInvalid        = "E_INVALID"
+	codeUnknownPacket  = "E_UNKNOWN_PACKET"
+	codeNotAuth        = "E_NOT_AUTH"
+	codeBadCredentials = "E_BAD_CREDENTIALS"
+	codeForbidden      = "E_FORBIDDEN"
+	codeNoUser         = "E_NO_USER"
+	codeUserExists     = "E_USER_EXISTS"
+	codeNoContact      = "E_NO_CONTACT"
+	codeContactExists  = "E_CONTACT_EXISTS"
+	codeNoSession      = "E_NO_SESSION"
+	codeBadState       = "E_BAD_STATE"
+	codeUnavailable    = "E_UNAVAILABLE"
+	codeRateLimit      = "E_RATE_LIMIT"
+	codeLocked         = "E_LOCKED"
+	codeTooLong        = "E_TOO_LONG"
+	codeLimit          = "E_LIMIT"
+	codeFailed         = "E_FAILED"
+)
+
+// errorCode возвращает код, который несёт ошибка. Ошибки без кода —
+// непредвиденные сбои, для клиента это codeInternal.
+func errorCode(err error) string {
+	var coded interface{ Code() string }
+	if errors.As(err, &coded) {
+		return coded.Code()
+	}
+	return codeInternal
+}
@@ -1,15 +1,23 @@
 package server
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"os"
 	"sync"
 	"time"
 )
 
+// Сроки файловой сессии, сообщаются клиентам в ответе info
+const (
+	fileAcceptTimeout   = 5 * time.Minute  // на принятие файла получателем
+	fileTransferTimeout = 10 * time.Minute // на передачу после принятия
+)
+
 // FileSession представляет сессию передачи файла
 type FileSession struct {
 	ID           string
@@ -26,6 +34,9 @@ type FileSession struct {
 	CreatedAt    time.Time
 	ExpiresAt    time.Time
 	mu           sync.Mutex
+
+	detach    chan chan []*os.File // запрос на передачу листенеров новому процессу, см. detach
+	proxyDone chan struct{}        // закрывается, когда прокси завершился
 }
 
 // FileTransferManager управляет сессиями передачи файлов
@@ -36,6 +47,15 @@ type FileTransferManager struct {
 	portRangeEnd   int
 	usedPorts      map[int]bool
 	portMu         sync.Mutex
+	proxies        sync.WaitGroup // работающие прокси, см. Wait
+	stop           chan struct{}  // закрывается при остановке сервера, см. Drain
+	stopOnce       sync.Once
+
+	// OnComplete вызывается после успешной передачи файла
+	OnComplete func(session *FileSession, bytesTransferred int64)
+	// OnStatus вызывается при каждой смене статуса сессии; bytesTransferred
+	// ненулевой только для завершённой передачи
+	OnStatus func(status string, bytesTransferred int64)
 }
 
 // NewFileTransferManager создает новый менеджер передачи файлов
@@ -45,6 +65,7 @@ func NewFileTransferManager(portStart, portEnd int) *FileTransferManager {
 		usedPorts:      make(map[int]bool),
 		portRangeStart: portStart,
 		portRangeEnd:   portEnd,
+		stop:           make(chan struct{}),
 	}
 }
 
@@ -61,14 +82,16 @@ func (ftm *FileTransferManager) CreateSession(sender, recipient, filename string
 		Hash:      hash,
 		Status:    "pending",
 		CreatedAt: time.Now(),
-		ExpiresAt: time.Now().Add(5 * time.Minute), // 5 минут на акцепт
+		ExpiresAt: time.Now().Add(fileAcceptTimeout),
 	}
 
 	ftm.mu.Lock()
 	ftm.sessions[sessionID] = session
 	ftm.mu.Unlock()
 
-	log.Printf("Created file session %s: %s -> %s, file: %s (%d bytes)", sessionID, sender, recipient, filename, size)
+	// Имя файла пишет обработчик fsnd с учётом LogRedact
+	slog.Info("Created file session", "transfer", sessionID, "sender", sender, "recipient", recipient, "size", size)
+	ftm.statusChanged("pending", 0)
 	return session, nil
 }
 
@@ -89,14 +112,16 @@ func (ftm *FileTransferManager) AcceptSession(sessionID string) (uploadPort, dow
 		return 0, 0, ErrSessionNotPending
 	}
 
-	// Выделяем два порта
-	uploadPort, err = ftm.allocatePort()
+	// Выделяем два порта и сразу слушаем их, чтобы клиент мог подключиться
+	// сразу после ответа
+	uploadPort, uploadListener, err := ftm.listenPort()
 	if err != nil {
 		return 0, 0, err
 	}
 
-	downloadPort, err = ftm.allocatePort()
+	downloadPort, downloadListener, err := ftm.listenPort()
 	if err != nil {
+		uploadListener.Close()
 		ftm.releasePort(uploadPort)
 		return 0, 0, err
 	}
@@ -104,12 +129,13 @@ func (ftm *FileTransferManager) AcceptSession(sessionID string) (uploadPort, dow
 	session.UploadPort = uploadPort
 	session.DownloadPort = downloadPort
 	session.Status = "accepted"
-	session.ExpiresAt = time.Now().Add(10 * time.Minute) // 10 минут на передачу
+	session.ExpiresAt = time.Now().Add(fileTransferTimeout)
 
-	// Запускаем прокси-серверы
-	go ftm.startProxy(session, uploadPort, downloadPort)
+	// Запускаем прокси-сервер
+	ftm.startProxy(session, uploadListener, downloadListener)
 
-	log.Printf("Accepted file session %s: upload port %d, download port %d", sessionID, uploadPort, downloadPort)
+	slog.Info("Accepted file session", "transfer", sessionID, "upload_port", uploadPort, "download_port", downloadPort)
+	ftm.statusChanged("accepted", 0)
 	return uploadPort, downloadPort, nil
 }
 
@@ -127,7 +153,8 @@ func (ftm *FileTransferManager) DeclineSession(sessionID string) error {
 	session.Status = "declined"
 	session.mu.Unlock()
 
-	log.Printf("Declined file session %s", sessionID)
+	slog.Info("Declined file session", "transfer", sessionID)
+	ftm.statusChanged("declined", 0)
 	return nil
 }
 
@@ -152,7 +179,8 @@ func (ftm *FileTransferManager) CancelSession(sessionID string) error {
 	}
 	session.mu.Unlock()
 
-	log.Printf("Cancelled file session %s", sessionID)
+	slog.Info("Cancelled file session", "transfer", sessionID)
+	ftm.statusChanged("cancelled", 0)
 	return nil
 }
 
@@ -164,6 +192,39 @@ func (ftm *FileTransferManager) GetSession(sessionID string) (*FileSession, bool
 	return session, exists
 }
 
+// Active возвращает сессии, которые ожидают ответа получателя или передают файл
+func (ftm *FileTransferManager) Active() []*FileSession {
+	ftm.mu.RLock()
+	defer ftm.mu.RUnlock()
+
+	var active []*FileSession
+	for _, session := range ftm.sessions {
+		session.mu.Lock()
+		switch session.Status {
+		case "pending", "accepted", "transferring":
+			active = append(active, session)
+		}
+		session.mu.Unlock()
+	}
+	return active
+}
+
+// PendingFor возвращает ещё не принятые предложения файлов для получателя
+func (ftm *FileTransferManager) PendingFor(recipient string) []*FileSession {
+	ftm.mu.RLock()
+	defer ftm.mu.RUnlock()
+
+	var pending []*FileSession
+	for _, session := range ftm.sessions {
+		session.mu.Lock()
+		if session.Recipient == recipient && session.Status == "pending" {
+			pending = append(pending, session)
+		}
+		session.mu.Unlock()
+	}
+	return pending
+}
+
 // CleanExpired очищает устаревшие сессии
 func (ftm *FileTransferManager) CleanExpired() {
 	ftm.mu.Lock()
@@ -173,7 +234,7 @@ func (ftm *FileTransferManager) CleanExpired() {
 	for id, session := range ftm.sessions {
 		session.mu.Lock()
 		if now.After(session.ExpiresAt) && session.Status != "completed" {
-			log.Printf("Cleaning expired file session %s", id)
+			slog.Info("Cleaning expired file session", "transfer", id)
 			session.Status = "cancelled"
 			if session.UploadConn != nil {
 				session.UploadConn.Close()
@@ -188,6 +249,7 @@ func (ftm *FileTransferManager) CleanExpired() {
 				ftm.releasePort(session.DownloadPort)
 			}
 			delete(ftm.sessions, id)
+			ftm.statusChanged("expired", 0)
 		}
 		session.mu.Unlock()
 	}
@@ -203,19 +265,70 @@ func (ftm *FileTransferManager) StartCleanupTask() {
 	}()
 }
 
-// allocatePort выделяет свободный порт из диапазона
-func (ftm *FileTransferManager) allocatePort() (int, error) {
+// Drain отменяет передачи, к которым ещё никто не подключился, и ждёт
+// завершения идущих. Когда ctx истекает, их соединения закрываются.
+func (ftm *FileTransferManager) Drain(ctx context.Context) error {
+	ftm.stopOnce.Do(func() { close(ftm.stop) })
+
+	done := make(chan struct{})
+	go func() {
+		ftm.proxies.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	for _, session := range ftm.Active() {
+		session.mu.Lock()
+		if session.UploadConn != nil {
+			session.UploadConn.Close()
+		}
+		if session.DownloadConn != nil {
+			session.DownloadConn.Close()
+		}
+		session.mu.Unlock()
+	}
+	<-done
+	return ctx.Err()
+}
+
+// statusChanged сообщает OnStatus о смене статуса сессии
+func (ftm *FileTransferManager) statusChanged(status string, bytesTransferred int64) {
+	if ftm.OnStatus != nil {
+		ftm.OnStatus(status, bytesTransferred)
+	}
+}
+
+// PortUsage возвращает число занятых портов и размер диапазона
+func (ftm *FileTransferManager) PortUsage() (used, total int) {
+	ftm.portMu.Lock()
+	defer ftm.portMu.Unlock()
+	return len(ftm.usedPorts), ftm.portRangeEnd - ftm.portRangeStart + 1
+}
+
+// listenPort занимает свободный порт из диапазона и открывает на нём листенер.
+// Порты, занятые другим процессом (например, старым при обновлении), пропускаются.
+func (ftm *FileTransferManager) listenPort() (int, net.Listener, error) {
 	ftm.portMu.Lock()
 	defer ftm.portMu.Unlock()
 
 	for port := ftm.portRangeStart; port <= ftm.portRangeEnd; port++ {
-		if !ftm.usedPorts[port] {
-			ftm.usedPorts[port] = true
-			return port, nil
+		if ftm.usedPorts[port] {
+			continue
+		}
+		listener, err := net.Listen("tcp", ":"+itoa(port))
+		if err != nil {
+			continue
 		}
+		ftm.usedPorts[port] = true
+		return port, listener, nil
 	}
 
-	return 0, ErrNoAvailablePorts
+	return 0, nil, ErrNoAvailablePorts
 }
 
 // releasePort освобождает порт
@@ -225,82 +338,123 @@ func (ftm *FileTransferManager) releasePort(port int) {
 	delete(ftm.usedPorts, port)
 }
 
-// startProxy запускает TCP прокси для передачи файла
-func (ftm *FileTransferManager) startProxy(session *FileSession, uploadPort, downloadPort int) {
-	// Запускаем листенеры на обоих портах
-	uploadListener, err := net.Listen("tcp", ":"+itoa(uploadPort))
-	if err != nil {
-		log.Printf("Failed to start upload listener on port %d: %v", uploadPort, err)
-		return
-	}
-	defer uploadListener.Close()
-
-	downloadListener, err := net.Listen("tcp", ":"+itoa(downloadPort))
-	if err != nil {
-		log.Printf("Failed to start download listener on port %d: %v", downloadPort, err)
-		return
-	}
-	defer downloadListener.Close()
+// startProxy запускает TCP прокси для передачи файла на открытых листенерах
+func (ftm *FileTransferManager) startProxy(session *FileSession, uploadListener, downloadListener net.Listener) {
+	session.detach = make(chan chan []*os.File)
+	session.proxyDone = make(chan struct{})
+	ftm.proxies.Add(1)
+	go ftm.runProxy(session, uploadListener, downloadListener)
+}
 
-	log.Printf("File transfer proxy started for session %s: upload=%d, download=%d", session.ID, uploadPort, downloadPort)
+// acceptResult — соединение, принятое листенером прокси
+type acceptResult struct {
+	upload bool
+	conn   net.Conn
+	err    error
+}
 
-	// Каналы для синхронизации
-	uploadReady := make(chan net.Conn, 1)
-	downloadReady := make(chan net.Conn, 1)
-	done := make(chan struct{})
+// runProxy ждёт подключения отправителя и получателя и пробрасывает данные
+func (ftm *FileTransferManager) runProxy(session *FileSession, uploadListener, downloadListener net.Listener) {
+	defer ftm.proxies.Done()
+	defer close(session.proxyDone)
+	defer uploadListener.Close()
+	defer downloadListener.Close()
 
-	// Горутина для приема upload соединения
-	go func() {
-		conn, err := uploadListener.Accept()
-		if err != nil {
-			log.Printf("Upload accept error for session %s: %v", session.ID, err)
-			close(done)
-			return
-		}
-		log.Printf("Upload connection established for session %s", session.ID)
-		uploadReady <- conn
-	}()
+	uploadPort, downloadPort := session.UploadPort, session.DownloadPort
+	slog.Info("File transfer proxy started", "transfer", session.ID, "upload_port", uploadPort, "download_port", downloadPort)
 
-	// Горутина для приема download соединения
-	go func() {
-		conn, err := downloadListener.Accept()
-		if err != nil {
-			log.Printf("Download accept error for session %s: %v", session.ID, err)
-			close(done)
-			return
-		}
-		log.Printf("Download connection established for session %s", session.ID)
-		downloadReady <- conn
-	}()
+	results := make(chan acceptResult, 2)
+	accept := func(listener net.Listener, upload bool) {
+		conn, err := listener.Accept()
+		results <- acceptResult{upload, conn, err}
+	}
+	go accept(uploadListener, true)
+	go accept(downloadListener, false)
 
 	// Ждем оба соединения или таймаут
 	var uploadConn, downloadConn net.Conn
 	timeout := time.After(session.ExpiresAt.Sub(time.Now()))
+	cleanup := func() {
+		if uploadConn != nil {
+			uploadConn.Close()
+		}
+		if downloadConn != nil {
+			downloadConn.Close()
+		}
+		ftm.releasePort(uploadPort)
+		ftm.releasePort(downloadPort)
+	}
 
 	for uploadConn == nil || downloadConn == nil {
 		select {
-		case uploadConn = <-uploadReady:
-		case downloadConn = <-downloadReady:
-		case <-timeout:
-			log.Printf("Timeout waiting for connections for session %s", session.ID)
-			if uploadConn != nil {
-				uploadConn.Close()
+		case r := <-results:
+			if r.err != nil {
+				if r.upload {
+					slog.Error("Upload accept error", "transfer", session.ID, "err", r.err)
+				} else {
+					slog.Error("Download accept error", "transfer", session.ID, "err", r.err)
+				}
+				cleanup()
+				return
 			}
-			if downloadConn != nil {
-				downloadConn.Close()
+			if r.upload {
+				slog.Info("Upload connection established", "transfer", session.ID)
+				uploadConn = r.conn
+			} else {
+				slog.Info("Download connection established", "transfer", session.ID)
+				downloadConn = r.conn
 			}
-			ftm.releasePort(uploadPort)
-			ftm.releasePort(downloadPort)
-			return
-		case <-done:
-			if uploadConn != nil {
-				uploadConn.Close()
+		case reply := <-session.detach:
+			if uploadConn != nil || downloadConn != nil {
+				// Передача уже началась и завершится в этом процессе
+				reply <- nil
+				continue
+			}
+			// Останавливаем приём; соединение, принятое до остановки,
+			// оставляет передачу в этом процессе
+			setAcceptDeadline(uploadListener, time.Now())
+			setAcceptDeadline(downloadListener, time.Now())
+			for i := 0; i < 2; i++ {
+				if r := <-results; r.err == nil {
+					if r.upload {
+						uploadConn = r.conn
+					} else {
+						downloadConn = r.conn
+					}
+				}
 			}
-			if downloadConn != nil {
-				downloadConn.Close()
+			var files []*os.File
+			if uploadConn == nil && downloadConn == nil {
+				files = listenerFiles(uploadListener, downloadListener)
 			}
-			ftm.releasePort(uploadPort)
-			ftm.releasePort(downloadPort)
+			if files == nil {
+				setAcceptDeadline(uploadListener, time.Time{})
+				setAcceptDeadline(downloadListener, time.Time{})
+				if uploadConn == nil {
+					go accept(uploadListener, true)
+				}
+				if downloadConn == nil {
+					go accept(downloadListener, false)
+				}
+				reply <- nil
+				continue
+			}
+			// Порты остаются занятыми: их слушает новый процесс
+			slog.Info("File transfer proxy handed off", "transfer", session.ID)
+			reply <- files
+			return
+		case <-ftm.stop:
+			slog.Info("File transfer cancelled by shutdown", "transfer", session.ID)
+			session.mu.Lock()
+			session.Status = "cancelled"
+			session.mu.Unlock()
+			ftm.statusChanged("cancelled", 0)
+			cleanup()
+			return
+		case <-timeout:
+			slog.Warn("Timeout waiting for connections", "transfer", session.ID)
+			ftm.statusChanged("timeout", 0)
+			cleanup()
 			return
 		}
 	}
@@ -311,14 +465,15 @@ func (ftm *FileTransferManager) startProxy(session *FileSession, uploadPort, dow
 	session.Status = "transferring"
 	session.mu.Unlock()
 
-	log.Printf("Starting file transfer for session %s", session.ID)
+	slog.Info("Starting file transfer", "transfer", session.ID)
+	ftm.statusChanged("transferring", 0)
 
 	// Пробрасываем данные от upload к download
 	bytesTransferred, err := io.Copy(downloadConn, uploadConn)
 	if err != nil {
-		log.Printf("File transfer error for session %s: %v", session.ID, err)
+		slog.Error("File transfer error", "transfer", session.ID, "err", err)
 	} else {
-		log.Printf("File transfer completed for session %s: %d bytes transferred", session.ID, bytesTransferred)
+		slog.Info("File transfer completed", "transfer", session.ID, "bytes", bytesTransferred)
 	}
 
 	// Закрываем соединения
@@ -338,7 +493,16 @@ func (ftm *FileTransferManager) startProxy(session *FileSession, uploadPort, dow
 	ftm.releasePort(uploadPort)
 	ftm.releasePort(downloadPort)
 
-	log.Printf("File transfer session %s finished with status: %s", session.ID, session.Status)
+	slog.Info("File transfer session finished", "transfer", session.ID, "status", session.Status)
+	if err == nil {
+		ftm.statusChanged("completed", bytesTransferred)
+	} else {
+		ftm.statusChanged("error", bytesTransferred)
+	}
+
+	if err == nil && ftm.OnComplete != nil {
+		ftm.OnComplete(session, bytesTransferred)
+	}
 }
 
 // generateSessionID генерирует уникальный ID сессии
@@ -365,16 +529,22 @@ func itoa(n int) string {
 
 // Ошибки
 var (
-	ErrSessionNotFound   = &FileTransferError{msg: "session not found"}
-	ErrSessionNotPending = &FileTransferError{msg: "session not in pending state"}
-	ErrNoAvailablePorts  = &FileTransferError{msg: "no available ports"}
+	ErrSessionNotFound   = &FileTransferError{msg: "session not found", code: codeNoSession}
+	ErrSessionNotPending = &FileTransferError{msg: "session not in pending state", code: codeBadState}
+	ErrNoAvailablePorts  = &FileTransferError{msg: "no available ports", code: codeUnavailable}
 )
 
 type FileTransferError struct {
-	msg string
+	msg  string
+	code string
 }
 
 func (e *FileTransferError) Error() string {
 	return e.msg
 }
 
+// Code возвращает машиночитаемый код для пакета fail
+func (e *FileTransferError) Code() string {
+	return e.code
+}
+
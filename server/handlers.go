@@ -1,208 +1,226 @@
 package server
 
 import (
-	"log"
+	"context"
+	"log/slog"
 	"msim/db"
 	"msim/protocol"
 	"net"
+	"net/http"
 	"strconv"
-	"strings"
 	"time"
 )
 
-func (s *Server) handlePing(conn net.Conn) {
+func (s *Server) handlePing(session *Session, pkt *protocol.Packet, args []string, conn net.Conn) {
 	s.sendPacket(conn, "pong")
 }
 
-func (s *Server) handleAuth(session *Session, pkt *protocol.Packet, conn net.Conn) {
-	var login, password string
+// login проверяет вход по протоколу и через API: блокировки, пароль или
+// API-ключ бота, задержку после неудачи и отключённые учётные записи.
+// Отказ возвращается ошибкой с кодом: *lockedError, errBadCredentials,
+// errAccountDisabled или errInternal.
+func (s *Server) login(logger *slog.Logger, login, password, ip, via string) (bot bool, err error) {
+	// Заблокированным логину и адресу пароль не проверяем
+	until, err := s.guard.locked(login, ip)
+	if err != nil {
+		logger.Error("Auth error", "err", err)
+		return false, errInternal
+	}
+	if !until.IsZero() {
+		s.audit.record(auditAuthLocked, login, ip, auditDetail("via", via))
+		return false, &lockedError{until: until}
+	}
 
-	// Формат: auth|login|password (DESTINATION=login, CONTENT=password)
-	// или auth|login|password (все в CONTENT)
-	if pkt.Destination != "" {
-		login = pkt.Destination
-		password = pkt.Content
-	} else {
-		if len(pkt.Fields) < 2 {
-			s.sendError(conn, "auth", "Invalid credentials")
-			return
+	// Боты вместо пароля передают API-ключ
+	valid, bot, err := s.authenticate(login, password)
+	if err != nil {
+		logger.Error("Auth error", "err", err)
+		return false, errInternal
+	}
+	if !valid {
+		delay, err := s.guard.failed(login, ip)
+		if err != nil {
+			logger.Error("Failed to record auth failure", "err", err)
 		}
-		login = pkt.Fields[0]
-		password = pkt.Fields[1]
+		s.audit.record(auditAuthFailure, login, ip, auditDetail("via", via))
+		time.Sleep(delay)
+		return false, errBadCredentials
 	}
-
-	if login == "" || password == "" {
-		s.sendError(conn, "auth", "Invalid credentials")
-		return
+	disabled, err := s.db.IsUserDisabled(login)
+	if err != nil {
+		logger.Error("Auth error", "err", err)
+		return false, errInternal
+	}
+	if disabled {
+		s.audit.record(auditAuthDisabled, login, ip, auditDetail("via", via))
+		return false, errAccountDisabled
+	}
+	if err := s.guard.succeeded(login); err != nil {
+		logger.Error("Failed to reset auth failures", "err", err)
 	}
 
+	s.audit.record(auditAuthSuccess, login, ip, auditDetail("via", via), auditDetail("bot", strconv.FormatBool(bot)))
+	return bot, nil
+}
+
+func (s *Server) handleAuth(session *Session, pkt *protocol.Packet, args []string, conn net.Conn) {
+	// Формат: auth|login|password
+	login, password := args[0], args[1]
+
 	// Если уже авторизован
 	if session.Login != "" {
 		s.sendOK(conn, "auth")
 		return
 	}
 
-	valid, err := s.db.AuthenticateUser(login, password)
+	bot, err := s.login(session.logger(), login, password, remoteIP(conn), "protocol")
 	if err != nil {
-		log.Printf("Auth error: %v", err)
-		s.sendError(conn, "auth", "Internal error")
-		return
-	}
-
-	if !valid {
-		s.sendError(conn, "auth", "Invalid credentials")
+		s.sendError(session, "auth", errorCode(err), err.Error())
 		return
 	}
 
 	// Авторизация успешна
 	session.Login = login
+	session.Bot = bot
 	s.addSession(login, session)
 	s.sendOK(conn, "auth")
 
 	// Обновляем время последнего подключения
 	now := time.Now().UTC()
 	if err := s.db.UpdateLastOnline(login, now); err != nil {
-		log.Printf("Failed to update last_online for %s: %v", login, err)
+		session.logger().Error("Failed to update last_online", "err", err)
+	}
+	// Боты подключаются на короткое время, поэтому контактов о них не уведомляем
+	if !bot {
+		s.notifyContactsOnline(login, now)
 	}
-	s.notifyContactsOnline(login, now)
+	s.motdOnLogin(session)
+	s.noticeOnLogin(session)
+	s.pluginsOnAuth(login, bot)
 }
 
-func (s *Server) handleRegister(session *Session, pkt *protocol.Packet, conn net.Conn) {
-	var login, password string
+func (s *Server) handleRegister(session *Session, pkt *protocol.Packet, args []string, conn net.Conn) {
+	// Формат: reg|login|password
+	login, password := args[0], args[1]
 
-	// Формат: reg|login|password (DESTINATION=login, CONTENT=password)
-	// или reg|login|password (все в CONTENT)
-	if pkt.Destination != "" {
-		login = pkt.Destination
-		password = pkt.Content
-	} else {
-		if len(pkt.Fields) < 2 {
-			s.sendError(conn, "reg", "Invalid data")
-			return
-		}
-		login = pkt.Fields[0]
-		password = pkt.Fields[1]
+	if !s.validLogin(login) {
+		s.sendError(session, "reg", codeInvalid, "Invalid login")
+		return
 	}
 
-	if login == "" || password == "" {
-		s.sendError(conn, "reg", "Invalid data")
+	ip := remoteIP(conn)
+	allowed, err := s.guard.allowRegistration(ip)
+	if err != nil {
+		session.logger().Error("Register error", "err", err)
+		s.sendError(session, "reg", codeInternal, "Internal error")
+		return
+	}
+	if !allowed {
+		s.audit.record(auditRegisterDenied, login, ip)
+		s.sendError(session, "reg", codeLocked, "Too many registrations")
 		return
 	}
 
 	exists, err := s.db.UserExists(login)
 	if err != nil {
-		log.Printf("Register error: %v", err)
-		s.sendError(conn, "reg", "Internal error")
+		session.logger().Error("Register error", "err", err)
+		s.sendError(session, "reg", codeInternal, "Internal error")
 		return
 	}
 
 	if exists {
-		s.sendError(conn, "reg", "User already exists")
+		s.sendError(session, "reg", codeUserExists, "User already exists")
 		return
 	}
 
 	err = s.db.CreateUser(login, password)
 	if err != nil {
-		log.Printf("Register error: %v", err)
-		s.sendError(conn, "reg", "Internal error")
+		session.logger().Error("Register error", "err", err)
+		s.sendError(session, "reg", codeInternal, "Internal error")
 		return
 	}
 
+	s.audit.record(auditRegister, login, ip)
 	s.sendOK(conn, "reg")
+	s.emitWebhook(webhookUserRegistered, map[string]string{"user": login})
 }
 
-func (s *Server) handleMessage(session *Session, pkt *protocol.Packet, conn net.Conn) {
-	if session.Login == "" {
-		s.sendError(conn, "msg", "Not authenticated")
-		return
-	}
+func (s *Server) handleMessage(session *Session, pkt *protocol.Packet, args []string, conn net.Conn) {
+	// Формат: msg|recipient|text
+	recipient, text := args[0], args[1]
 
-	recipient := pkt.Destination
-	text := pkt.Content
-
-	if recipient == "" {
-		s.sendError(conn, "msg", "Recipient required")
+	if _, err := s.deliverMessage(session.Login, recipient, text); err != nil {
+		s.sendError(session, "msg", errorCode(err), err.Error())
 		return
 	}
 
-	if text == "" {
-		s.sendError(conn, "msg", "Message text required")
-		return
-	}
+	s.sendOK(conn, "msg")
+}
 
+// deliverMessage сохраняет сообщение и отправляет его получателю, если он онлайн.
+// Используется и протоколом, и HTTP API, поэтому сообщение доходит до получателя
+// независимо от того, каким способом подключены стороны.
+func (s *Server) deliverMessage(sender, recipient, text string) (time.Time, error) {
 	// Проверяем, существует ли получатель в системе
 	exists, err := s.db.UserExists(recipient)
 	if err != nil {
-		log.Printf("Message error: %v", err)
-		s.sendError(conn, "msg", "Internal error")
-		return
+		slog.Error("Message error", "sender", sender, "recipient", recipient, "err", err)
+		return time.Time{}, errInternal
 	}
 
 	if !exists {
-		s.sendError(conn, "msg", "Recipient not found")
-		return
+		return time.Time{}, errRecipientNotFound
+	}
+
+	if !s.validMessage(text) {
+		return time.Time{}, errMessageTooLong
+	}
+
+	// Плагины могут изменить текст или отклонить сообщение
+	msg := Message{Sender: sender, Recipient: recipient, Text: text}
+	if err := s.beforeMessage(&msg); err != nil {
+		return time.Time{}, err
 	}
+	text = msg.Text
 
 	timestamp := time.Now().UTC()
-	err = s.db.SaveMessage(session.Login, recipient, text, timestamp)
+	start := time.Now()
+	err = s.db.SaveMessage(sender, recipient, text, timestamp)
+	s.promMetrics.messageStore.observe("", time.Since(start))
 	if err != nil {
-		log.Printf("Message error: %v", err)
-		s.sendError(conn, "msg", "Internal error")
-		return
+		slog.Error("Message error", "sender", sender, "recipient", recipient, "err", err)
+		return time.Time{}, errInternal
 	}
 
-	// Отправляем сообщение получателю, если он онлайн
 	// Формат: msg|sender|text|timestamp (timestamp - отдельное неэкранированное поле)
+	ts := timestamp.Format("2006-01-02T15:04:05Z")
 	if recipientConn, ok := s.getSessionConn(recipient); ok {
-		timestampStr := timestamp.Format("2006-01-02T15:04:05Z")
-		// Формируем пакет вручную: msg|sender|text|timestamp
-		packet := "msg|" + protocol.Escape(session.Login) + "|" + protocol.Escape(text) + "|" + timestampStr + "\n"
-		recipientConn.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout))
-		if _, err := recipientConn.Write([]byte(packet)); err != nil {
-			log.Printf("Error writing message to %s: %v", recipient, err)
-		}
+		s.sendEncoded(recipientConn, &protocol.MessagePacket{
+			Sender:    sender,
+			Text:      text,
+			Timestamp: ts,
+		})
 	}
 
-	s.sendOK(conn, "msg")
-}
+	s.emitMessageWebhook(webhookMessageStored, sender, recipient, map[string]string{
+		"from":      sender,
+		"to":        recipient,
+		"text":      text,
+		"timestamp": ts,
+	})
 
-func (s *Server) handleAck(session *Session, pkt *protocol.Packet, conn net.Conn) {
-	if session.Login == "" {
-		s.sendError(conn, "ack", "Not authenticated")
-		return
-	}
-
-	var sender, timestampStr string
+	msg.Timestamp = timestamp
+	s.afterMessage(msg)
 
-	// Формат: ack|sender|timestamp (DESTINATION=sender, CONTENT=timestamp)
-	if pkt.Destination != "" {
-		sender = pkt.Destination
-		timestampStr = pkt.Content
-	} else {
-		if len(pkt.Fields) < 2 {
-			s.sendError(conn, "ack", "Invalid ack format")
-			return
-		}
-		sender = pkt.Fields[0]
-		timestampStr = pkt.Fields[1]
-	}
-
-	if sender == "" || timestampStr == "" {
-		s.sendError(conn, "ack", "Invalid ack format")
-		return
-	}
+	return timestamp, nil
+}
 
-	timestamp, err := time.Parse("2006-01-02T15:04:05Z", timestampStr)
-	if err != nil {
-		s.sendError(conn, "ack", "Invalid timestamp")
-		return
-	}
+func (s *Server) handleAck(session *Session, pkt *protocol.Packet, args []string, conn net.Conn) {
+	// Формат: ack|sender|timestamp
+	sender, timestampStr := args[0], args[1]
 
-	// Обновляем статус сообщения
-	err = s.db.MarkMessageAcknowledged(sender, session.Login, timestamp)
-	if err != nil {
-		log.Printf("Ack error: %v", err)
-		s.sendError(conn, "ack", "Internal error")
+	if err := s.acknowledgeMessage(session.Login, sender, timestampStr); err != nil {
+		s.sendError(session, "ack", errorCode(err), err.Error())
 		return
 	}
 
@@ -215,334 +233,244 @@ func (s *Server) handleAck(session *Session, pkt *protocol.Packet, conn net.Conn
 	}
 }
 
-func (s *Server) handleHistory(session *Session, pkt *protocol.Packet, conn net.Conn) {
-	if session.Login == "" {
-		s.sendError(conn, "hist", "Not authenticated")
-		return
+// acknowledgeMessage отмечает сообщение от sender к recipient доставленным
+func (s *Server) acknowledgeMessage(recipient, sender, timestampStr string) error {
+	timestamp, err := time.Parse("2006-01-02T15:04:05Z", timestampStr)
+	if err != nil {
+		return errInvalidTimestamp
 	}
 
-	contact := pkt.Destination
-	if contact == "" {
-		if len(pkt.Fields) > 0 {
-			contact = pkt.Fields[0]
-		} else {
-			s.sendError(conn, "hist", "Contact required")
-			return
-		}
+	// Обновляем статус сообщения
+	if err := s.db.MarkMessageAcknowledged(sender, recipient, timestamp); err != nil {
+		slog.Error("Ack error", "sender", sender, "recipient", recipient, "err", err)
+		return errInternal
 	}
 
+	s.emitMessageWebhook(webhookMessageAcked, sender, recipient, map[string]string{
+		"from":      sender,
+		"to":        recipient,
+		"timestamp": timestampStr,
+	})
+	return nil
+}
+
+func (s *Server) handleHistory(session *Session, pkt *protocol.Packet, args []string, conn net.Conn) {
+	contact := args[0]
 	offset := 0
 	limit := 1000 // по умолчанию большое число для получения всех сообщений
 
-	// Формат: hist|contact или hist|contact|limit или hist|contact|offset|limit
-	// Если DESTINATION указан, то параметры в Fields (из CONTENT)
-	if pkt.Destination != "" {
-		// hist|contact|limit - один параметр в CONTENT
-		if len(pkt.Fields) == 1 {
-			if parsed, err := strconv.Atoi(pkt.Fields[0]); err == nil {
-				limit = parsed
-			}
-		}
-		// hist|contact|offset|limit - два параметра в CONTENT
-		if len(pkt.Fields) >= 2 {
-			if parsed, err := strconv.Atoi(pkt.Fields[0]); err == nil {
-				offset = parsed
-			}
-			if parsed, err := strconv.Atoi(pkt.Fields[1]); err == nil {
-				limit = parsed
-			}
-		}
-	} else {
-		// Формат без DESTINATION: hist|contact|limit или hist|contact|offset|limit (все в CONTENT)
-		if len(pkt.Fields) >= 1 {
-			contact = pkt.Fields[0]
-		}
-		if len(pkt.Fields) >= 2 {
-			if parsed, err := strconv.Atoi(pkt.Fields[1]); err == nil {
-				limit = parsed
-			}
-		}
-		if len(pkt.Fields) >= 3 {
-			if parsed, err := strconv.Atoi(pkt.Fields[1]); err == nil {
-				offset = parsed
-			}
-			if parsed, err := strconv.Atoi(pkt.Fields[2]); err == nil {
-				limit = parsed
-			}
-		}
+	// Формат: hist|contact или hist|contact|limit или hist|contact|offset|limit:
+	// единственный числовой параметр — это limit
+	offsetStr, limitStr := args[1], args[2]
+	if limitStr == "" {
+		offsetStr, limitStr = "", offsetStr
+	}
+	if parsed, err := strconv.Atoi(offsetStr); err == nil {
+		offset = parsed
+	}
+	if parsed, err := strconv.Atoi(limitStr); err == nil {
+		limit = parsed
 	}
 
 	messages, err := s.db.GetMessages(session.Login, contact, offset, limit)
 	if err != nil {
-		log.Printf("History error: %v", err)
-		s.sendError(conn, "hist", "Internal error")
+		session.logger().Error("History error", "err", err)
+		s.sendError(session, "hist", codeInternal, "Internal error")
 		return
 	}
 
-	var items []string
-	for _, msg := range messages {
-		timestampStr := msg.Timestamp.Format("2006-01-02T15:04:05Z")
-		// Формат: msg|sender|text|timestamp|status (| не экранируются внутри списка)
-		item := "msg|" + protocol.Escape(msg.Sender) + "|" + protocol.Escape(msg.Text) + "|" + timestampStr + "|" + msg.Status
-		items = append(items, item)
-	}
-
-	response := strings.Join(items, ",")
 	// Формат: hist|contact|msg|sender|text|timestamp|status,msg|...
-	// response содержит msg|sender|text|timestamp|status, где | не должны экранироваться
-	rawContent := protocol.Escape(contact) + "|" + response
-	s.sendPacketRaw(conn, "hist", rawContent)
+	history := &protocol.HistoryPacket{Contact: contact}
+	for _, msg := range messages {
+		history.Entries = append(history.Entries, protocol.HistoryEntry{
+			Sender:    msg.Sender,
+			Text:      msg.Text,
+			Timestamp: msg.Timestamp.Format("2006-01-02T15:04:05Z"),
+			Status:    msg.Status,
+		})
+	}
+	s.sendEncoded(conn, history)
 }
 
-func (s *Server) handleClearHistory(session *Session, pkt *protocol.Packet, conn net.Conn) {
-	if session.Login == "" {
-		s.sendError(conn, "hclear", "Not authenticated")
-		return
-	}
-
-	contact := pkt.Destination
-	if contact == "" {
-		if len(pkt.Fields) > 0 {
-			contact = pkt.Fields[0]
-		} else {
-			contact = pkt.Content
-		}
-	}
-
-	if contact == "" {
-		s.sendError(conn, "hclear", "Contact required")
-		return
-	}
-
+func (s *Server) handleClearHistory(session *Session, pkt *protocol.Packet, args []string, conn net.Conn) {
+	contact := args[0]
 	err := s.db.ClearHistory(session.Login, contact)
 	if err != nil {
-		log.Printf("Clear history error: %v", err)
-		s.sendError(conn, "hclear", "Internal error")
+		session.logger().Error("Clear history error", "err", err)
+		s.sendError(session, "hclear", codeInternal, "Internal error")
 		return
 	}
+	s.audit.record(auditHistoryClear, session.Login, remoteIP(conn), auditDetail("contact", contact))
 
 	s.sendOK(conn, "hclear")
 }
 
-func (s *Server) handleStatus(session *Session, pkt *protocol.Packet, conn net.Conn) {
-	if session.Login == "" {
-		s.sendError(conn, "stat", "Not authenticated")
-		return
-	}
-
-	// Извлекаем опциональный параметр - ID пользователя
-	var targetUser string
-	if pkt.Destination != "" {
-		targetUser = pkt.Destination
-	} else if pkt.Content != "" {
-		targetUser = pkt.Content
-	} else if len(pkt.Fields) > 0 {
-		targetUser = pkt.Fields[0]
-	}
+func (s *Server) handleStatus(session *Session, pkt *protocol.Packet, args []string, conn net.Conn) {
+	// Опциональный параметр - ID пользователя
+	targetUser := args[0]
 
-	var items []string
+	// Формат: stat|user|status|last_seen,user|status|last_seen,...
+	statuses := &protocol.StatusPacket{}
 
 	if targetUser != "" {
 		// Запрос статуса конкретного пользователя
 		// Проверяем, существует ли пользователь
 		exists, err := s.db.UserExists(targetUser)
 		if err != nil {
-			log.Printf("Status error: %v", err)
-			s.sendError(conn, "stat", "Internal error")
+			session.logger().Error("Status error", "err", err)
+			s.sendError(session, "stat", codeInternal, "Internal error")
 			return
 		}
 
 		if !exists {
-			s.sendError(conn, "stat", "User not found")
+			s.sendError(session, "stat", codeNoUser, "User not found")
 			return
 		}
 
-		// Проверяем статус пользователя и получаем last_seen
-		status := "off"
-		var lastSeen time.Time
-		if _, ok := s.getSession(targetUser); ok {
-			status = "on"
-		}
-
-		// Получаем время последнего изменения статуса
-		lastOnline, lastOffline, err := s.db.GetUserStatus(targetUser)
+		entry, err := s.userStatus(targetUser)
 		if err != nil {
-			log.Printf("Status error getting user status: %v", err)
-			s.sendError(conn, "stat", "Internal error")
+			session.logger().Error("Status error getting user status", "err", err)
+			s.sendError(session, "stat", codeInternal, "Internal error")
 			return
 		}
-
-		// last_seen - большее из last_online и last_offline
-		if lastOnline.After(lastOffline) {
-			lastSeen = lastOnline
-		} else {
-			lastSeen = lastOffline
-		}
-
-		// Формат: user|status|last_seen (| не экранируется внутри списка)
-		item := protocol.Escape(targetUser) + "|" + status + "|" + lastSeen.Format(time.RFC3339)
-		items = append(items, item)
+		statuses.Entries = append(statuses.Entries, entry)
 	} else {
 		// Запрос статусов всех контактов
 		contacts, err := s.db.GetContacts(session.Login)
 		if err != nil {
-			log.Printf("Status error: %v", err)
-			s.sendError(conn, "stat", "Internal error")
+			session.logger().Error("Status error", "err", err)
+			s.sendError(session, "stat", codeInternal, "Internal error")
 			return
 		}
 
 		for _, contact := range contacts {
-			status := "off"
-			var lastSeen time.Time
-			if _, ok := s.getSession(contact.Contact); ok {
-				status = "on"
-			}
-
-			// Получаем время последнего изменения статуса
-			lastOnline, lastOffline, err := s.db.GetUserStatus(contact.Contact)
+			entry, err := s.userStatus(contact.Contact)
 			if err != nil {
-				log.Printf("Status error getting contact status: %v", err)
+				session.logger().Error("Status error getting contact status", "err", err)
 				continue // Пропускаем контакт при ошибке
 			}
-
-			// last_seen - большее из last_online и last_offline
-			if lastOnline.After(lastOffline) {
-				lastSeen = lastOnline
-			} else {
-				lastSeen = lastOffline
-			}
-
-			// Формат: user|status|last_seen (| не экранируется внутри списка)
-			item := protocol.Escape(contact.Contact) + "|" + status + "|" + lastSeen.Format(time.RFC3339)
-			items = append(items, item)
+			statuses.Entries = append(statuses.Entries, entry)
 		}
 	}
 
-	response := strings.Join(items, ",")
-	// response содержит user|status|last_seen, где | не должен экранироваться
-	s.sendPacketRaw(conn, "stat", response)
+	s.sendEncoded(conn, statuses)
 }
 
-func (s *Server) handleList(session *Session, conn net.Conn) {
-	if session.Login == "" {
-		s.sendError(conn, "list", "Not authenticated")
-		return
+// userStatus возвращает текущий статус пользователя и время его последнего изменения
+func (s *Server) userStatus(login string) (protocol.StatusEntry, error) {
+	status := "off"
+	if _, ok := s.getSession(login); ok {
+		status = "on"
 	}
 
-	contacts, err := s.db.GetContacts(session.Login)
+	// Получаем время последнего изменения статуса
+	lastOnline, lastOffline, err := s.db.GetUserStatus(login)
 	if err != nil {
-		log.Printf("List error: %v", err)
-		s.sendError(conn, "list", "Internal error")
-		return
+		return protocol.StatusEntry{}, err
 	}
 
-	var items []string
-	for _, contact := range contacts {
-		// Формат: contact|nick (| не экранируется внутри списка)
-		item := protocol.Escape(contact.Contact) + "|" + protocol.Escape(contact.Nick)
-		items = append(items, item)
+	// last_seen - большее из last_online и last_offline
+	lastSeen := lastOffline
+	if lastOnline.After(lastOffline) {
+		lastSeen = lastOnline
 	}
 
-	response := strings.Join(items, ",")
-	// response содержит contact|nick, где | не должен экранироваться
-	s.sendPacketRaw(conn, "list", response)
+	bot, err := s.db.IsBot(login)
+	if err != nil {
+		return protocol.StatusEntry{}, err
+	}
+
+	return protocol.StatusEntry{
+		User:     login,
+		Status:   status,
+		LastSeen: lastSeen.Format(time.RFC3339),
+		Bot:      bot,
+	}, nil
 }
 
-func (s *Server) handleAddContact(session *Session, pkt *protocol.Packet, conn net.Conn) {
-	if session.Login == "" {
-		s.sendError(conn, "add", "Not authenticated")
+func (s *Server) handleList(session *Session, pkt *protocol.Packet, args []string, conn net.Conn) {
+	contacts, err := s.db.GetContacts(session.Login)
+	if err != nil {
+		session.logger().Error("List error", "err", err)
+		s.sendError(session, "list", codeInternal, "Internal error")
 		return
 	}
 
-	// Формат: add|contact|nick или add|contact (DESTINATION=contact, CONTENT=nick или пусто)
-	// или add|contact|nick где оба в CONTENT
-	var contact, nick string
-	if pkt.Destination != "" {
-		contact = pkt.Destination
-		if len(pkt.Fields) > 0 {
-			nick = pkt.Fields[0]
-		} else {
-			nick = pkt.Content
-		}
-	} else {
-		if len(pkt.Fields) < 1 {
-			s.sendError(conn, "add", "Invalid data")
-			return
-		}
-		contact = pkt.Fields[0]
-		if len(pkt.Fields) >= 2 {
-			nick = pkt.Fields[1]
-		}
+	// Формат: list|contact|nick[|bot],contact|nick[|bot],...
+	list := &protocol.ListPacket{}
+	for _, contact := range contacts {
+		list.Entries = append(list.Entries, protocol.ContactEntry{Login: contact.Contact, Nick: contact.Nick, Bot: contact.Bot})
 	}
+	s.sendEncoded(conn, list)
+}
+
+func (s *Server) handleAddContact(session *Session, pkt *protocol.Packet, args []string, conn net.Conn) {
+	// Формат: add|contact|nick или add|contact (ник по умолчанию — id контакта)
+	contact, nick := args[0], args[1]
 
-	if contact == "" {
-		s.sendError(conn, "add", "Invalid data")
+	if err := s.addContact(session.Login, contact, nick); err != nil {
+		s.sendError(session, "add", errorCode(err), err.Error())
 		return
 	}
 
+	s.sendOK(conn, "add")
+}
+
+// addContact добавляет существующего пользователя в список контактов owner
+func (s *Server) addContact(owner, contact, nick string) error {
 	// Проверяем, существует ли пользователь-контакт в системе
 	exists, err := s.db.UserExists(contact)
 	if err != nil {
-		log.Printf("Add contact error: %v", err)
-		s.sendError(conn, "add", "Internal error")
-		return
+		slog.Error("Add contact error", "login", owner, "contact", contact, "err", err)
+		return errInternal
 	}
 
 	if !exists {
-		s.sendError(conn, "add", "User not found")
-		return
+		return errUserNotFound
 	}
 
 	// Если ник не указан, используем id контакта в качестве ника
 	if nick == "" {
 		nick = contact
 	}
-
-	err = s.db.AddContact(session.Login, contact, nick)
-	if err != nil {
-		log.Printf("Add contact error: %v", err)
-		s.sendError(conn, "add", "Contact already exists or internal error")
-		return
-	}
-
-	s.sendOK(conn, "add")
-}
-
-func (s *Server) handleRenameContact(session *Session, pkt *protocol.Packet, conn net.Conn) {
-	if session.Login == "" {
-		s.sendError(conn, "ren", "Not authenticated")
-		return
+	if !s.validNick(nick) {
+		return errInvalidNick
 	}
 
-	var contact, nick string
-	if pkt.Destination != "" {
-		contact = pkt.Destination
-		if len(pkt.Fields) > 0 {
-			nick = pkt.Fields[0]
-		} else {
-			nick = pkt.Content
+	if s.cfg().MaxContacts > 0 {
+		count, err := s.db.CountContacts(owner)
+		if err != nil {
+			slog.Error("Add contact error", "login", owner, "contact", contact, "err", err)
+			return errInternal
 		}
-	} else {
-		if len(pkt.Fields) < 2 {
-			s.sendError(conn, "ren", "Invalid data")
-			return
+		if count >= s.cfg().MaxContacts {
+			return errContactLimit
 		}
-		contact = pkt.Fields[0]
-		nick = pkt.Fields[1]
 	}
 
-	if contact == "" || nick == "" {
-		s.sendError(conn, "ren", "Invalid data")
+	if err := s.db.AddContact(owner, contact, nick); err != nil {
+		slog.Error("Add contact error", "login", owner, "contact", contact, "err", err)
+		return errContactExists
+	}
+	return nil
+}
+
+func (s *Server) handleRenameContact(session *Session, pkt *protocol.Packet, args []string, conn net.Conn) {
+	// Формат: ren|contact|nick
+	contact, nick := args[0], args[1]
+
+	if !s.validNick(nick) {
+		s.sendError(session, "ren", codeInvalid, "Invalid nick")
 		return
 	}
 
 	err := s.db.UpdateContactNick(session.Login, contact, nick)
 	if err != nil {
 		if err == db.ErrNoRows {
-			s.sendError(conn, "ren", "Contact not found")
+			s.sendError(session, "ren", codeNoContact, "Contact not found")
 		} else {
-			log.Printf("Rename contact error: %v", err)
-			s.sendError(conn, "ren", "Internal error")
+			session.logger().Error("Rename contact error", "err", err)
+			s.sendError(session, "ren", codeInternal, "Internal error")
 		}
 		return
 	}
@@ -550,43 +478,30 @@ func (s *Server) handleRenameContact(session *Session, pkt *protocol.Packet, con
 	s.sendOK(conn, "ren")
 }
 
-func (s *Server) handleDeleteContact(session *Session, pkt *protocol.Packet, conn net.Conn) {
-	if session.Login == "" {
-		s.sendError(conn, "del", "Not authenticated")
-		return
-	}
-
-	var contact string
-	if pkt.Destination != "" {
-		contact = pkt.Destination
-	} else {
-		if len(pkt.Fields) > 0 {
-			contact = pkt.Fields[0]
-		} else {
-			contact = pkt.Content
-		}
-	}
-
-	if contact == "" {
-		s.sendError(conn, "del", "Invalid data")
-		return
-	}
-
+func (s *Server) handleDeleteContact(session *Session, pkt *protocol.Packet, args []string, conn net.Conn) {
+	contact := args[0]
 	err := s.db.DeleteContact(session.Login, contact)
 	if err != nil {
 		if err == db.ErrNoRows {
-			s.sendError(conn, "del", "Contact not found")
+			s.sendError(session, "del", codeNoContact, "Contact not found")
 		} else {
-			log.Printf("Delete contact error: %v", err)
-			s.sendError(conn, "del", "Internal error")
+			session.logger().Error("Delete contact error", "err", err)
+			s.sendError(session, "del", codeInternal, "Internal error")
 		}
 		return
 	}
+	s.audit.record(auditContactDelete, session.Login, remoteIP(conn), auditDetail("contact", contact))
 
 	s.sendOK(conn, "del")
 }
 
 func (s *Server) notifyContactsOnline(login string, timestamp time.Time) {
+	s.pluginsOnPresence(login, true, timestamp)
+	s.emitWebhook(webhookUserOnline, map[string]string{
+		"user":      login,
+		"timestamp": timestamp.Format(time.RFC3339),
+	})
+
 	contacts, err := s.db.GetContacts(login)
 	if err != nil {
 		return
@@ -601,6 +516,12 @@ func (s *Server) notifyContactsOnline(login string, timestamp time.Time) {
 }
 
 func (s *Server) notifyContactsOffline(login string, timestamp time.Time) {
+	s.pluginsOnPresence(login, false, timestamp)
+	s.emitWebhook(webhookUserOffline, map[string]string{
+		"user":      login,
+		"timestamp": timestamp.Format(time.RFC3339),
+	})
+
 	contacts, err := s.db.GetContacts(login)
 	if err != nil {
 		return
@@ -614,45 +535,173 @@ func (s *Server) notifyContactsOffline(login string, timestamp time.Time) {
 	}
 }
 
-func (s *Server) handleBye(session *Session, pkt *protocol.Packet, conn net.Conn) {
+func (s *Server) handleBye(session *Session, pkt *protocol.Packet, args []string, conn net.Conn) {
 	// Клиент запросил завершение сессии
 	// Отправляем подтверждение
 	s.sendPacket(conn, "bye")
 
-	// Удаляем сессию
-	if session.Login != "" {
-		remoteAddr := conn.RemoteAddr().String()
-		s.removeSession(session.Login)
+	// Удаляем сессию, если её не вытеснило новое подключение
+	if session.Login != "" && s.removeSession(session) {
 
 		// Обновляем время последнего отключения
 		now := time.Now().UTC()
 		if err := s.db.UpdateLastOffline(session.Login, now); err != nil {
-			log.Printf("Failed to update last_offline for %s: %v", session.Login, err)
+			session.logger().Error("Failed to update last_offline", "err", err)
+		}
+		if !session.Bot {
+			s.notifyContactsOffline(session.Login, now)
 		}
-		s.notifyContactsOffline(session.Login, now)
-		log.Printf("Client %s disconnected (bye) from %s", session.Login, remoteAddr)
+		session.logger().Info("Client disconnected (bye)")
 	}
 
 	// Соединение закроется в defer handleConnection
 }
 
-// Shutdown отправляет bye всем подключенным клиентам с указанием причины
+// Shutdown останавливает сервер: перестаёт принимать соединения, рассылает
+// контактам off, даёт закончить обработку текущих пакетов, отправляет всем
+// клиентам bye с указанием причины, ждёт идущих передач файлов и одной
+// транзакцией сохраняет время отключения пользователей.
 // reason может быть: "maintenance", "restart", "timeout"
 // completionTime - время завершения обслуживания/перезагрузки в формате ISO 8601 (UTC)
 // Для timeout completionTime может быть нулевым
-func (s *Server) Shutdown(reason string, completionTime time.Time) {
-	// Set shutdown flag and close listener
+// Когда ctx истекает, оставшиеся соединения закрываются и возвращается
+// ctx.Err(); повторный вызов возвращает ErrShuttingDown.
+func (s *Server) Shutdown(ctx context.Context, reason string, completionTime time.Time) error {
 	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		return ErrShuttingDown
+	}
 	s.shutdown = true
 	if s.listener != nil {
 		s.listener.Close()
 	}
+	var httpServers []*http.Server
+	for _, srv := range []*http.Server{s.wsServer, s.apiServer, s.metricsSrv} {
+		if srv != nil {
+			httpServers = append(httpServers, srv)
+		}
+	}
 	sessions := make([]*Session, 0, len(s.sessions))
 	for _, sess := range s.sessions {
 		sessions = append(sessions, sess)
 	}
+	conns := make([]*Session, 0, len(s.active))
+	for sess := range s.active {
+		conns = append(conns, sess)
+	}
+	for _, sess := range sessions {
+		if _, ok := s.active[sess]; !ok {
+			// Поток событий HTTP API
+			conns = append(conns, sess)
+		}
+	}
+	s.mu.Unlock()
+
+	// HTTP-серверы дожидаются текущих запросов; потоки событий завершатся,
+	// когда закроются их сессии
+	httpDone := make(chan error, len(httpServers))
+	for _, srv := range httpServers {
+		go func(srv *http.Server) {
+			err := srv.Shutdown(ctx)
+			if err != nil {
+				srv.Close()
+			}
+			httpDone <- err
+		}(srv)
+	}
+
+	// Контакты узнают об отключении, пока они ещё на связи
+	now := time.Now().UTC()
+	for _, sess := range sessions {
+		if !sess.Bot {
+			s.notifyContactsOffline(sess.Login, now)
+		}
+	}
+
+	var details string
+	if !completionTime.IsZero() {
+		details = completionTime.UTC().Format("2006-01-02T15:04:05Z")
+	}
+	for _, sess := range conns {
+		go func(sess *Session) {
+			// Пакет, который уже обрабатывается, получит ответ до bye
+			sess.busy.Lock()
+			defer sess.busy.Unlock()
+			s.sendBye(sess.Conn, reason, details)
+			sess.Conn.Close()
+		}(sess)
+	}
+
+	var err error
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		for _, sess := range conns {
+			sess.Conn.Close()
+		}
+		<-done
+		err = ctx.Err()
+	}
+	if ferr := s.fileManager.Drain(ctx); err == nil {
+		err = ferr
+	}
+	for range httpServers {
+		if herr := <-httpDone; err == nil {
+			err = herr
+		}
+	}
+
+	// Сессии, открытые через HTTP API во время остановки, тоже отключены
+	seen := make(map[string]bool, len(sessions))
+	logins := make([]string, 0, len(sessions))
+	s.mu.Lock()
+	for _, sess := range sessions {
+		seen[sess.Login] = true
+		logins = append(logins, sess.Login)
+	}
+	for login := range s.sessions {
+		if !seen[login] {
+			logins = append(logins, login)
+		}
+	}
+	s.sessions = make(map[string]*Session)
 	s.mu.Unlock()
 
+	if uerr := s.db.UpdateLastOfflineAll(logins, now); uerr != nil {
+		slog.Error("Failed to update last_offline", "err", uerr)
+	}
+
+	// Недоставленные события останутся в очереди до следующего запуска
+	if s.webhooks != nil {
+		s.webhooks.Stop()
+	}
+	slog.Info("Server drained", "sessions", len(logins), "connections", len(conns))
+	return err
+}
+
+// isShuttingDown сообщает, что сервер останавливается или передал работу
+// новому процессу
+func (s *Server) isShuttingDown() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.shutdown
+}
+
+// disconnectAll отключает всех пользователей пакетом bye|reason|completionTime
+func (s *Server) disconnectAll(reason string, completionTime time.Time) {
+	s.mu.RLock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	s.mu.RUnlock()
+
 	var details string
 	if !completionTime.IsZero() {
 		details = completionTime.UTC().Format("2006-01-02T15:04:05Z")
@@ -665,129 +714,68 @@ func (s *Server) Shutdown(reason string, completionTime time.Time) {
 		if sess.Login != "" {
 			// Обновляем время последнего отключения
 			if err := s.db.UpdateLastOffline(sess.Login, now); err != nil {
-				log.Printf("Failed to update last_offline for %s: %v", sess.Login, err)
+				sess.logger().Error("Failed to update last_offline", "err", err)
 			}
-			s.removeSession(sess.Login)
+			s.removeSession(sess)
+			s.emitWebhook(webhookUserOffline, map[string]string{
+				"user":      sess.Login,
+				"timestamp": now.Format(time.RFC3339),
+			})
 		}
 	}
 }
 
-func (s *Server) handleHelp(conn net.Conn) {
+func (s *Server) handleHelp(session *Session, pkt *protocol.Packet, args []string, conn net.Conn) {
 	// Формат: help|command1,command2,command3,...
-	commands := []string{
-		"ping",
-		"auth",
-		"reg",
-		"msg",
-		"ack",
-		"hist",
-		"hclear",
-		"offmsg",
-		"stat",
-		"list",
-		"add",
-		"ren",
-		"del",
-		"bye",
-		"help",
-		"fsnd",
-		"facc",
-		"fdec",
-		"fcan",
-		"fst",
-	}
-
-	response := strings.Join(commands, ",")
-	// response содержит список команд через запятую, запятые не должны экранироваться
-	s.sendPacketRaw(conn, "help", response)
+	// Список строится по реестру команд, включая пакеты плагинов
+	s.sendEncoded(conn, &protocol.HelpPacket{Commands: s.commands.names()})
 }
 
-func (s *Server) handleOfflineMessages(session *Session, conn net.Conn) {
-	if session.Login == "" {
-		s.sendError(conn, "offmsg", "Not authenticated")
-		return
-	}
-
+func (s *Server) handleOfflineMessages(session *Session, pkt *protocol.Packet, args []string, conn net.Conn) {
 	counts, err := s.db.GetOfflineMessageCounts(session.Login)
 	if err != nil {
-		log.Printf("Offmsg error: %v", err)
-		s.sendError(conn, "offmsg", "Internal error")
+		session.logger().Error("Offmsg error", "err", err)
+		s.sendError(session, "offmsg", codeInternal, "Internal error")
 		return
 	}
 
-	var items []string
+	// Формат: offmsg|contact|count,contact|count,...
+	offline := &protocol.OfflinePacket{}
 	for sender, count := range counts {
-		// Формат: contact|count (| не экранируется внутри списка)
-		item := protocol.Escape(sender) + "|" + strconv.Itoa(count)
-		items = append(items, item)
+		offline.Entries = append(offline.Entries, protocol.OfflineEntry{Contact: sender, Count: count})
 	}
-
-	response := strings.Join(items, ",")
-	// response содержит contact|count, где | не должен экранироваться
-	s.sendPacketRaw(conn, "offmsg", response)
+	s.sendEncoded(conn, offline)
 }
 
-func (s *Server) handleFileSend(session *Session, pkt *protocol.Packet, conn net.Conn) {
-	if session.Login == "" {
-		s.sendError(conn, "fsnd", "Not authenticated")
-		return
-	}
-
+func (s *Server) handleFileSend(session *Session, pkt *protocol.Packet, args []string, conn net.Conn) {
 	// Формат: fsnd|recipient|filename|size|hash
-	var recipient, filename, sizeStr, hash string
-
-	if pkt.Destination != "" {
-		recipient = pkt.Destination
-		// Остальные поля в Content или Fields
-		if len(pkt.Fields) >= 3 {
-			filename = pkt.Fields[0]
-			sizeStr = pkt.Fields[1]
-			hash = pkt.Fields[2]
-		} else {
-			s.sendError(conn, "fsnd", "Invalid format")
-			return
-		}
-	} else {
-		if len(pkt.Fields) < 4 {
-			s.sendError(conn, "fsnd", "Invalid format")
-			return
-		}
-		recipient = pkt.Fields[0]
-		filename = pkt.Fields[1]
-		sizeStr = pkt.Fields[2]
-		hash = pkt.Fields[3]
-	}
-
-	if recipient == "" || filename == "" || sizeStr == "" {
-		s.sendError(conn, "fsnd", "Invalid data")
-		return
-	}
+	recipient, filename, sizeStr, hash := args[0], args[1], args[2], args[3]
 
 	// Проверяем, существует ли получатель
 	exists, err := s.db.UserExists(recipient)
 	if err != nil {
-		log.Printf("File send error: %v", err)
-		s.sendError(conn, "fsnd", "Internal error")
+		session.logger().Error("File send error", "err", err)
+		s.sendError(session, "fsnd", codeInternal, "Internal error")
 		return
 	}
 
 	if !exists {
-		s.sendError(conn, "fsnd", "Recipient not found")
+		s.sendError(session, "fsnd", codeNoUser, "Recipient not found")
 		return
 	}
 
 	// Парсим размер
 	size, err := strconv.ParseInt(sizeStr, 10, 64)
 	if err != nil {
-		s.sendError(conn, "fsnd", "Invalid size")
+		s.sendError(session, "fsnd", codeInvalid, "Invalid size")
 		return
 	}
 
 	// Создаем сессию передачи файла
 	fileSession, err := s.fileManager.CreateSession(session.Login, recipient, filename, size, hash)
 	if err != nil {
-		log.Printf("File send error: %v", err)
-		s.sendError(conn, "fsnd", "Failed to create session")
+		session.logger().Error("File send error", "err", err)
+		s.sendError(session, "fsnd", codeInternal, "Failed to create session")
 		return
 	}
 
@@ -801,63 +789,37 @@ func (s *Server) handleFileSend(session *Session, pkt *protocol.Packet, conn net
 		s.sendPacket(recipientConn, "fsnd", session.Login, filename, sizeStr, hash, fileSession.ID)
 	}
 
-	log.Printf("File send initiated: %s -> %s, file: %s, session: %s", session.Login, recipient, filename, fileSession.ID)
+	session.logger().Info("File send initiated", "recipient", recipient, "filename", s.redact("filename", filename), "size", size, "transfer", fileSession.ID)
 }
 
-func (s *Server) handleFileAccept(session *Session, pkt *protocol.Packet, conn net.Conn) {
-	if session.Login == "" {
-		s.sendError(conn, "facc", "Not authenticated")
-		return
-	}
-
+func (s *Server) handleFileAccept(session *Session, pkt *protocol.Packet, args []string, conn net.Conn) {
 	// Формат: facc|sender|session_id
-	var sender, sessionID string
-
-	if pkt.Destination != "" {
-		sender = pkt.Destination
-		if len(pkt.Fields) > 0 {
-			sessionID = pkt.Fields[0]
-		} else {
-			sessionID = pkt.Content
-		}
-	} else {
-		if len(pkt.Fields) < 2 {
-			s.sendError(conn, "facc", "Invalid format")
-			return
-		}
-		sender = pkt.Fields[0]
-		sessionID = pkt.Fields[1]
-	}
-
-	if sessionID == "" {
-		s.sendError(conn, "facc", "Session ID required")
-		return
-	}
+	sender, sessionID := args[0], args[1]
 
 	// Получаем сессию
 	fileSession, exists := s.fileManager.GetSession(sessionID)
 	if !exists {
-		s.sendError(conn, "facc", "Session not found")
+		s.sendError(session, "facc", codeNoSession, "Session not found")
 		return
 	}
 
 	// Проверяем, что получатель соответствует
 	if fileSession.Recipient != session.Login {
-		s.sendError(conn, "facc", "Not authorized")
+		s.sendError(session, "facc", codeForbidden, "Not authorized")
 		return
 	}
 
 	// Проверяем отправителя (если указан)
 	if sender != "" && fileSession.Sender != sender {
-		s.sendError(conn, "facc", "Sender mismatch")
+		s.sendError(session, "facc", codeForbidden, "Sender mismatch")
 		return
 	}
 
 	// Принимаем файл и выделяем порты
 	uploadPort, downloadPort, err := s.fileManager.AcceptSession(sessionID)
 	if err != nil {
-		log.Printf("File accept error: %v", err)
-		s.sendError(conn, "facc", err.Error())
+		session.logger().Error("File accept error", "err", err)
+		s.sendError(session, "facc", errorCode(err), err.Error())
 		return
 	}
 
@@ -869,61 +831,31 @@ func (s *Server) handleFileAccept(session *Session, pkt *protocol.Packet, conn n
 		s.sendPacket(senderConn, "facc", session.Login, sessionID, strconv.Itoa(uploadPort))
 	}
 
-	log.Printf("File accept: session %s, upload port %d, download port %d", sessionID, uploadPort, downloadPort)
+	session.logger().Info("File accepted", "transfer", sessionID, "upload_port", uploadPort, "download_port", downloadPort)
 }
 
-func (s *Server) handleFileDecline(session *Session, pkt *protocol.Packet, conn net.Conn) {
-	if session.Login == "" {
-		s.sendError(conn, "fdec", "Not authenticated")
-		return
-	}
-
-	// Формат: fdec|sender|session_id|reason
-	var sessionID, reason string
-
-	if pkt.Destination != "" {
-		// sender = pkt.Destination - необязательно для проверки
-		if len(pkt.Fields) >= 1 {
-			sessionID = pkt.Fields[0]
-		}
-		if len(pkt.Fields) >= 2 {
-			reason = pkt.Fields[1]
-		}
-	} else {
-		if len(pkt.Fields) < 2 {
-			s.sendError(conn, "fdec", "Invalid format")
-			return
-		}
-		// sender = pkt.Fields[0] - необязательно для проверки
-		sessionID = pkt.Fields[1]
-		if len(pkt.Fields) >= 3 {
-			reason = pkt.Fields[2]
-		}
-	}
-
-	if sessionID == "" {
-		s.sendError(conn, "fdec", "Session ID required")
-		return
-	}
+func (s *Server) handleFileDecline(session *Session, pkt *protocol.Packet, args []string, conn net.Conn) {
+	// Формат: fdec|sender|session_id|reason, sender не проверяется
+	sessionID, reason := args[1], args[2]
 
 	// Получаем сессию
 	fileSession, exists := s.fileManager.GetSession(sessionID)
 	if !exists {
-		s.sendError(conn, "fdec", "Session not found")
+		s.sendError(session, "fdec", codeNoSession, "Session not found")
 		return
 	}
 
 	// Проверяем, что получатель соответствует
 	if fileSession.Recipient != session.Login {
-		s.sendError(conn, "fdec", "Not authorized")
+		s.sendError(session, "fdec", codeForbidden, "Not authorized")
 		return
 	}
 
 	// Отклоняем файл
 	err := s.fileManager.DeclineSession(sessionID)
 	if err != nil {
-		log.Printf("File decline error: %v", err)
-		s.sendError(conn, "fdec", err.Error())
+		session.logger().Error("File decline error", "err", err)
+		s.sendError(session, "fdec", errorCode(err), err.Error())
 		return
 	}
 
@@ -934,61 +866,31 @@ func (s *Server) handleFileDecline(session *Session, pkt *protocol.Packet, conn
 		s.sendPacket(senderConn, "fdec", session.Login, sessionID, reason)
 	}
 
-	log.Printf("File declined: session %s, reason: %s", sessionID, reason)
+	session.logger().Info("File declined", "transfer", sessionID, "reason", s.redact("reason", reason))
 }
 
-func (s *Server) handleFileCancel(session *Session, pkt *protocol.Packet, conn net.Conn) {
-	if session.Login == "" {
-		s.sendError(conn, "fcan", "Not authenticated")
-		return
-	}
-
-	// Формат: fcan|user|session_id|reason
-	var sessionID, reason string
-
-	if pkt.Destination != "" {
-		// user = pkt.Destination - необязательно для проверки
-		if len(pkt.Fields) >= 1 {
-			sessionID = pkt.Fields[0]
-		}
-		if len(pkt.Fields) >= 2 {
-			reason = pkt.Fields[1]
-		}
-	} else {
-		if len(pkt.Fields) < 2 {
-			s.sendError(conn, "fcan", "Invalid format")
-			return
-		}
-		// user = pkt.Fields[0] - необязательно для проверки
-		sessionID = pkt.Fields[1]
-		if len(pkt.Fields) >= 3 {
-			reason = pkt.Fields[2]
-		}
-	}
-
-	if sessionID == "" {
-		s.sendError(conn, "fcan", "Session ID required")
-		return
-	}
+func (s *Server) handleFileCancel(session *Session, pkt *protocol.Packet, args []string, conn net.Conn) {
+	// Формат: fcan|user|session_id|reason, user не проверяется
+	sessionID, reason := args[1], args[2]
 
 	// Получаем сессию
 	fileSession, exists := s.fileManager.GetSession(sessionID)
 	if !exists {
-		s.sendError(conn, "fcan", "Session not found")
+		s.sendError(session, "fcan", codeNoSession, "Session not found")
 		return
 	}
 
 	// Проверяем, что пользователь участвует в передаче
 	if fileSession.Sender != session.Login && fileSession.Recipient != session.Login {
-		s.sendError(conn, "fcan", "Not authorized")
+		s.sendError(session, "fcan", codeForbidden, "Not authorized")
 		return
 	}
 
 	// Отменяем передачу
 	err := s.fileManager.CancelSession(sessionID)
 	if err != nil {
-		log.Printf("File cancel error: %v", err)
-		s.sendError(conn, "fcan", err.Error())
+		session.logger().Error("File cancel error", "err", err)
+		s.sendError(session, "fcan", errorCode(err), err.Error())
 		return
 	}
 
@@ -1006,40 +908,23 @@ func (s *Server) handleFileCancel(session *Session, pkt *protocol.Packet, conn n
 		s.sendPacket(otherConn, "fcan", session.Login, sessionID, reason)
 	}
 
-	log.Printf("File cancelled: session %s by %s, reason: %s", sessionID, session.Login, reason)
+	session.logger().Info("File cancelled", "transfer", sessionID, "reason", s.redact("reason", reason))
 }
 
-func (s *Server) handleFileStatus(session *Session, pkt *protocol.Packet, conn net.Conn) {
-	if session.Login == "" {
-		s.sendError(conn, "fst", "Not authenticated")
-		return
-	}
-
+func (s *Server) handleFileStatus(session *Session, pkt *protocol.Packet, args []string, conn net.Conn) {
 	// Формат: fst|session_id
-	sessionID := pkt.Destination
-	if sessionID == "" {
-		if len(pkt.Fields) > 0 {
-			sessionID = pkt.Fields[0]
-		} else {
-			sessionID = pkt.Content
-		}
-	}
-
-	if sessionID == "" {
-		s.sendError(conn, "fst", "Session ID required")
-		return
-	}
+	sessionID := args[0]
 
 	// Получаем сессию
 	fileSession, exists := s.fileManager.GetSession(sessionID)
 	if !exists {
-		s.sendError(conn, "fst", "Session not found")
+		s.sendError(session, "fst", codeNoSession, "Session not found")
 		return
 	}
 
 	// Проверяем, что пользователь участвует в передаче
 	if fileSession.Sender != session.Login && fileSession.Recipient != session.Login {
-		s.sendError(conn, "fst", "Not authorized")
+		s.sendError(session, "fst", codeForbidden, "Not authorized")
 		return
 	}
 
@@ -1047,3 +932,43 @@ func (s *Server) handleFileStatus(session *Session, pkt *protocol.Packet, conn n
 	// Формат: fst|session_id|status
 	s.sendPacket(conn, "fst", sessionID, fileSession.Status)
 }
+
+func (s *Server) handleWebhookOptIn(session *Session, pkt *protocol.Packet, args []string, conn net.Conn) {
+	// Формат: hook — запрос текущего состояния, hook|on или hook|off — изменение
+	switch args[0] {
+	case "":
+		enabled, err := s.db.WebhookMessagesEnabled(session.Login)
+		if err != nil {
+			session.logger().Error("Webhook opt-in error", "err", err)
+			s.sendError(session, "hook", codeInternal, "Internal error")
+			return
+		}
+		state := "off"
+		if enabled {
+			state = "on"
+		}
+		s.sendPacket(conn, "hook", state)
+	case "on", "off":
+		if err := s.db.SetWebhookMessages(session.Login, args[0] == "on"); err != nil {
+			session.logger().Error("Webhook opt-in error", "err", err)
+			s.sendError(session, "hook", codeInternal, "Internal error")
+			return
+		}
+		s.sendOK(conn, "hook")
+	default:
+		s.sendError(session, "hook", codeInvalid, "Invalid data")
+	}
+}
+
+// fileCompleted вызывается менеджером передачи файлов после успешной передачи
+func (s *Server) fileCompleted(fileSession *FileSession, bytesTransferred int64) {
+	s.emitWebhook(webhookFileCompleted, map[string]interface{}{
+		"session_id": fileSession.ID,
+		"from":       fileSession.Sender,
+		"to":         fileSession.Recipient,
+		"filename":   fileSession.Filename,
+		"size":       fileSession.Size,
+		"hash":       fileSession.Hash,
+		"bytes":      bytesTransferred,
+	})
+}
@@ -0,0 +1,395 @@
+package server
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Обновление без простоя. Старый процесс вызывает Detach: перестаёт
+// принимать соединения (листенеры остаются открытыми, и новые подключения
+// ждут в очереди ядра) и отдаёт копии листенеров вместе с передачами файлов,
+// к которым ещё никто не подключился. Подключённые клиенты продолжают
+// работать. Новый процесс вызывает Inherit до Start и продолжает принимать
+// соединения на тех же сокетах. Затем старый процесс вызывает Retire: он
+// отключает клиентов пакетом bye|restart и дожидается идущих передач.
+// Если новый процесс не запустился, вместо Retire вызывается Resume.
+
+// Handoff — состояние, передаваемое новому процессу вместе с файлами листенеров
+type Handoff struct {
+	Listeners   []string          `json:"listeners"` // имена листенеров в порядке файлов
+	Transfers   []HandoffTransfer `json:"transfers"`
+	Maintenance *Maintenance      `json:"maintenance,omitempty"` // запланированное обслуживание
+}
+
+// HandoffTransfer — передача файла, не начавшаяся к моменту обновления.
+// Листенеры принятой передачи называются upload:ID и download:ID.
+type HandoffTransfer struct {
+	ID           string    `json:"id"`
+	Sender       string    `json:"sender"`
+	Recipient    string    `json:"recipient"`
+	Filename     string    `json:"filename"`
+	Size         int64     `json:"size"`
+	Hash         string    `json:"hash"`
+	Status       string    `json:"status"` // pending или accepted
+	UploadPort   int       `json:"upload_port,omitempty"`
+	DownloadPort int       `json:"download_port,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// ErrShuttingDown — сервер уже останавливается или передаёт листенеры
+var ErrShuttingDown = errors.New("server is shutting down")
+
+// listen открывает листенер порта или берёт унаследованный от старого процесса
+func (s *Server) listen(name string, port int) (net.Listener, error) {
+	s.mu.Lock()
+	listener, ok := s.inherited[name]
+	delete(s.inherited, name)
+	s.mu.Unlock()
+
+	if ok && port != 0 && listenerPort(listener) != port {
+		// Порт изменился в настройках: старый сокет больше не нужен
+		slog.Info("Inherited listener port changed", "listener", name, "port", port)
+		listener.Close()
+		ok = false
+	}
+	if !ok {
+		var err error
+		if listener, err = net.Listen("tcp", ":"+itoa(port)); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+	s.listeners[name] = listener
+	s.mu.Unlock()
+	return listener, nil
+}
+
+func listenerPort(listener net.Listener) int {
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	return 0
+}
+
+// Inherit принимает листенеры и передачи файлов от старого процесса.
+// Вызывается до Start; файлы после вызова можно закрыть.
+func (s *Server) Inherit(h *Handoff, files []*os.File) error {
+	if len(files) != len(h.Listeners) {
+		return errors.New("handoff listener count mismatch")
+	}
+	listeners := make(map[string]net.Listener, len(files))
+	for i, name := range h.Listeners {
+		listener, err := net.FileListener(files[i])
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		listeners[name] = listener
+	}
+
+	// Шлюзы, выключенные в новых настройках, не нужны
+	config := s.cfg()
+	enabled := map[string]bool{
+		"chat":    true,
+		"ws":      config.WSPort != 0,
+		"api":     config.APIPort != 0,
+		"metrics": config.MetricsPort != 0,
+	}
+	s.mu.Lock()
+	for name, listener := range listeners {
+		if strings.HasPrefix(name, "upload:") || strings.HasPrefix(name, "download:") {
+			continue
+		}
+		if enabled[name] {
+			s.inherited[name] = listener
+		} else {
+			listener.Close()
+		}
+	}
+	s.mu.Unlock()
+
+	s.fileManager.adopt(h.Transfers, listeners)
+
+	if m := h.Maintenance; m != nil && m.Start.After(time.Now()) {
+		s.maintenance.mu.Lock()
+		s.maintenance.current = m
+		s.startMaintenanceTimer()
+		s.maintenance.mu.Unlock()
+	}
+	slog.Info("Inherited listeners from the previous process", "listeners", len(listeners), "transfers", len(h.Transfers))
+	return nil
+}
+
+// Detach готовит передачу листенеров новому процессу: останавливает приём
+// соединений и возвращает состояние и копии листенеров. Клиенты остаются
+// подключены, пока новый процесс не подтвердит готовность: их отключает Retire.
+// После Detach нужно вызвать Retire или Resume.
+func (s *Server) Detach() (*Handoff, []*os.File, error) {
+	s.mu.Lock()
+	if s.shutdown || s.paused != nil {
+		s.mu.Unlock()
+		return nil, nil, ErrShuttingDown
+	}
+	s.paused = make(chan struct{})
+	if s.listener != nil {
+		// Новые подключения ждут в очереди ядра, их примет новый процесс
+		setAcceptDeadline(s.listener, time.Now())
+	}
+	s.mu.Unlock()
+
+	// Очередь веб-хуков хранится в базе, её доставит новый процесс
+	if s.webhooks != nil {
+		s.webhooks.Stop()
+	}
+
+	// Обслуживание объявит и начнёт новый процесс
+	h := &Handoff{}
+	s.maintenance.mu.Lock()
+	s.stopMaintenanceTimer()
+	if s.maintenance.current != nil {
+		m := *s.maintenance.current
+		h.Maintenance = &m
+	}
+	s.maintenance.mu.Unlock()
+
+	var files []*os.File
+	s.mu.RLock()
+	for name, listener := range s.listeners {
+		f := listenerFiles(listener)
+		if f == nil {
+			slog.Error("Failed to hand off listener", "listener", name)
+			continue
+		}
+		h.Listeners = append(h.Listeners, name)
+		files = append(files, f...)
+	}
+	s.mu.RUnlock()
+
+	transfers, transferFiles := s.fileManager.detach()
+	h.Transfers = transfers
+	for name, f := range transferFiles {
+		h.Listeners = append(h.Listeners, name)
+		files = append(files, f)
+	}
+	return h, files, nil
+}
+
+// Resume возвращает процессу передачи файлов и приём соединений, если новый
+// процесс не запустился. Файлы после вызова можно закрыть.
+func (s *Server) Resume(h *Handoff, files []*os.File) {
+	listeners := make(map[string]net.Listener)
+	for i, name := range h.Listeners {
+		if !strings.HasPrefix(name, "upload:") && !strings.HasPrefix(name, "download:") {
+			continue
+		}
+		listener, err := net.FileListener(files[i])
+		if err != nil {
+			slog.Error("Failed to resume file transfer listener", "listener", name, "err", err)
+			continue
+		}
+		listeners[name] = listener
+	}
+	s.fileManager.adopt(h.Transfers, listeners)
+
+	if s.webhooks != nil {
+		s.webhooks.start()
+	}
+
+	s.maintenance.mu.Lock()
+	if s.maintenance.current != nil {
+		s.startMaintenanceTimer()
+	}
+	s.maintenance.mu.Unlock()
+
+	s.mu.Lock()
+	if s.listener != nil {
+		setAcceptDeadline(s.listener, time.Time{})
+	}
+	if s.paused != nil {
+		close(s.paused)
+		s.paused = nil
+	}
+	s.mu.Unlock()
+	slog.Info("Handoff cancelled, accepting connections again")
+}
+
+// Retire закрывает копии листенеров после запуска нового процесса и ждёт
+// завершения передач файлов, начавшихся до обновления
+func (s *Server) Retire() {
+	s.mu.Lock()
+	s.shutdown = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.wsServer != nil {
+		s.wsServer.Close()
+	}
+	if s.apiServer != nil {
+		s.apiServer.Close()
+	}
+	if s.metricsSrv != nil {
+		s.metricsSrv.Close()
+	}
+	if s.paused != nil {
+		close(s.paused)
+		s.paused = nil
+	}
+	s.mu.Unlock()
+
+	// Клиенты переподключатся сразу — уже к новому процессу
+	s.disconnectAll("restart", time.Now())
+
+	s.fileManager.Wait()
+	slog.Info("Previous process retired")
+}
+
+// setAcceptDeadline прерывает ожидание Accept, не закрывая сокет;
+// нулевое время снимает ограничение
+func setAcceptDeadline(listener net.Listener, t time.Time) {
+	if l, ok := listener.(interface{ SetDeadline(time.Time) error }); ok {
+		l.SetDeadline(t)
+	}
+}
+
+// listenerFiles возвращает копии дескрипторов листенеров или nil, если
+// хотя бы один нельзя скопировать
+func listenerFiles(listeners ...net.Listener) []*os.File {
+	files := make([]*os.File, 0, len(listeners))
+	for _, listener := range listeners {
+		l, ok := listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			break
+		}
+		f, err := l.File()
+		if err != nil {
+			break
+		}
+		files = append(files, f)
+	}
+	if len(files) != len(listeners) {
+		for _, f := range files {
+			f.Close()
+		}
+		return nil
+	}
+	return files
+}
+
+// detach забирает передачи, к которым ещё никто не подключился: ожидающие
+// ответа получателя и принятые, прокси которых ещё ждёт соединений.
+// Идущие передачи остаются и завершаются в этом процессе.
+func (ftm *FileTransferManager) detach() ([]HandoffTransfer, map[string]*os.File) {
+	ftm.mu.RLock()
+	sessions := make([]*FileSession, 0, len(ftm.sessions))
+	for _, session := range ftm.sessions {
+		sessions = append(sessions, session)
+	}
+	ftm.mu.RUnlock()
+
+	var transfers []HandoffTransfer
+	files := make(map[string]*os.File)
+	for _, session := range sessions {
+		session.mu.Lock()
+		status, detach, done := session.Status, session.detach, session.proxyDone
+		session.mu.Unlock()
+
+		switch status {
+		case "pending":
+		case "accepted":
+			reply := make(chan []*os.File, 1)
+			select {
+			case detach <- reply:
+			case <-done:
+				continue
+			}
+			f := <-reply
+			if f == nil {
+				continue
+			}
+			files["upload:"+session.ID] = f[0]
+			files["download:"+session.ID] = f[1]
+		default:
+			continue
+		}
+
+		session.mu.Lock()
+		transfers = append(transfers, HandoffTransfer{
+			ID:           session.ID,
+			Sender:       session.Sender,
+			Recipient:    session.Recipient,
+			Filename:     session.Filename,
+			Size:         session.Size,
+			Hash:         session.Hash,
+			Status:       session.Status,
+			UploadPort:   session.UploadPort,
+			DownloadPort: session.DownloadPort,
+			CreatedAt:    session.CreatedAt,
+			ExpiresAt:    session.ExpiresAt,
+		})
+		session.mu.Unlock()
+
+		ftm.mu.Lock()
+		delete(ftm.sessions, session.ID)
+		ftm.mu.Unlock()
+	}
+	return transfers, files
+}
+
+// adopt восстанавливает передачи, отданные detach, и запускает их прокси
+// на переданных листенерах
+func (ftm *FileTransferManager) adopt(transfers []HandoffTransfer, listeners map[string]net.Listener) {
+	for _, t := range transfers {
+		session := &FileSession{
+			ID:           t.ID,
+			Sender:       t.Sender,
+			Recipient:    t.Recipient,
+			Filename:     t.Filename,
+			Size:         t.Size,
+			Hash:         t.Hash,
+			Status:       t.Status,
+			UploadPort:   t.UploadPort,
+			DownloadPort: t.DownloadPort,
+			CreatedAt:    t.CreatedAt,
+			ExpiresAt:    t.ExpiresAt,
+		}
+
+		if t.Status == "accepted" {
+			upload, download := listeners["upload:"+t.ID], listeners["download:"+t.ID]
+			if upload == nil || download == nil {
+				slog.Error("File transfer listeners missing after handoff", "transfer", t.ID)
+				if upload != nil {
+					upload.Close()
+				}
+				if download != nil {
+					download.Close()
+				}
+				continue
+			}
+			ftm.portMu.Lock()
+			ftm.usedPorts[t.UploadPort] = true
+			ftm.usedPorts[t.DownloadPort] = true
+			ftm.portMu.Unlock()
+
+			session.mu.Lock()
+			ftm.startProxy(session, upload, download)
+			session.mu.Unlock()
+		}
+
+		ftm.mu.Lock()
+		ftm.sessions[t.ID] = session
+		ftm.mu.Unlock()
+	}
+}
+
+// Wait ждёт завершения всех прокси передач файлов
+func (ftm *FileTransferManager) Wait() {
+	ftm.proxies.Wait()
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"msim/protocol"
+	"net"
+	"time"
+)
+
+// Сведения о сервере и сообщение дня. Пакет info, как и help, доступен без
+// авторизации: клиент может узнать лимиты до входа. Сообщение дня (MOTD)
+// отправляется пакетом motd|text после ok|auth; Reload меняет его для
+// следующих входов.
+
+func (s *Server) handleInfo(session *Session, pkt *protocol.Packet, args []string, conn net.Conn) {
+	// Формат: info|name|...,version|...,uptime|...,...
+	cfg := s.cfg()
+	s.sendEncoded(conn, &protocol.InfoPacket{
+		Name:                cfg.Name,
+		Version:             cfg.Version,
+		Uptime:              int(time.Since(s.started).Seconds()),
+		MaxLine:             cfg.MaxLineLength,
+		MaxMessage:          cfg.MaxMessageLength,
+		FileAcceptTimeout:   int(fileAcceptTimeout.Seconds()),
+		FileTransferTimeout: int(fileTransferTimeout.Seconds()),
+		Features:            s.features(),
+	})
+}
+
+// features перечисляет включённые возможности сервера: передача файлов есть
+// всегда, шлюз WebSocket, HTTP API и веб-хуки — если настроены
+func (s *Server) features() []string {
+	cfg := s.cfg()
+	features := []string{"files"}
+	if cfg.WSPort > 0 {
+		features = append(features, "websocket")
+	}
+	if cfg.APIPort > 0 {
+		features = append(features, "api")
+	}
+	if s.webhooks != nil {
+		features = append(features, "webhooks")
+	}
+	return features
+}
+
+// motdOnLogin отправляет сообщение дня вошедшему пользователю
+func (s *Server) motdOnLogin(session *Session) {
+	if motd := s.cfg().MOTD; motd != "" {
+		s.sendPacket(session.Conn, protocol.TypeMotd, motd)
+	}
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"unicode"
+	"unicode/utf8"
+)
+
+// defaultMaxLineLength — максимальная длина строки пакета, если она не задана
+const defaultMaxLineLength = 64 * 1024
+
+// errLineTooLong возвращается readLine для строки длиннее MaxLineLength
+var errLineTooLong = errors.New("line too long")
+
+// readLine читает строку до \n, держа в памяти не больше max байт.
+// Остаток слишком длинной строки пропускается до \n, и возвращается errLineTooLong,
+// поэтому клиент без перевода строки не может занять память сервера.
+func readLine(reader *bufio.Reader, max int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if len(line)+len(chunk) > max {
+			for err == bufio.ErrBufferFull {
+				_, err = reader.ReadSlice('\n')
+			}
+			if err != nil {
+				return "", err
+			}
+			return "", errLineTooLong
+		}
+		line = append(line, chunk...)
+		if err != bufio.ErrBufferFull {
+			return string(line), err
+		}
+	}
+}
+
+// validLogin проверяет логин нового пользователя: буквы, цифры и символы . _ - + @,
+// длина не больше MaxLoginLength символов
+func (s *Server) validLogin(login string) bool {
+	if login == "" || !utf8.ValidString(login) {
+		return false
+	}
+	if s.cfg().MaxLoginLength > 0 && utf8.RuneCountInString(login) > s.cfg().MaxLoginLength {
+		return false
+	}
+	for _, r := range login {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			continue
+		}
+		switch r {
+		case '.', '_', '-', '+', '@':
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// validNick проверяет ник контакта: печатные символы, длина не больше MaxNickLength символов
+func (s *Server) validNick(nick string) bool {
+	if !utf8.ValidString(nick) {
+		return false
+	}
+	if s.cfg().MaxNickLength > 0 && utf8.RuneCountInString(nick) > s.cfg().MaxNickLength {
+		return false
+	}
+	for _, r := range nick {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// validMessage проверяет длину текста сообщения
+func (s *Server) validMessage(text string) bool {
+	return s.cfg().MaxMessageLength <= 0 || utf8.RuneCountInString(text) <= s.cfg().MaxMessageLength
+}
+
+// acquireConn учитывает новое соединение с адреса; false — достигнут MaxConnsPerIP
+func (s *Server) acquireConn(ip string) bool {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	if s.cfg().MaxConnsPerIP > 0 && s.connsPerIP[ip] >= s.cfg().MaxConnsPerIP {
+		return false
+	}
+	s.connsPerIP[ip]++
+	return true
+}
+
+// releaseConn освобождает место, занятое acquireConn
+func (s *Server) releaseConn(ip string) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	if s.connsPerIP[ip] <= 1 {
+		delete(s.connsPerIP, ip)
+	} else {
+		s.connsPerIP[ip]--
+	}
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"log/slog"
+	"msim/db"
+	"msim/models"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Области счётчиков неудачных попыток
+const (
+	lockoutLogin        = "login" // неудачные входы в аккаунт
+	lockoutIP           = "ip"    // неудачные входы с адреса
+	lockoutRegistration = "reg"   // регистрации с адреса
+)
+
+const (
+	// lockoutReset — время без неудачных попыток, после которого счётчик входов обнуляется
+	lockoutReset = 24 * time.Hour
+	// maxLockout ограничивает рост блокировки при повторных сериях неудач
+	maxLockout = 24 * time.Hour
+)
+
+// authGuard защищает вход и регистрацию от перебора.
+// Каждая неудачная попытка входа задерживает ответ вдвое дольше предыдущей,
+// а после порога попыток логин или адрес блокируется; каждая следующая серия
+// неудач удваивает блокировку. Счётчики хранятся в базе и переживают перезапуск.
+type authGuard struct {
+	db     *db.DB
+	config func() *ServerConfig // текущие настройки сервера
+	audit  *auditLog
+	mu     sync.Mutex // счётчики читаются и обновляются целиком
+
+	delay     time.Duration // задержка ответа после первой неудачи, дальше удваивается
+	maxDelay  time.Duration
+	lastPrune time.Time
+}
+
+func newAuthGuard(database *db.DB, config func() *ServerConfig, audit *auditLog) *authGuard {
+	return &authGuard{
+		db:       database,
+		config:   config,
+		audit:    audit,
+		delay:    250 * time.Millisecond,
+		maxDelay: 5 * time.Second,
+	}
+}
+
+// locked возвращает время окончания блокировки логина или адреса, нулевое — если входить можно
+func (g *authGuard) locked(login, ip string) (time.Time, error) {
+	config := g.config()
+	if config.LockoutThreshold <= 0 && config.LockoutIPThreshold <= 0 {
+		return time.Time{}, nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var until time.Time
+	for _, key := range [][2]string{{lockoutLogin, login}, {lockoutIP, ip}} {
+		lockout, err := g.db.GetLockout(key[0], key[1])
+		if err != nil {
+			return time.Time{}, err
+		}
+		if lockout.LockedUntil.After(time.Now()) && lockout.LockedUntil.After(until) {
+			until = lockout.LockedUntil
+		}
+	}
+	return until, nil
+}
+
+// failed учитывает неудачный вход и возвращает задержку перед ответом клиенту
+func (g *authGuard) failed(login, ip string) (time.Duration, error) {
+	config := g.config()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// Забытые счётчики удаляем не чаще раза в час
+	if time.Since(g.lastPrune) > time.Hour {
+		if err := g.db.PruneLockouts(time.Now().Add(-lockoutReset)); err != nil {
+			slog.Error("Failed to prune lockouts", "err", err)
+		}
+		g.lastPrune = time.Now()
+	}
+
+	var attempts int
+	for _, key := range []struct {
+		scope, key string
+		threshold  int
+	}{
+		{lockoutLogin, login, config.LockoutThreshold},
+		{lockoutIP, ip, config.LockoutIPThreshold},
+	} {
+		if key.threshold <= 0 {
+			continue
+		}
+		lockout, err := g.db.GetLockout(key.scope, key.key)
+		if err != nil {
+			return 0, err
+		}
+		now := time.Now()
+		if now.Sub(lockout.LastAttempt) > lockoutReset {
+			lockout.Attempts = 0
+		}
+		lockout.Attempts++
+		lockout.LastAttempt = now
+		if lockout.Attempts%key.threshold == 0 {
+			// Каждая следующая серия неудач блокирует вдвое дольше
+			duration := config.LockoutDuration << (lockout.Attempts/key.threshold - 1)
+			if duration <= 0 || duration > maxLockout {
+				duration = maxLockout
+			}
+			lockout.LockedUntil = now.Add(duration)
+			slog.Warn("Auth lockout", "scope", key.scope, "key", key.key,
+				"until", lockout.LockedUntil.Format(time.RFC3339), "attempts", lockout.Attempts)
+			g.audit.record(auditLockout, login, ip, auditDetail("scope", key.scope),
+				auditDetail("attempts", strconv.Itoa(lockout.Attempts)), auditDetail("until", lockout.LockedUntil.UTC().Format(time.RFC3339)))
+		}
+		if err := g.db.SaveLockout(lockout); err != nil {
+			return 0, err
+		}
+		if lockout.Attempts > attempts {
+			attempts = lockout.Attempts
+		}
+	}
+
+	if attempts == 0 {
+		return 0, nil
+	}
+	delay := g.delay << (attempts - 1)
+	if delay <= 0 || delay > g.maxDelay {
+		delay = g.maxDelay
+	}
+	return delay, nil
+}
+
+// succeeded сбрасывает счётчик логина после успешного входа.
+// Счётчик адреса не сбрасывается, иначе вход в свой аккаунт позволял бы перебирать чужие.
+func (g *authGuard) succeeded(login string) error {
+	if g.config().LockoutThreshold <= 0 {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.db.DeleteLockout(lockoutLogin, login)
+}
+
+// allowRegistration учитывает регистрацию с адреса и сообщает, разрешена ли она.
+// После RegistrationsPerIP регистраций без перерыва в RegistrationWindow
+// адрес не может регистрировать аккаунты ещё RegistrationWindow.
+func (g *authGuard) allowRegistration(ip string) (bool, error) {
+	config := g.config()
+	if config.RegistrationsPerIP <= 0 {
+		return true, nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	lockout, err := g.db.GetLockout(lockoutRegistration, ip)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+	if lockout.LockedUntil.After(now) {
+		return false, nil
+	}
+	if now.Sub(lockout.LastAttempt) > config.RegistrationWindow {
+		lockout.Attempts = 0
+	}
+	lockout.Attempts++
+	lockout.LastAttempt = now
+	lockout.LockedUntil = time.Time{}
+	if lockout.Attempts >= config.RegistrationsPerIP {
+		lockout.LockedUntil = now.Add(config.RegistrationWindow)
+		slog.Warn("Registration lockout", "ip", ip, "until", lockout.LockedUntil.Format(time.RFC3339))
+	}
+	return true, g.db.SaveLockout(lockout)
+}
+
+// Lockouts возвращает счётчики неудачных попыток для управляющего сокета
+func (s *Server) Lockouts() ([]models.Lockout, error) {
+	return s.db.GetLockouts()
+}
+
+// ClearLockouts снимает блокировки логина или адреса, пустой key — все блокировки
+func (s *Server) ClearLockouts(key string) (int64, error) {
+	s.guard.mu.Lock()
+	defer s.guard.mu.Unlock()
+	return s.db.ClearLockouts(key)
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"msim/protocol"
+	"net"
+	"slices"
+	"strings"
+)
+
+// redactedValue заменяет в логе секретные и скрытые настройкой LogRedact поля
+const redactedValue = "***"
+
+// newConnID возвращает номер соединения для связывания записей лога одной сессии
+func newConnID() string {
+	bytes := make([]byte, 6)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+// logger возвращает логгер с адресом клиента, номером соединения и логином
+func (sess *Session) logger() *slog.Logger {
+	attrs := make([]any, 0, 6)
+	if sess.Conn != nil {
+		attrs = append(attrs, "remote", sess.Conn.RemoteAddr().String())
+	}
+	if sess.ID != "" {
+		attrs = append(attrs, "session", sess.ID)
+	}
+	if sess.Login != "" {
+		attrs = append(attrs, "login", sess.Login)
+	}
+	return slog.With(attrs...)
+}
+
+// connLogger возвращает логгер соединения, для которого сессия ещё не создана
+func connLogger(conn net.Conn) *slog.Logger {
+	return slog.With("remote", conn.RemoteAddr().String())
+}
+
+// redact возвращает значение поля для лога: *** для полей из LogRedact
+func (s *Server) redact(field, value string) string {
+	if slices.Contains(s.cfg().LogRedact, field) {
+		return redactedValue
+	}
+	return value
+}
+
+// packetAttrs раскладывает аргументы пакета по именам из схемы команды, см. packetArgs.
+// Секретные аргументы и поля из LogRedact заменяются на ***.
+func (s *Server) packetAttrs(cmd *command, args []string) []slog.Attr {
+	attrs := []slog.Attr{slog.String("type", cmd.name)}
+	if len(cmd.args) == 0 {
+		if len(args) > 0 {
+			attrs = append(attrs, slog.String("args", s.redact("args", strings.Join(args, "|"))))
+		}
+		return attrs
+	}
+	for i, a := range cmd.args {
+		value := args[i]
+		if value == "" {
+			continue
+		}
+		if a.secret {
+			value = redactedValue
+		}
+		attrs = append(attrs, slog.String(a.name, s.redact(a.name, value)))
+	}
+	return attrs
+}
+
+// logPacket пишет входящий пакет на уровне debug; исходная строка
+// добавляется только при включённом LogPackets
+func (s *Server) logPacket(session *Session, cmd *command, pkt *protocol.Packet, args []string) {
+	logger := session.logger()
+	if !logger.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	attrs := s.packetAttrs(cmd, args)
+	if s.cfg().LogPackets {
+		attrs = append(attrs, slog.String("raw", redactPacket(cmd, pkt)))
+	}
+	logger.LogAttrs(context.Background(), slog.LevelDebug, "Packet received", attrs...)
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Запланированное обслуживание. О нём сообщает пакет
+// notice|start|end|text: подключённым пользователям — сразу и затем каждые
+// MaintenanceNotice, вошедшим позже — после авторизации. Пустой
+// notice отменяет объявление. В момент начала вызывается обработчик,
+// заданный OnMaintenanceStart, — обычно он останавливает сервер.
+
+// Maintenance — запланированное обслуживание сервера
+type Maintenance struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Text  string    `json:"text,omitempty"`
+}
+
+// Ошибки планирования обслуживания
+var (
+	ErrInvalidMaintenance = errors.New("maintenance must start in the future and end after it starts")
+	ErrNoMaintenance      = errors.New("no maintenance scheduled")
+)
+
+type maintenanceSchedule struct {
+	mu      sync.Mutex
+	current *Maintenance
+	stop    chan struct{} // останавливает напоминания и таймер начала
+	onStart func(Maintenance)
+}
+
+// ScheduleMaintenance планирует обслуживание вместо прежнего и сразу
+// сообщает о нём подключённым пользователям
+func (s *Server) ScheduleMaintenance(m Maintenance) error {
+	if !m.Start.After(time.Now()) || !m.End.After(m.Start) {
+		return ErrInvalidMaintenance
+	}
+	m.Start, m.End = m.Start.UTC(), m.End.UTC()
+
+	s.maintenance.mu.Lock()
+	s.maintenance.current = &m
+	s.startMaintenanceTimer()
+	s.maintenance.mu.Unlock()
+
+	slog.Info("Maintenance scheduled", "start", m.Start, "end", m.End)
+	s.announceMaintenance(&m)
+	return nil
+}
+
+// CancelMaintenance отменяет запланированное обслуживание
+func (s *Server) CancelMaintenance() error {
+	s.maintenance.mu.Lock()
+	if s.maintenance.current == nil {
+		s.maintenance.mu.Unlock()
+		return ErrNoMaintenance
+	}
+	s.maintenance.current = nil
+	s.stopMaintenanceTimer()
+	s.maintenance.mu.Unlock()
+
+	slog.Info("Maintenance cancelled")
+	s.announceMaintenance(nil)
+	return nil
+}
+
+// Maintenance возвращает запланированное обслуживание
+func (s *Server) Maintenance() (Maintenance, bool) {
+	s.maintenance.mu.Lock()
+	defer s.maintenance.mu.Unlock()
+	if s.maintenance.current == nil {
+		return Maintenance{}, false
+	}
+	return *s.maintenance.current, true
+}
+
+// OnMaintenanceStart задаёт обработчик, вызываемый в момент начала обслуживания
+func (s *Server) OnMaintenanceStart(f func(Maintenance)) {
+	s.maintenance.mu.Lock()
+	defer s.maintenance.mu.Unlock()
+	s.maintenance.onStart = f
+}
+
+// startMaintenanceTimer перезапускает напоминания текущего обслуживания.
+// Вызывается под maintenance.mu.
+func (s *Server) startMaintenanceTimer() {
+	s.stopMaintenanceTimer()
+	stop := make(chan struct{})
+	s.maintenance.stop = stop
+	go s.runMaintenance(*s.maintenance.current, stop)
+}
+
+// stopMaintenanceTimer вызывается под maintenance.mu
+func (s *Server) stopMaintenanceTimer() {
+	if s.maintenance.stop != nil {
+		close(s.maintenance.stop)
+		s.maintenance.stop = nil
+	}
+}
+
+func (s *Server) runMaintenance(m Maintenance, stop chan struct{}) {
+	start := time.NewTimer(time.Until(m.Start))
+	defer start.Stop()
+
+	var remind <-chan time.Time
+	if interval := s.cfg().MaintenanceNotice; interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		remind = ticker.C
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-remind:
+			s.announceMaintenance(&m)
+		case <-start.C:
+			s.maintenance.mu.Lock()
+			if s.maintenance.stop != stop {
+				// Обслуживание отменили или перепланировали
+				s.maintenance.mu.Unlock()
+				return
+			}
+			s.maintenance.current = nil
+			s.maintenance.stop = nil
+			onStart := s.maintenance.onStart
+			s.maintenance.mu.Unlock()
+
+			slog.Info("Maintenance started", "end", m.End)
+			if onStart != nil {
+				onStart(m)
+			}
+			return
+		}
+	}
+}
+
+// announceMaintenance рассылает notice всем авторизованным сессиям;
+// nil отменяет объявление
+func (s *Server) announceMaintenance(m *Maintenance) {
+	s.mu.RLock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	s.mu.RUnlock()
+
+	for _, sess := range sessions {
+		s.sendMaintenance(sess, m)
+	}
+}
+
+// sendMaintenance отправляет сессии notice|start|end|text или пустой notice
+func (s *Server) sendMaintenance(session *Session, m *Maintenance) {
+	if m == nil {
+		s.sendPacket(session.Conn, "notice")
+		return
+	}
+	s.sendPacket(session.Conn, "notice", m.Start.Format(time.RFC3339), m.End.Format(time.RFC3339), m.Text)
+}
+
+// noticeOnLogin сообщает о запланированном обслуживании вошедшему пользователю
+func (s *Server) noticeOnLogin(session *Session) {
+	if m, ok := s.Maintenance(); ok {
+		s.sendMaintenance(session, &m)
+	}
+}
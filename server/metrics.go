@@ -0,0 +1,242 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Границы гистограмм в секундах
+var (
+	latencyBuckets   = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+	dbLatencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25}
+)
+
+// counterVec — счётчик с одной меткой (или без меток, если label пустая)
+type counterVec struct {
+	name, help, label string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help, label string) *counterVec {
+	return &counterVec{name: name, help: help, label: label, values: make(map[string]float64)}
+}
+
+func (c *counterVec) add(labelValue string, v float64) {
+	c.mu.Lock()
+	c.values[labelValue] += v
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	if c.label == "" {
+		writeSample(w, c.name, "", c.values[""])
+		return
+	}
+	for _, value := range sortedKeys(c.values) {
+		writeSample(w, c.name, labelPair(c.label, value), c.values[value])
+	}
+}
+
+// histogramVec — гистограмма с одной меткой
+type histogramVec struct {
+	name, help, label string
+	buckets           []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64 // по границам buckets, не накопительно
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help, label string, buckets []float64) *histogramVec {
+	return &histogramVec{name: name, help: help, label: label, buckets: buckets, series: make(map[string]*histogramSeries)}
+}
+
+func (h *histogramVec) observe(labelValue string, d time.Duration) {
+	v := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[labelValue]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[labelValue] = s
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	values := make([]string, 0, len(h.series))
+	for value := range h.series {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		s := h.series[value]
+		labels := ""
+		if h.label != "" {
+			labels = labelPair(h.label, value) + ","
+		}
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			writeSample(w, h.name+"_bucket", labels+labelPair("le", strconv.FormatFloat(bound, 'g', -1, 64)), float64(cumulative))
+		}
+		writeSample(w, h.name+"_bucket", labels+labelPair("le", "+Inf"), float64(s.count))
+		writeSample(w, h.name+"_sum", strings.TrimSuffix(labels, ","), s.sum)
+		writeSample(w, h.name+"_count", strings.TrimSuffix(labels, ","), float64(s.count))
+	}
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeSample(w io.Writer, name, labels string, v float64) {
+	if labels != "" {
+		name += "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s %s\n", name, strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+func writeGauge(w io.Writer, name, help string, v float64) {
+	writeHeader(w, name, help, "gauge")
+	writeSample(w, name, "", v)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelPair(name, value string) string {
+	return name + `="` + labelEscaper.Replace(value) + `"`
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// serverMetrics — метрики сервера для Prometheus.
+// Пакеты по типам берутся из commandMetrics, мгновенные значения считаются при запросе.
+type serverMetrics struct {
+	openConnections atomic.Int64
+	connections     *counterVec
+	fails           *counterVec
+	messageStore    *histogramVec
+	fileTransfers   *counterVec
+	fileBytes       *counterVec
+	dbQueries       *histogramVec
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		connections:   newCounterVec("msim_connections_total", "Accepted client connections.", ""),
+		fails:         newCounterVec("msim_fail_responses_total", "fail packets sent, by operation.", "operation"),
+		messageStore:  newHistogramVec("msim_message_store_seconds", "Time to store a message.", "", latencyBuckets),
+		fileTransfers: newCounterVec("msim_file_transfers_total", "File transfer sessions reaching a status.", "status"),
+		fileBytes:     newCounterVec("msim_file_transfer_bytes_total", "Bytes proxied by file transfers.", ""),
+		dbQueries:     newHistogramVec("msim_db_query_seconds", "Database query latency, by statement type.", "statement", dbLatencyBuckets),
+	}
+}
+
+// writeMetrics выводит все метрики в текстовом формате Prometheus
+func (s *Server) writeMetrics(w io.Writer) {
+	m := s.promMetrics
+
+	s.mu.RLock()
+	sessions := len(s.sessions)
+	s.mu.RUnlock()
+
+	writeGauge(w, "msim_connections", "Open client connections.", float64(m.openConnections.Load()))
+	m.connections.write(w)
+	writeGauge(w, "msim_sessions", "Authenticated sessions.", float64(sessions))
+
+	commands := s.metrics.snapshot()
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	writeHeader(w, "msim_packets_total", "Handled packets, by type.", "counter")
+	for _, name := range names {
+		writeSample(w, "msim_packets_total", labelPair("type", name), float64(commands[name].Count))
+	}
+	writeHeader(w, "msim_packet_seconds_total", "Time spent handling packets, by type.", "counter")
+	for _, name := range names {
+		writeSample(w, "msim_packet_seconds_total", labelPair("type", name), commands[name].Duration.Seconds())
+	}
+
+	m.fails.write(w)
+	m.messageStore.write(w)
+	m.fileTransfers.write(w)
+	m.fileBytes.write(w)
+
+	used, total := s.fileManager.PortUsage()
+	writeGauge(w, "msim_file_ports_in_use", "File transfer ports in use.", float64(used))
+	writeGauge(w, "msim_file_ports", "File transfer port pool size.", float64(total))
+
+	m.dbQueries.write(w)
+}
+
+// StartMetrics запускает HTTP-эндпоинт /metrics для Prometheus
+func (s *Server) StartMetrics() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.writeMetrics(w)
+	})
+	srv := &http.Server{
+		Addr:              ":" + strconv.Itoa(s.cfg().MetricsPort),
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		return nil
+	}
+	s.metricsSrv = srv
+	s.mu.Unlock()
+
+	slog.Info("Metrics endpoint started", "port", s.cfg().MetricsPort)
+
+	listener, err := s.listen("metrics", s.cfg().MetricsPort)
+	if err != nil {
+		return err
+	}
+	err = srv.Serve(listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
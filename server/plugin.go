@@ -0,0 +1,209 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"msim/protocol"
+	"net"
+	"time"
+)
+
+// Plugin — расширение сервера, подключаемое при запуске через Server.Register.
+// Кроме Name плагин реализует любой набор интерфейсов-хуков ниже.
+type Plugin interface {
+	Name() string
+}
+
+// Host — возможности сервера, доступные плагинам
+type Host interface {
+	// SendMessage сохраняет сообщение и доставляет его получателю,
+	// как если бы sender отправил его сам. Хуки сообщений вызываются и для него,
+	// поэтому плагин, отвечающий на сообщения, должен пропускать свои.
+	SendMessage(sender, recipient, text string) error
+	// Online сообщает, подключён ли пользователь
+	Online(login string) bool
+}
+
+// Starter вызывается один раз при регистрации плагина
+type Starter interface {
+	Start(host Host) error
+}
+
+// Message — сообщение, проходящее через хуки
+type Message struct {
+	Sender    string
+	Recipient string
+	Text      string
+	Timestamp time.Time // заполнено только в AfterMessage
+}
+
+// BeforeMessageHook вызывается перед сохранением сообщения. Хук может изменить
+// текст; ненулевая ошибка отклоняет сообщение, и её текст получает отправитель.
+type BeforeMessageHook interface {
+	BeforeMessage(msg *Message) error
+}
+
+// AfterMessageHook вызывается после сохранения и доставки сообщения
+type AfterMessageHook interface {
+	AfterMessage(msg Message)
+}
+
+// AuthHook вызывается после успешной авторизации
+type AuthHook interface {
+	OnAuth(login string, bot bool)
+}
+
+// PresenceHook вызывается при подключении и отключении пользователя
+type PresenceHook interface {
+	OnPresence(login string, online bool, at time.Time)
+}
+
+// PacketHandler обрабатывает собственные типы пакетов плагина
+type PacketHandler interface {
+	Packets() []string
+	HandlePacket(ctx *PacketContext, pkt *protocol.Packet)
+}
+
+// PacketContext — соединение, от которого пришёл пакет плагина
+type PacketContext struct {
+	// Login — логин отправителя, пусто для неавторизованного соединения
+	Login string
+
+	server  *Server
+	session *Session
+	conn    net.Conn
+}
+
+// Reply отправляет клиенту пакет pktType|field1|field2|...
+func (c *PacketContext) Reply(pktType string, fields ...string) {
+	c.server.sendPacket(c.conn, pktType, fields...)
+}
+
+// OK отправляет ok|operation
+func (c *PacketContext) OK(operation string) {
+	c.server.sendOK(c.conn, operation)
+}
+
+// Fail отправляет fail|operation|description; код отказа плагина — E_FAILED
+func (c *PacketContext) Fail(operation, description string) {
+	c.server.sendError(c.session, operation, codeFailed, description)
+}
+
+// Register подключает плагин. Вызывается до Start: список плагинов
+// после запуска сервера не меняется и читается без блокировок.
+func (s *Server) Register(p Plugin) error {
+	if handler, ok := p.(PacketHandler); ok {
+		for _, pktType := range handler.Packets() {
+			cmd, exists := s.commands.get(pktType)
+			if exists && cmd.plugin == "" {
+				return fmt.Errorf("plugin %s: packet type %q is built in", p.Name(), pktType)
+			}
+			if exists {
+				return fmt.Errorf("plugin %s: packet type %q is already handled by %s", p.Name(), pktType, cmd.plugin)
+			}
+		}
+	}
+
+	if starter, ok := p.(Starter); ok {
+		if err := starter.Start(s); err != nil {
+			return fmt.Errorf("plugin %s: %w", p.Name(), err)
+		}
+	}
+
+	if handler, ok := p.(PacketHandler); ok {
+		for _, pktType := range handler.Packets() {
+			s.commands.add(&command{
+				name:  pktType,
+				class: rateClassQuery,
+				// Схема пакетов плагина неизвестна, поэтому в лог они пишутся без полей
+				args:    []commandArg{{name: "data", secret: true}},
+				handler: s.pluginPacketHandler(p, handler),
+				plugin:  p.Name(),
+			})
+		}
+	}
+	s.plugins = append(s.plugins, p)
+	slog.Info("Plugin registered", "plugin", p.Name())
+	return nil
+}
+
+// SendMessage отправляет сообщение от имени sender (для плагинов)
+func (s *Server) SendMessage(sender, recipient, text string) error {
+	_, err := s.deliverMessage(sender, recipient, text)
+	return err
+}
+
+// Online сообщает, подключён ли пользователь
+func (s *Server) Online(login string) bool {
+	_, ok := s.getSession(login)
+	return ok
+}
+
+// callPlugin вызывает хук плагина; паника в плагине не роняет сервер
+func callPlugin(p Plugin, hook string, fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("Plugin panicked", "plugin", p.Name(), "hook", hook, "panic", r)
+		}
+	}()
+	fn()
+}
+
+// beforeMessage прогоняет сообщение через BeforeMessage всех плагинов
+func (s *Server) beforeMessage(msg *Message) error {
+	for _, p := range s.plugins {
+		hook, ok := p.(BeforeMessageHook)
+		if !ok {
+			continue
+		}
+		var err error
+		callPlugin(p, "BeforeMessage", func() {
+			err = hook.BeforeMessage(msg)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) afterMessage(msg Message) {
+	for _, p := range s.plugins {
+		if hook, ok := p.(AfterMessageHook); ok {
+			callPlugin(p, "AfterMessage", func() {
+				hook.AfterMessage(msg)
+			})
+		}
+	}
+}
+
+func (s *Server) pluginsOnAuth(login string, bot bool) {
+	for _, p := range s.plugins {
+		if hook, ok := p.(AuthHook); ok {
+			callPlugin(p, "OnAuth", func() {
+				hook.OnAuth(login, bot)
+			})
+		}
+	}
+}
+
+func (s *Server) pluginsOnPresence(login string, online bool, at time.Time) {
+	for _, p := range s.plugins {
+		if hook, ok := p.(PresenceHook); ok {
+			callPlugin(p, "OnPresence", func() {
+				hook.OnPresence(login, online, at)
+			})
+		}
+	}
+}
+
+// pluginPacketHandler оборачивает обработчик пакетов плагина в commandHandler.
+// Авторизацию плагин проверяет сам по PacketContext.Login.
+func (s *Server) pluginPacketHandler(p Plugin, handler PacketHandler) commandHandler {
+	return func(session *Session, pkt *protocol.Packet, args []string, conn net.Conn) {
+		ctx := &PacketContext{Login: session.Login, server: s, session: session, conn: conn}
+		callPlugin(p, "HandlePacket", func() {
+			handler.HandlePacket(ctx, pkt)
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package server
+
+import (
+	"msim/protocol"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Классы команд для ограничения частоты запросов
+const (
+	rateClassMsg   = "msg"   // сообщения
+	rateClassAuth  = "auth"  // вход и регистрация
+	rateClassFile  = "file"  // передача файлов
+	rateClassQuery = "query" // запросы к базе: история, статусы, контакты
+)
+
+// Области, в которых считаются запросы
+const (
+	rateScopeSession = "session"
+	rateScopeLogin   = "login"
+	rateScopeIP      = "ip"
+)
+
+// floodWindow — время, за которое накопленные отказы забываются
+const floodWindow = time.Minute
+
+// RateLimit — маркерная корзина: Rate запросов в секунду, не больше Burst подряд.
+// Нулевой Rate отключает ограничение.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimits — ограничения класса команд для сессии, логина и IP-адреса
+type RateLimits struct {
+	Session RateLimit
+	Login   RateLimit
+	IP      RateLimit
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill пополняет корзину на время, прошедшее с прошлого запроса
+func (b *tokenBucket) refill(limit RateLimit, now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * limit.Rate
+	if b.tokens > float64(limit.Burst) {
+		b.tokens = float64(limit.Burst)
+	}
+	b.last = now
+}
+
+// rateKey — корзина: область, ключ внутри области и класс команд.
+// Для сессии ключом служит сам *Session.
+type rateKey struct {
+	scope string
+	key   interface{}
+	class string
+}
+
+// rateLimiter хранит корзины всех сессий, логинов и адресов.
+// Полные корзины удаляются при периодической очистке.
+type rateLimiter struct {
+	mu        sync.Mutex
+	limits    map[string]RateLimits
+	buckets   map[rateKey]*tokenBucket
+	limited   map[string]int64 // отказы по классам
+	floods    int64            // отключения по bye|flood
+	lastSweep time.Time
+}
+
+func newRateLimiter(limits map[string]RateLimits) *rateLimiter {
+	return &rateLimiter{
+		limits:    limits,
+		buckets:   make(map[rateKey]*tokenBucket),
+		limited:   make(map[string]int64),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow списывает по маркеру из корзин сессии, логина и адреса.
+// Маркеры списываются, только если их хватает во всех корзинах.
+// У запросов HTTP API сессии нет (session == nil): считаются только логин и адрес.
+func (l *rateLimiter) allow(class string, session *Session, login, ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limits, ok := l.limits[class]
+	if !ok {
+		return true
+	}
+
+	type check struct {
+		key   rateKey
+		limit RateLimit
+	}
+	checks := []check{
+		{rateKey{rateScopeIP, ip, class}, limits.IP},
+	}
+	if session != nil {
+		checks = append(checks, check{rateKey{rateScopeSession, session, class}, limits.Session})
+	}
+	if login != "" {
+		checks = append(checks, check{rateKey{rateScopeLogin, login, class}, limits.Login})
+	}
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > time.Minute {
+		l.sweep(now)
+	}
+
+	buckets := make([]*tokenBucket, len(checks))
+	for i, c := range checks {
+		if c.limit.Rate <= 0 {
+			continue
+		}
+		b, ok := l.buckets[c.key]
+		if !ok {
+			b = &tokenBucket{tokens: float64(c.limit.Burst), last: now}
+			l.buckets[c.key] = b
+		}
+		b.refill(c.limit, now)
+		if b.tokens < 1 {
+			l.limited[class]++
+			return false
+		}
+		buckets[i] = b
+	}
+	for _, b := range buckets {
+		if b != nil {
+			b.tokens--
+		}
+	}
+	return true
+}
+
+// sweep удаляет корзины, которые успели наполниться: они не отличаются от новых
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		limit := l.limitFor(key)
+		if b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= float64(limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+func (l *rateLimiter) limitFor(key rateKey) RateLimit {
+	limits := l.limits[key.class]
+	switch key.scope {
+	case rateScopeSession:
+		return limits.Session
+	case rateScopeLogin:
+		return limits.Login
+	default:
+		return limits.IP
+	}
+}
+
+// setLimits заменяет ограничения при перезагрузке настроек. Накопленные
+// корзины сохраняются и дальше пополняются по новым значениям.
+func (l *rateLimiter) setLimits(limits map[string]RateLimits) {
+	l.mu.Lock()
+	l.limits = limits
+	l.mu.Unlock()
+}
+
+func (l *rateLimiter) flooded() {
+	l.mu.Lock()
+	l.floods++
+	l.mu.Unlock()
+}
+
+// counters возвращает копию счётчиков отказов по классам и число отключений
+func (l *rateLimiter) counters() (map[string]int64, int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limited := make(map[string]int64, len(l.limited))
+	for class, n := range l.limited {
+		limited[class] = n
+	}
+	return limited, l.floods
+}
+
+// String форматирует счётчики для команды stats: limited=class:count;...,floods=N
+func (l *rateLimiter) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	classes := make([]string, 0, len(l.limited))
+	for class := range l.limited {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	parts := make([]string, len(classes))
+	for i, class := range classes {
+		parts[i] = class + ":" + strconv.FormatInt(l.limited[class], 10)
+	}
+	return "limited=" + strings.Join(parts, ";") + ",floods=" + strconv.FormatInt(l.floods, 10)
+}
+
+// remoteIP возвращает адрес клиента без порта
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// requestIP возвращает адрес клиента HTTP-запроса без порта
+func requestIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// rateLimitMiddleware отклоняет команды сверх лимита, а после FloodStrikes
+// отказов за floodWindow отключает клиента с bye|flood
+func (s *Server) rateLimitMiddleware(cmd *command, next commandHandler) commandHandler {
+	if cmd.class == "" {
+		return next
+	}
+	return func(session *Session, pkt *protocol.Packet, args []string, conn net.Conn) {
+		if s.limiter.allow(cmd.class, session, session.Login, remoteIP(conn)) {
+			next(session, pkt, args, conn)
+			return
+		}
+
+		s.sendError(session, cmd.name, codeRateLimit, "Too many requests")
+		if s.cfg().FloodStrikes <= 0 {
+			return
+		}
+
+		now := time.Now()
+		session.mu.Lock()
+		if now.Sub(session.lastStrike) > floodWindow {
+			session.strikes = 0
+		}
+		session.strikes++
+		session.lastStrike = now
+		flood := session.strikes >= s.cfg().FloodStrikes
+		session.mu.Unlock()
+
+		if flood {
+			session.logger().Warn("Client disconnected for flooding")
+			s.limiter.flooded()
+			s.sendBye(conn, "flood", "")
+			conn.Close()
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import "slices"
+
+// Reload применяет новые настройки без разрыва соединений: таймауты, лимиты,
+// блокировки, параметры лога и срок хранения аудита действуют сразу.
+// Порты, пути и веб-хуки читаются только при запуске — для них сохраняются
+// старые значения, а имена изменившихся полей возвращаются вызывающему.
+func (s *Server) Reload(next *ServerConfig) []string {
+	cfg := *next
+	applyDefaults(&cfg)
+	old := s.cfg()
+
+	var restart []string
+	keep := func(name string, changed bool) {
+		if changed {
+			restart = append(restart, name)
+		}
+	}
+	keep("Port", cfg.Port != old.Port)
+	keep("FilePortRangeStart", cfg.FilePortRangeStart != old.FilePortRangeStart)
+	keep("FilePortRangeEnd", cfg.FilePortRangeEnd != old.FilePortRangeEnd)
+	keep("WSPort", cfg.WSPort != old.WSPort)
+	keep("WSPath", cfg.WSPath != old.WSPath)
+	keep("WSAllowedOrigins", !slices.Equal(cfg.WSAllowedOrigins, old.WSAllowedOrigins))
+	keep("APIPort", cfg.APIPort != old.APIPort)
+	keep("WebhookURLs", !slices.Equal(cfg.WebhookURLs, old.WebhookURLs))
+	keep("WebhookSecret", cfg.WebhookSecret != old.WebhookSecret)
+	keep("WebhookEvents", !slices.Equal(cfg.WebhookEvents, old.WebhookEvents))
+	keep("WebhookMaxAttempts", cfg.WebhookMaxAttempts != old.WebhookMaxAttempts)
+	keep("MetricsPort", cfg.MetricsPort != old.MetricsPort)
+
+	cfg.Port = old.Port
+	cfg.FilePortRangeStart, cfg.FilePortRangeEnd = old.FilePortRangeStart, old.FilePortRangeEnd
+	cfg.WSPort, cfg.WSPath, cfg.WSAllowedOrigins = old.WSPort, old.WSPath, old.WSAllowedOrigins
+	cfg.APIPort = old.APIPort
+	cfg.WebhookURLs, cfg.WebhookSecret = old.WebhookURLs, old.WebhookSecret
+	cfg.WebhookEvents, cfg.WebhookMaxAttempts = old.WebhookEvents, old.WebhookMaxAttempts
+	cfg.MetricsPort = old.MetricsPort
+
+	s.conf.Store(&cfg)
+	s.limiter.setLimits(cfg.RateLimits)
+	s.audit.setRetention(cfg.AuditRetention)
+	return restart
+}
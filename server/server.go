@@ -3,86 +3,219 @@ package server
 import (
 	"bufio"
 	"io"
-	"log"
+	"log/slog"
 	"msim/db"
 	"msim/protocol"
 	"net"
+	"net/http"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Server struct {
 	db          *db.DB
-	config      *ServerConfig
+	conf        atomic.Pointer[ServerConfig] // текущие настройки, см. cfg и Reload
 	sessions    map[string]*Session
 	mu          sync.RWMutex
 	fileManager *FileTransferManager
 	listener    net.Listener
+	listeners   map[string]net.Listener // открытые листенеры по именам: chat, ws, api, metrics
+	inherited   map[string]net.Listener // листенеры старого процесса, см. Inherit
+	paused      chan struct{}           // закрывается, когда Detach завершён Resume или Retire
+	active      map[*Session]struct{}   // соединения TCP и WebSocket, см. Shutdown
+	handlers    sync.WaitGroup          // работающие handleConnection
+	maintenance maintenanceSchedule     // запланированное обслуживание, см. maintenance.go
+	wsServer    *http.Server
+	apiServer   *http.Server
+	metricsSrv  *http.Server
+	apiTokens   apiTokens
+	webhooks    *webhookDispatcher // nil, если веб-хуки не настроены
+	plugins     []Plugin
+	commands    *commandRegistry
+	metrics     *commandMetrics
+	promMetrics *serverMetrics // метрики для Prometheus, см. metrics.go
+	limiter     *rateLimiter
+	guard       *authGuard
+	audit       *auditLog
+	connsMu     sync.Mutex
+	connsPerIP  map[string]int // открытые соединения по адресам, см. limits.go
 	shutdown    bool
+	started     time.Time // время запуска для uptime в ответе info
 }
 
 type ServerConfig struct {
-	Port              int
-	ReadTimeout       time.Duration
-	WriteTimeout      time.Duration
+	Port               int
+	ReadTimeout        time.Duration
+	WriteTimeout       time.Duration
 	FilePortRangeStart int
 	FilePortRangeEnd   int
+	WSPort             int                   // порт шлюза WebSocket, 0 — шлюз выключен
+	WSPath             string                // путь WebSocket-эндпоинта
+	WSAllowedOrigins   []string              // разрешённые Origin, пусто — только тот же хост
+	APIPort            int                   // порт HTTP API, 0 — API выключен
+	APITokenTTL        time.Duration         // срок действия токена API
+	WebhookURLs        []string              // адреса веб-хуков, пусто — веб-хуки выключены
+	WebhookSecret      string                // ключ подписи HMAC-SHA256, пусто — без подписи
+	WebhookEvents      []string              // события для отправки, пусто — все
+	WebhookMaxAttempts int                   // число попыток доставки события
+	RateLimits         map[string]RateLimits // ограничения частоты по классам команд, пусто — без ограничений
+	FloodStrikes       int                   // отказов по лимиту до bye|flood, 0 — не отключать
+	LockoutThreshold   int                   // неудачных входов в аккаунт до блокировки, 0 — не блокировать
+	LockoutIPThreshold int                   // неудачных входов с адреса до блокировки, 0 — не блокировать
+	LockoutDuration    time.Duration         // первая блокировка, следующие вдвое дольше
+	RegistrationsPerIP int                   // регистраций с адреса подряд, 0 — без ограничений
+	RegistrationWindow time.Duration         // перерыв, обнуляющий счётчик регистраций, и срок их блокировки
+	MaxLineLength      int                   // максимальная длина строки пакета в байтах
+	MaxMessageLength   int                   // максимальная длина текста сообщения в символах, 0 — без ограничений
+	MaxLoginLength     int                   // максимальная длина логина в символах, 0 — без ограничений
+	MaxNickLength      int                   // максимальная длина ника контакта в символах, 0 — без ограничений
+	MaxContacts        int                   // максимальный размер списка контактов, 0 — без ограничений
+	MaxConnsPerIP      int                   // одновременных соединений с адреса, 0 — без ограничений
+	MetricsPort        int                   // порт эндпоинта /metrics, 0 — метрики выключены
+	LogRedact          []string              // аргументы пакетов, скрываемые в логе: text, filename и т.д.
+	LogPackets         bool                  // писать в лог исходные строки пакетов (уровень debug)
+	AuditRetention     time.Duration         // срок хранения журнала аудита, 0 — бессрочно
+	MaintenanceNotice  time.Duration         // период повтора объявления об обслуживании, 0 — только один раз
+	Name               string                // имя сервера в ответе info
+	Version            string                // версия сервера в ответе info
+	MOTD               string                // сообщение дня после авторизации, пусто — не отправляется
 }
 
 type Session struct {
-	Login    string
-	Conn     net.Conn
-	LastPing time.Time
-	mu       sync.Mutex
+	ID          string // номер соединения в логе
+	Login       string
+	Bot         bool // бот-аккаунт: подключения не рассылаются контактам
+	Conn        net.Conn
+	ConnectedAt time.Time
+	LastPing    time.Time
+	caps        map[string]bool // согласованные возможности протокола, см. caps.go
+	mu          sync.Mutex
+	busy        sync.Mutex // удерживается, пока обрабатывается пакет, см. Shutdown
+
+	strikes    int       // отказы по лимиту частоты, см. ratelimit.go
+	lastStrike time.Time // время последнего отказа
 }
 
 func New(database *db.DB, config *ServerConfig) *Server {
-	// Если диапазон портов не задан, используем значения по умолчанию
-	if config.FilePortRangeStart == 0 {
-		config.FilePortRangeStart = 35000
-	}
-	if config.FilePortRangeEnd == 0 {
-		config.FilePortRangeEnd = 35999
-	}
+	applyDefaults(config)
 
 	fileManager := NewFileTransferManager(config.FilePortRangeStart, config.FilePortRangeEnd)
 	fileManager.StartCleanupTask()
 
-	return &Server{
+	s := &Server{
 		db:          database,
-		config:      config,
 		sessions:    make(map[string]*Session),
 		fileManager: fileManager,
+		webhooks:    newWebhookDispatcher(database, config),
+		metrics:     newCommandMetrics(),
+		promMetrics: newServerMetrics(),
+		limiter:     newRateLimiter(config.RateLimits),
+		audit:       newAuditLog(database, config.AuditRetention),
+		connsPerIP:  make(map[string]int),
+		listeners:   make(map[string]net.Listener),
+		inherited:   make(map[string]net.Listener),
+		active:      make(map[*Session]struct{}),
+		started:     time.Now(),
+	}
+	s.conf.Store(config)
+	s.guard = newAuthGuard(database, s.cfg, s.audit)
+	s.commands = newCommandRegistry(s.recoverMiddleware, s.metricsMiddleware, s.logMiddleware, s.rateLimitMiddleware, s.authMiddleware, s.argsMiddleware)
+	for _, cmd := range s.builtinCommands() {
+		s.commands.add(cmd)
 	}
+	fileManager.OnComplete = s.fileCompleted
+	fileManager.OnStatus = func(status string, bytesTransferred int64) {
+		s.promMetrics.fileTransfers.add(status, 1)
+		s.promMetrics.fileBytes.add("", float64(bytesTransferred))
+	}
+	database.SetQueryObserver(s.promMetrics.dbQueries.observe)
+
+	if s.webhooks != nil {
+		go s.webhooks.run()
+	}
+
+	return s
+}
+
+// applyDefaults заполняет незаданные настройки значениями по умолчанию
+func applyDefaults(config *ServerConfig) {
+	// Если диапазон портов не задан, используем значения по умолчанию
+	if config.FilePortRangeStart == 0 {
+		config.FilePortRangeStart = 35000
+	}
+	if config.FilePortRangeEnd == 0 {
+		config.FilePortRangeEnd = 35999
+	}
+	if config.APITokenTTL == 0 {
+		config.APITokenTTL = 24 * time.Hour
+	}
+	if config.LockoutDuration == 0 {
+		config.LockoutDuration = 15 * time.Minute
+	}
+	if config.RegistrationWindow == 0 {
+		config.RegistrationWindow = time.Hour
+	}
+	if config.MaxLineLength == 0 {
+		config.MaxLineLength = defaultMaxLineLength
+	}
+	if config.Name == "" {
+		config.Name = "mSIM"
+	}
+	if config.Version == "" {
+		config.Version = "dev"
+	}
+}
+
+// cfg возвращает текущие настройки. Reload заменяет их целиком, поэтому
+// значения одного вызова cfg согласованы между собой.
+func (s *Server) cfg() *ServerConfig {
+	return s.conf.Load()
 }
 
 func (s *Server) Start() error {
-	listener, err := net.Listen("tcp", ":"+strconv.Itoa(s.config.Port))
+	listener, err := s.listen("chat", s.cfg().Port)
 	if err != nil {
 		return err
 	}
 	s.listener = listener
 	defer listener.Close()
 
-	log.Printf("MSIM server started on port %d", s.config.Port)
+	slog.Info("MSIM server started", "port", s.cfg().Port)
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
 			s.mu.RLock()
 			isShutdown := s.shutdown
+			paused := s.paused
 			s.mu.RUnlock()
 			if isShutdown {
-				log.Printf("Server shutdown, stopping accept loop")
+				slog.Info("Server shutdown, stopping accept loop")
 				return nil
 			}
-			log.Printf("Error accepting connection: %v", err)
+			if paused != nil {
+				// Листенер передаётся новому процессу, см. Detach
+				<-paused
+				continue
+			}
+			slog.Error("Error accepting connection", "err", err)
 			continue
 		}
 
-		go s.handleConnection(conn)
+		ip := remoteIP(conn)
+		if !s.acquireConn(ip) {
+			slog.Warn("Too many connections, rejected", "ip", ip)
+			s.sendPacket(conn, "fail", "Too many connections")
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer s.releaseConn(ip)
+			s.handleConnection(conn)
+		}()
 	}
 }
 
@@ -98,13 +231,22 @@ func (s *Server) handleConnection(conn net.Conn) {
 		conn.Close()
 	}()
 
-	remoteAddr := conn.RemoteAddr().String()
-	log.Printf("New client connected from %s", remoteAddr)
+	s.promMetrics.connections.add("", 1)
+	s.promMetrics.openConnections.Add(1)
+	defer s.promMetrics.openConnections.Add(-1)
 
 	session := &Session{
-		Conn:     conn,
-		LastPing: time.Now(),
+		ID:          newConnID(),
+		Conn:        conn,
+		ConnectedAt: time.Now(),
+		LastPing:    time.Now(),
+	}
+	if !s.trackConn(session) {
+		// Сервер уже останавливается
+		return
 	}
+	defer s.untrackConn(session)
+	session.logger().Info("Client connected")
 
 	reader := bufio.NewReader(conn)
 	ticker := time.NewTicker(30 * time.Second)
@@ -119,14 +261,13 @@ func (s *Server) handleConnection(conn net.Conn) {
 			if sess.Login != "" {
 				s.mu.Lock()
 				if sess, ok := s.sessions[sess.Login]; ok {
-					if time.Since(sess.LastPing) > s.config.ReadTimeout {
-						login := sess.Login
+					if time.Since(sess.LastPing) > s.cfg().ReadTimeout {
 						s.mu.Unlock()
 						// Устанавливаем флаг для отправки bye с причиной timeout
 						shouldSendBye = true
 						byeReason = "timeout"
 						byeDetails = ""
-						log.Printf("Client %s disconnected due to timeout from %s", login, remoteAddr)
+						session.logger().Info("Client disconnected due to timeout")
 						conn.Close()
 						return
 					}
@@ -137,8 +278,13 @@ func (s *Server) handleConnection(conn net.Conn) {
 	}()
 
 	for {
-		conn.SetReadDeadline(time.Now().Add(s.config.ReadTimeout))
-		line, err := reader.ReadString('\n')
+		conn.SetReadDeadline(time.Now().Add(s.cfg().ReadTimeout))
+		line, err := readLine(reader, s.cfg().MaxLineLength)
+		if err == errLineTooLong {
+			session.logger().Warn("Packet too long, discarded")
+			s.sendError(session, "", codeTooLong, "Packet too long")
+			continue
+		}
 		if err != nil {
 			if err != io.EOF {
 				// Проверяем, не таймаут ли это
@@ -154,7 +300,7 @@ func (s *Server) handleConnection(conn net.Conn) {
 				if strings.Contains(err.Error(), "use of closed network connection") {
 					break
 				}
-				log.Printf("Error reading from %s: %v", remoteAddr, err)
+				session.logger().Error("Read error", "err", err)
 			}
 			// EOF или другая ошибка - закрываем соединение
 			break
@@ -166,19 +312,26 @@ func (s *Server) handleConnection(conn net.Conn) {
 			continue
 		}
 
-		// Логируем входящие пакеты (без паролей)
-		if !strings.HasPrefix(line, "auth|") && !strings.HasPrefix(line, "reg|") {
-			log.Printf("Received from %s: %q", remoteAddr, line)
-		}
-
 		pkt, err := protocol.ParsePacket(line + "\n")
 		if err != nil {
-			log.Printf("Parse error from %s: %v, line: %q", remoteAddr, err, line)
-			s.sendError(conn, "", "Invalid packet format")
+			logger := session.logger().With("err", err, "length", len(line))
+			if s.cfg().LogPackets {
+				logger = logger.With("raw", line)
+			}
+			logger.Warn("Packet parse error")
+			s.sendError(session, "", codeInvalid, "Invalid packet format")
 			continue
 		}
 
+		session.busy.Lock()
+		if s.isShuttingDown() {
+			// Сервер останавливается: новые пакеты не обрабатываются, bye
+			// и закрытие соединения — за Shutdown
+			session.busy.Unlock()
+			break
+		}
 		s.handlePacket(session, pkt, conn)
+		session.busy.Unlock()
 
 		// Если был отправлен bye от клиента, выходим из цикла
 		// Сессия уже удалена в handleBye
@@ -187,20 +340,22 @@ func (s *Server) handleConnection(conn net.Conn) {
 		}
 	}
 
-	// Удаляем сессию при отключении (если не было bye)
-	if session.Login != "" {
-		s.removeSession(session.Login)
+	// Удаляем сессию при отключении (если не было bye). Вытесненная сессия
+	// уже не числится за пользователем: он остаётся онлайн.
+	if session.Login != "" && s.removeSession(session) {
 
-		// Обновляем время последнего отключения
-		now := time.Now().UTC()
-		if err := s.db.UpdateLastOffline(session.Login, now); err != nil {
-			log.Printf("Failed to update last_offline for %s: %v", session.Login, err)
+		// При остановке сервера время отключения сохраняет Shutdown
+		if !s.isShuttingDown() {
+			now := time.Now().UTC()
+			if err := s.db.UpdateLastOffline(session.Login, now); err != nil {
+				session.logger().Error("Failed to update last_offline", "err", err)
+			}
+			if !session.Bot {
+				s.notifyContactsOffline(session.Login, now)
+			}
 		}
-		s.notifyContactsOffline(session.Login, now)
-		log.Printf("Client %s disconnected from %s", session.Login, remoteAddr)
-	} else {
-		log.Printf("Client disconnected from %s", remoteAddr)
 	}
+	session.logger().Info("Client disconnected")
 }
 
 func (s *Server) handlePacket(session *Session, pkt *protocol.Packet, conn net.Conn) {
@@ -208,50 +363,13 @@ func (s *Server) handlePacket(session *Session, pkt *protocol.Packet, conn net.C
 	session.LastPing = time.Now()
 	session.mu.Unlock()
 
-	switch pkt.Type {
-	case "ping":
-		s.handlePing(conn)
-	case "auth":
-		s.handleAuth(session, pkt, conn)
-	case "reg":
-		s.handleRegister(session, pkt, conn)
-	case "msg":
-		s.handleMessage(session, pkt, conn)
-	case "ack":
-		s.handleAck(session, pkt, conn)
-	case "hist":
-		s.handleHistory(session, pkt, conn)
-	case "hclear":
-		s.handleClearHistory(session, pkt, conn)
-	case "offmsg":
-		s.handleOfflineMessages(session, conn)
-	case "stat":
-		s.handleStatus(session, pkt, conn)
-	case "list":
-		s.handleList(session, conn)
-	case "add":
-		s.handleAddContact(session, pkt, conn)
-	case "ren":
-		s.handleRenameContact(session, pkt, conn)
-	case "del":
-		s.handleDeleteContact(session, pkt, conn)
-	case "bye":
-		s.handleBye(session, pkt, conn)
-	case "help":
-		s.handleHelp(conn)
-	case "fsnd":
-		s.handleFileSend(session, pkt, conn)
-	case "facc":
-		s.handleFileAccept(session, pkt, conn)
-	case "fdec":
-		s.handleFileDecline(session, pkt, conn)
-	case "fcan":
-		s.handleFileCancel(session, pkt, conn)
-	case "fst":
-		s.handleFileStatus(session, pkt, conn)
-	default:
-		s.sendError(conn, "", "Unknown packet type")
+	cmd, handler, ok := s.commands.lookup(pkt.Type)
+	if !ok {
+		session.logger().Warn("Unknown packet type", "type", pkt.Type)
+		s.sendError(session, "", codeUnknownPacket, "Unknown packet type")
+		return
 	}
+	handler(session, pkt, packetArgs(cmd, pkt), conn)
 }
 
 // sendPacket отправляет пакет с несколькими полями, разделенными неэкранированным |
@@ -259,28 +377,19 @@ func (s *Server) handlePacket(session *Session, pkt *protocol.Packet, conn net.C
 // Каждое поле экранируется отдельно
 // Используется для всех типов пакетов: TYPE, TYPE|CONTENT, TYPE|DESTINATION|CONTENT, и т.д.
 func (s *Server) sendPacket(conn net.Conn, pktType string, fields ...string) {
-	var parts []string
-	parts = append(parts, protocol.Escape(pktType))
-
-	for _, field := range fields {
-		parts = append(parts, protocol.Escape(field))
-	}
+	s.writeLine(conn, protocol.FormatFields(pktType, fields...))
+}
 
-	packet := strings.Join(parts, "|") + "\n"
-	conn.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout))
-	if _, err := conn.Write([]byte(packet)); err != nil {
-		log.Printf("Error writing to connection: %v", err)
-	}
+// sendEncoded отправляет пакет со структурированным содержимым (hist, stat, list и т.д.)
+func (s *Server) sendEncoded(conn net.Conn, pkt protocol.Encoder) {
+	s.writeLine(conn, pkt.Encode())
 }
 
-// sendPacketRaw отправляет пакет с неэкранированным content
-// Используется для пакетов, где content содержит неэкранированные | (например, stat, list)
-// Формат: pktType|rawContent\n
-func (s *Server) sendPacketRaw(conn net.Conn, pktType, rawContent string) {
-	packet := protocol.Escape(pktType) + "|" + rawContent + "\n"
-	conn.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout))
-	if _, err := conn.Write([]byte(packet)); err != nil {
-		log.Printf("Error writing to connection: %v", err)
+// writeLine записывает готовую строку пакета в соединение
+func (s *Server) writeLine(conn net.Conn, line string) {
+	conn.SetWriteDeadline(time.Now().Add(s.cfg().WriteTimeout))
+	if _, err := conn.Write([]byte(line)); err != nil {
+		connLogger(conn).Error("Write error", "err", err)
 	}
 }
 
@@ -292,12 +401,17 @@ func (s *Server) sendOK(conn net.Conn, operation string) {
 	}
 }
 
-func (s *Server) sendError(conn net.Conn, operation, description string) {
-	if operation != "" {
+// sendError отправляет fail; code получают только клиенты, согласовавшие capErrCodes
+func (s *Server) sendError(session *Session, operation, code, description string) {
+	s.promMetrics.fails.add(operation, 1)
+	if session.hasCap(capErrCodes) {
+		// Формат: fail|operation|description|code, operation может быть пустым
+		s.sendPacket(session.Conn, "fail", operation, description, code)
+	} else if operation != "" {
 		// Формат: fail|operation|description
-		s.sendPacket(conn, "fail", operation, description)
+		s.sendPacket(session.Conn, "fail", operation, description)
 	} else {
-		s.sendPacket(conn, "fail", description)
+		s.sendPacket(session.Conn, "fail", description)
 	}
 }
 
@@ -315,16 +429,51 @@ func (s *Server) sendBye(conn net.Conn, reason, details string) {
 	}
 }
 
+// addSession регистрирует сессию пользователя. Прежнюю сессию того же
+// пользователя вытесняет новая: она получает bye|replaced и закрывается.
 func (s *Server) addSession(login string, session *Session) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	old, ok := s.sessions[login]
 	s.sessions[login] = session
+	s.mu.Unlock()
+
+	if ok && old != session {
+		s.sendBye(old.Conn, "replaced", "")
+		old.Conn.Close()
+		old.logger().Info("Session replaced by a new connection")
+	}
 }
 
-func (s *Server) removeSession(login string) {
+// trackConn учитывает соединение для Shutdown; после начала остановки
+// соединения не принимаются
+func (s *Server) trackConn(session *Session) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	delete(s.sessions, login)
+	if s.shutdown {
+		return false
+	}
+	s.active[session] = struct{}{}
+	s.handlers.Add(1)
+	return true
+}
+
+func (s *Server) untrackConn(session *Session) {
+	s.mu.Lock()
+	delete(s.active, session)
+	s.mu.Unlock()
+	s.handlers.Done()
+}
+
+// removeSession удаляет сессию, если её ещё не вытеснила другая.
+// Возвращает false, если пользователь уже подключён заново.
+func (s *Server) removeSession(session *Session) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions[session.Login] != session {
+		return false
+	}
+	delete(s.sessions, session.Login)
+	return true
 }
 
 func (s *Server) getSession(login string) (*Session, bool) {
@@ -353,5 +502,6 @@ func (s *Server) GetStats() string {
 		users = append(users, login)
 	}
 
-	return "connections=" + strconv.Itoa(activeConnections) + ",users=" + strings.Join(users, ";")
+	return "connections=" + strconv.Itoa(activeConnections) + ",users=" + strings.Join(users, ";") +
+		",commands=" + s.metrics.String() + "," + s.limiter.String()
 }
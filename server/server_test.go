@@ -2,13 +2,30 @@ package server
 
 import (
 	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"msim/db"
+	"msim/models"
 	"msim/protocol"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 // setupTestServer создает тестовый сервер с временной базой данных
@@ -1324,3 +1341,1943 @@ func TestUnauthenticatedAccess(t *testing.T) {
 		t.Errorf("Expected fail|msg|Not authenticated, got %q", response)
 	}
 }
+
+// readWSFrame читает один текстовый фрейм WebSocket
+func readWSFrame(t *testing.T, ws *websocket.Conn) string {
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		t.Fatalf("Failed to read frame: %v", err)
+	}
+	return string(data)
+}
+
+// TestWebSocketGateway тестирует обмен сообщениями между клиентом WebSocket и клиентом TCP
+func TestWebSocketGateway(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	if err := srv.db.CreateUser("web@example.com", "password123"); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	if err := srv.db.CreateUser("tcp@example.com", "password123"); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	httpSrv := httptest.NewServer(srv.wsHandler())
+	defer httpSrv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpSrv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Failed to dial websocket: %v", err)
+	}
+	defer ws.Close()
+
+	// Клиент TCP
+	serverConn, clientConn := createTestConnection()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	go func() {
+		srv.handleConnection(serverConn)
+	}()
+	sendRequest(clientConn, "auth|tcp@example.com|password123")
+	if response, _ := readResponse(clientConn, 5*time.Second); response != "ok|auth" {
+		t.Fatalf("Expected ok|auth, got %q", response)
+	}
+
+	// Авторизация через WebSocket: один фрейм — один пакет
+	ws.WriteMessage(websocket.TextMessage, []byte("auth|web@example.com|password123"))
+	if frame := readWSFrame(t, ws); frame != "ok|auth" {
+		t.Fatalf("Expected ok|auth, got %q", frame)
+	}
+
+	// Сообщение от WebSocket-клиента TCP-клиенту
+	ws.WriteMessage(websocket.TextMessage, []byte("msg|tcp@example.com|Hello\\, TCP"))
+	msg, err := readResponse(clientConn, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	if !strings.HasPrefix(msg, "msg|web@example.com|Hello\\, TCP|") {
+		t.Errorf("Expected msg from web@example.com, got %q", msg)
+	}
+	if frame := readWSFrame(t, ws); frame != "ok|msg" {
+		t.Errorf("Expected ok|msg, got %q", frame)
+	}
+
+	// Сообщение от TCP-клиента приходит WebSocket-клиенту отдельным фреймом
+	sendRequest(clientConn, "msg|web@example.com|Hi web")
+	if frame := readWSFrame(t, ws); !strings.HasPrefix(frame, "msg|tcp@example.com|Hi web|") {
+		t.Errorf("Expected msg from tcp@example.com, got %q", frame)
+	}
+
+	// После закрытия WebSocket сессия удаляется
+	ws.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := srv.getSession("web@example.com"); !ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Session of web@example.com was not removed after websocket close")
+}
+
+// TestWebSocketOrigin тестирует проверку заголовка Origin
+func TestWebSocketOrigin(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	httpSrv := httptest.NewServer(srv.wsHandler())
+	defer httpSrv.Close()
+	wsURL := "ws" + strings.TrimPrefix(httpSrv.URL, "http")
+
+	// Чужая страница отклоняется
+	header := http.Header{"Origin": []string{"http://evil.example.com"}}
+	if _, _, err := websocket.DefaultDialer.Dial(wsURL, header); err == nil {
+		t.Errorf("Expected foreign origin to be rejected")
+	}
+
+	// Явно разрешённая страница допускается
+	srv.cfg().WSAllowedOrigins = []string{"http://chat.example.com"}
+	header = http.Header{"Origin": []string{"http://chat.example.com"}}
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+	if err != nil {
+		t.Fatalf("Expected allowed origin to connect: %v", err)
+	}
+	ws.Close()
+}
+
+// apiRequest выполняет запрос к HTTP API и разбирает JSON-ответ в out
+func apiRequest(t *testing.T, method, url, token, body string, out interface{}) int {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("Failed to decode response of %s %s: %v", method, url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// apiLogin получает токен API
+func apiLogin(t *testing.T, baseURL, login string) string {
+	t.Helper()
+	var resp struct {
+		Token string `json:"token"`
+	}
+	status := apiRequest(t, "POST", baseURL+"/api/v1/login", "",
+		`{"login":"`+login+`","password":"password123"}`, &resp)
+	if status != http.StatusOK || resp.Token == "" {
+		t.Fatalf("Login of %s failed with status %d", login, status)
+	}
+	return resp.Token
+}
+
+// TestAPI тестирует HTTP API и доставку сообщений в TCP-сессию
+func TestAPI(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	if err := srv.db.CreateUser("api@example.com", "password123"); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	if err := srv.db.CreateUser("tcp@example.com", "password123"); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	httpSrv := httptest.NewServer(srv.apiHandler())
+	defer httpSrv.Close()
+	base := httpSrv.URL
+
+	// Без токена и с неверным паролем доступа нет
+	if status := apiRequest(t, "GET", base+"/api/v1/contacts", "", "", nil); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without token, got %d", status)
+	}
+	if status := apiRequest(t, "POST", base+"/api/v1/login", "",
+		`{"login":"api@example.com","password":"wrong"}`, nil); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for wrong password, got %d", status)
+	}
+
+	token := apiLogin(t, base, "api@example.com")
+
+	// Клиент TCP
+	serverConn, clientConn := createTestConnection()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	go func() {
+		srv.handleConnection(serverConn)
+	}()
+	sendRequest(clientConn, "auth|tcp@example.com|password123")
+	if response, _ := readResponse(clientConn, 5*time.Second); response != "ok|auth" {
+		t.Fatalf("Expected ok|auth, got %q", response)
+	}
+
+	// Сообщение через API сразу приходит в TCP-сессию
+	done := make(chan string, 1)
+	go func() {
+		msg, _ := readResponse(clientConn, 5*time.Second)
+		done <- msg
+	}()
+	var sent struct {
+		Timestamp string `json:"timestamp"`
+	}
+	if status := apiRequest(t, "POST", base+"/api/v1/messages", token,
+		`{"to":"tcp@example.com","text":"Hello, TCP"}`, &sent); status != http.StatusCreated {
+		t.Fatalf("Expected 201 for message, got %d", status)
+	}
+	if msg := <-done; msg != "msg|api@example.com|Hello\\, TCP|"+sent.Timestamp {
+		t.Errorf("Unexpected message in TCP session: %q", msg)
+	}
+
+	if status := apiRequest(t, "POST", base+"/api/v1/messages", token,
+		`{"to":"nobody@example.com","text":"Hi"}`, nil); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown recipient, got %d", status)
+	}
+
+	// История с пагинацией
+	var history struct {
+		Messages []apiMessage `json:"messages"`
+	}
+	if status := apiRequest(t, "GET", base+"/api/v1/messages/tcp@example.com?limit=10", token, "", &history); status != http.StatusOK {
+		t.Fatalf("Expected 200 for history, got %d", status)
+	}
+	if len(history.Messages) != 1 || history.Messages[0].Text != "Hello, TCP" {
+		t.Errorf("Unexpected history: %+v", history.Messages)
+	}
+	for _, limit := range []string{"0", "-1"} {
+		if status := apiRequest(t, "GET", base+"/api/v1/messages/tcp@example.com?limit="+limit, token, "", nil); status != http.StatusBadRequest {
+			t.Errorf("Expected 400 for limit=%s, got %d", limit, status)
+		}
+	}
+
+	// Контакты: добавление, переименование, удаление
+	if status := apiRequest(t, "POST", base+"/api/v1/contacts", token,
+		`{"login":"tcp@example.com","nick":"Friend"}`, nil); status != http.StatusCreated {
+		t.Fatalf("Expected 201 for add contact, got %d", status)
+	}
+	if status := apiRequest(t, "POST", base+"/api/v1/contacts", token,
+		`{"login":"tcp@example.com"}`, nil); status != http.StatusConflict {
+		t.Errorf("Expected 409 for duplicate contact, got %d", status)
+	}
+	if status := apiRequest(t, "PUT", base+"/api/v1/contacts/tcp@example.com", token,
+		`{"nick":"Buddy"}`, nil); status != http.StatusNoContent {
+		t.Errorf("Expected 204 for rename, got %d", status)
+	}
+	var contacts []apiContact
+	apiRequest(t, "GET", base+"/api/v1/contacts", token, "", &contacts)
+	if len(contacts) != 1 || contacts[0].Nick != "Buddy" {
+		t.Errorf("Unexpected contacts: %+v", contacts)
+	}
+
+	// Статусы контактов
+	var statuses []apiStatus
+	apiRequest(t, "GET", base+"/api/v1/statuses", token, "", &statuses)
+	if len(statuses) != 1 || !statuses[0].Online {
+		t.Errorf("Expected tcp@example.com online, got %+v", statuses)
+	}
+
+	if status := apiRequest(t, "DELETE", base+"/api/v1/contacts/tcp@example.com", token, "", nil); status != http.StatusNoContent {
+		t.Errorf("Expected 204 for delete, got %d", status)
+	}
+	if status := apiRequest(t, "DELETE", base+"/api/v1/contacts/tcp@example.com", token, "", nil); status != http.StatusNotFound {
+		t.Errorf("Expected 404 for deleted contact, got %d", status)
+	}
+
+	// После выхода токен недействителен
+	apiRequest(t, "POST", base+"/api/v1/logout", token, "", nil)
+	if status := apiRequest(t, "GET", base+"/api/v1/contacts", token, "", nil); status != http.StatusUnauthorized {
+		t.Errorf("Expected 401 after logout, got %d", status)
+	}
+}
+
+// TestAPIEvents тестирует доставку сообщений из TCP-сессии в поток событий API
+func TestAPIEvents(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	if err := srv.db.CreateUser("api@example.com", "password123"); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	if err := srv.db.CreateUser("tcp@example.com", "password123"); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	httpSrv := httptest.NewServer(srv.apiHandler())
+	defer httpSrv.Close()
+	token := apiLogin(t, httpSrv.URL, "api@example.com")
+
+	req, _ := http.NewRequest("GET", httpSrv.URL+"/api/v1/events", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to open event stream: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// Ждём регистрации сессии потока событий
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := srv.getSession("api@example.com"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Event stream session was not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	serverConn, clientConn := createTestConnection()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	go func() {
+		srv.handleConnection(serverConn)
+	}()
+	sendRequest(clientConn, "auth|tcp@example.com|password123")
+	readResponse(clientConn, 5*time.Second)
+	sendRequest(clientConn, "msg|api@example.com|Hi\\, API")
+	readResponse(clientConn, 5*time.Second)
+
+	reader := bufio.NewReader(resp.Body)
+	var event, data string
+	for event == "" || data == "" {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if strings.HasPrefix(line, "event: ") {
+			event = strings.TrimPrefix(line, "event: ")
+		} else if strings.HasPrefix(line, "data: ") {
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+
+	var msg map[string]string
+	if err := json.Unmarshal([]byte(data), &msg); err != nil {
+		t.Fatalf("Invalid event data %q: %v", data, err)
+	}
+	if event != "msg" || msg["from"] != "tcp@example.com" || msg["text"] != "Hi, API" {
+		t.Errorf("Unexpected event %q: %v", event, msg)
+	}
+}
+
+// TestSessionReplaced тестирует вытеснение сессии новым подключением того же пользователя
+func TestSessionReplaced(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	if err := srv.db.CreateUser("alice@example.com", "password123"); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	connect := func() (net.Conn, chan struct{}) {
+		serverConn, clientConn := createTestConnection()
+		done := make(chan struct{})
+		go func() {
+			srv.handleConnection(serverConn)
+			close(done)
+		}()
+		return clientConn, done
+	}
+	waitClosed := func(done chan struct{}) {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Replaced connection was not closed")
+		}
+	}
+
+	first, firstDone := connect()
+	defer first.Close()
+	sendRequest(first, "auth|alice@example.com|password123")
+	readResponse(first, 5*time.Second)
+
+	second, secondDone := connect()
+	defer second.Close()
+	sendRequest(second, "auth|alice@example.com|password123")
+	if response, _ := readResponse(first, 5*time.Second); response != "bye|replaced" {
+		t.Errorf("Expected bye|replaced on the old connection, got %q", response)
+	}
+	if response, _ := readResponse(second, 5*time.Second); response != "ok|auth" {
+		t.Fatalf("Expected ok|auth, got %q", response)
+	}
+	waitClosed(firstDone)
+	// Закрытие старого соединения не удаляет новую сессию
+	if session, ok := srv.getSession("alice@example.com"); !ok || session.Conn == nil || session.Login != "alice@example.com" {
+		t.Fatalf("Expected the new session to stay registered")
+	}
+	sendRequest(second, "ping")
+	if response, _ := readResponse(second, 5*time.Second); response != "pong" {
+		t.Fatalf("Expected the new connection to work, got %q", response)
+	}
+
+	// Поток событий API вытесняет TCP-сессию и остаётся зарегистрированным
+	httpSrv := httptest.NewServer(srv.apiHandler())
+	defer httpSrv.Close()
+	token := apiLogin(t, httpSrv.URL, "alice@example.com")
+	req, _ := http.NewRequest("GET", httpSrv.URL+"/api/v1/events", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	events := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("Failed to open event stream: %v", err)
+			close(events)
+			return
+		}
+		events <- resp
+	}()
+	if response, _ := readResponse(second, 5*time.Second); response != "bye|replaced" {
+		t.Errorf("Expected bye|replaced on the TCP connection, got %q", response)
+	}
+	if resp := <-events; resp != nil {
+		defer resp.Body.Close()
+	}
+	waitClosed(secondDone)
+	session, ok := srv.getSession("alice@example.com")
+	if !ok {
+		t.Fatal("Expected the event stream session to stay registered")
+	}
+	if _, isSSE := session.Conn.(*sseConn); !isSSE {
+		t.Errorf("Expected the event stream session, got %T", session.Conn)
+	}
+}
+
+// TestWebhooks тестирует отправку веб-хуков, подпись, повторы и согласие на события сообщений
+func TestWebhooks(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	type hookRequest struct {
+		event     string
+		body      []byte
+		signature string
+	}
+	requests := make(chan hookRequest, 100)
+	var calls int32
+	standIn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Первый запрос завершается ошибкой, чтобы проверить повтор из очереди
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		requests <- hookRequest{r.Header.Get("X-MSIM-Event"), body, r.Header.Get("X-MSIM-Signature")}
+	}))
+	defer standIn.Close()
+
+	srv.webhooks = newWebhookDispatcher(srv.db, &ServerConfig{
+		WebhookURLs:   []string{standIn.URL},
+		WebhookSecret: "s3cret",
+		WebhookEvents: []string{webhookUserRegistered, webhookMessageStored},
+	})
+	srv.webhooks.retryDelay = 10 * time.Millisecond
+	go srv.webhooks.run()
+	defer srv.webhooks.Stop()
+
+	waitEvent := func(event string) map[string]interface{} {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case req := <-requests:
+				if req.event != event {
+					continue
+				}
+				mac := hmac.New(sha256.New, []byte("s3cret"))
+				mac.Write(req.body)
+				if req.signature != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+					t.Errorf("Invalid signature %q", req.signature)
+				}
+				var payload struct {
+					Event string                 `json:"event"`
+					Data  map[string]interface{} `json:"data"`
+				}
+				if err := json.Unmarshal(req.body, &payload); err != nil || payload.Event != event {
+					t.Fatalf("Invalid payload %q: %v", req.body, err)
+				}
+				return payload.Data
+			case <-timeout:
+				t.Fatalf("Webhook %s was not delivered", event)
+				return nil
+			}
+		}
+	}
+
+	if err := srv.db.CreateUser("friend@example.com", "password123"); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	serverConn, clientConn := createTestConnection()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	go func() {
+		srv.handleConnection(serverConn)
+	}()
+
+	// Регистрация: первая попытка доставки неудачна, событие приходит после повтора
+	sendRequest(clientConn, "reg|new@example.com|password123")
+	readResponse(clientConn, 5*time.Second)
+	if data := waitEvent(webhookUserRegistered); data["user"] != "new@example.com" {
+		t.Errorf("Unexpected registration data: %v", data)
+	}
+
+	sendRequest(clientConn, "auth|new@example.com|password123")
+	readResponse(clientConn, 5*time.Second)
+
+	// Без согласия события о сообщениях не отправляются
+	sendRequest(clientConn, "msg|friend@example.com|first")
+	readResponse(clientConn, 5*time.Second)
+
+	sendRequest(clientConn, "hook")
+	if response, _ := readResponse(clientConn, 5*time.Second); response != "hook|off" {
+		t.Errorf("Expected hook|off, got %q", response)
+	}
+	sendRequest(clientConn, "hook|on")
+	if response, _ := readResponse(clientConn, 5*time.Second); response != "ok|hook" {
+		t.Errorf("Expected ok|hook, got %q", response)
+	}
+
+	sendRequest(clientConn, "msg|friend@example.com|second")
+	readResponse(clientConn, 5*time.Second)
+	data := waitEvent(webhookMessageStored)
+	if data["text"] != "second" || data["from"] != "new@example.com" || data["to"] != "friend@example.com" {
+		t.Errorf("Unexpected message data: %v", data)
+	}
+}
+
+// TestBots тестирует вход бота по API-ключу, отсутствие уведомлений о статусе и отметку в list
+func TestBots(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	if err := srv.db.CreateUser("human@example.com", "password123"); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	if err := srv.CreateBot("bot@example.com"); err != nil {
+		t.Fatalf("Failed to create bot: %v", err)
+	}
+	if err := srv.CreateBot("human@example.com"); err != ErrUserExists {
+		t.Errorf("Expected ErrUserExists, got %v", err)
+	}
+	if _, err := srv.IssueAPIKey("human@example.com"); err != ErrNotBot {
+		t.Errorf("Expected ErrNotBot, got %v", err)
+	}
+	key, err := srv.IssueAPIKey("bot@example.com")
+	if err != nil {
+		t.Fatalf("Failed to issue key: %v", err)
+	}
+	srv.db.AddContact("human@example.com", "bot@example.com", "Bot")
+	srv.db.AddContact("bot@example.com", "human@example.com", "Human")
+
+	humanServer, humanClient := createTestConnection()
+	defer humanServer.Close()
+	defer humanClient.Close()
+	go srv.handleConnection(humanServer)
+	sendRequest(humanClient, "auth|human@example.com|password123")
+	readResponse(humanClient, 5*time.Second)
+
+	sendRequest(humanClient, "list")
+	if response, _ := readResponse(humanClient, 5*time.Second); response != "list|bot@example.com|Bot|bot" {
+		t.Errorf("Expected bot marker in list, got %q", response)
+	}
+
+	botServer, botClient := createTestConnection()
+	defer botServer.Close()
+	defer botClient.Close()
+	go srv.handleConnection(botServer)
+
+	// Пароль боту не подходит, только ключ
+	sendRequest(botClient, "auth|bot@example.com|password123")
+	if response, _ := readResponse(botClient, 5*time.Second); response != "fail|auth|Invalid credentials" {
+		t.Errorf("Expected auth failure with password, got %q", response)
+	}
+	sendRequest(botClient, "auth|bot@example.com|"+key)
+	if response, _ := readResponse(botClient, 5*time.Second); response != "ok|auth" {
+		t.Fatalf("Expected ok|auth with key, got %q", response)
+	}
+
+	// Первым человек получает сообщение, а не on|bot@example.com
+	sendRequest(botClient, "msg|human@example.com|build passed")
+	if response, _ := readResponse(humanClient, 5*time.Second); !strings.HasPrefix(response, "msg|bot@example.com|build passed|") {
+		t.Errorf("Expected message from bot without presence notification, got %q", response)
+	}
+	readResponse(botClient, 5*time.Second)
+
+	sendRequest(humanClient, "stat|bot@example.com")
+	if response, _ := readResponse(humanClient, 5*time.Second); !strings.HasPrefix(response, "stat|bot@example.com|on|") || !strings.HasSuffix(response, "|bot") {
+		t.Errorf("Expected bot marker in stat, got %q", response)
+	}
+
+	// Отключение бота тоже не рассылается
+	sendRequest(botClient, "bye")
+	readResponse(botClient, 5*time.Second)
+	sendRequest(humanClient, "ping")
+	if response, _ := readResponse(humanClient, 5*time.Second); response != "pong" {
+		t.Errorf("Expected pong without off notification, got %q", response)
+	}
+
+	// Отозванный ключ больше не подходит
+	keys, err := srv.APIKeys("bot@example.com")
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("Expected one key, got %v, %v", keys, err)
+	}
+	if err := srv.RevokeAPIKey(keys[0].ID); err != nil {
+		t.Fatalf("Failed to revoke key: %v", err)
+	}
+	if err := srv.RevokeAPIKey(keys[0].ID); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound for revoked key, got %v", err)
+	}
+	if valid, _, _ := srv.authenticate("bot@example.com", key); valid {
+		t.Errorf("Expected revoked key to be rejected")
+	}
+}
+
+// testPlugin реализует все хуки и записывает вызовы
+type testPlugin struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (p *testPlugin) Name() string { return "test" }
+
+func (p *testPlugin) record(event string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = append(p.events, event)
+}
+
+func (p *testPlugin) recorded() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.events...)
+}
+
+func (p *testPlugin) BeforeMessage(msg *Message) error {
+	if strings.Contains(msg.Text, "spam") {
+		return errors.New("Message rejected")
+	}
+	msg.Text = strings.ToUpper(msg.Text)
+	return nil
+}
+
+func (p *testPlugin) AfterMessage(msg Message) {
+	p.record("after:" + msg.Sender + ":" + msg.Text)
+}
+
+func (p *testPlugin) OnAuth(login string, bot bool) {
+	p.record("auth:" + login)
+}
+
+func (p *testPlugin) OnPresence(login string, online bool, at time.Time) {
+	if online {
+		p.record("online:" + login)
+	} else {
+		p.record("offline:" + login)
+	}
+}
+
+func (p *testPlugin) Packets() []string { return []string{"whoami", "boom"} }
+
+func (p *testPlugin) HandlePacket(ctx *PacketContext, pkt *protocol.Packet) {
+	if pkt.Type == "boom" {
+		panic("boom")
+	}
+	if ctx.Login == "" {
+		ctx.Fail("whoami", "Not authenticated")
+		return
+	}
+	ctx.Reply("whoami", ctx.Login)
+}
+
+// TestPlugins тестирует хуки плагинов и собственные типы пакетов
+func TestPlugins(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	plugin := &testPlugin{}
+	if err := srv.Register(plugin); err != nil {
+		t.Fatalf("Failed to register plugin: %v", err)
+	}
+	if err := srv.Register(plugin); err == nil {
+		t.Errorf("Expected error for duplicate packet types")
+	}
+
+	if err := srv.db.CreateUser("sender@example.com", "password123"); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	if err := srv.db.CreateUser("recipient@example.com", "password123"); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	serverConn, clientConn := createTestConnection()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	go srv.handleConnection(serverConn)
+
+	sendRequest(clientConn, "whoami")
+	if response, _ := readResponse(clientConn, 5*time.Second); response != "fail|whoami|Not authenticated" {
+		t.Errorf("Expected plugin failure before auth, got %q", response)
+	}
+
+	sendRequest(clientConn, "auth|sender@example.com|password123")
+	readResponse(clientConn, 5*time.Second)
+
+	sendRequest(clientConn, "whoami")
+	if response, _ := readResponse(clientConn, 5*time.Second); response != "whoami|sender@example.com" {
+		t.Errorf("Expected whoami|sender@example.com, got %q", response)
+	}
+
+	// Паника в плагине не закрывает соединение
+	sendRequest(clientConn, "boom")
+	sendRequest(clientConn, "ping")
+	if response, _ := readResponse(clientConn, 5*time.Second); response != "pong" {
+		t.Errorf("Expected pong after plugin panic, got %q", response)
+	}
+
+	sendRequest(clientConn, "msg|recipient@example.com|buy spam")
+	if response, _ := readResponse(clientConn, 5*time.Second); response != "fail|msg|Message rejected" {
+		t.Errorf("Expected rejected message, got %q", response)
+	}
+	sendRequest(clientConn, "msg|recipient@example.com|hello")
+	readResponse(clientConn, 5*time.Second)
+
+	messages, _ := srv.db.GetMessages("sender@example.com", "recipient@example.com", 0, 10)
+	if len(messages) != 1 || messages[0].Text != "HELLO" {
+		t.Errorf("Expected one modified message, got %+v", messages)
+	}
+
+	sendRequest(clientConn, "help")
+	if response, _ := readResponse(clientConn, 5*time.Second); !strings.Contains(response, "whoami") {
+		t.Errorf("Expected plugin packet in help, got %q", response)
+	}
+
+	expected := []string{"online:sender@example.com", "auth:sender@example.com", "after:sender@example.com:HELLO"}
+	if events := plugin.recorded(); strings.Join(events, " ") != strings.Join(expected, " ") {
+		t.Errorf("Expected hook calls %v, got %v", expected, events)
+	}
+}
+
+// TestRedactPacket тестирует скрытие секретных аргументов в логе
+func TestRedactPacket(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	tests := []struct {
+		line     string
+		expected string
+	}{
+		{"auth|user@example.com|secret", "auth|user@example.com|***"},
+		{"reg|user@example.com|pa\\|ss", "reg|user@example.com|***"},
+		{"msg|friend@example.com|hello", "msg|friend@example.com|hello"},
+		{"auth|user@example.com", "auth|user@example.com"},
+		{"ping", "ping"},
+	}
+	for _, tt := range tests {
+		pkt, err := protocol.ParsePacket(tt.line + "\n")
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", tt.line, err)
+		}
+		cmd, _ := srv.commands.get(pkt.Type)
+		if got := redactPacket(cmd, pkt); got != tt.expected {
+			t.Errorf("redactPacket(%q) = %q, want %q", tt.line, got, tt.expected)
+		}
+	}
+}
+
+// TestCommandArgs тестирует разбор аргументов по схеме и проверку обязательных
+func TestCommandArgs(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	args := []struct {
+		line     string
+		expected []string
+	}{
+		{"msg|bob@example.com|a|b", []string{"bob@example.com", "a|b"}},
+		{"hist|bob@example.com|20", []string{"bob@example.com", "20", ""}},
+		{"hclear|bob@example.com", []string{"bob@example.com"}},
+		{"auth", []string{"", ""}},
+		{"caps|errcodes|teleport", []string{"errcodes|teleport"}},
+	}
+	for _, tt := range args {
+		pkt, err := protocol.ParsePacket(tt.line + "\n")
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", tt.line, err)
+		}
+		cmd, _ := srv.commands.get(pkt.Type)
+		if got := packetArgs(cmd, pkt); !slices.Equal(got, tt.expected) {
+			t.Errorf("packetArgs(%q) = %q, want %q", tt.line, got, tt.expected)
+		}
+	}
+
+	if err := srv.db.CreateUser("alice@example.com", "password123"); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	serverConn, clientConn := createTestConnection()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	go srv.handleConnection(serverConn)
+
+	tests := []struct {
+		request  string
+		expected string
+	}{
+		{"auth|alice@example.com", "fail|auth|Invalid credentials"},
+		{"reg|bob@example.com", "fail|reg|Invalid data"},
+		{"auth|alice@example.com|password123", "ok|auth"},
+		{"msg|bob@example.com", "fail|msg|Message text required"},
+		{"ack|bob@example.com", "fail|ack|Invalid ack format"},
+		{"hist", "fail|hist|Contact required"},
+		{"hclear", "fail|hclear|Contact required"},
+		{"ren|bob@example.com", "fail|ren|Invalid data"},
+		{"del", "fail|del|Invalid data"},
+		{"fsnd|bob@example.com|a.txt", "fail|fsnd|Invalid format"},
+		{"facc|bob@example.com", "fail|facc|Session ID required"},
+		{"fst", "fail|fst|Session ID required"},
+		{"hook|maybe", "fail|hook|Invalid data"},
+	}
+	for _, tt := range tests {
+		sendRequest(clientConn, tt.request)
+		if response, _ := readResponse(clientConn, 5*time.Second); response != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.request, tt.expected, response)
+		}
+	}
+}
+
+// TestCommandMiddleware тестирует восстановление после паники и счётчики команд
+func TestCommandMiddleware(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	srv.commands.add(&command{
+		name:    "crash",
+		handler: func(session *Session, pkt *protocol.Packet, args []string, conn net.Conn) { panic("crash") },
+	})
+
+	serverConn, clientConn := createTestConnection()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	go srv.handleConnection(serverConn)
+
+	sendRequest(clientConn, "crash")
+	if response, _ := readResponse(clientConn, 5*time.Second); response != "fail|crash|Internal error" {
+		t.Errorf("Expected fail|crash|Internal error, got %q", response)
+	}
+	sendRequest(clientConn, "ping")
+	if response, _ := readResponse(clientConn, 5*time.Second); response != "pong" {
+		t.Errorf("Expected pong after panic, got %q", response)
+	}
+	sendRequest(clientConn, "list")
+	if response, _ := readResponse(clientConn, 5*time.Second); response != "fail|list|Not authenticated" {
+		t.Errorf("Expected fail|list|Not authenticated, got %q", response)
+	}
+
+	// Счётчик обновляется после отправки ответа, поэтому ждём его
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := srv.GetStats()
+		if strings.Contains(stats, "commands=crash:1;list:1;ping:1") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected command counters in stats, got %q", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestErrorCodes тестирует согласование кодов ошибок в пакете fail
+func TestErrorCodes(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	serverConn, clientConn := createTestConnection()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	go srv.handleConnection(serverConn)
+
+	// До согласования формат не меняется
+	sendRequest(clientConn, "list")
+	if response, _ := readResponse(clientConn, 5*time.Second); response != "fail|list|Not authenticated" {
+		t.Errorf("Expected fail|list|Not authenticated, got %q", response)
+	}
+
+	sendRequest(clientConn, "caps")
+	if response, _ := readResponse(clientConn, 5*time.Second); response != "caps|errcodes" {
+		t.Errorf("Expected caps|errcodes, got %q", response)
+	}
+
+	// Неизвестные возможности пропускаются
+	sendRequest(clientConn, "caps|errcodes|teleport")
+	if response, _ := readResponse(clientConn, 5*time.Second); response != "caps|errcodes" {
+		t.Errorf("Expected caps|errcodes, got %q", response)
+	}
+
+	tests := []struct {
+		request  string
+		expected string
+	}{
+		{"list", "fail|list|Not authenticated|E_NOT_AUTH"},
+		{"auth|nobody@example.com|wrong", "fail|auth|Invalid credentials|E_BAD_CREDENTIALS"},
+		{"nosuchpacket", "fail||Unknown packet type|E_UNKNOWN_PACKET"},
+		{"reg||", "fail|reg|Invalid data|E_INVALID"},
+	}
+	for _, tt := range tests {
+		sendRequest(clientConn, tt.request)
+		if response, _ := readResponse(clientConn, 5*time.Second); response != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.request, tt.expected, response)
+		}
+	}
+
+	// Код берётся из самой ошибки, а не из её текста
+	codes := []struct {
+		err      error
+		expected string
+	}{
+		{errUserNotFound, codeNoUser},
+		{fmt.Errorf("send: %w", errRecipientNotFound), codeNoUser},
+		{ErrSessionNotFound, codeNoSession},
+		{errors.New("User not found"), codeInternal},
+	}
+	for _, tt := range codes {
+		if code := errorCode(tt.err); code != tt.expected {
+			t.Errorf("errorCode(%q): expected %s, got %s", tt.err, tt.expected, code)
+		}
+	}
+}
+
+// TestRateLimit тестирует ограничение частоты команд и отключение за флуд
+func TestRateLimit(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	srv.cfg().FloodStrikes = 2
+	srv.limiter = newRateLimiter(map[string]RateLimits{
+		rateClassQuery: {Session: RateLimit{Rate: 0.001, Burst: 2}},
+	})
+
+	serverConn, clientConn := createTestConnection()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	go srv.handleConnection(serverConn)
+
+	expected := []string{
+		"fail|list|Not authenticated",
+		"fail|list|Not authenticated",
+		"fail|list|Too many requests",
+		"fail|list|Too many requests",
+	}
+	for _, want := range expected {
+		sendRequest(clientConn, "list")
+		if response, _ := readResponse(clientConn, 5*time.Second); response != want {
+			t.Errorf("Expected %q, got %q", want, response)
+		}
+	}
+	if response, _ := readResponse(clientConn, 5*time.Second); response != "bye|flood" {
+		t.Errorf("Expected bye|flood, got %q", response)
+	}
+	if _, err := readResponse(clientConn, time.Second); err == nil {
+		t.Error("Expected connection to be closed after flood")
+	}
+	if stats := srv.GetStats(); !strings.Contains(stats, "limited=query:2,floods=1") {
+		t.Errorf("Expected rate limit counters in stats, got %q", stats)
+	}
+
+	// Лимит по адресу общий для всех соединений с него
+	srv.limiter = newRateLimiter(map[string]RateLimits{
+		rateClassAuth: {IP: RateLimit{Rate: 0.001, Burst: 1}},
+	})
+	first, firstClient := createTestConnection()
+	second, secondClient := createTestConnection()
+	defer first.Close()
+	defer firstClient.Close()
+	defer second.Close()
+	defer secondClient.Close()
+	go srv.handleConnection(first)
+	go srv.handleConnection(second)
+
+	sendRequest(firstClient, "auth|nobody@example.com|password")
+	if response, _ := readResponse(firstClient, 5*time.Second); response != "fail|auth|Invalid credentials" {
+		t.Errorf("Expected fail|auth|Invalid credentials, got %q", response)
+	}
+	// Клиент, согласовавший коды ошибок, получает E_RATE_LIMIT
+	sendRequest(secondClient, "caps|errcodes")
+	if response, _ := readResponse(secondClient, 5*time.Second); response != "caps|errcodes" {
+		t.Fatalf("Expected caps|errcodes, got %q", response)
+	}
+	sendRequest(secondClient, "auth|nobody@example.com|password")
+	if response, _ := readResponse(secondClient, 5*time.Second); response != "fail|auth|Too many requests|E_RATE_LIMIT" {
+		t.Errorf("Expected fail|auth|Too many requests|E_RATE_LIMIT, got %q", response)
+	}
+
+	// HTTP API делит корзины логина и адреса с протоколом
+	srv.limiter = newRateLimiter(map[string]RateLimits{
+		rateClassAuth: {IP: RateLimit{Rate: 0.001, Burst: 1}},
+		rateClassMsg:  {Login: RateLimit{Rate: 0.001, Burst: 1}},
+	})
+	if err := srv.db.CreateUser("api@example.com", "password123"); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	httpSrv := httptest.NewServer(srv.apiHandler())
+	defer httpSrv.Close()
+	token := apiLogin(t, httpSrv.URL, "api@example.com")
+
+	var apiErr struct {
+		Code string `json:"code"`
+	}
+	if status := apiRequest(t, "POST", httpSrv.URL+"/api/v1/login", "",
+		`{"login":"api@example.com","password":"password123"}`, &apiErr); status != http.StatusTooManyRequests || apiErr.Code != codeRateLimit {
+		t.Errorf("Expected 429 %s for second login, got %d %s", codeRateLimit, status, apiErr.Code)
+	}
+	if status := apiRequest(t, "POST", httpSrv.URL+"/api/v1/messages", token,
+		`{"to":"api@example.com","text":"one"}`, nil); status != http.StatusCreated {
+		t.Errorf("Expected 201 for first message, got %d", status)
+	}
+	apiErr.Code = ""
+	if status := apiRequest(t, "POST", httpSrv.URL+"/api/v1/messages", token,
+		`{"to":"api@example.com","text":"two"}`, &apiErr); status != http.StatusTooManyRequests || apiErr.Code != codeRateLimit {
+		t.Errorf("Expected 429 %s for second message, got %d %s", codeRateLimit, status, apiErr.Code)
+	}
+
+	session := &Session{Login: "api@example.com"}
+	if srv.limiter.allow(rateClassMsg, session, session.Login, "192.0.2.1") {
+		t.Error("Expected the login limit spent over HTTP to apply to protocol sessions")
+	}
+}
+
+// TestAuthLockout тестирует блокировку перебора паролей и ограничение регистраций
+func TestAuthLockout(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	srv.cfg().LockoutThreshold = 2
+	srv.cfg().LockoutDuration = time.Hour
+	srv.cfg().RegistrationsPerIP = 2
+	srv.guard.delay = time.Millisecond
+
+	if err := srv.db.CreateUser("victim@example.com", "password123"); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	// exchange отправляет запросы по новому соединению и возвращает последний ответ
+	exchange := func(srv *Server, requests ...string) string {
+		serverConn, clientConn := createTestConnection()
+		defer clientConn.Close()
+		go srv.handleConnection(serverConn)
+		var response string
+		for _, request := range requests {
+			sendRequest(clientConn, request)
+			response, _ = readResponse(clientConn, 5*time.Second)
+		}
+		return response
+	}
+
+	for i := 0; i < 2; i++ {
+		if response := exchange(srv, "auth|victim@example.com|wrong"); response != "fail|auth|Invalid credentials" {
+			t.Errorf("Expected fail|auth|Invalid credentials, got %q", response)
+		}
+	}
+	// После порога не принимается даже верный пароль
+	if response := exchange(srv, "auth|victim@example.com|password123"); response != "fail|auth|Too many failed attempts" {
+		t.Errorf("Expected fail|auth|Too many failed attempts, got %q", response)
+	}
+	if response := exchange(srv, "caps|errcodes", "auth|victim@example.com|password123"); response != "fail|auth|Too many failed attempts|E_LOCKED" {
+		t.Errorf("Expected E_LOCKED for locked login, got %q", response)
+	}
+
+	// Блокировка хранится в базе и переживает перезапуск сервера
+	restarted := New(srv.db, srv.cfg())
+	if response := exchange(restarted, "auth|victim@example.com|password123"); response != "fail|auth|Too many failed attempts" {
+		t.Errorf("Expected lockout after restart, got %q", response)
+	}
+
+	lockouts, err := restarted.Lockouts()
+	if err != nil || len(lockouts) != 1 || lockouts[0].Key != "victim@example.com" || lockouts[0].LockedUntil.IsZero() {
+		t.Fatalf("Expected a single login lockout, got %+v (%v)", lockouts, err)
+	}
+	if n, err := restarted.ClearLockouts("victim@example.com"); err != nil || n != 1 {
+		t.Fatalf("Expected 1 cleared lockout, got %d (%v)", n, err)
+	}
+	if response := exchange(restarted, "auth|victim@example.com|password123"); response != "ok|auth" {
+		t.Errorf("Expected ok|auth after clearing lockout, got %q", response)
+	}
+
+	for _, login := range []string{"first@example.com", "second@example.com"} {
+		if response := exchange(srv, "reg|"+login+"|password"); response != "ok|reg" {
+			t.Errorf("Expected ok|reg for %s, got %q", login, response)
+		}
+	}
+	if response := exchange(srv, "reg|third@example.com|password"); response != "fail|reg|Too many registrations" {
+		t.Errorf("Expected fail|reg|Too many registrations, got %q", response)
+	}
+	if response := exchange(srv, "caps|errcodes", "reg|third@example.com|password"); response != "fail|reg|Too many registrations|E_LOCKED" {
+		t.Errorf("Expected E_LOCKED for registration limit, got %q", response)
+	}
+}
+
+// TestInputLimits тестирует ограничения длины строк, логинов, ников, сообщений и контактов
+func TestInputLimits(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	// Остаток длинной строки пропускается, следующая читается как обычно
+	reader := bufio.NewReaderSize(strings.NewReader(strings.Repeat("x", 100)+"\nping\n"), 16)
+	if _, err := readLine(reader, 32); err != errLineTooLong {
+		t.Errorf("Expected errLineTooLong, got %v", err)
+	}
+	if line, err := readLine(reader, 32); err != nil || line != "ping\n" {
+		t.Errorf("Expected ping after long line, got %q (%v)", line, err)
+	}
+
+	srv.cfg().MaxLineLength = 64
+	srv.cfg().MaxMessageLength = 5
+	srv.cfg().MaxLoginLength = 20
+	srv.cfg().MaxNickLength = 8
+	srv.cfg().MaxContacts = 1
+	srv.cfg().MaxConnsPerIP = 1
+
+	serverConn, clientConn := createTestConnection()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	go srv.handleConnection(serverConn)
+
+	tests := []struct {
+		request  string
+		expected string
+	}{
+		{"msg|someone|" + strings.Repeat("a", 100), "fail|Packet too long"},
+		{"ping", "pong"},
+		{"reg|bad login|password", "fail|reg|Invalid login"},
+		{"reg|very.long.login@example.com|password", "fail|reg|Invalid login"},
+		{"reg|alice@example.com|password", "ok|reg"},
+		{"caps|errcodes", "caps|errcodes"},
+		{"msg|someone|" + strings.Repeat("a", 100), "fail||Packet too long|E_TOO_LONG"},
+		{"reg|bad login|password", "fail|reg|Invalid login|E_INVALID"},
+		{"auth|alice@example.com|password", "ok|auth"},
+		{"msg|alice@example.com|hello!", "fail|msg|Message too long|E_TOO_LONG"},
+		{"add|bob@example.com|Bob\x07", "fail|add|Invalid nick|E_INVALID"},
+		{"add|bob@example.com|Bob", "ok|add"},
+		{"ren|bob@example.com|Bob\x07", "fail|ren|Invalid nick|E_INVALID"},
+		{"add|carol@example.com|Carol", "fail|add|Contact list is full|E_LIMIT"},
+		{"del|bob@example.com", "ok|del"},
+	}
+	for _, login := range []string{"bob@example.com", "carol@example.com"} {
+		if err := srv.db.CreateUser(login, "password"); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+	for _, tt := range tests {
+		sendRequest(clientConn, tt.request)
+		if response, _ := readResponse(clientConn, 5*time.Second); response != tt.expected {
+			t.Errorf("%.20s: expected %q, got %q", tt.request, tt.expected, response)
+		}
+	}
+
+	if _, err := srv.deliverMessage("alice@example.com", "bob@example.com", "hello!"); err != errMessageTooLong {
+		t.Errorf("Expected errMessageTooLong, got %v", err)
+	}
+	if err := srv.addContact("alice@example.com", "bob@example.com", "Bob\x07"); err != errInvalidNick {
+		t.Errorf("Expected errInvalidNick, got %v", err)
+	}
+	if err := srv.addContact("alice@example.com", "bob@example.com", "Bob"); err != nil {
+		t.Errorf("Failed to add contact: %v", err)
+	}
+	if err := srv.addContact("alice@example.com", "carol@example.com", "Carol"); err != errContactLimit {
+		t.Errorf("Expected errContactLimit, got %v", err)
+	}
+
+	if !srv.acquireConn("192.0.2.1") || srv.acquireConn("192.0.2.1") {
+		t.Error("Expected only one connection per IP")
+	}
+	srv.releaseConn("192.0.2.1")
+	if !srv.acquireConn("192.0.2.1") {
+		t.Error("Expected connection to be accepted after release")
+	}
+}
+
+// TestMetrics тестирует вывод метрик в формате Prometheus
+func TestMetrics(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	serverConn, clientConn := createTestConnection()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	go srv.handleConnection(serverConn)
+
+	for _, request := range []string{"list", "reg|alice@example.com|password", "auth|alice@example.com|password", "msg|alice@example.com|hi"} {
+		sendRequest(clientConn, request)
+		if _, err := readResponse(clientConn, 5*time.Second); err != nil {
+			t.Fatalf("%s: %v", request, err)
+		}
+	}
+	if _, err := srv.fileManager.CreateSession("alice@example.com", "bob@example.com", "a.txt", 10, "hash"); err != nil {
+		t.Fatalf("Failed to create file session: %v", err)
+	}
+
+	var buf strings.Builder
+	srv.writeMetrics(&buf)
+	metrics := buf.String()
+
+	for _, line := range []string{
+		"msim_connections 1\n",
+		"msim_connections_total 1\n",
+		"msim_sessions 1\n",
+		`msim_packets_total{type="auth"} 1` + "\n",
+		`msim_fail_responses_total{operation="list"} 1` + "\n",
+		`msim_message_store_seconds_count 1` + "\n",
+		`msim_file_transfers_total{status="pending"} 1` + "\n",
+		"msim_file_ports 1000\n",
+		"# TYPE msim_db_query_seconds histogram\n",
+		`msim_db_query_seconds_bucket{statement="SELECT",le="+Inf"}`,
+	} {
+		if !strings.Contains(metrics, line) {
+			t.Errorf("Expected %q in metrics output:\n%s", line, metrics)
+		}
+	}
+}
+
+// TestLogRedaction тестирует скрытие полей пакетов в структурированном логе
+func TestLogRedaction(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+	srv.cfg().LogRedact = []string{"text", "filename"}
+
+	var buf strings.Builder
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	serverConn, clientConn := createTestConnection()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	session := &Session{ID: "abc123", Login: "alice@example.com", Conn: serverConn}
+
+	logPacket := func(line string) map[string]interface{} {
+		t.Helper()
+		buf.Reset()
+		pkt, err := protocol.ParsePacket(line + "\n")
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", line, err)
+		}
+		cmd, _ := srv.commands.get(pkt.Type)
+		srv.logPacket(session, cmd, pkt, packetArgs(cmd, pkt))
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(buf.String()), &entry); err != nil {
+			t.Fatalf("Failed to decode log entry %q: %v", buf.String(), err)
+		}
+		return entry
+	}
+
+	entry := logPacket("msg|bob@example.com|meet me at noon")
+	expected := map[string]interface{}{
+		"type": "msg", "recipient": "bob@example.com", "text": "***",
+		"session": "abc123", "login": "alice@example.com",
+	}
+	for key, value := range expected {
+		if entry[key] != value {
+			t.Errorf("Expected %s=%v, got %v", key, value, entry[key])
+		}
+	}
+	if _, ok := entry["raw"]; ok {
+		t.Error("Raw packet logged without LogPackets")
+	}
+
+	if entry := logPacket("fsnd|bob@example.com|report.pdf|100|hash"); entry["filename"] != "***" || entry["size"] != "100" {
+		t.Errorf("Expected redacted filename, got %v", entry)
+	}
+	if entry := logPacket("auth|alice@example.com|password"); entry["password"] != "***" {
+		t.Errorf("Expected hidden password, got %v", entry)
+	}
+	if entry := logPacket("stat"); entry["user"] != nil {
+		t.Errorf("Expected no attribute for a missing argument, got %v", entry)
+	}
+
+	srv.cfg().LogPackets = true
+	entry = logPacket("msg|bob@example.com|meet me at noon")
+	if entry["raw"] != "msg|bob@example.com|meet me at noon" || entry["text"] != "***" {
+		t.Errorf("Expected raw packet with LogPackets, got %v", entry)
+	}
+	if entry := logPacket("auth|alice@example.com|password"); entry["raw"] != "auth|alice@example.com|***" {
+		t.Errorf("Expected password hidden in raw packet, got %v", entry)
+	}
+}
+
+// TestAuditLog тестирует запись событий безопасности и выборку журнала аудита
+func TestAuditLog(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+	srv.guard.delay = time.Millisecond
+
+	if err := srv.db.CreateUser("bob@example.com", "password"); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	serverConn, clientConn := createTestConnection()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	go srv.handleConnection(serverConn)
+
+	for _, tt := range []struct {
+		request  string
+		expected string
+	}{
+		{"reg|alice@example.com|password", "ok|reg"},
+		{"auth|alice@example.com|wrong", "fail|auth|Invalid credentials"},
+		{"auth|alice@example.com|password", "ok|auth"},
+		{"add|bob@example.com|Bob", "ok|add"},
+		{"hclear|bob@example.com", "ok|hclear"},
+		{"del|bob@example.com", "ok|del"},
+	} {
+		sendRequest(clientConn, tt.request)
+		if response, _ := readResponse(clientConn, 5*time.Second); response != tt.expected {
+			t.Fatalf("%s: expected %q, got %q", tt.request, tt.expected, response)
+		}
+	}
+	srv.Audit("shutdown", "", "reason", "planned maintenance")
+
+	events, err := srv.AuditEvents(db.AuditFilter{Login: "alice@example.com"})
+	if err != nil {
+		t.Fatalf("Failed to query audit log: %v", err)
+	}
+	var names []string
+	for _, e := range events {
+		names = append(names, e.Event)
+	}
+	expected := "contact.delete history.clear auth.success auth.failure register"
+	if strings.Join(names, " ") != expected {
+		t.Errorf("Expected events %q, got %q", expected, strings.Join(names, " "))
+	}
+	if events[0].Details != "contact=bob@example.com" || events[0].IP != "pipe" {
+		t.Errorf("Unexpected contact.delete event: %+v", events[0])
+	}
+
+	events, err = srv.AuditEvents(db.AuditFilter{Event: "admin.*"})
+	if err != nil || len(events) != 1 || events[0].Details != "reason=planned_maintenance" {
+		t.Errorf("Expected admin.shutdown event, got %+v (%v)", events, err)
+	}
+
+	events, err = srv.AuditEvents(db.AuditFilter{Event: "auth.failure", Since: time.Now().Add(-time.Hour), Limit: 10})
+	if err != nil || len(events) != 1 {
+		t.Errorf("Expected one auth.failure event, got %+v (%v)", events, err)
+	}
+	if events, _ := srv.AuditEvents(db.AuditFilter{Until: time.Now().Add(-time.Hour)}); len(events) != 0 {
+		t.Errorf("Expected no events before an hour ago, got %+v", events)
+	}
+
+	// Устаревшие события удаляются при следующей записи
+	old := &models.AuditEvent{Timestamp: time.Now().Add(-2 * time.Hour), Event: auditRegister, Login: "old@example.com"}
+	if err := srv.db.AddAuditEvent(old); err != nil {
+		t.Fatalf("Failed to add audit event: %v", err)
+	}
+	srv.audit.setRetention(time.Hour)
+	srv.audit.record(auditRegister, "new@example.com", "")
+	if events, _ := srv.AuditEvents(db.AuditFilter{Login: "old@example.com"}); len(events) != 0 {
+		t.Errorf("Expected expired event to be pruned, got %+v", events)
+	}
+}
+
+func TestReload(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	serverConn, clientConn := createTestConnection()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	go srv.handleConnection(serverConn)
+
+	sendRequest(clientConn, "list")
+	if response, _ := readResponse(clientConn, 5*time.Second); response != "fail|list|Not authenticated" {
+		t.Fatalf("Unexpected response before reload: %q", response)
+	}
+
+	restart := srv.Reload(&ServerConfig{
+		Port:         4000,
+		WSPath:       "/chat",
+		ReadTimeout:  time.Minute,
+		WriteTimeout: 10 * time.Second,
+		RateLimits: map[string]RateLimits{
+			rateClassQuery: {Session: RateLimit{Rate: 0.001, Burst: 1}},
+		},
+		LogRedact: []string{"text"},
+	})
+	if strings.Join(restart, ",") != "Port,WSPath" {
+		t.Errorf("Expected Port and WSPath to require a restart, got %v", restart)
+	}
+	if srv.cfg().Port != 0 || srv.cfg().WSPath != "" {
+		t.Errorf("Expected startup settings to keep old values, got port %d path %q", srv.cfg().Port, srv.cfg().WSPath)
+	}
+	if srv.cfg().ReadTimeout != time.Minute || srv.cfg().MaxLineLength != defaultMaxLineLength {
+		t.Errorf("Expected reloaded settings with defaults, got %+v", srv.cfg())
+	}
+
+	// Новые лимиты действуют на уже открытое соединение
+	expected := []string{"fail|list|Not authenticated", "fail|list|Too many requests"}
+	for _, want := range expected {
+		sendRequest(clientConn, "list")
+		if response, _ := readResponse(clientConn, 5*time.Second); response != want {
+			t.Errorf("Expected %q, got %q", want, response)
+		}
+	}
+}
+
+// TestInfo проверяет ответ info без авторизации и сообщение дня после входа
+func TestInfo(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	if err := srv.db.CreateUser("alice@example.com", "password123"); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	serverConn, clientConn := createTestConnection()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	go srv.handleConnection(serverConn)
+
+	sendRequest(clientConn, "info")
+	response, err := readResponse(clientConn, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to read info: %v", err)
+	}
+	info, err := protocol.DecodeInfo(response)
+	if err != nil {
+		t.Fatalf("Failed to decode %q: %v", response, err)
+	}
+	if info.Name != "mSIM" || info.Version != "dev" || info.MaxLine != defaultMaxLineLength {
+		t.Errorf("Unexpected info %+v", info)
+	}
+	if info.FileAcceptTimeout != 300 || info.FileTransferTimeout != 600 {
+		t.Errorf("Unexpected file transfer limits %+v", info)
+	}
+	if strings.Join(info.Features, ",") != "files" {
+		t.Errorf("Expected only file transfers to be enabled, got %v", info.Features)
+	}
+
+	// Без сообщения дня после ok|auth ничего не приходит
+	sendRequest(clientConn, "auth|alice@example.com|password123")
+	if response, _ := readResponse(clientConn, 5*time.Second); response != "ok|auth" {
+		t.Fatalf("Expected ok|auth, got %q", response)
+	}
+	sendRequest(clientConn, "ping")
+	if response, _ := readResponse(clientConn, 5*time.Second); response != "pong" {
+		t.Fatalf("Expected pong without MOTD, got %q", response)
+	}
+	sendRequest(clientConn, "bye")
+	readResponse(clientConn, 5*time.Second)
+
+	// Сообщение дня задаётся перезагрузкой настроек
+	srv.Reload(&ServerConfig{
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		Name:         "Example chat",
+		MOTD:         "Welcome!\nBe nice.",
+	})
+	serverConn2, clientConn2 := createTestConnection()
+	defer serverConn2.Close()
+	defer clientConn2.Close()
+	go srv.handleConnection(serverConn2)
+
+	sendRequest(clientConn2, "auth|alice@example.com|password123")
+	if response, _ := readResponse(clientConn2, 5*time.Second); response != "ok|auth" {
+		t.Fatalf("Expected ok|auth, got %q", response)
+	}
+	if response, _ := readResponse(clientConn2, 5*time.Second); response != `motd|Welcome!\nBe nice.` {
+		t.Errorf("Expected escaped MOTD, got %q", response)
+	}
+	sendRequest(clientConn2, "info")
+	response, _ = readResponse(clientConn2, 5*time.Second)
+	if info, err := protocol.DecodeInfo(response); err != nil || info.Name != "Example chat" {
+		t.Errorf("Expected reloaded server name, got %q", response)
+	}
+}
+
+// TestAdminCommands тестирует команды управляющего сокета
+func TestAdminCommands(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	password, err := srv.CreateUser("user1@example.com", "")
+	if err != nil || password == "" {
+		t.Fatalf("Failed to create user: %q, %v", password, err)
+	}
+	if _, err := srv.CreateUser("user1@example.com", "password123"); err != ErrUserExists {
+		t.Errorf("Expected ErrUserExists, got %v", err)
+	}
+	if _, err := srv.CreateUser("not a login", "password123"); err != ErrInvalidLogin {
+		t.Errorf("Expected ErrInvalidLogin, got %v", err)
+	}
+	if _, err := srv.ResetPassword("missing@example.com", ""); err != ErrUnknownUser {
+		t.Errorf("Expected ErrUnknownUser, got %v", err)
+	}
+	if _, err := srv.ResetPassword("user1@example.com", "newpassword"); err != nil {
+		t.Fatalf("Failed to reset password: %v", err)
+	}
+	srv.CreateUser("user2@example.com", "password123")
+
+	connect := func(login, password string) net.Conn {
+		serverConn, clientConn := createTestConnection()
+		t.Cleanup(func() { clientConn.Close() })
+		go srv.handleConnection(serverConn)
+		sendRequest(clientConn, "auth|"+login+"|"+password)
+		if response, _ := readResponse(clientConn, 5*time.Second); response != "ok|auth" {
+			t.Fatalf("Unexpected auth response for %s: %q", login, response)
+		}
+		return clientConn
+	}
+	conn1 := connect("user1@example.com", "newpassword")
+	conn2 := connect("user2@example.com", "password123")
+
+	sessions := srv.Sessions()
+	if len(sessions) != 2 || sessions[0].Login != "user1@example.com" || sessions[0].ConnectedAt.IsZero() {
+		t.Fatalf("Unexpected sessions %+v", sessions)
+	}
+
+	// Запись в net.Pipe блокируется до чтения, поэтому рассылка идёт в горутине
+	sent := make(chan int, 1)
+	go func() { sent <- srv.Broadcast("Hello", []string{"user2@example.com", "missing@example.com"}) }()
+	response, _ := readResponse(conn2, 5*time.Second)
+	if !strings.HasPrefix(response, "sys|") || !strings.HasSuffix(response, "|Hello") {
+		t.Errorf("Expected sys packet, got %q", response)
+	}
+	if n := <-sent; n != 1 {
+		t.Errorf("Expected 1 recipient, got %d", n)
+	}
+
+	if err := srv.Kick("missing@example.com", ""); err != ErrNotConnected {
+		t.Errorf("Expected ErrNotConnected, got %v", err)
+	}
+	go srv.Kick("user2@example.com", "Spam")
+	if response, _ := readResponse(conn2, 5*time.Second); response != "bye|kicked|Spam" {
+		t.Errorf("Expected kick notice, got %q", response)
+	}
+
+	// Заблокированный пользователь отключается и не может войти
+	go srv.SetUserDisabled("user1@example.com", true)
+	if response, _ := readResponse(conn1, 5*time.Second); response != "bye|kicked|Account disabled" {
+		t.Errorf("Expected disabled notice, got %q", response)
+	}
+	serverConn, clientConn := createTestConnection()
+	defer clientConn.Close()
+	go srv.handleConnection(serverConn)
+	sendRequest(clientConn, "auth|user1@example.com|newpassword")
+	if response, _ := readResponse(clientConn, 5*time.Second); response != "fail|auth|Account disabled" {
+		t.Errorf("Expected disabled account, got %q", response)
+	}
+	if err := srv.SetUserDisabled("missing@example.com", true); err != ErrUnknownUser {
+		t.Errorf("Expected ErrUnknownUser, got %v", err)
+	}
+
+	counts, err := srv.Counts()
+	if err != nil {
+		t.Fatalf("Failed to count rows: %v", err)
+	}
+	if counts.Users != 2 || counts.Disabled != 1 {
+		t.Errorf("Unexpected counts %+v", counts)
+	}
+
+	if err := srv.SetUserDisabled("user1@example.com", false); err != nil {
+		t.Fatalf("Failed to enable user: %v", err)
+	}
+	conn1 = connect("user1@example.com", "newpassword")
+
+	fs, err := srv.fileManager.CreateSession("user1@example.com", "user2@example.com", "report.pdf", 1024, "hash")
+	if err != nil {
+		t.Fatalf("Failed to create transfer: %v", err)
+	}
+	transfers := srv.Transfers()
+	if len(transfers) != 1 || transfers[0].ID != fs.ID || transfers[0].Filename != "report.pdf" {
+		t.Fatalf("Unexpected transfers %+v", transfers)
+	}
+	if err := srv.CancelTransfer("missing", ""); err != ErrSessionNotFound {
+		t.Errorf("Expected ErrSessionNotFound, got %v", err)
+	}
+	go srv.CancelTransfer(fs.ID, "Cancelled by administrator")
+	expected := "fcan|user2@example.com|" + fs.ID + "|Cancelled by administrator"
+	if response, _ := readResponse(conn1, 5*time.Second); response != expected {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+}
+
+// TestHandoff тестирует передачу листенеров и передач файлов новому процессу
+func TestHandoff(t *testing.T) {
+	srv1, cleanup1 := setupTestServer(t)
+	defer cleanup1()
+	srv2, cleanup2 := setupTestServer(t)
+	defer cleanup2()
+
+	if err := srv1.db.CreateUser("alice@example.com", "password123"); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	startAndWait := func(srv *Server) string {
+		go srv.Start()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			srv.mu.RLock()
+			listener := srv.listeners["chat"]
+			srv.mu.RUnlock()
+			if listener != nil {
+				return listener.Addr().String()
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("Server did not start")
+		return ""
+	}
+	ping := func(addr string) string {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer conn.Close()
+		sendRequest(conn, "ping")
+		response, _ := readResponse(conn, 5*time.Second)
+		return response
+	}
+
+	addr := startAndWait(srv1)
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer client.Close()
+	sendRequest(client, "auth|alice@example.com|password123")
+	if response, _ := readResponse(client, 5*time.Second); response != "ok|auth" {
+		t.Fatalf("Expected ok|auth, got %q", response)
+	}
+
+	fs, err := srv1.fileManager.CreateSession("alice@example.com", "bob@example.com", "a.txt", 5, "hash")
+	if err != nil {
+		t.Fatalf("Failed to create transfer: %v", err)
+	}
+	uploadPort, downloadPort, err := srv1.fileManager.AcceptSession(fs.ID)
+	if err != nil {
+		t.Fatalf("Failed to accept transfer: %v", err)
+	}
+
+	// Отказ нового процесса: старый продолжает работу
+	h, files, err := srv1.Detach()
+	if err != nil {
+		t.Fatalf("Detach failed: %v", err)
+	}
+	if _, _, err := srv1.Detach(); err != ErrShuttingDown {
+		t.Errorf("Expected ErrShuttingDown on second Detach, got %v", err)
+	}
+	// До Retire подключённые клиенты обслуживаются как обычно
+	sendRequest(client, "ping")
+	if response, _ := readResponse(client, 5*time.Second); response != "pong" {
+		t.Fatalf("Expected pong between Detach and Resume, got %q", response)
+	}
+	srv1.Resume(h, files)
+	for _, f := range files {
+		f.Close()
+	}
+	if response := ping(addr); response != "pong" {
+		t.Fatalf("Expected pong after Resume, got %q", response)
+	}
+	// Клиенты не отключались: новый процесс так и не стал готов
+	sendRequest(client, "ping")
+	if response, _ := readResponse(client, 5*time.Second); response != "pong" {
+		t.Fatalf("Expected the client to stay connected after Resume, got %q", response)
+	}
+
+	h, files, err = srv1.Detach()
+	if err != nil {
+		t.Fatalf("Detach failed: %v", err)
+	}
+	if len(h.Transfers) != 1 || h.Transfers[0].ID != fs.ID {
+		t.Fatalf("Expected accepted transfer in handoff, got %+v", h.Transfers)
+	}
+	if err := srv2.Inherit(h, files); err != nil {
+		t.Fatalf("Inherit failed: %v", err)
+	}
+	for _, f := range files {
+		f.Close()
+	}
+	if startAndWait(srv2) != addr {
+		t.Fatal("Expected the new server on the same address")
+	}
+	defer srv2.Shutdown(context.Background(), "maintenance", time.Time{})
+	sendRequest(client, "ping")
+	if response, _ := readResponse(client, 5*time.Second); response != "pong" {
+		t.Fatalf("Expected pong between Detach and Retire, got %q", response)
+	}
+
+	retired := make(chan struct{})
+	go func() {
+		srv1.Retire()
+		close(retired)
+	}()
+	select {
+	case <-retired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Retire did not return")
+	}
+	if response, _ := readResponse(client, 5*time.Second); !strings.HasPrefix(response, "bye|restart|") {
+		t.Errorf("Expected bye|restart after Retire, got %q", response)
+	}
+
+	if response := ping(addr); response != "pong" {
+		t.Errorf("Expected pong from the new server, got %q", response)
+	}
+	if transfers := srv2.Transfers(); len(transfers) != 1 || transfers[0].ID != fs.ID {
+		t.Errorf("Expected adopted transfer, got %+v", transfers)
+	}
+
+	// Прокси передачи работает в новом процессе
+	upload, err := net.Dial("tcp", "127.0.0.1:"+itoa(uploadPort))
+	if err != nil {
+		t.Fatalf("Failed to connect upload: %v", err)
+	}
+	download, err := net.Dial("tcp", "127.0.0.1:"+itoa(downloadPort))
+	if err != nil {
+		t.Fatalf("Failed to connect download: %v", err)
+	}
+	defer download.Close()
+	upload.Write([]byte("hello"))
+	upload.Close()
+	download.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, _ := io.ReadAll(download)
+	if string(data) != "hello" {
+		t.Errorf("Expected file data through the new server, got %q", data)
+	}
+}
+
+// TestShutdown тестирует остановку сервера с ожиданием клиентов и передач файлов
+func TestShutdown(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	for _, login := range []string{"alice@example.com", "bob@example.com"} {
+		if err := srv.db.CreateUser(login, "password123"); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+	srv.db.AddContact("alice@example.com", "bob@example.com", "Bob")
+	srv.db.AddContact("bob@example.com", "alice@example.com", "Alice")
+
+	// Пакеты каждого клиента читаются в своей горутине: запись в net.Pipe
+	// блокируется до чтения
+	connect := func(login string) <-chan string {
+		serverConn, clientConn := createTestConnection()
+		go srv.handleConnection(serverConn)
+		sendRequest(clientConn, "auth|"+login+"|password123")
+		if response, _ := readResponse(clientConn, 5*time.Second); response != "ok|auth" {
+			t.Fatalf("Expected ok|auth, got %q", response)
+		}
+		lines := make(chan string, 16)
+		go func() {
+			defer close(lines)
+			defer clientConn.Close()
+			reader := bufio.NewReader(clientConn)
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				lines <- strings.TrimSuffix(line, "\n")
+			}
+		}()
+		return lines
+	}
+	alice := connect("alice@example.com")
+	bob := connect("bob@example.com")
+	if line := <-alice; !strings.HasPrefix(line, "on|bob@example.com|") {
+		t.Fatalf("Expected on|bob@example.com, got %q", line)
+	}
+
+	// Принятая передача без соединений отменяется сразу
+	waiting, _ := srv.fileManager.CreateSession("alice@example.com", "bob@example.com", "a.txt", 5, "hash")
+	if _, _, err := srv.fileManager.AcceptSession(waiting.ID); err != nil {
+		t.Fatalf("Failed to accept transfer: %v", err)
+	}
+
+	// Идущая передача не успевает завершиться до истечения ctx
+	running, _ := srv.fileManager.CreateSession("alice@example.com", "bob@example.com", "b.txt", 10, "hash")
+	uploadPort, downloadPort, err := srv.fileManager.AcceptSession(running.ID)
+	if err != nil {
+		t.Fatalf("Failed to accept transfer: %v", err)
+	}
+	upload, err := net.Dial("tcp", "127.0.0.1:"+itoa(uploadPort))
+	if err != nil {
+		t.Fatalf("Failed to connect upload: %v", err)
+	}
+	defer upload.Close()
+	download, err := net.Dial("tcp", "127.0.0.1:"+itoa(downloadPort))
+	if err != nil {
+		t.Fatalf("Failed to connect download: %v", err)
+	}
+	defer download.Close()
+	upload.Write([]byte("hello"))
+
+	completion := time.Date(2024, 1, 1, 13, 0, 0, 0, time.UTC)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	result := make(chan error, 1)
+	go func() {
+		result <- srv.Shutdown(ctx, "maintenance", completion)
+	}()
+
+	for _, c := range []struct {
+		lines   <-chan string
+		contact string
+	}{{alice, "bob@example.com"}, {bob, "alice@example.com"}} {
+		if line := <-c.lines; !strings.HasPrefix(line, "off|"+c.contact+"|") {
+			t.Errorf("Expected off|%s before bye, got %q", c.contact, line)
+		}
+		if line := <-c.lines; line != "bye|maintenance|2024-01-01T13:00:00Z" {
+			t.Errorf("Expected bye|maintenance, got %q", line)
+		}
+		if line, ok := <-c.lines; ok {
+			t.Errorf("Expected connection to be closed, got %q", line)
+		}
+	}
+
+	select {
+	case err := <-result:
+		if err != context.DeadlineExceeded {
+			t.Errorf("Expected DeadlineExceeded because of the running transfer, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return after the deadline")
+	}
+
+	waiting.mu.Lock()
+	status := waiting.Status
+	waiting.mu.Unlock()
+	if status != "cancelled" {
+		t.Errorf("Expected waiting transfer to be cancelled, got %q", status)
+	}
+	download.SetReadDeadline(time.Now().Add(5 * time.Second))
+	io.ReadAll(download)
+
+	for _, login := range []string{"alice@example.com", "bob@example.com"} {
+		_, lastOffline, err := srv.db.GetUserStatus(login)
+		if err != nil || lastOffline.IsZero() {
+			t.Errorf("Expected last_offline of %s to be saved, got %v, %v", login, lastOffline, err)
+		}
+	}
+	if err := srv.Shutdown(context.Background(), "maintenance", time.Time{}); err != ErrShuttingDown {
+		t.Errorf("Expected ErrShuttingDown, got %v", err)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	srv, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	for _, login := range []string{"alice@example.com", "bob@example.com"} {
+		if err := srv.db.CreateUser(login, "password123"); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+
+	connect := func(login string) (<-chan string, net.Conn) {
+		serverConn, clientConn := createTestConnection()
+		go srv.handleConnection(serverConn)
+		sendRequest(clientConn, "auth|"+login+"|password123")
+		if response, _ := readResponse(clientConn, 5*time.Second); response != "ok|auth" {
+			t.Fatalf("Expected ok|auth, got %q", response)
+		}
+		lines := make(chan string, 16)
+		go func() {
+			defer close(lines)
+			defer clientConn.Close()
+			reader := bufio.NewReader(clientConn)
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				lines <- strings.TrimSuffix(line, "\n")
+			}
+		}()
+		return lines, clientConn
+	}
+	next := func(lines <-chan string) string {
+		select {
+		case line := <-lines:
+			return line
+		case <-time.After(5 * time.Second):
+			return "timeout"
+		}
+	}
+
+	start := time.Now().Add(time.Hour).Truncate(time.Second)
+	end := start.Add(30 * time.Minute)
+	if err := srv.ScheduleMaintenance(Maintenance{Start: start.Add(-2 * time.Hour), End: end}); err != ErrInvalidMaintenance {
+		t.Errorf("Expected ErrInvalidMaintenance for a start in the past, got %v", err)
+	}
+	if err := srv.ScheduleMaintenance(Maintenance{Start: start, End: start}); err != ErrInvalidMaintenance {
+		t.Errorf("Expected ErrInvalidMaintenance for an empty window, got %v", err)
+	}
+
+	// Подключённый пользователь получает объявление сразу. Ответ на ping
+	// означает, что авторизация обработана полностью
+	alice, aliceConn := connect("alice@example.com")
+	sendRequest(aliceConn, "ping")
+	if line := next(alice); line != "pong" {
+		t.Fatalf("Expected pong, got %q", line)
+	}
+	if err := srv.ScheduleMaintenance(Maintenance{Start: start, End: end, Text: "Database upgrade"}); err != nil {
+		t.Fatalf("Failed to schedule maintenance: %v", err)
+	}
+	want := "notice|" + start.UTC().Format(time.RFC3339) + "|" + end.UTC().Format(time.RFC3339) + "|Database upgrade"
+	if line := next(alice); line != want {
+		t.Errorf("Expected %q, got %q", want, line)
+	}
+
+	// Вошедший позже — после авторизации
+	bob, _ := connect("bob@example.com")
+	if line := next(bob); line != want {
+		t.Errorf("Expected %q after auth, got %q", want, line)
+	}
+
+	if err := srv.CancelMaintenance(); err != nil {
+		t.Fatalf("Failed to cancel maintenance: %v", err)
+	}
+	for _, lines := range []<-chan string{alice, bob} {
+		if line := next(lines); line != "notice" {
+			t.Errorf("Expected bare notice on cancel, got %q", line)
+		}
+	}
+	if _, ok := srv.Maintenance(); ok {
+		t.Error("Expected no maintenance after cancel")
+	}
+	if err := srv.CancelMaintenance(); err != ErrNoMaintenance {
+		t.Errorf("Expected ErrNoMaintenance, got %v", err)
+	}
+
+	// В момент начала вызывается обработчик, объявление снимается
+	started := make(chan Maintenance, 1)
+	srv.OnMaintenanceStart(func(m Maintenance) { started <- m })
+	soon := Maintenance{Start: time.Now().Add(200 * time.Millisecond), End: time.Now().Add(time.Hour)}
+	if err := srv.ScheduleMaintenance(soon); err != nil {
+		t.Fatalf("Failed to schedule maintenance: %v", err)
+	}
+	next(alice)
+	next(bob)
+	select {
+	case m := <-started:
+		if !m.End.Equal(soon.End) {
+			t.Errorf("Expected end %v, got %v", soon.End, m.End)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Maintenance start handler was not called")
+	}
+	if _, ok := srv.Maintenance(); ok {
+		t.Error("Expected the schedule to be cleared once maintenance starts")
+	}
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"msim/db"
+	"msim/models"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// События веб-хуков
+const (
+	webhookMessageStored  = "message.stored"
+	webhookMessageAcked   = "message.acked"
+	webhookUserOnline     = "user.online"
+	webhookUserOffline    = "user.offline"
+	webhookUserRegistered = "user.registered"
+	webhookFileCompleted  = "file.completed"
+)
+
+// Параметры очереди доставки
+const (
+	webhookBatchSize       = 50
+	webhookRequestTimeout  = 10 * time.Second
+	webhookDefaultAttempts = 10
+	webhookMaxRetryDelay   = time.Hour
+)
+
+// webhookPayload — тело запроса веб-хука
+type webhookPayload struct {
+	ID        string      `json:"id"`
+	Event     string      `json:"event"`
+	Timestamp string      `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+// webhookDispatcher сохраняет события в очередь в SQLite и доставляет их
+// фоновой горутиной. Недоставленные события переживают перезапуск сервера.
+type webhookDispatcher struct {
+	db          *db.DB
+	urls        []string
+	secret      string
+	events      map[string]bool // пусто — все события
+	maxAttempts int
+	retryDelay  time.Duration // задержка перед первым повтором, дальше удваивается
+	client      *http.Client
+
+	wake     chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// newWebhookDispatcher возвращает nil, если веб-хуки не настроены
+func newWebhookDispatcher(database *db.DB, config *ServerConfig) *webhookDispatcher {
+	if len(config.WebhookURLs) == 0 {
+		return nil
+	}
+
+	d := &webhookDispatcher{
+		db:          database,
+		urls:        config.WebhookURLs,
+		secret:      config.WebhookSecret,
+		maxAttempts: config.WebhookMaxAttempts,
+		retryDelay:  5 * time.Second,
+		client:      &http.Client{Timeout: webhookRequestTimeout},
+		wake:        make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	if d.maxAttempts <= 0 {
+		d.maxAttempts = webhookDefaultAttempts
+	}
+	if len(config.WebhookEvents) > 0 {
+		d.events = make(map[string]bool)
+		for _, event := range config.WebhookEvents {
+			d.events[event] = true
+		}
+	}
+	return d
+}
+
+// wants проверяет, подписаны ли веб-хуки на событие
+func (d *webhookDispatcher) wants(event string) bool {
+	return len(d.events) == 0 || d.events[event]
+}
+
+// enqueue ставит событие в очередь для каждого адреса
+func (d *webhookDispatcher) enqueue(event string, data interface{}) {
+	now := time.Now().UTC()
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	payload, err := json.Marshal(webhookPayload{
+		ID:        hex.EncodeToString(id),
+		Event:     event,
+		Timestamp: now.Format("2006-01-02T15:04:05Z"),
+		Data:      data,
+	})
+	if err != nil {
+		slog.Error("Webhook encode error", "event", event, "err", err)
+		return
+	}
+
+	for _, url := range d.urls {
+		if _, err := d.db.EnqueueWebhook(url, event, string(payload), now); err != nil {
+			slog.Error("Webhook enqueue error", "event", event, "err", err)
+		}
+	}
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run доставляет события из очереди, пока не вызван Stop
+func (d *webhookDispatcher) run() {
+	defer close(d.done)
+
+	for {
+		d.deliverDue()
+
+		// Спим до ближайшей повторной попытки или до нового события
+		wait := time.Minute
+		if next, ok, err := d.db.NextWebhookAttempt(); err != nil {
+			slog.Error("Webhook queue error", "err", err)
+		} else if ok {
+			if until := time.Until(next); until < wait {
+				wait = until
+			}
+		}
+		if wait < 0 {
+			wait = 0
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-d.wake:
+		case <-timer.C:
+		case <-d.stop:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// start возобновляет доставку после Stop, см. Resume
+func (d *webhookDispatcher) start() {
+	d.stop = make(chan struct{})
+	d.done = make(chan struct{})
+	d.stopOnce = sync.Once{}
+	go d.run()
+}
+
+// Stop останавливает доставку; оставшиеся события будут отправлены после запуска
+func (d *webhookDispatcher) Stop() {
+	d.stopOnce.Do(func() {
+		close(d.stop)
+	})
+	<-d.done
+}
+
+func (d *webhookDispatcher) deliverDue() {
+	deliveries, err := d.db.DueWebhooks(time.Now(), webhookBatchSize)
+	if err != nil {
+		slog.Error("Webhook queue error", "err", err)
+		return
+	}
+
+	for _, delivery := range deliveries {
+		select {
+		case <-d.stop:
+			return
+		default:
+		}
+
+		if err := d.post(delivery); err != nil {
+			d.retry(delivery, err)
+			continue
+		}
+		if err := d.db.DeleteWebhook(delivery.ID); err != nil {
+			slog.Error("Webhook queue error", "err", err)
+		}
+	}
+}
+
+// post отправляет одно событие; успехом считается любой ответ 2xx
+func (d *webhookDispatcher) post(delivery models.WebhookDelivery) error {
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "msim-webhook")
+	req.Header.Set("X-MSIM-Event", delivery.Event)
+	req.Header.Set("X-MSIM-Delivery", strconv.FormatInt(delivery.ID, 10))
+	if d.secret != "" {
+		req.Header.Set("X-MSIM-Signature", "sha256="+signWebhook(d.secret, body))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// retry откладывает повторную попытку с экспоненциальной задержкой
+// или помечает доставку неудачной после maxAttempts попыток
+func (d *webhookDispatcher) retry(delivery models.WebhookDelivery, deliveryErr error) {
+	attempts := delivery.Attempts + 1
+	if attempts >= d.maxAttempts {
+		slog.Error("Webhook delivery failed", "event", delivery.Event, "url", delivery.URL, "attempts", attempts, "err", deliveryErr)
+		if err := d.db.FailWebhook(delivery.ID, attempts, deliveryErr.Error()); err != nil {
+			slog.Error("Webhook queue error", "err", err)
+		}
+		return
+	}
+
+	delay := d.retryDelay << (attempts - 1)
+	if delay <= 0 || delay > webhookMaxRetryDelay {
+		delay = webhookMaxRetryDelay
+	}
+	slog.Warn("Webhook delivery failed, will retry", "event", delivery.Event, "url", delivery.URL, "attempt", attempts, "retry_in", delay, "err", deliveryErr)
+	if err := d.db.RetryWebhook(delivery.ID, attempts, time.Now().Add(delay), deliveryErr.Error()); err != nil {
+		slog.Error("Webhook queue error", "err", err)
+	}
+}
+
+// signWebhook возвращает HMAC-SHA256 тела запроса в hex
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// emitWebhook отправляет событие, если веб-хуки включены и подписаны на него
+func (s *Server) emitWebhook(event string, data interface{}) {
+	if s.webhooks == nil || !s.webhooks.wants(event) {
+		return
+	}
+	s.webhooks.enqueue(event, data)
+}
+
+// emitMessageWebhook отправляет событие о сообщении, только если
+// отправитель или получатель включил веб-хуки для сообщений
+func (s *Server) emitMessageWebhook(event, sender, recipient string, data interface{}) {
+	if s.webhooks == nil || !s.webhooks.wants(event) {
+		return
+	}
+	for _, login := range []string{sender, recipient} {
+		enabled, err := s.db.WebhookMessagesEnabled(login)
+		if err != nil {
+			slog.Error("Webhook opt-in check failed", "login", login, "err", err)
+			continue
+		}
+		if enabled {
+			s.webhooks.enqueue(event, data)
+			return
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// StartWebSocket запускает шлюз WebSocket для браузерных клиентов.
+// Каждый текстовый фрейм — один пакет mSIM без завершающего \n.
+func (s *Server) StartWebSocket() error {
+	srv := &http.Server{
+		Addr:              ":" + strconv.Itoa(s.cfg().WSPort),
+		Handler:           s.wsHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		return nil
+	}
+	s.wsServer = srv
+	s.mu.Unlock()
+
+	slog.Info("WebSocket gateway started", "port", s.cfg().WSPort, "path", s.cfg().WSPath)
+
+	listener, err := s.listen("ws", s.cfg().WSPort)
+	if err != nil {
+		return err
+	}
+	err = srv.Serve(listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// wsHandler принимает WebSocket-соединения и обрабатывает их так же, как TCP
+func (s *Server) wsHandler() http.Handler {
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  4096,
+		WriteBufferSize: 4096,
+		CheckOrigin:     s.checkOrigin,
+	}
+
+	path := s.cfg().WSPath
+	if path == "" {
+		path = "/"
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		ip := requestIP(r)
+		if !s.acquireConn(ip) {
+			slog.Warn("Too many connections, rejected", "ip", ip)
+			http.Error(w, "Too many connections", http.StatusTooManyRequests)
+			return
+		}
+		defer s.releaseConn(ip)
+
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// Upgrade уже отправил клиенту ответ с ошибкой
+			slog.Warn("WebSocket upgrade failed", "remote", r.RemoteAddr, "err", err)
+			return
+		}
+		// Фрейм — один пакет, поэтому его размер ограничен так же, как строка TCP;
+		// при превышении gorilla/websocket закрывает соединение
+		ws.SetReadLimit(int64(s.cfg().MaxLineLength))
+		s.handleConnection(newWSConn(ws))
+	})
+	return mux
+}
+
+// checkOrigin разрешает подключение браузерам с разрешённых страниц.
+// Клиенты без заголовка Origin (не браузеры) допускаются всегда.
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if len(s.cfg().WSAllowedOrigins) == 0 {
+		// По умолчанию — только страницы с того же хоста
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+
+	for _, allowed := range s.cfg().WSAllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// wsConn представляет WebSocket-соединение как net.Conn, чтобы handleConnection,
+// сессии, таймауты и уведомления работали с ним без изменений.
+// Входящие фреймы читает отдельная горутина: тайм-аут чтения у gorilla/websocket
+// необратимо ломает соединение, а handleConnection после тайм-аута читает снова.
+type wsConn struct {
+	ws      *websocket.Conn
+	frames  chan []byte
+	readErr error // причина закрытия frames
+	pending []byte
+
+	deadlineMu   sync.Mutex
+	readDeadline time.Time
+
+	writeMu   sync.Mutex
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newWSConn(ws *websocket.Conn) *wsConn {
+	c := &wsConn{
+		ws:     ws,
+		frames: make(chan []byte),
+		done:   make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+// readLoop превращает текстовые фреймы в строки пакетов
+func (c *wsConn) readLoop() {
+	defer close(c.frames)
+	for {
+		msgType, data, err := c.ws.ReadMessage()
+		if err != nil {
+			c.readErr = err
+			return
+		}
+		if msgType != websocket.TextMessage {
+			continue
+		}
+
+		line := append([]byte(strings.TrimRight(string(data), "\r\n")), '\n')
+		select {
+		case c.frames <- line:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		c.deadlineMu.Lock()
+		deadline := c.readDeadline
+		c.deadlineMu.Unlock()
+
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			expired = timer.C
+		}
+
+		select {
+		case line, ok := <-c.frames:
+			if !ok {
+				if websocket.IsCloseError(c.readErr, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+				return 0, c.readErr
+			}
+			c.pending = line
+		case <-c.done:
+			return 0, net.ErrClosed
+		case <-expired:
+			return 0, wsTimeoutError{}
+		}
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write отправляет каждую строку пакета отдельным текстовым фреймом
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	for _, line := range strings.Split(strings.TrimSuffix(string(p), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		if err := c.ws.WriteMessage(websocket.TextMessage, []byte(line)); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			time.Now().Add(time.Second))
+		err = c.ws.Close()
+	})
+	return err
+}
+
+func (c *wsConn) LocalAddr() net.Addr  { return c.ws.LocalAddr() }
+func (c *wsConn) RemoteAddr() net.Addr { return c.ws.RemoteAddr() }
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	c.readDeadline = t
+	c.deadlineMu.Unlock()
+	return nil
+}
+
+func (c *wsConn) SetWriteDeadline(t time.Time) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.ws.SetWriteDeadline(t)
+}
+
+// wsTimeoutError — тайм-аут чтения, после которого соединение остаётся рабочим
+type wsTimeoutError struct{}
+
+func (wsTimeoutError) Error() string   { return "websocket read timeout" }
+func (wsTimeoutError) Timeout() bool   { return true }
+func (wsTimeoutError) Temporary() bool { return true }
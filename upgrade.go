@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"msim/server"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// A zero-downtime upgrade starts the binary at os.Executable() again with
+// the same arguments and hands it the listening sockets. The new process
+// finds them through MSIM_UPGRADE and these descriptors:
+//
+//	fd 3   JSON server.Handoff, read to EOF
+//	fd 4   the new process writes "ready\n" once it accepts connections
+//	fd 5+  listeners in Handoff.Listeners order
+//
+// The old process then stops listening, waits for file transfers already in
+// progress and exits. If the new process fails to start, the old one keeps
+// serving.
+const envUpgrade = "MSIM_UPGRADE"
+
+const (
+	upgradeStateFD     = 3
+	upgradeReadyFD     = 4
+	upgradeListenersFD = 5
+)
+
+// upgradeTimeout is how long the old process waits for the new one to be ready
+const upgradeTimeout = 30 * time.Second
+
+// controlListener names the control socket among the handed-over listeners
+const controlListener = "control"
+
+// start launches the new process and waits until it accepts connections.
+// On success the caller must call retire; on failure the server is serving
+// again as before.
+func (p *process) start() (int, error) {
+	if !p.running.TryLock() {
+		return 0, errors.New("upgrade already in progress")
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		p.running.Unlock()
+		return 0, err
+	}
+
+	h, files, err := p.srv.Detach()
+	if err != nil {
+		p.running.Unlock()
+		return 0, err
+	}
+	if p.control != nil {
+		if f, err := p.control.File(); err == nil {
+			h.Listeners = append(h.Listeners, controlListener)
+			files = append(files, f)
+		} else {
+			slog.Error("Failed to hand off control socket", "err", err)
+		}
+	}
+
+	slog.Info("Starting new process", "executable", executable, "listeners", len(files), "transfers", len(h.Transfers))
+	pid, err := spawn(executable, h, files)
+	if err != nil {
+		slog.Error("Upgrade failed", "err", err)
+		p.srv.Resume(h, files)
+	}
+	for _, f := range files {
+		f.Close()
+	}
+	if err != nil {
+		p.running.Unlock()
+		return 0, err
+	}
+
+	p.srv.Audit("upgrade", "", "pid", strconv.Itoa(pid))
+	return pid, nil
+}
+
+// retire stops listening after a successful start, waits for file transfers
+// still in progress and exits. The socket path and the pid file now belong
+// to the new process and are left in place.
+func (p *process) retire(pid int) {
+	p.retiring.Store(true)
+	slog.Info("New process is ready, finishing file transfers", "pid", pid)
+
+	if p.control != nil {
+		p.control.SetUnlinkOnClose(false)
+		p.control.Close()
+	}
+	p.srv.Retire()
+	os.Exit(0)
+}
+
+// spawn starts the new process with the handoff state and listener files and
+// waits for it to report ready
+func spawn(executable string, h *server.Handoff, files []*os.File) (int, error) {
+	stateR, stateW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		stateR.Close()
+		stateW.Close()
+		return 0, err
+	}
+	defer readyR.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), envUpgrade+"=1")
+	cmd.ExtraFiles = append([]*os.File{stateR, readyW}, files...)
+
+	err = cmd.Start()
+	stateR.Close()
+	readyW.Close()
+	if err != nil {
+		stateW.Close()
+		return 0, err
+	}
+
+	// The new process reads the state only after opening the database
+	go func() {
+		json.NewEncoder(stateW).Encode(h)
+		stateW.Close()
+	}()
+
+	ready := make(chan error, 1)
+	go func() {
+		line, err := bufio.NewReader(readyR).ReadString('\n')
+		if err == nil && line != "ready\n" {
+			err = fmt.Errorf("unexpected reply %q", line)
+		}
+		ready <- err
+	}()
+
+	select {
+	case err = <-ready:
+	case <-time.After(upgradeTimeout):
+		err = errors.New("timed out")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, fmt.Errorf("new process did not start: %w", err)
+	}
+
+	go cmd.Wait()
+	return cmd.Process.Pid, nil
+}
+
+// inherit takes over the listeners of the previous process when started by
+// an upgrade. It returns the inherited control socket, if any, and a function
+// that tells the previous process this one is ready; both are nil otherwise.
+func inherit(srv *server.Server) (*os.File, func(), error) {
+	if os.Getenv(envUpgrade) == "" {
+		return nil, nil, nil
+	}
+	// Not passed on to the process of the next upgrade
+	os.Unsetenv(envUpgrade)
+
+	state := os.NewFile(upgradeStateFD, "handoff")
+	var h server.Handoff
+	err := json.NewDecoder(state).Decode(&h)
+	state.Close()
+	if err != nil {
+		return nil, nil, fmt.Errorf("read handoff state: %w", err)
+	}
+
+	var control *os.File
+	var names []string
+	var files []*os.File
+	for i, name := range h.Listeners {
+		f := os.NewFile(uintptr(upgradeListenersFD+i), name)
+		if name == controlListener {
+			control = f
+			continue
+		}
+		names = append(names, name)
+		files = append(files, f)
+	}
+	h.Listeners = names
+
+	err = srv.Inherit(&h, files)
+	for _, f := range files {
+		f.Close()
+	}
+	if err != nil {
+		if control != nil {
+			control.Close()
+		}
+		return nil, nil, err
+	}
+
+	readyPipe := os.NewFile(upgradeReadyFD, "ready")
+	ready := func() {
+		readyPipe.Write([]byte("ready\n"))
+		readyPipe.Close()
+	}
+	return control, ready, nil
+}